@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// abuseDetector flags source IPs that cast votes under many different client
+// IDs in a short window, which is the signature of ballot stuffing by rotating
+// the client-supplied ID. Flagged IPs can optionally be blocked for a cooldown.
+type abuseDetector struct {
+	window     time.Duration // sliding window length
+	maxClients int           // distinct client IDs allowed per IP within the window
+	block      bool          // whether flagged IPs are temporarily blocked
+	cooldown   time.Duration // how long a block lasts
+
+	mu      sync.Mutex
+	votes   map[string][]voteSighting // IP -> recent votes, oldest first
+	blocked map[string]time.Time      // IP -> block expiry
+}
+
+// voteSighting records a single vote attempt from an IP
+type voteSighting struct {
+	at       time.Time
+	clientID string
+}
+
+var abuse = newAbuseDetector()
+
+// newAbuseDetector creates a detector configured from the environment
+func newAbuseDetector() *abuseDetector {
+	return &abuseDetector{
+		window:     envDuration("ABUSE_WINDOW", 10*time.Second),
+		maxClients: envInt("ABUSE_MAX_CLIENTS", 5),
+		block:      envBool("ABUSE_BLOCK", false),
+		cooldown:   envDuration("ABUSE_COOLDOWN", 5*time.Minute),
+		votes:      make(map[string][]voteSighting),
+		blocked:    make(map[string]time.Time),
+	}
+}
+
+// Blocked reports whether votes from ip are currently being rejected
+func (d *abuseDetector) Blocked(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	until, ok := d.blocked[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(d.blocked, ip)
+		return false
+	}
+	return true
+}
+
+// Record notes a vote attempt and reports whether the IP crossed the threshold
+func (d *abuseDetector) Record(ip, clientID string) bool {
+	if d.maxClients <= 0 {
+		return false
+	}
+
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sightings := append(prune(d.votes[ip], now.Add(-d.window)), voteSighting{at: now, clientID: clientID})
+	d.votes[ip] = sightings
+
+	distinct := make(map[string]struct{}, len(sightings))
+	for _, s := range sightings {
+		distinct[s.clientID] = struct{}{}
+	}
+	if len(distinct) <= d.maxClients {
+		return false
+	}
+
+	abuseFlagsTotal.Inc()
+	logger.Warn("Possible ballot stuffing", "remote_ip", ip, "client_ids", len(distinct), "window", d.window)
+
+	if d.block {
+		d.blocked[ip] = now.Add(d.cooldown)
+		delete(d.votes, ip)
+		logger.Warn("Blocking votes", "remote_ip", ip, "cooldown", d.cooldown)
+	}
+	return true
+}
+
+// Sweep drops expired windows and blocks so idle IPs don't accumulate
+func (d *abuseDetector) Sweep() {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ip, sightings := range d.votes {
+		if kept := prune(sightings, now.Add(-d.window)); len(kept) == 0 {
+			delete(d.votes, ip)
+		} else {
+			d.votes[ip] = kept
+		}
+	}
+	for ip, until := range d.blocked {
+		if now.After(until) {
+			delete(d.blocked, ip)
+		}
+	}
+}
+
+// runSweeper periodically cleans up detector state
+func (d *abuseDetector) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.Sweep()
+	}
+}
+
+// prune removes sightings older than cutoff
+func prune(sightings []voteSighting, cutoff time.Time) []voteSighting {
+	i := 0
+	for i < len(sightings) && sightings[i].at.Before(cutoff) {
+		i++
+	}
+	return sightings[i:]
+}
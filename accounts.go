@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts are optional: with ACCOUNTS=true people can register and sign
+// in, and get a session token, a JWT, to send as "Authorization: Bearer".
+// Polls created with one belong to the account rather than to an owner
+// token, so the creator can list and manage them from any device, for as
+// long as the polls live. Without ALLOW_ANONYMOUS_POLLS, creating a poll
+// takes an account.
+var (
+	accountsEnabled     = envBool("ACCOUNTS", false)
+	allowAnonymousPolls = envBool("ALLOW_ANONYMOUS_POLLS", true)
+	sessionTTL          = envDuration("SESSION_TTL", 24*time.Hour)
+	jwtSecret           = loadJWTSecret()
+)
+
+// Limits on account credentials. bcrypt only looks at a password's first
+// 72 bytes, so longer ones are refused rather than silently truncated.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// sessionIssuer is the iss claim of the session tokens this server signs
+const sessionIssuer = "pulse"
+
+// usernamePattern is what a username may look like
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// authLimit slows down password guessing
+var authLimit = newRateLimiter("auth", "RATE_AUTH", 0.2, 10) // sign-ins and registrations per IP
+
+// dummyPasswordHash is compared against when a username doesn't exist, so
+// a sign-in takes as long whether or not the account does
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// loadJWTSecret reads the key session tokens are signed with. Without
+// JWT_SECRET a random one is used, so sessions end with a restart and
+// aren't recognized by other instances.
+func loadJWTSecret() []byte {
+	if secret := envString("JWT_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	if accountsEnabled {
+		logger.Warn("JWT_SECRET is not set; sessions won't survive a restart or work across instances")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fatal("Failed to generate JWT secret", "error", err)
+	}
+	return secret
+}
+
+// accountKey is the hash of an account: its username, password hash and
+// creation time
+func accountKey(accountID string) string {
+	return fmt.Sprintf("account:%s", accountID)
+}
+
+// usernameKey maps a username, in lower case, to its account's ID
+func usernameKey(username string) string {
+	return fmt.Sprintf("username:%s", strings.ToLower(username))
+}
+
+// accountOwnerHash is what polls owned by an account record as their
+// owner_hash. It can't collide with a token's hash, which is hex only.
+func accountOwnerHash(accountID string) string {
+	return "account:" + accountID
+}
+
+// Credentials is the body of POST /api/auth/register and /api/auth/login
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Account is an account as the API shows it
+type Account struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email,omitempty"` // accounts from an identity provider
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Session is the response to a registration or sign-in
+type Session struct {
+	Token     string  `json:"token"`
+	ExpiresAt int64   `json:"expiresAt"` // Unix seconds
+	Account   Account `json:"account"`
+}
+
+// sessionClaims are the claims of a session token; the subject is the
+// account ID
+type sessionClaims struct {
+	Username string `json:"name"`
+	Email    string `json:"email,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// issueSession signs a session token for an account
+func issueSession(account Account, now time.Time) (Session, error) {
+	expiresAt := now.Add(sessionTTL)
+	claims := sessionClaims{
+		Username: account.Username,
+		Email:    account.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessionIssuer,
+			Subject:   account.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{Token: token, ExpiresAt: expiresAt.Unix(), Account: account}, nil
+}
+
+// parseSession checks a session token and returns its claims
+func parseSession(token string) (*sessionClaims, bool) {
+	var claims sessionClaims
+	parsed, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(sessionIssuer), jwt.WithExpirationRequired())
+	if err != nil || !parsed.Valid || claims.Subject == "" {
+		return nil, false
+	}
+	return &claims, true
+}
+
+// isSessionToken tells session tokens, which are JWTs, apart from owner
+// tokens, which are hex
+func isSessionToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// sessionFromRequest returns the claims of the request's session token,
+// when accounts are enabled and it carries a valid one. Browsers can't
+// set headers on a WebSocket handshake, so ?session= works too.
+func sessionFromRequest(r *http.Request) (*sessionClaims, bool) {
+	token := ownerTokenFromRequest(r)
+	if !isSessionToken(token) {
+		token = r.URL.Query().Get("session")
+	}
+	if !accountsEnabled || !isSessionToken(token) {
+		return nil, false
+	}
+	return parseSession(token)
+}
+
+// accountFromRequest returns the ID of the account the request is signed
+// in as, or "" if it isn't
+func accountFromRequest(r *http.Request) string {
+	if claims, ok := sessionFromRequest(r); ok {
+		return claims.Subject
+	}
+	return ""
+}
+
+// readCredentials decodes and checks the body of a registration or
+// sign-in, writing the error response when it can't
+func readCredentials(w http.ResponseWriter, r *http.Request) (Credentials, bool) {
+	if !accountsEnabled || !passwordAccounts {
+		http.Error(w, "Password accounts are disabled", http.StatusNotFound)
+		return Credentials{}, false
+	}
+	if !authLimit.Allow(clientIP(r)) {
+		tooManyRequests(w, authLimit, "Too many attempts, try again later")
+		return Credentials{}, false
+	}
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return Credentials{}, false
+	}
+	creds.Username = strings.TrimSpace(creds.Username)
+	return creds, true
+}
+
+// register handles POST /api/auth/register, which creates an account and
+// signs it in
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	if !usernamePattern.MatchString(creds.Username) {
+		http.Error(w, "username must be 3-32 letters, digits, '.', '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if len(creds.Password) < minPasswordLength || len(creds.Password) > maxPasswordLength {
+		http.Error(w, fmt.Sprintf("password must be between %d and %d bytes", minPasswordLength, maxPasswordLength), http.StatusBadRequest)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		requestLogger(r).Error("Failed to hash password", "error", err)
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+
+	account := Account{ID: newToken(), Username: creds.Username, CreatedAt: time.Now().Unix()}
+	claimed, err := kv.SetNX(usernameKey(account.Username), account.ID, 0)
+	if err != nil {
+		requestLogger(r).Error("Failed to claim username", "error", err)
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		http.Error(w, "Username is taken", http.StatusConflict)
+		return
+	}
+	err = kv.HSet(accountKey(account.ID), map[string]interface{}{
+		"username":      account.Username,
+		"password_hash": string(hash),
+		"created_at":    account.CreatedAt,
+	})
+	if err != nil {
+		kv.Del(usernameKey(account.Username))
+		requestLogger(r).Error("Failed to save account", "error", err)
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Account registered", "account_id", account.ID)
+
+	writeSession(w, r, account, http.StatusCreated)
+}
+
+// login handles POST /api/auth/login, which signs an account in
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	account, hash, err := loadAccountByUsername(creds.Username)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		requestLogger(r).Error("Failed to load account", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		hash = string(dummyPasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Password)) != nil || err != nil {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	writeSession(w, r, account, http.StatusOK)
+}
+
+// writeSession signs an account in by responding with a session
+func writeSession(w http.ResponseWriter, r *http.Request, account Account, status int) {
+	session, err := issueSession(account, time.Now())
+	if err != nil {
+		requestLogger(r).Error("Failed to sign session token", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(session)
+}
+
+// loadAccountByUsername returns an account and its password hash, or
+// errKeyNotFound when there's no such account
+func loadAccountByUsername(username string) (Account, string, error) {
+	id, err := kv.Get(usernameKey(username))
+	if err != nil {
+		return Account{}, "", err
+	}
+	return loadAccount(id)
+}
+
+// loadAccount returns an account and its password hash, or errKeyNotFound
+// when there's no such account
+func loadAccount(accountID string) (Account, string, error) {
+	data, err := kv.HGetAll(accountKey(accountID))
+	if err != nil {
+		return Account{}, "", err
+	}
+	if len(data) == 0 {
+		return Account{}, "", errKeyNotFound
+	}
+	account := Account{ID: accountID, Username: data["username"], Email: data["email"]}
+	fmt.Sscanf(data["created_at"], "%d", &account.CreatedAt)
+	return account, data["password_hash"], nil
+}
+
+// currentAccount handles GET /api/auth/me, the account signed in with the
+// request's session token
+func (s *Server) currentAccount(w http.ResponseWriter, r *http.Request) {
+	claims, ok := sessionFromRequest(r)
+	if !ok {
+		http.Error(w, "Sign-in required", http.StatusUnauthorized)
+		return
+	}
+	account, _, err := loadAccount(claims.Subject)
+	if errors.Is(err, errKeyNotFound) {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load account", "error", err)
+		http.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+// authConfig handles GET /api/auth/config, which tells the pages how
+// people can sign in and whether creating a poll takes it
+func (s *Server) authConfig(w http.ResponseWriter, r *http.Request) {
+	config := map[string]interface{}{
+		"accounts":        accountsEnabled,
+		"passwords":       accountsEnabled && passwordAccounts,
+		"anonymous_polls": allowAnonymousPolls || !accountsEnabled,
+	}
+	if oidcEnabled() {
+		config["oidc"] = oidcProviderName
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// adminToken guards operator endpoints; they're disabled when unset
+	adminToken = envString("ADMIN_TOKEN", "")
+
+	// summaryCacheTTL is how long SCAN-derived numbers are reused
+	summaryCacheTTL = envDuration("ADMIN_SUMMARY_CACHE", 30*time.Second)
+
+	// summaryScanLimit bounds how many keys one summary may scan
+	summaryScanLimit = envInt("ADMIN_SCAN_LIMIT", 100000)
+
+	// Counters since process start
+	pollsCreated  atomic.Int64
+	votesRecorded atomic.Int64
+
+	startedAt = time.Now()
+
+	pollCountCache struct {
+		sync.Mutex
+		count     int64
+		truncated bool
+		at        time.Time
+	}
+)
+
+// PlatformSummary is a quick operational overview for humans
+type PlatformSummary struct {
+	TotalPolls        int64 `json:"totalPolls"`
+	TotalPollsCapped  bool  `json:"totalPollsTruncated"`
+	ActiveConnections int   `json:"activeConnections"`
+	VotesSinceStart   int64 `json:"votesSinceStartup"`
+	PollsSinceStart   int64 `json:"pollsCreatedSinceStartup"`
+	UptimeSeconds     int64 `json:"uptimeSeconds"`
+	CachedAt          int64 `json:"pollCountCachedAt"`
+}
+
+// requireAdmin checks the request for the operator ADMIN_TOKEN. It writes
+// the error response and returns false when the check fails.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.Error(w, "Admin endpoints are disabled", http.StatusNotFound)
+		return false
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether the request carries the operator ADMIN_TOKEN
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if token == "" {
+		token = ownerTokenFromRequest(r)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminSummary handles GET /api/admin/metrics/summary
+func (s *Server) adminSummary(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	count, truncated, at, err := cachedPollCount()
+	if err != nil {
+		requestLogger(r).Error("Failed to count polls", "error", err)
+		http.Error(w, "Failed to count polls", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PlatformSummary{
+		TotalPolls:        count,
+		TotalPollsCapped:  truncated,
+		ActiveConnections: activeConnectionCount(),
+		VotesSinceStart:   votesRecorded.Load(),
+		PollsSinceStart:   pollsCreated.Load(),
+		UptimeSeconds:     int64(time.Since(startedAt).Seconds()),
+		CachedAt:          at.Unix(),
+	})
+}
+
+// cachedPollCount returns the number of stored polls, rescanning Redis at
+// most once per summaryCacheTTL
+func cachedPollCount() (int64, bool, time.Time, error) {
+	pollCountCache.Lock()
+	defer pollCountCache.Unlock()
+
+	if !pollCountCache.at.IsZero() && time.Since(pollCountCache.at) < summaryCacheTTL {
+		return pollCountCache.count, pollCountCache.truncated, pollCountCache.at, nil
+	}
+
+	count, truncated, err := store.ScanPolls(summaryScanLimit, func([]string) error { return nil })
+	if err != nil {
+		return 0, false, time.Time{}, err
+	}
+
+	pollCountCache.count = int64(count)
+	pollCountCache.truncated = truncated
+	pollCountCache.at = time.Now()
+	return pollCountCache.count, pollCountCache.truncated, pollCountCache.at, nil
+}
+
+// activeConnectionCount returns the number of WebSocket clients on this
+// instance
+func activeConnectionCount() int {
+	total := 0
+	for _, sub := range hub.All() {
+		if _, ok := sub.(*wsClient); ok {
+			total++
+		}
+	}
+	return total
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on who a poll can be restricted to
+const (
+	maxAllowedEmails   = 1000  // addresses and domains per poll
+	maxInvitesPerCall  = 500   // links one POST /invites or /ballots hands out
+	maxInvitesPerPoll  = 10000 // of each kind
+	maxAllowedEmailLen = 254
+)
+
+// invitesKey is the set of the hashes of a poll's invite tokens, the
+// one-time voting links of require_invite polls
+func invitesKey(pollID string) string {
+	return fmt.Sprintf("invites:%s", pollID)
+}
+
+// Invite is one voting link handed out by POST /api/poll/{pollID}/invites
+// or /ballots
+type Invite struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// InviteRequest is the body of POST /api/poll/{pollID}/invites and
+// /ballots
+type InviteRequest struct {
+	Count  int   `json:"count"`
+	Weight int64 `json:"weight"` // of each token, on weighted polls
+}
+
+// normalizeAllowedEmails checks the allowed_emails of a new poll, which
+// are addresses or whole domains, and lower-cases them. A leading "@" on
+// a domain is dropped.
+func normalizeAllowedEmails(entries []string) ([]string, error) {
+	if len(entries) > maxAllowedEmails {
+		return nil, fmt.Errorf("allowed_emails may have at most %d entries", maxAllowedEmails)
+	}
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(entry)), "@")
+		local, domain, isAddress := strings.Cut(entry, "@")
+		if !isAddress {
+			domain = entry
+		}
+		if domain == "" || (isAddress && local == "") || len(entry) > maxAllowedEmailLen ||
+			strings.ContainsAny(entry, " ,") || strings.Contains(domain, "@") {
+			return nil, fmt.Errorf("allowed_emails: %q is neither an email address nor a domain", entry)
+		}
+		normalized = append(normalized, entry)
+	}
+	return normalized, nil
+}
+
+// emailAllowed reports whether an email is on a poll's allowed_emails,
+// as an address or through its domain
+func emailAllowed(allowed, email string) bool {
+	email = strings.ToLower(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return false
+	}
+	for _, entry := range strings.Split(allowed, ",") {
+		if entry == email || entry == email[at+1:] {
+			return true
+		}
+	}
+	return false
+}
+
+// voterAllowed checks a ballot's voter against the poll's restrictions:
+// the voter link, an invite, signing in and the allowed emails. It returns
+// the status to refuse the ballot with, or "" when the voter may vote.
+func voterAllowed(state map[string]string, v voteRequest) string {
+	if !voterTokenValid(state, v.VoterToken) {
+		return voteDenied
+	}
+	if state["require_invite"] == "1" {
+		if v.VoterToken == "" {
+			return voteDenied
+		}
+		invited, err := kv.SIsMember(invitesKey(v.PollID), hashToken(v.VoterToken))
+		if err != nil {
+			v.log().Error("Failed to check invite", "error", err)
+			return voteError
+		}
+		if !invited {
+			return voteDenied
+		}
+	}
+	if state["ballot_tokens"] == "1" && v.VoterToken == "" {
+		return voteDenied
+	}
+	if state["require_sign_in"] == "1" && v.Account == "" {
+		return voteSignInRequired
+	}
+	if allowed := state["allowed_emails"]; allowed != "" {
+		account, _, err := loadAccount(v.Account)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			v.log().Error("Failed to load account", "error", err)
+			return voteError
+		}
+		if !emailAllowed(allowed, account.Email) {
+			return voteDenied
+		}
+	}
+	return ""
+}
+
+// createInvites handles POST /api/poll/{pollID}/invites, which hands out
+// count one-time voting links for a require_invite poll. Each counts one
+// ballot, or on allow_revote polls lets its holder change that ballot;
+// only the hashes of the tokens are kept.
+func (s *Server) createInvites(w http.ResponseWriter, r *http.Request) {
+	issueVoterTokens(w, r, "require_invite", invitesKey, "invites")
+}
+
+// issueVoterTokens hands out the voting links of a poll restricted by the
+// setting, keeping their hashes in the set at key(pollID), and writes them
+// as the response's name field
+func issueVoterTokens(w http.ResponseWriter, r *http.Request, setting string, key func(string) string, name string) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	req := InviteRequest{Count: 1}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Count < 1 || req.Count > maxInvitesPerCall {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxInvitesPerCall), http.StatusBadRequest)
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if data[setting] != "1" {
+		http.Error(w, fmt.Sprintf("Poll doesn't take %s; create it with %s", name, setting), http.StatusConflict)
+		return
+	}
+	if req.Weight != 0 && data["weighted"] != "1" {
+		http.Error(w, "weight needs a weighted poll", http.StatusBadRequest)
+		return
+	}
+	if req.Weight < 0 || req.Weight > maxVoteWeight {
+		http.Error(w, fmt.Sprintf("weight must be between 1 and %d", maxVoteWeight), http.StatusBadRequest)
+		return
+	}
+
+	tokensKey := key(pollID)
+	issued, err := store.IncrPollField(pollID, name+"_issued", 0)
+	if err != nil {
+		requestLogger(r).Error("Failed to count issued links", "kind", name, "error", err)
+		http.Error(w, "Failed to create "+name, http.StatusInternalServerError)
+		return
+	}
+	if issued+int64(req.Count) > maxInvitesPerPoll {
+		http.Error(w, fmt.Sprintf("A poll may have at most %d %s", maxInvitesPerPoll, name), http.StatusConflict)
+		return
+	}
+	ttl, err := store.PollTTL(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+
+	invites := make([]Invite, req.Count)
+	hashes := make([]string, req.Count)
+	weights := make(map[string]interface{}, req.Count)
+	for i := range invites {
+		token := newToken()
+		invites[i] = Invite{Token: token, URL: fmt.Sprintf("/poll.html?id=%s&vt=%s", pollID, token)}
+		hashes[i] = hashToken(token)
+		weights[hashToken(token)] = req.Weight
+	}
+	err = kv.Batch(func(b KeyBatch) {
+		b.SAdd(tokensKey, hashes...)
+		if ttl > 0 {
+			b.Expire(tokensKey, ttl)
+		}
+		if req.Weight > 0 {
+			b.HSet(weightsKey(pollID), weights)
+			if ttl > 0 {
+				b.Expire(weightsKey(pollID), ttl)
+			}
+		}
+	})
+	if err != nil {
+		requestLogger(r).Error("Failed to save voting links", "kind", name, "error", err)
+		http.Error(w, "Failed to create "+name, http.StatusInternalServerError)
+		return
+	}
+	total, err := store.IncrPollField(pollID, name+"_issued", int64(req.Count))
+	if err != nil {
+		requestLogger(r).Error("Failed to count issued links", "kind", name, "error", err)
+		http.Error(w, "Failed to create "+name, http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Voting links created", "kind", name, "count", req.Count)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{name: invites, "issued": total})
+}
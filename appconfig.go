@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config holds the deployment settings of the server: where Redis lives and
+// where to listen. Values come from an optional JSON file named by
+// CONFIG_FILE, and environment variables override the file.
+type Config struct {
+	Store            string `json:"store"`      // redis, postgres, or memory for local dev
+	RedisMode        string `json:"redis_mode"` // standalone, sentinel or cluster
+	RedisAddr        string `json:"redis_addr"` // comma-separated seeds in sentinel/cluster mode
+	RedisPassword    string `json:"redis_password"`
+	RedisDB          int    `json:"redis_db"`
+	RedisPoolSize    int    `json:"redis_pool_size"` // 0 lets go-redis pick
+	RedisMasterName  string `json:"redis_master_name"`
+	SentinelPassword string `json:"sentinel_password"`
+	PostgresURL      string `json:"postgres_url"` // connection string for store postgres
+	ListenAddr       string `json:"listen_addr"`
+
+	// HTTPS is served with either a certificate and key from files or
+	// certificates obtained from Let's Encrypt for AutocertDomains
+	TLSCertFile      string   `json:"tls_cert_file"`
+	TLSKeyFile       string   `json:"tls_key_file"`
+	AutocertDomains  []string `json:"autocert_domains"`
+	AutocertCacheDir string   `json:"autocert_cache_dir"`
+	AutocertEmail    string   `json:"autocert_email"`
+	HTTPRedirectAddr string   `json:"http_redirect_addr"` // plain HTTP listener redirecting to HTTPS; empty disables it
+}
+
+// loadConfig builds the Config from defaults, the config file and the
+// environment, in that order of precedence
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Store:      storeRedis,
+		RedisMode:  redisStandalone,
+		RedisAddr:  "localhost:6379",
+		ListenAddr: ":8080",
+
+		AutocertCacheDir: "certs",
+	}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %v", path, err)
+		}
+	}
+
+	cfg.Store = envString("STORE", cfg.Store)
+	cfg.RedisMode = envString("REDIS_MODE", cfg.RedisMode)
+	cfg.RedisAddr = envString("REDIS_ADDR", cfg.RedisAddr)
+	cfg.RedisPassword = envString("REDIS_PASSWORD", cfg.RedisPassword)
+	cfg.RedisDB = envInt("REDIS_DB", cfg.RedisDB)
+	cfg.RedisPoolSize = envInt("REDIS_POOL_SIZE", cfg.RedisPoolSize)
+	cfg.RedisMasterName = envString("REDIS_MASTER_NAME", cfg.RedisMasterName)
+	cfg.SentinelPassword = envString("REDIS_SENTINEL_PASSWORD", cfg.SentinelPassword)
+	cfg.PostgresURL = envString("POSTGRES_URL", cfg.PostgresURL)
+	cfg.ListenAddr = envString("LISTEN_ADDR", cfg.ListenAddr)
+
+	// PORT is the common convention on container platforms
+	if port := os.Getenv("PORT"); port != "" && os.Getenv("LISTEN_ADDR") == "" {
+		cfg.ListenAddr = ":" + port
+	}
+
+	cfg.TLSCertFile = envString("TLS_CERT_FILE", cfg.TLSCertFile)
+	cfg.TLSKeyFile = envString("TLS_KEY_FILE", cfg.TLSKeyFile)
+	if domains := os.Getenv("AUTOCERT_DOMAINS"); domains != "" {
+		cfg.AutocertDomains = nil
+		for _, domain := range strings.Split(domains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				cfg.AutocertDomains = append(cfg.AutocertDomains, domain)
+			}
+		}
+	}
+	cfg.AutocertCacheDir = envString("AUTOCERT_CACHE_DIR", cfg.AutocertCacheDir)
+	cfg.AutocertEmail = envString("AUTOCERT_EMAIL", cfg.AutocertEmail)
+	if len(cfg.AutocertDomains) > 0 && cfg.HTTPRedirectAddr == "" {
+		// Let's Encrypt's HTTP challenge always comes in on port 80
+		cfg.HTTPRedirectAddr = ":80"
+	}
+	cfg.HTTPRedirectAddr = envString("HTTP_REDIRECT_ADDR", cfg.HTTPRedirectAddr)
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if cfg.Store == storePostgres && cfg.PostgresURL == "" {
+		return cfg, fmt.Errorf("store postgres needs postgres_url")
+	}
+	if cfg.TLSCertFile != "" && len(cfg.AutocertDomains) > 0 {
+		return cfg, fmt.Errorf("tls_cert_file and autocert_domains are mutually exclusive")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// archivePoll handles POST /api/poll/{pollID}/archive. Archiving is a soft
+// delete: the poll is closed, hidden from the default listing and kept for
+// RESULTS_RETENTION, but stays readable by ID.
+func (s *Server) archivePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	status, err := pollStatus(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if status != statusClosed {
+		if err := markClosed(pollID); err != nil {
+			requestLogger(r).Error("Failed to close poll for archiving", "error", err)
+			http.Error(w, "Failed to archive poll", http.StatusInternalServerError)
+			return
+		}
+		go afterClose(pollID)
+	}
+
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"archived": "1", "archived_at": time.Now().Unix()}); err != nil {
+		requestLogger(r).Error("Failed to archive poll", "error", err)
+		http.Error(w, "Failed to archive poll", http.StatusInternalServerError)
+		return
+	}
+	retainResults(pollID)
+	requestLogger(r).Info("Poll archived")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       pollID,
+		"status":   statusClosed,
+		"archived": true,
+	})
+}
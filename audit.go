@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Polls created with audit_log keep a record of every accepted ballot in a
+// Redis stream, so disputes can be settled after the fact. Voters and
+// their addresses are only kept as hashes salted per poll.
+
+const (
+	defaultAuditPage = 100
+	maxAuditPage     = 1000
+)
+
+// auditIDPattern matches the stream entry IDs pages are continued after
+var auditIDPattern = regexp.MustCompile(`^[0-9]{1,20}(-[0-9]{1,20})?$`)
+
+// Audit log actions
+const (
+	auditVote    = "vote"
+	auditChange  = "change"
+	auditRetract = "retract"
+	auditReset   = "reset" // all votes before it were cleared
+)
+
+// auditKey is the stream holding a poll's audit log
+func auditKey(pollID string) string {
+	return fmt.Sprintf("audit:%s", pollID)
+}
+
+// AuditEntry is one record of the audit log
+type AuditEntry struct {
+	ID      string `json:"id"`     // stream entry ID, for paging
+	Action  string `json:"action"` // "vote", "change", "retract" or "reset"
+	Voter   string `json:"voter"`  // salted hash of the voter's ID
+	Ballot  string `json:"ballot"` // as stored; the withdrawn ballot on a retract
+	Segment string `json:"segment,omitempty"`
+	IP      string `json:"ip,omitempty"` // salted hash of the source address
+	At      int64  `json:"at"`           // Unix millis
+}
+
+// AuditPage is a page of the audit log, oldest first
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Next    string       `json:"next,omitempty"` // pass as after= for the next page
+}
+
+// auditBallot appends a ballot to the audit log of a poll that keeps one.
+// Failures are logged; the vote itself already counted.
+func auditBallot(state map[string]string, v voteRequest, action, member, stored string, at time.Time) {
+	if state["audit_log"] != "1" {
+		return
+	}
+	salt := state["audit_salt"]
+	ballot, segment := splitBallot(stored)
+	values := map[string]interface{}{
+		"action": action,
+		"voter":  saltedHash(salt, member),
+		"ballot": ballot,
+		"at":     at.UnixMilli(),
+	}
+	if segment != "" {
+		values["segment"] = segment
+	}
+	if v.IP != "" {
+		values["ip"] = saltedHash(salt, v.IP)
+	}
+
+	key := auditKey(v.PollID)
+	err := kv.Batch(func(b KeyBatch) {
+		b.XAdd(key, values)
+		if expiresAt, err := strconv.ParseInt(state["expires_at"], 10, 64); err == nil {
+			b.ExpireAt(key, time.Unix(expiresAt, 0))
+		}
+	})
+	if err != nil {
+		v.log().Error("Failed to write audit log", "action", action, "error", err)
+	}
+}
+
+// getAuditLog handles GET /api/poll/{pollID}/audit?after=<id>&limit=N
+func (s *Server) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	limit := defaultAuditPage
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAuditPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	after := r.URL.Query().Get("after")
+	if after != "" && !auditIDPattern.MatchString(after) {
+		http.Error(w, "Invalid after", http.StatusBadRequest)
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if data["audit_log"] != "1" {
+		http.Error(w, "Poll has no audit log", http.StatusNotFound)
+		return
+	}
+
+	messages, err := kv.XRange(auditKey(pollID), after, int64(limit))
+	if err != nil {
+		requestLogger(r).Error("Failed to load audit log", "error", err)
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+
+	page := AuditPage{Entries: make([]AuditEntry, 0, len(messages))}
+	for _, msg := range messages {
+		entry := AuditEntry{ID: msg.ID}
+		entry.Action = msg.Values["action"]
+		entry.Voter = msg.Values["voter"]
+		entry.Ballot = msg.Values["ballot"]
+		entry.Segment = msg.Values["segment"]
+		entry.IP = msg.Values["ip"]
+		entry.At, _ = strconv.ParseInt(msg.Values["at"], 10, 64)
+		page.Entries = append(page.Entries, entry)
+	}
+	if len(messages) == limit {
+		page.Next = messages[len(messages)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ballotsKey is the set of the hashes of a poll's unspent ballot tokens.
+// Unlike an invite, a ballot token is removed as it's cast, so nothing
+// ties the ballot it cast to it.
+func ballotsKey(pollID string) string {
+	return fmt.Sprintf("ballots:%s", pollID)
+}
+
+// createBallots handles POST /api/poll/{pollID}/ballots, which mints count
+// single-use ballot tokens for a ballot_tokens poll, for formal votes where
+// every member gets exactly one anonymous vote
+func (s *Server) createBallots(w http.ResponseWriter, r *http.Request) {
+	issueVoterTokens(w, r, "ballot_tokens", ballotsKey, "ballots")
+}
+
+// spendBallot takes a ballot token out of the poll's unspent set. SREM
+// removes it at most once, so two ballots racing on one token can't both
+// count. It reports whether the token was unspent.
+func spendBallot(pollID, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	removed, err := kv.SRem(ballotsKey(pollID), hashToken(token))
+	return removed == 1, err
+}
+
+// refundBallot puts back a ballot token whose ballot failed to be recorded
+func refundBallot(pollID, token string) {
+	if _, err := kv.SAdd(ballotsKey(pollID), hashToken(token)); err != nil {
+		logger.Error("Failed to refund ballot token", "poll_id", pollID, "error", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// batchInterval is how often batched connections receive their updates
+var batchInterval = envDuration("BROADCAST_BATCH_INTERVAL", 250*time.Millisecond)
+
+// BatchMessage carries every update a batched connection received since
+// the previous flush
+type BatchMessage struct {
+	Type    string         `json:"type"` // "batch"
+	Updates []BatchedEvent `json:"updates"`
+}
+
+// BatchedEvent is one broadcast message inside a batch
+type BatchedEvent struct {
+	PollID string          `json:"pollId"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// updateBatch buffers broadcasts for a connection that negotiated the
+// pulse.json.batch subprotocol. Vote updates are full snapshots, so only
+// the newest one per poll is kept; other events are kept in order.
+type updateBatch struct {
+	mu      sync.Mutex
+	pending []BatchedEvent
+	votes   map[string]int // poll ID -> index of its pending voteUpdate
+}
+
+func newUpdateBatch() *updateBatch {
+	return &updateBatch{votes: make(map[string]int)}
+}
+
+// add queues a broadcast message for the next flush
+func (b *updateBatch) add(pollID, eventType string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := BatchedEvent{PollID: pollID, Event: payload}
+	if eventType == "voteUpdate" {
+		if i, ok := b.votes[pollID]; ok {
+			b.pending[i] = event
+			return
+		}
+		b.votes[pollID] = len(b.pending)
+	}
+	b.pending = append(b.pending, event)
+}
+
+// take empties the batch and returns what was queued
+func (b *updateBatch) take() []BatchedEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := b.pending
+	b.pending = nil
+	clear(b.votes)
+	return pending
+}
+
+// runBatchFlusher writes the client's queued updates as one frame every
+// batchInterval until done is closed
+func (c *wsClient) runBatchFlusher(done <-chan struct{}) {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if pending := c.batch.take(); len(pending) > 0 {
+				c.writeJSON(BatchMessage{Type: "batch", Updates: pending})
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBulkIDs caps how many polls a single bulk request may ask for
+var maxBulkIDs = envInt("MAX_BULK_IDS", 50)
+
+// BulkResultsRequest represents the request body for POST /api/polls/results
+type BulkResultsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// PollResults is the current tally of a single poll
+type PollResults struct {
+	Votes  map[string]int `json:"votes,omitempty"`
+	Total  int            `json:"total"`
+	Status string         `json:"status"`
+	Hidden bool           `json:"results_hidden,omitempty"`
+}
+
+// BulkResultsResponse maps poll IDs to their results
+type BulkResultsResponse struct {
+	Results  map[string]PollResults `json:"results"`
+	NotFound []string               `json:"notFound"`
+}
+
+// bulkResults handles POST /api/polls/results
+func (s *Server) bulkResults(w http.ResponseWriter, r *http.Request) {
+	var req BulkResultsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "At least one poll ID required", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBulkIDs {
+		http.Error(w, fmt.Sprintf("At most %d poll IDs allowed", maxBulkIDs), http.StatusBadRequest)
+		return
+	}
+
+	// Drop duplicate IDs so each poll is fetched once
+	seen := make(map[string]bool, len(req.IDs))
+	ids := make([]string, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	// Fetch every poll hash in a single round-trip
+	polls, err := store.GetPolls(ids)
+	if err != nil {
+		requestLogger(r).Error("Failed to fetch bulk results", "error", err)
+		http.Error(w, "Failed to fetch results", http.StatusInternalServerError)
+		return
+	}
+
+	resp := BulkResultsResponse{
+		Results:  make(map[string]PollResults, len(ids)),
+		NotFound: []string{},
+	}
+	for i, id := range ids {
+		data := polls[i]
+		if len(data) == 0 {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+
+		status := data["status"]
+		if status == "" {
+			status = statusActive
+		}
+		if resultsHidden(r, id, data) {
+			resp.Results[id] = PollResults{Status: status, Hidden: true}
+			continue
+		}
+
+		votes := parseVotes(data)
+		total := totalVotes(votes)
+		resp.Results[id] = PollResults{Votes: votes, Total: total, Status: status}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// captchaProvider is "hcaptcha" or "turnstile"
+	captchaProvider = envString("CAPTCHA_PROVIDER", "hcaptcha")
+
+	// captchaSecret is the provider secret; polls can't require a CAPTCHA
+	// when it is unset
+	captchaSecret = envString("CAPTCHA_SECRET", "")
+
+	// captchaVerifyURL overrides the provider's verify endpoint
+	captchaVerifyURL = envString("CAPTCHA_VERIFY_URL", "")
+
+	captchaClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// Verify endpoints of the supported providers
+var captchaEndpoints = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// captchaConfigured reports whether polls may use require_captcha
+func captchaConfigured() bool {
+	return captchaSecret != "" && captchaEndpoint() != ""
+}
+
+// captchaEndpoint returns the verify URL for the configured provider
+func captchaEndpoint() string {
+	if captchaVerifyURL != "" {
+		return captchaVerifyURL
+	}
+	return captchaEndpoints[captchaProvider]
+}
+
+// verifyCaptcha checks a client's CAPTCHA response token with the provider
+func verifyCaptcha(token, ip string) error {
+	if token == "" {
+		return fmt.Errorf("no CAPTCHA token")
+	}
+
+	form := url.Values{
+		"secret":   {captchaSecret},
+		"response": {token},
+		"remoteip": {ip},
+	}
+	resp, err := captchaClient.PostForm(captchaEndpoint(), form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("bad verify response: %v", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("rejected: %v", result.ErrorCodes)
+	}
+	return nil
+}
+
+// passCaptcha reports whether the connection may vote on a require_captcha
+// poll. A successful check is remembered for the rest of the connection, so
+// a voter is only challenged once per session.
+func (c *wsClient) passCaptcha(token, ip string) bool {
+	if !c.requireCaptcha || c.captchaPassed.Load() {
+		return true
+	}
+	if err := verifyCaptcha(token, ip); err != nil {
+		c.log.Info("CAPTCHA check failed", "error", err)
+		return false
+	}
+	c.captchaPassed.Store(true)
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Chart layout, in SVG user units
+const (
+	chartWidth      = 600
+	chartPadding    = 20
+	chartTitleSpace = 50
+	chartRowHeight  = 44
+	chartBarHeight  = 16
+	chartLabelChars = 60 // longer option text is cut off
+)
+
+// chartPalette colors options that don't set their own color
+var chartPalette = []string{"#667eea", "#f56565", "#48bb78", "#ed8936", "#9f7aea", "#38b2ac", "#ecc94b", "#ed64a6"}
+
+// pollChart handles GET /api/poll/{pollID}/chart.svg, a horizontal bar
+// chart of the current tallies for embedding without JavaScript
+func (s *Server) pollChart(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if privilegedViewer(r, data) {
+		w.Header().Set("Cache-Control", "private, max-age=5")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=5")
+	}
+
+	summary := buildSummary(pollID, data, 0)
+	if resultsHidden(r, pollID, data) {
+		w.Write(renderHiddenChart(summary.Question))
+		return
+	}
+	w.Write(renderChart(summary, data))
+}
+
+// renderChart draws one labeled bar per option, in option order
+func renderChart(summary *PollSummary, data map[string]string) []byte {
+	height := chartTitleSpace + len(summary.Results)*chartRowHeight + chartPadding
+	barSpace := float64(chartWidth - 2*chartPadding - 60) // room for the percentage
+
+	var b strings.Builder
+	writeChartHeader(&b, height, summary.Question)
+	for i, result := range summary.Results {
+		y := chartTitleSpace + i*chartRowHeight
+		width := barSpace * result.Percent / 100
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="13" fill="#333">%s</text>`+"\n",
+			chartPadding, y+12, chartText(result.Text, chartLabelChars))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%d" rx="3" fill="%s"/>`+"\n",
+			chartPadding, y+18, width, chartBarHeight, optionColor(data, result.ID, i))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" font-size="12" fill="#555">%.1f%% (%d)</text>`+"\n",
+			float64(chartPadding)+width+6, y+30, result.Percent, result.Votes)
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+// renderHiddenChart draws the placeholder shown while results are hidden
+func renderHiddenChart(question string) []byte {
+	height := chartTitleSpace + chartRowHeight + chartPadding
+	var b strings.Builder
+	writeChartHeader(&b, height, question)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="14" fill="#888" text-anchor="middle">Results hidden</text>`+"\n",
+		chartWidth/2, chartTitleSpace+chartRowHeight/2)
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+// writeChartHeader opens the SVG document and draws the title
+func writeChartHeader(b *strings.Builder, height int, question string) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`+"\n",
+		chartWidth, height, chartWidth, height)
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="#fff"/>`+"\n")
+	fmt.Fprintf(b, `<text x="%d" y="%d" font-size="18" font-weight="bold" fill="#222">%s</text>`+"\n",
+		chartPadding, chartPadding+14, chartText(question, chartLabelChars))
+}
+
+// optionColor returns the color set in the option's metadata, falling
+// back to the palette for options without one
+func optionColor(data map[string]string, optionID string, i int) string {
+	if color := optionMeta(data, optionID).Color; colorPattern.MatchString(color) {
+		return color
+	}
+	return chartPalette[i%len(chartPalette)]
+}
+
+// chartText escapes text for SVG and cuts it to max runes
+func chartText(text string, max int) string {
+	if utf8.RuneCountInString(text) > max {
+		text = string([]rune(text)[:max-1]) + "…"
+	}
+	return html.EscapeString(text)
+}
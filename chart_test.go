@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChartUsesOptionColors(t *testing.T) {
+	s := newTestServer(t)
+	req := testPollRequest()
+	req.Options[0].Color = "#1e90ff"
+	poll := createTestPoll(t, s, req)
+
+	w := apiRequest(t, s, http.MethodGet, "/api/poll/"+poll.ID+"/chart.svg", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chart: %d %s", w.Code, w.Body)
+	}
+	svg := w.Body.String()
+	if !strings.Contains(svg, `fill="#1e90ff"`) {
+		t.Errorf("the first option's color is missing from the chart:\n%s", svg)
+	}
+	// The option without a color keeps its palette color
+	if !strings.Contains(svg, `fill="`+chartPalette[1]+`"`) {
+		t.Errorf("the second option lost its palette color:\n%s", svg)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxChoicesOf returns how many options one ballot may select; polls
+// without max_choices are single-choice
+func maxChoicesOf(data map[string]string) int {
+	n, err := strconv.Atoi(data["max_choices"])
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// validateMaxChoices checks max_choices at creation; 0 and 1 both mean a
+// single-choice poll
+func validateMaxChoices(maxChoices, options int) error {
+	if maxChoices < 0 || (maxChoices > 1 && maxChoices > options) {
+		return fmt.Errorf("max_choices must be between 1 and the number of options (%d)", options)
+	}
+	return nil
+}
+
+// countedChoices returns the options a ballot adds a vote to: every pick
+// of a multi-select ballot, but only the first preference of a ranked one
+func countedChoices(data map[string]string, choices []string) []string {
+	if pollTypeOf(data) == pollTypeRanked {
+		return choices[:1]
+	}
+	return choices
+}
+
+// choices returns the options a vote selects: the rated options of a
+// rating ballot, the list of a multi-select ballot, or the single option
+// of a plain vote
+func (v voteRequest) choices() []string {
+	if len(v.Ratings) > 0 {
+		return ratedOptions(v.Ratings)
+	}
+	if len(v.Options) > 0 {
+		return v.Options
+	}
+	if v.Option != "" {
+		return []string{v.Option}
+	}
+	return nil
+}
+
+// validBallot reports whether choices selects between 1 and the poll's
+// max_choices distinct existing options. A ranked or rating ballot may
+// rank or rate any number of them, and an open-text answer selects none.
+func validBallot(data map[string]string, choices []string) bool {
+	limit := maxChoicesOf(data)
+	switch pollTypeOf(data) {
+	case pollTypeRanked, pollTypeRating:
+		limit = len(parseOptions(data))
+	case pollTypeText:
+		return len(choices) == 0
+	}
+	if len(choices) == 0 || len(choices) > limit {
+		return false
+	}
+	seen := make(map[string]bool, len(choices))
+	for _, optionID := range choices {
+		if _, ok := data["option_"+optionID]; !ok || seen[optionID] {
+			return false
+		}
+		seen[optionID] = true
+	}
+	return true
+}
+
+// encodeBallot is how a voter's selection is kept in vote:<pollID>
+func encodeBallot(choices []string) string {
+	return strings.Join(choices, ",")
+}
+
+// segmentSeparator divides a stored ballot from the voter's segment
+const segmentSeparator = "\x1f"
+
+// storedBallot is how a ballot is kept in vote:<pollID>: the encoded
+// ballot, followed by the voter's segment if they gave one, so a revote
+// or retraction can also move the segment counters
+func storedBallot(ballot, segment string) string {
+	if segment == "" {
+		return ballot
+	}
+	return ballot + segmentSeparator + segment
+}
+
+// splitBallot separates a stored ballot from the voter's segment
+func splitBallot(stored string) (string, string) {
+	if i := strings.LastIndex(stored, segmentSeparator); i >= 0 {
+		return stored[:i], stored[i+len(segmentSeparator):]
+	}
+	return stored, ""
+}
+
+// ballotCounters returns the counters a ballot adds to: the option totals
+// first, in ballot order (or the response count of an open-text poll),
+// then the segment counters and, on rating polls, each option's score sum
+// and distribution. choices are the options the ballot counts towards.
+func ballotCounters(data map[string]string, choices []string, ratings map[string]int, segment string) []Increment {
+	var counters []Increment
+	if pollTypeOf(data) == pollTypeText {
+		counters = append(counters, incr("responses"))
+	}
+	for _, optionID := range choices {
+		counters = append(counters, incr(fmt.Sprintf("votes_%s", optionID)))
+	}
+	if segment != "" {
+		for _, optionID := range choices {
+			counters = append(counters, incr(segmentVoteKey(optionID, segment)))
+		}
+	}
+	for _, optionID := range choices {
+		if score, ok := ratings[optionID]; ok {
+			counters = append(counters,
+				Increment{Field: ratingSumKey(optionID), By: int64(score)},
+				incr(ratingDistKey(optionID, score)))
+		}
+	}
+	return counters
+}
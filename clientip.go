@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustProxyHeaders controls whether X-Forwarded-For / X-Real-IP are honoured.
+// Only enable this when the server sits behind a proxy that sets them.
+var trustProxyHeaders = envBool("TRUST_PROXY_HEADERS", false)
+
+// clientIP resolves the originating IP address of a request
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// The left-most entry is the original client
+			first := strings.TrimSpace(strings.Split(fwd, ",")[0])
+			if first != "" {
+				return first
+			}
+		}
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			return strings.TrimSpace(real)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
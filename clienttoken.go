@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Client IDs are issued by the server as client tokens,
+// "<id>.<expiry>.<signature>", signed for one poll. Votes carrying a
+// client ID the server didn't sign, or whose token expired, are refused,
+// so voters can't mint identities of their own. The <id> part is the
+// voter's identity; renewing a token keeps it.
+var (
+	clientTokenTTL       = envDuration("CLIENT_TOKEN_TTL", 24*time.Hour)
+	allowUnsignedClients = envBool("ALLOW_UNSIGNED_CLIENT_IDS", false) // accept client-chosen IDs, as before tokens
+)
+
+// ClientToken is sent on WebSocket connect, and by GET
+// /api/poll/{pollID}/token, for the client to use as its clientId
+type ClientToken struct {
+	Type      string `json:"type"` // "clientToken"
+	ClientID  string `json:"clientId"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix seconds
+}
+
+// clientTokenMAC signs a client ID for a poll until expiry
+func clientTokenMAC(pollID, id, expiry string) string {
+	mac := hmac.New(sha256.New, voterSecret)
+	for _, part := range []string{"client", pollID, id, expiry} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueClientToken signs a client token for a poll. An earlier token of
+// the same poll, even an expired one, is renewed with the same identity.
+func issueClientToken(pollID, previous string, now time.Time) ClientToken {
+	id, _, ok := parseClientToken(pollID, previous)
+	if !ok {
+		id = newToken()
+	}
+	return signClientToken(pollID, id, now)
+}
+
+// signClientToken signs a client token for a given identity, such as one
+// derived from a chat user's ID
+func signClientToken(pollID, id string, now time.Time) ClientToken {
+	expiresAt := now.Add(clientTokenTTL).Unix()
+	expiry := strconv.FormatInt(expiresAt, 10)
+	return ClientToken{
+		Type:      "clientToken",
+		ClientID:  id + "." + expiry + "." + clientTokenMAC(pollID, id, expiry),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// parseClientToken returns the identity and expiry of a client token, and
+// whether the server signed it for this poll
+func parseClientToken(pollID, token string) (string, time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	id, expiry, signature := parts[0], parts[1], parts[2]
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(clientTokenMAC(pollID, id, expiry))) {
+		return "", time.Time{}, false
+	}
+	return id, time.Unix(seconds, 0), true
+}
+
+// verifyClientID checks the client ID a vote carries and returns the
+// voter identity it stands for, or the status to refuse the vote with
+func verifyClientID(pollID, clientID string, now time.Time) (string, string) {
+	id, expires, ok := parseClientToken(pollID, clientID)
+	switch {
+	case ok && now.After(expires):
+		return "", voteClientExpired
+	case ok:
+		return id, ""
+	case allowUnsignedClients && clientID != "":
+		return clientID, ""
+	}
+	return "", voteClientInvalid
+}
+
+// clientIdentity returns the voter identity behind a client ID for
+// lookups such as "has this viewer voted", where an expired token still
+// says who the viewer is. It returns "" for IDs the server won't accept.
+func clientIdentity(pollID, clientID string) string {
+	if id, _, ok := parseClientToken(pollID, clientID); ok {
+		return id
+	}
+	if allowUnsignedClients {
+		return clientID
+	}
+	return ""
+}
+
+// getClientToken handles GET /api/poll/{pollID}/token, issuing a client
+// token to clients that vote over REST. Passing ?clientId= renews it.
+func (s *Server) getClientToken(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(issueClientToken(pollID, r.URL.Query().Get("clientId"), time.Now()))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCommentsPerPoll is how many of a poll's most recent comments are kept
+var maxCommentsPerPoll = envInt("MAX_COMMENTS_PER_POLL", 200)
+
+const (
+	maxCommentLength    = 500
+	defaultCommentsPage = 20
+	maxCommentsPage     = 100
+)
+
+// Comment is a single free-text comment on a poll
+type Comment struct {
+	Text      string `json:"text"`
+	Author    string `json:"author,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// CommentsPage is a page of comments, newest first
+type CommentsPage struct {
+	Comments []Comment `json:"comments"`
+	Offset   int       `json:"offset"`
+	Limit    int       `json:"limit"`
+	Total    int64     `json:"total"` // comments currently retained
+}
+
+// commentsKey is the Redis list holding a poll's comments, newest first
+func commentsKey(pollID string) string {
+	return fmt.Sprintf("comments:%s", pollID)
+}
+
+// addComment handles POST /api/poll/{pollID}/comments
+func (s *Server) addComment(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	var comment Comment
+	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	comment.Text = normalizeText(comment.Text)
+	comment.Author = normalizeText(comment.Author)
+	if comment.Text == "" || len([]rune(comment.Text)) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("Comment must be 1-%d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+	if len([]rune(comment.Author)) > maxSegmentLength {
+		http.Error(w, fmt.Sprintf("Author must be at most %d characters", maxSegmentLength), http.StatusBadRequest)
+		return
+	}
+	comment.CreatedAt = time.Now().Unix()
+
+	if data, _ := store.GetPoll(pollID); len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	// The comments list lives exactly as long as the poll
+	ttl, err := store.PollTTL(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+
+	if err := pushComment(pollID, comment, ttl); err != nil {
+		requestLogger(r).Error("Failed to store comment", "error", err)
+		http.Error(w, "Failed to store comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// pushComment prepends a comment and trims the list to the newest
+// maxCommentsPerPoll entries, so a chatty poll can't grow without bound.
+// A limit of 0 keeps every comment.
+func pushComment(pollID string, comment Comment, ttl time.Duration) error {
+	payload, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	key := commentsKey(pollID)
+	return kv.Batch(func(b KeyBatch) {
+		b.LPush(key, string(payload))
+		b.LTrim(key, 0, int64(maxCommentsPerPoll-1))
+		if ttl > 0 {
+			b.Expire(key, ttl)
+		}
+	})
+}
+
+// getComments handles GET /api/poll/{pollID}/comments?offset=N&limit=N
+func (s *Server) getComments(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	offset, limit := 0, defaultCommentsPage
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must not be negative", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxCommentsPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxCommentsPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	if data, _ := store.GetPoll(pollID); len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	key := commentsKey(pollID)
+	comments, err := kv.LRange(key, int64(offset), int64(offset+limit-1))
+	var total int64
+	if err == nil {
+		total, err = kv.LLen(key)
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load comments", "error", err)
+		http.Error(w, "Failed to load comments", http.StatusInternalServerError)
+		return
+	}
+
+	page := CommentsPage{
+		Comments: make([]Comment, 0, len(comments)),
+		Offset:   offset,
+		Limit:    limit,
+		Total:    total,
+	}
+	for _, raw := range comments {
+		var comment Comment
+		if json.Unmarshal([]byte(raw), &comment) == nil {
+			page.Comments = append(page.Comments, comment)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// withCommentCap sets maxCommentsPerPoll for one test
+func withCommentCap(t *testing.T, limit int) {
+	t.Helper()
+	saved := maxCommentsPerPoll
+	maxCommentsPerPoll = limit
+	t.Cleanup(func() { maxCommentsPerPoll = saved })
+}
+
+// testComments returns the first page of a poll's comments
+func testComments(t *testing.T, s *Server, pollID string) CommentsPage {
+	t.Helper()
+	w := apiRequest(t, s, http.MethodGet, "/api/poll/"+pollID+"/comments?limit=100", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("comments: %d %s", w.Code, w.Body)
+	}
+	var page CommentsPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding comments: %v", err)
+	}
+	return page
+}
+
+func TestCommentsTrimmedToCap(t *testing.T) {
+	s := newTestServer(t)
+	withCommentCap(t, 5)
+	poll := createTestPoll(t, s, testPollRequest())
+
+	for i := 0; i < 8; i++ {
+		comment := Comment{Text: fmt.Sprintf("comment %d", i)}
+		if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/comments", "", comment); w.Code != http.StatusCreated {
+			t.Fatalf("comment %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+
+	page := testComments(t, s, poll.ID)
+	if page.Total != 5 || len(page.Comments) != 5 {
+		t.Fatalf("%d comments retained (total %d), want 5", len(page.Comments), page.Total)
+	}
+	// The newest are kept, newest first
+	for i, comment := range page.Comments {
+		if want := fmt.Sprintf("comment %d", 7-i); comment.Text != want {
+			t.Errorf("comment %d is %q, want %q", i, comment.Text, want)
+		}
+	}
+}
+
+func TestCommentWhitespaceTrimmed(t *testing.T) {
+	s := newTestServer(t)
+	poll := createTestPoll(t, s, testPollRequest())
+
+	comment := Comment{Text: "  \tNice poll!\n ", Author: "  Sam  "}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/comments", "", comment); w.Code != http.StatusCreated {
+		t.Fatalf("comment: %d %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/comments", "", Comment{Text: " \n\t "}); w.Code != http.StatusBadRequest {
+		t.Fatalf("blank comment: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	page := testComments(t, s, poll.ID)
+	if len(page.Comments) != 1 {
+		t.Fatalf("%d comments, want 1", len(page.Comments))
+	}
+	if got := page.Comments[0]; got.Text != "Nice poll!" || got.Author != "Sam" {
+		t.Fatalf("stored %q by %q, want the text and author trimmed", got.Text, got.Author)
+	}
+}
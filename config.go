@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PollConfig is the static definition of a poll, without its vote counts.
+// It only changes when the owner edits the poll or its status changes.
+type PollConfig struct {
+	ID       string         `json:"id"`
+	Question string         `json:"question"`
+	Status   string         `json:"status"`
+	Options  []ConfigOption `json:"options"` // in canonical order
+	Settings PollSettings   `json:"settings"`
+	Version  int64          `json:"config_version"`
+}
+
+// ConfigOption is one option of a PollConfig
+type ConfigOption struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	OptionMeta
+}
+
+// PollSettings are the creation-time settings of a poll
+type PollSettings struct {
+	ConfirmVotes bool         `json:"confirm_votes"`
+	AllowRevote  bool         `json:"allow_revote"`
+	MinOpen      int          `json:"min_open_seconds"`
+	VoterOnly    bool         `json:"require_voter_token"`
+	SignInOnly   bool         `json:"require_sign_in"`
+	InviteOnly   bool         `json:"require_invite"`
+	BallotTokens bool         `json:"ballot_tokens"`
+	Weighted     bool         `json:"weighted"`
+	Identified   bool         `json:"identified"`
+	Moderated    bool         `json:"moderated"`
+	EmailOnly    bool         `json:"email_restricted"`
+	RevealAfter  bool         `json:"reveal_after_vote"`
+	HideResults  bool         `json:"hide_results"`
+	Visibility   string       `json:"results_visibility"`
+	Captcha      bool         `json:"require_captcha"`
+	Segments     []string     `json:"segments"`
+	Shuffle      bool         `json:"shuffle_options"`
+	CloseGrace   int          `json:"close_grace_seconds"`
+	Dedup        string       `json:"dedup"`
+	MaxChoices   int          `json:"max_choices"`
+	PollType     string       `json:"poll_type"`
+	Scale        *RatingScale `json:"scale,omitempty"`
+}
+
+// bumpConfigVersion records that a poll's configuration changed, which
+// invalidates cached copies of GET /api/poll/{pollID}/config
+func bumpConfigVersion(pollID string) {
+	if _, err := store.IncrPollField(pollID, "config_version", 1); err != nil {
+		logger.Error("Failed to bump config version", "poll_id", pollID, "error", err)
+		return
+	}
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"config_updated_at": time.Now().Unix()}); err != nil {
+		logger.Error("Failed to bump config version", "poll_id", pollID, "error", err)
+	}
+}
+
+// getPollConfig handles GET /api/poll/{pollID}/config. Responses carry an
+// ETag built from config_version and a Last-Modified time, and conditional
+// requests that still match get 304 Not Modified.
+func (s *Server) getPollConfig(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	version, _ := strconv.ParseInt(data["config_version"], 10, 64)
+	etag := fmt.Sprintf(`"%s-%d"`, pollID, version)
+
+	// Polls that were never edited date from their creation
+	updated, _ := strconv.ParseInt(data["config_updated_at"], 10, 64)
+	if updated == 0 {
+		updated, _ = strconv.ParseInt(data["created_at"], 10, 64)
+	}
+	modified := time.Unix(updated, 0).UTC()
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if updated > 0 {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modified, updated > 0) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	config := PollConfig{
+		ID:       pollID,
+		Question: data["question"],
+		Status:   data["status"],
+		Version:  version,
+		Settings: PollSettings{
+			ConfirmVotes: data["confirm_votes"] == "1",
+			AllowRevote:  data["allow_revote"] == "1",
+			VoterOnly:    data["voter_hash"] != "",
+			SignInOnly:   data["require_sign_in"] == "1",
+			InviteOnly:   data["require_invite"] == "1",
+			BallotTokens: data["ballot_tokens"] == "1",
+			Weighted:     data["weighted"] == "1",
+			Identified:   data["identified"] == "1",
+			Moderated:    data["moderated"] == "1",
+			EmailOnly:    data["allowed_emails"] != "",
+			RevealAfter:  data["reveal_after_vote"] == "1",
+			HideResults:  data["hide_results"] == "1",
+			Visibility:   resultsVisibilityOf(data),
+			Captcha:      data["require_captcha"] == "1",
+			Segments:     parseSegments(data["segments"]),
+			Shuffle:      data["shuffle_options"] == "1",
+			Dedup:        data["dedup"],
+		},
+	}
+	if config.Status == "" {
+		config.Status = statusActive
+	}
+	if config.Settings.Dedup == "" {
+		config.Settings.Dedup = dedupClient
+	}
+	config.Settings.MinOpen, _ = strconv.Atoi(data["min_open_seconds"])
+	config.Settings.CloseGrace, _ = strconv.Atoi(data["close_grace_seconds"])
+	config.Settings.MaxChoices = maxChoicesOf(data)
+	config.Settings.PollType = pollTypeOf(data)
+	if config.Settings.PollType == pollTypeRating {
+		config.Settings.Scale = ratingScaleOf(data)
+	}
+
+	options := parseOptions(data)
+	for _, option := range parseOptionDetails(data, optionOrder(options, false, pollID, "")) {
+		config.Options = append(config.Options, ConfigOption{ID: option.ID, Text: option.Text, OptionMeta: option.OptionMeta})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+// when the request has no entity tag to compare
+func notModified(r *http.Request, etag string, modified time.Time, hasModified bool) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && hasModified {
+		t, err := http.ParseTime(since)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag || candidate == "W/"+etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+)
+
+// confirmWindow is how long a voteIntent stays valid waiting for voteConfirm
+var confirmWindow = envDuration("VOTE_CONFIRM_WINDOW", 15*time.Second)
+
+// pendingIntent is a vote waiting for the client to confirm it
+type pendingIntent struct {
+	token   string
+	vote    voteRequest
+	expires time.Time
+}
+
+// ConfirmRequired asks the client to confirm a vote intent
+type ConfirmRequired struct {
+	Type      string         `json:"type"`
+	Token     string         `json:"token"`
+	Option    string         `json:"option"`
+	Options   []string       `json:"options,omitempty"` // multi-select ballot
+	Ratings   map[string]int `json:"ratings,omitempty"` // rating ballot
+	Answer    string         `json:"answer,omitempty"`  // open-text poll
+	ExpiresIn int            `json:"expiresIn"`         // seconds
+	MsgID     string         `json:"msgId,omitempty"`
+}
+
+// handleVoteIntent registers a vote intent and replies with a confirmation
+// token. A connection holds a single intent; a new one replaces the old.
+// Pending intents are only touched by the connection's read loop.
+func (c *wsClient) handleVoteIntent(pollID string, msg VoteMessage, ip, userAgent string) {
+	if (msg.Option == "" && len(msg.Options) == 0 && len(msg.Ratings) == 0 && msg.Answer == "") || msg.ClientID == "" {
+		c.writeJSON(VoteAck{Type: "voteAck", Status: voteInvalid, Option: msg.Option, Options: msg.Options, Ratings: msg.Ratings, MsgID: msg.MsgID})
+		return
+	}
+	if !c.passCaptcha(msg.CaptchaToken, ip) {
+		c.writeJSON(VoteAck{Type: "voteAck", Status: voteCaptchaFailed, Option: msg.Option, Options: msg.Options, Ratings: msg.Ratings, MsgID: msg.MsgID})
+		return
+	}
+
+	c.pending = &pendingIntent{
+		token: newToken(),
+		vote: voteRequest{
+			PollID:     pollID,
+			Option:     msg.Option,
+			Options:    msg.Options,
+			Ratings:    msg.Ratings,
+			Answer:     normalizeText(msg.Answer),
+			ClientID:   msg.ClientID,
+			IP:         ip,
+			UserAgent:  userAgent,
+			VoterToken: msg.VoterToken,
+			Segment:    normalizeText(msg.Segment),
+			Player:     playerName(msg.Player),
+			Name:       playerName(msg.Name),
+
+			VoterCookie: c.voterCookie,
+			Fingerprint: c.fingerprint,
+			Account:     c.account,
+			Log:         c.log,
+		},
+		expires: time.Now().Add(confirmWindow),
+	}
+	c.writeJSON(ConfirmRequired{
+		Type:      "confirmRequired",
+		Token:     c.pending.token,
+		Option:    msg.Option,
+		Options:   msg.Options,
+		Ratings:   msg.Ratings,
+		Answer:    normalizeText(msg.Answer),
+		ExpiresIn: int(confirmWindow / time.Second),
+		MsgID:     msg.MsgID,
+	})
+}
+
+// handleVoteConfirm records the pending vote if the token matches and the
+// confirmation arrived within the window
+func (c *wsClient) handleVoteConfirm(msg VoteMessage, receivedAt time.Time) {
+	intent := c.pending
+	if intent == nil || intent.token != msg.Token {
+		c.writeJSON(VoteAck{Type: "voteAck", Status: voteExpired, MsgID: msg.MsgID})
+		return
+	}
+	c.pending = nil
+
+	if time.Now().After(intent.expires) {
+		c.writeJSON(VoteAck{Type: "voteAck", Status: voteExpired, Option: intent.vote.Option, Options: intent.vote.Options, Ratings: intent.vote.Ratings, MsgID: msg.MsgID})
+		return
+	}
+
+	intent.vote.ReceivedAt = receivedAt
+	status := handleVote(intent.vote)
+	c.writeJSON(VoteAck{Type: "voteAck", Status: status, Option: intent.vote.Option, Options: intent.vote.Options, Ratings: intent.vote.Ratings, MsgID: msg.MsgID})
+	c.afterVote(intent.vote.PollID, status)
+}
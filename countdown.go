@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// countdownInterval is how often viewers of a poll with a closes_at are
+// sent the time left. Clients count down locally in between, so this only
+// has to be often enough to correct their clocks' drift.
+var countdownInterval = envDuration("COUNTDOWN_INTERVAL", 10*time.Second)
+
+// Countdown tells viewers how long a poll has left before its closes_at.
+// ServerTime lets a client work out how far its own clock is off.
+type Countdown struct {
+	Type       string `json:"type"` // "countdown"
+	PollID     string `json:"pollId"`
+	ClosesAt   int64  `json:"closesAt"`   // Unix seconds
+	Remaining  int64  `json:"remaining"`  // seconds, 0 once the poll closes
+	ServerTime int64  `json:"serverTime"` // Unix millis
+}
+
+// countdownFor builds the countdown of a poll closing at closesAt
+func countdownFor(pollID string, closesAt int64, now time.Time) Countdown {
+	remaining := closesAt - now.Unix()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Countdown{
+		Type:       "countdown",
+		PollID:     pollID,
+		ClosesAt:   closesAt,
+		Remaining:  remaining,
+		ServerTime: now.UnixMilli(),
+	}
+}
+
+// pollCountdown returns the countdown of a poll's hash, or false if the
+// poll isn't counting down to a close
+func pollCountdown(pollID string, data map[string]string, now time.Time) (Countdown, bool) {
+	closesAt, err := strconv.ParseInt(data["closes_at"], 10, 64)
+	if err != nil || closesAt <= 0 || data["status"] == statusClosed {
+		return Countdown{}, false
+	}
+	return countdownFor(pollID, closesAt, now), true
+}
+
+// runCountdown sends the viewers on this instance the time left on their
+// polls. Like the expiry watcher, every instance only serves its own
+// viewers, so nothing goes through the update stream.
+func runCountdown(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pollIDs := hub.Rooms()
+		if len(pollIDs) == 0 {
+			continue
+		}
+
+		polls, err := store.GetPolls(pollIDs, "closes_at", "status")
+		if err != nil {
+			logger.Error("Countdown check failed", "error", err)
+			continue
+		}
+
+		now := time.Now()
+		for i, data := range polls {
+			countdown, ok := pollCountdown(pollIDs[i], data, now)
+			if !ok || countdown.Remaining == 0 {
+				// The scheduler announces the close itself
+				continue
+			}
+			payload, _ := json.Marshal(countdown)
+			hub.Broadcast(pollIDs[i], string(payload))
+		}
+	}
+}
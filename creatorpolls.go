@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// creatorRetention is how long a creator's expired polls stay in their
+// listing after expiring
+var creatorRetention = envDuration("CREATOR_INDEX_RETENTION", 30*24*time.Hour)
+
+// maxCreatorPolls caps a creator's index; the oldest polls drop out first
+const maxCreatorPolls = 1000
+
+// Statuses GET /api/polls?mine=true can filter on. Open covers every
+// state a poll can still take votes in or return to.
+const (
+	creatorFilterOpen    = "open"
+	creatorFilterClosed  = "closed"
+	creatorFilterExpired = "expired"
+)
+
+// creatorPollsKey is the sorted set of the polls created with an owner
+// token, scored by creation time. Unlike the quota set it keeps polls
+// after they expire, so creators can still find them.
+func creatorPollsKey(ownerHash string) string {
+	return fmt.Sprintf("creator:%s", ownerHash)
+}
+
+// creatorInfoKey holds what the listing shows of a creator's polls once
+// they've expired, as JSON creatorInfo per poll ID
+func creatorInfoKey(ownerHash string) string {
+	return fmt.Sprintf("creatorinfo:%s", ownerHash)
+}
+
+// creatorInfo is what's kept of a poll in its creator's index
+type creatorInfo struct {
+	Question  string `json:"question"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// CreatorPollsPage is the body of GET /api/polls?mine=true
+type CreatorPollsPage struct {
+	Polls  []PollListing `json:"polls"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	Total  int           `json:"total"` // polls matching the filter
+}
+
+// indexCreatorPoll adds a new poll to its creator's index. The index lives
+// until its newest poll has expired and been retained.
+func indexCreatorPoll(ownerHash, pollID, question string, createdAt time.Time, ttl time.Duration) {
+	info, _ := json.Marshal(creatorInfo{Question: question, ExpiresAt: createdAt.Add(ttl).Unix()})
+	key, infoKey := creatorPollsKey(ownerHash), creatorInfoKey(ownerHash)
+	lifetime := ttl + creatorRetention
+
+	err := kv.Batch(func(b KeyBatch) {
+		b.ZAdd(key, pollID, float64(createdAt.Unix()))
+		b.HSet(infoKey, map[string]interface{}{pollID: info})
+	})
+	var current time.Duration
+	var size int64
+	if err == nil {
+		current, err = kv.TTL(key)
+	}
+	if err == nil {
+		size, err = kv.ZCard(key)
+	}
+	if err != nil {
+		logger.Error("Failed to index poll", "poll_id", pollID, "error", err)
+		return
+	}
+	if current < lifetime {
+		kv.Expire(key, lifetime)
+		kv.Expire(infoKey, lifetime)
+	}
+	if extra := size - maxCreatorPolls; extra > 0 {
+		dropped, _ := kv.ZPopMin(key, extra)
+		for _, z := range dropped {
+			kv.HDel(infoKey, z.Member)
+		}
+	}
+}
+
+// forgetCreatorPoll removes a deleted poll from its creator's index
+func forgetCreatorPoll(ownerHash, pollID string) {
+	kv.ZRem(creatorPollsKey(ownerHash), pollID)
+	kv.HDel(creatorInfoKey(ownerHash), pollID)
+}
+
+// listCreatorPolls handles GET /api/polls?mine=true, the polls created with
+// the request's owner token or by its account. It takes ?status=open|closed|expired,
+// ?sort=newest|oldest and ?offset= and ?limit= for paging.
+func (s *Server) listCreatorPolls(w http.ResponseWriter, r *http.Request) {
+	ownerHash := ownerHashFromRequest(r)
+	if ownerHash == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := query.Get("status")
+	if filter != "" && filter != creatorFilterOpen && filter != creatorFilterClosed && filter != creatorFilterExpired {
+		http.Error(w, "status must be open, closed or expired", http.StatusBadRequest)
+		return
+	}
+	sortOrder := query.Get("sort")
+	if sortOrder == "" {
+		sortOrder = "newest"
+	}
+	if sortOrder != "newest" && sortOrder != "oldest" {
+		http.Error(w, "sort must be newest or oldest", http.StatusBadRequest)
+		return
+	}
+	offset, limit := 0, defaultListLimit
+	if raw := query.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must not be negative", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	polls, err := loadCreatorPolls(ownerHash, time.Now())
+	if err != nil {
+		requestLogger(r).Error("Failed to list creator polls", "error", err)
+		http.Error(w, "Failed to list polls", http.StatusInternalServerError)
+		return
+	}
+
+	matching := polls[:0]
+	for _, poll := range polls {
+		if filter == "" || creatorFilterOf(poll) == filter {
+			matching = append(matching, poll)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		a, b := matching[i], matching[j]
+		if a.CreatedAt != b.CreatedAt {
+			return (a.CreatedAt > b.CreatedAt) == (sortOrder == "newest")
+		}
+		return a.ID < b.ID
+	})
+
+	page := CreatorPollsPage{Polls: []PollListing{}, Offset: offset, Limit: limit, Total: len(matching)}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page.Polls = matching[offset:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// creatorFilterOf returns the status filter a listed poll falls under
+func creatorFilterOf(poll PollListing) string {
+	switch poll.Status {
+	case statusExpired:
+		return creatorFilterExpired
+	case statusClosed:
+		return creatorFilterClosed
+	}
+	return creatorFilterOpen
+}
+
+// loadCreatorPolls lists a creator's indexed polls. Polls that are gone
+// are listed as expired from what the index kept of them, and dropped once
+// they're older than the retention. Live polls in the owner's quota set
+// that predate the index are added to it on the way.
+func loadCreatorPolls(ownerHash string, now time.Time) ([]PollListing, error) {
+	key, infoKey := creatorPollsKey(ownerHash), creatorInfoKey(ownerHash)
+	indexed, err := kv.ZRange(key, 0, -1, false)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := kv.HGetAll(infoKey)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(indexed))
+	createdAt := make(map[string]int64, len(indexed))
+	for _, z := range indexed {
+		id := z.Member
+		ids = append(ids, id)
+		createdAt[id] = int64(z.Score)
+	}
+	live, err := kv.SMembers(ownerPollsKey(ownerHash))
+	if err != nil {
+		return nil, err
+	}
+	unindexed := make(map[string]bool)
+	for _, id := range live {
+		if _, ok := createdAt[id]; !ok {
+			ids = append(ids, id)
+			unindexed[id] = true
+		}
+	}
+
+	data, err := store.GetPolls(ids, append(listingFields, "expires_at")...)
+	if err != nil {
+		return nil, err
+	}
+
+	polls := make([]PollListing, 0, len(ids))
+	var stale []string
+	for i, id := range ids {
+		if listing, ok := parseListing(id, data[i]); ok {
+			listing.ExpiresAt, _ = strconv.ParseInt(data[i]["expires_at"], 10, 64)
+			polls = append(polls, listing)
+			if unindexed[id] {
+				expires := time.Unix(listing.ExpiresAt, 0)
+				indexCreatorPoll(ownerHash, id, listing.Question, time.Unix(listing.CreatedAt, 0), expires.Sub(time.Unix(listing.CreatedAt, 0)))
+			}
+			continue
+		}
+		if unindexed[id] {
+			continue
+		}
+		var info creatorInfo
+		if json.Unmarshal([]byte(infos[id]), &info) != nil || now.Sub(time.Unix(info.ExpiresAt, 0)) > creatorRetention {
+			stale = append(stale, id)
+			continue
+		}
+		polls = append(polls, PollListing{
+			ID:        id,
+			Question:  info.Question,
+			Status:    statusExpired,
+			CreatedAt: createdAt[id],
+			ExpiresAt: info.ExpiresAt,
+		})
+	}
+
+	if len(stale) > 0 {
+		kv.ZRem(key, stale...)
+		kv.HDel(infoKey, stale...)
+	}
+	return polls, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// A deck groups polls into one presenter-driven session under a short
+// code the audience can type. The presenter advances it question by
+// question, and everyone following the deck is moved along.
+
+// Limits on a deck
+const (
+	maxDeckPolls      = 100
+	maxDeckTitleBytes = 200
+)
+
+// deckRoomPrefix marks updates published for a deck rather than a poll
+const deckRoomPrefix = "deck:"
+
+// deckCodes are easy to read aloud and type from a projector
+var deckCodes = idPolicy{charset: idCharsets["friendly"], length: 6}
+
+// deckHub holds the connections following a deck on this instance. Decks
+// aren't polls, so they are kept out of the poll hub, whose rooms are
+// checked for expiry and closed on shutdown.
+var deckHub = newHub()
+
+// deckKey holds a deck's title, owner, polls and current position
+func deckKey(code string) string {
+	return fmt.Sprintf("deck:%s", code)
+}
+
+// deckRoom is the room, and the update ID, of a deck's followers
+func deckRoom(code string) string {
+	return deckRoomPrefix + code
+}
+
+// CreateDeckRequest is the body of POST /api/deck
+type CreateDeckRequest struct {
+	Title     string   `json:"title"`
+	Polls     []string `json:"polls"`              // poll IDs, in presenting order
+	ExpiresIn int      `json:"expires_in_seconds"` // 0 for POLL_TTL_DEFAULT
+}
+
+// Deck is the body of GET /api/deck/{code}
+type Deck struct {
+	Code      string   `json:"code"`
+	Title     string   `json:"title,omitempty"`
+	Polls     []string `json:"polls"`
+	Current   int      `json:"current"` // index into polls
+	PollID    string   `json:"poll_id"` // the current question
+	CreatedAt int64    `json:"created_at,omitempty"`
+}
+
+// QuestionChanged is sent to a deck's followers when they connect and
+// whenever the presenter moves to another question
+type QuestionChanged struct {
+	Type     string `json:"type"` // "questionChanged"
+	Code     string `json:"code"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	PollID   string `json:"pollId"`
+	Question string `json:"question"`
+}
+
+// parseDeck reads a deck hash
+func parseDeck(code string, data map[string]string) Deck {
+	deck := Deck{Code: code, Title: data["title"], Polls: strings.Split(data["polls"], ",")}
+	deck.Current, _ = strconv.Atoi(data["current"])
+	deck.CreatedAt, _ = strconv.ParseInt(data["created_at"], 10, 64)
+	if deck.Current >= 0 && deck.Current < len(deck.Polls) {
+		deck.PollID = deck.Polls[deck.Current]
+	}
+	return deck
+}
+
+// questionChanged builds the message announcing a deck's current question
+func questionChanged(deck Deck) QuestionChanged {
+	poll, _ := pollFields(deck.PollID, "question")
+	return QuestionChanged{
+		Type:     "questionChanged",
+		Code:     deck.Code,
+		Index:    deck.Current,
+		Total:    len(deck.Polls),
+		PollID:   deck.PollID,
+		Question: poll["question"],
+	}
+}
+
+// createDeck handles POST /api/deck. The caller's owner token has to own
+// every poll of the deck, and becomes the deck's owner token.
+func (s *Server) createDeck(w http.ResponseWriter, r *http.Request) {
+	ownerHash := ownerHashFromRequest(r)
+	if ownerHash == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateDeckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Title = normalizeText(req.Title)
+	if len(req.Polls) == 0 || len(req.Polls) > maxDeckPolls {
+		http.Error(w, fmt.Sprintf("A deck needs between 1 and %d polls", maxDeckPolls), http.StatusBadRequest)
+		return
+	}
+	if len(req.Title) > maxDeckTitleBytes {
+		http.Error(w, fmt.Sprintf("title must be at most %d bytes", maxDeckTitleBytes), http.StatusBadRequest)
+		return
+	}
+	ttl, err := pollTTL(req.ExpiresIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]bool, len(req.Polls))
+	for _, pollID := range req.Polls {
+		if seen[pollID] {
+			http.Error(w, fmt.Sprintf("Duplicate poll: %q", pollID), http.StatusBadRequest)
+			return
+		}
+		seen[pollID] = true
+		poll, err := pollFields(pollID, "owner_hash")
+		if err != nil || !ownerMatches(r, poll["owner_hash"]) {
+			http.Error(w, fmt.Sprintf("Poll %q not found or not owned by this token", pollID), http.StatusForbidden)
+			return
+		}
+	}
+
+	fields := map[string]interface{}{
+		"title":      req.Title,
+		"owner_hash": ownerHash,
+		"polls":      strings.Join(req.Polls, ","),
+		"current":    0,
+		"created_at": time.Now().Unix(),
+	}
+
+	// Claim a free code the same way createPoll claims a poll ID
+	var code string
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		candidate := deckCodes.Generate()
+		claimed, err := kv.HSetNX(deckKey(candidate), "owner_hash", fields["owner_hash"])
+		if err != nil {
+			requestLogger(r).Error("Failed to save deck", "error", err)
+			http.Error(w, "Failed to create deck", http.StatusInternalServerError)
+			return
+		}
+		if claimed {
+			code = candidate
+			break
+		}
+	}
+	if code == "" {
+		requestLogger(r).Error("Failed to find a free deck code", "attempts", maxIDAttempts)
+		http.Error(w, "Failed to create deck", http.StatusInternalServerError)
+		return
+	}
+	err = kv.Batch(func(b KeyBatch) {
+		b.HSet(deckKey(code), fields)
+		b.Expire(deckKey(code), ttl)
+	})
+	if err != nil {
+		kv.Del(deckKey(code))
+		requestLogger(r).Error("Failed to save deck", "error", err)
+		http.Error(w, "Failed to create deck", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Deck created", "deck", code, "polls", len(req.Polls))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":   code,
+		"url":    fmt.Sprintf("/poll.html?deck=%s", code),
+		"pollId": req.Polls[0],
+	})
+}
+
+// getDeck handles GET /api/deck/{code}
+func (s *Server) getDeck(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	data, err := kv.HGetAll(deckKey(code))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Deck not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(parseDeck(code, data))
+}
+
+// advanceDeck handles POST /api/deck/{code}/next, moving the deck's
+// followers on to its next question
+func (s *Server) advanceDeck(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	key := deckKey(code)
+	data, err := kv.HGetAll(key)
+	if err != nil {
+		http.Error(w, "Failed to load deck", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Deck not found", http.StatusNotFound)
+		return
+	}
+	if ownerTokenFromRequest(r) == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return
+	}
+	if !ownerMatches(r, data["owner_hash"]) {
+		http.Error(w, "Invalid owner token", http.StatusForbidden)
+		return
+	}
+
+	deck := parseDeck(code, data)
+	next, err := kv.HIncrBy(key, "current", 1)
+	if err != nil {
+		requestLogger(r).Error("Failed to advance deck", "deck", code, "error", err)
+		http.Error(w, "Failed to advance deck", http.StatusInternalServerError)
+		return
+	}
+	if int(next) >= len(deck.Polls) {
+		// Undo the step past the end; a concurrent advance undoes its own
+		kv.HIncrBy(key, "current", -1)
+		http.Error(w, "Deck is on its last question", http.StatusConflict)
+		return
+	}
+	deck.Current = int(next)
+	deck.PollID = deck.Polls[next]
+
+	requestLogger(r).Info("Deck advanced", "deck", code, "index", deck.Current, "poll_id", deck.PollID)
+	publishEventContext(r.Context(), deckRoom(code), questionChanged(deck))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deck)
+}
+
+// followDeck handles WebSocket connections to /ws/deck/{code}. Followers
+// are told the current question, then each change, and send nothing; they
+// vote on the poll's own connection.
+func (s *Server) followDeck(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	data, err := kv.HGetAll(deckKey(code))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Deck not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	client := &wsClient{
+		conn: conn,
+		send: make(chan wsFrame, wsSendBuffer),
+		done: make(chan struct{}),
+		log:  requestLogger(r).With("deck", code),
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	go client.writePump(quit)
+	client.keepAlive()
+
+	room := deckRoom(code)
+	deckHub.Register(room, client)
+	defer deckHub.Unregister(room, client)
+
+	client.writeJSON(questionChanged(parseDeck(code, data)))
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				client.log.Warn("WebSocket error", "error", err)
+			}
+			return
+		}
+	}
+}
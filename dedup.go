@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Dedup policies decide what identifies a voter in the voted set
+const (
+	dedupClient      = "client"      // the client-supplied clientId (default)
+	dedupFingerprint = "fingerprint" // a salted hash of IP and User-Agent
+	dedupLenient     = "lenient"     // the signed voter cookie or the clientId
+	dedupStrict      = "strict"      // lenient, plus the IP and any fingerprint header
+	dedupOff         = "off"         // every ballot counts
+)
+
+// validateDedup checks a requested dedup policy. Revotes have to find the
+// voter's earlier ballot, which only the single-identifier policies can
+// promise.
+func validateDedup(mode string, allowRevote bool) error {
+	switch mode {
+	case "", dedupClient, dedupFingerprint:
+		return nil
+	case dedupLenient, dedupStrict, dedupOff:
+		if allowRevote {
+			return fmt.Errorf("allow_revote needs dedup %q or %q", dedupClient, dedupFingerprint)
+		}
+		return nil
+	}
+	return fmt.Errorf("dedup must be one of %q, %q, %q, %q or %q",
+		dedupClient, dedupFingerprint, dedupLenient, dedupStrict, dedupOff)
+}
+
+// saltedDedup reports whether a policy hashes identifiers with a per-poll
+// salt
+func saltedDedup(mode string) bool {
+	return mode == dedupFingerprint || mode == dedupStrict
+}
+
+// voterIDs returns the voted-set members identifying a ballot's voter
+// under the poll's dedup policy. The first one keys the ballot in
+// vote:<pollID>; the ballot is a duplicate if any of them already voted.
+// Raw IPs and fingerprints never leave memory.
+func voterIDs(state map[string]string, v voteRequest) []string {
+	// Signed-in voters are who their account is, whatever the policy
+	if state["require_sign_in"] == "1" {
+		return []string{"account:" + v.Account}
+	}
+	// Invited voters are who their invite is
+	if state["require_invite"] == "1" {
+		if v.VoterToken == "" {
+			return nil
+		}
+		return []string{"invite:" + hashToken(v.VoterToken)}
+	}
+	// Spent ballot tokens keep the voter anonymous; the token is the check
+	if state["ballot_tokens"] == "1" {
+		return []string{"ballot:" + newToken()}
+	}
+	salt := state["dedup_salt"]
+	switch state["dedup"] {
+	case dedupFingerprint:
+		return []string{fingerprint(salt, v.IP, v.UserAgent)}
+	case dedupOff:
+		return []string{"anon:" + newToken()}
+	case dedupLenient, dedupStrict:
+		var ids []string
+		if v.VoterCookie != "" {
+			ids = append(ids, "cookie:"+v.VoterCookie)
+		}
+		if v.ClientID != "" {
+			ids = append(ids, "client:"+v.ClientID)
+		}
+		if state["dedup"] == dedupStrict {
+			ids = append(ids, "ip:"+saltedHash(salt, v.IP))
+			if v.Fingerprint != "" {
+				ids = append(ids, "fp:"+saltedHash(salt, v.Fingerprint))
+			}
+		}
+		return ids
+	}
+	return []string{v.ClientID}
+}
+
+// hasVoted reports whether a viewer already voted, as far as the poll's
+// dedup policy can tell who they are
+func hasVoted(state map[string]string, v voteRequest) bool {
+	if state["dedup"] == dedupOff {
+		return false
+	}
+	ids := voterIDs(state, v)
+	if len(ids) == 0 || ids[0] == "" {
+		return false
+	}
+	voted, err := store.HasVoted(v.PollID, ids[0])
+	return err == nil && voted
+}
+
+// fingerprint hashes a source IP and User-Agent with the poll's salt, so
+// the digests can't be matched across polls or reversed by brute-forcing
+// the IPv4 space without the salt
+func fingerprint(salt, ip, userAgent string) string {
+	return saltedHash(salt, ip, userAgent)
+}
+
+// saltedHash is an HMAC-SHA256 of parts keyed with a poll's salt
+func saltedHash(salt string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	for i, part := range parts {
+		if i > 0 {
+			mac.Write([]byte{0})
+		}
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// deletePoll handles DELETE /api/poll/{pollID}. Unlike archiving, the poll,
+// its voters and comments are destroyed right away. Viewers get a
+// pollDeleted message and are disconnected.
+func (s *Server) deletePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	if err := store.DeletePoll(pollID); err != nil {
+		requestLogger(r).Error("Failed to delete poll", "error", err)
+		http.Error(w, "Failed to delete poll", http.StatusInternalServerError)
+		return
+	}
+	if ownerHash := data["owner_hash"]; ownerHash != "" {
+		untrackOwnerPoll(ownerHash, pollID)
+		forgetCreatorPoll(ownerHash, pollID)
+	}
+	releaseJoinCode(pollID, data["join_code"])
+	requestLogger(r).Info("Poll deleted")
+	publishEvent(pollID, PollEvent{Type: "pollDeleted", PollID: pollID, Status: statusDeleted})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Discord settings. The integration is disabled unless DISCORD_PUBLIC_KEY,
+// the application's public key from the developer portal, is set.
+var (
+	discordPublicKey = loadDiscordPublicKey()
+	discordAPIURL    = strings.TrimSuffix(envString("DISCORD_API_URL", "https://discord.com/api/v10"), "/")
+)
+
+// loadDiscordPublicKey reads DISCORD_PUBLIC_KEY, given in hex
+func loadDiscordPublicKey() ed25519.PublicKey {
+	raw := envString("DISCORD_PUBLIC_KEY", "")
+	if raw == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(raw)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		logger.Warn("Invalid DISCORD_PUBLIC_KEY, Discord integration disabled")
+		return nil
+	}
+	return ed25519.PublicKey(key)
+}
+
+// Discord interaction types
+const (
+	discordPing      = 1
+	discordCommand   = 2
+	discordComponent = 3
+)
+
+// Discord interaction response types
+const (
+	discordPong          = 1
+	discordMessage       = 4
+	discordUpdateMessage = 7
+)
+
+// Discord message components, and the flag of messages only the user who
+// interacted sees
+const (
+	discordComponentRow    = 1
+	discordComponentButton = 2
+	discordButtonPrimary   = 1
+	discordEphemeral       = 64
+)
+
+// Limits of Discord messages, and of requests to the endpoint
+const (
+	discordMaxContent       = 2000
+	discordMaxButtonLabel   = 80
+	discordButtonsPerRow    = 5
+	discordMaxButtonOptions = 25 // five rows of five
+	discordMaxBody          = 64 << 10
+)
+
+// discordVotePrefix starts the custom ID of a vote button,
+// "vote:<pollID>:<optionID>"
+const discordVotePrefix = "vote:"
+
+// Replies to /poll commands that don't create a poll
+const (
+	discordCommandUsage   = "Use `/poll question:<question> options:<Option 1 | Option 2 | ...>`"
+	discordTooManyOptions = "Discord messages fit at most 25 buttons, so the poll can have at most 25 options."
+)
+
+// discordUser is a Discord user; only the ID is used
+type discordUser struct {
+	ID string `json:"id"`
+}
+
+// discordInteraction is the part of a Discord interaction the integration
+// needs. Member is set in servers, User in direct messages.
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	GuildID       string `json:"guild_id"`
+	Member        *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User *discordUser `json:"user"`
+	Data struct {
+		Name     string `json:"name"`
+		CustomID string `json:"custom_id"`
+		Options  []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+}
+
+// userID returns the ID of the user who caused the interaction
+func (in discordInteraction) userID() string {
+	if in.Member != nil {
+		return in.Member.User.ID
+	}
+	if in.User != nil {
+		return in.User.ID
+	}
+	return ""
+}
+
+// option returns the value of a slash command option
+func (in discordInteraction) option(name string) string {
+	for _, option := range in.Data.Options {
+		if option.Name == name {
+			return option.Value
+		}
+	}
+	return ""
+}
+
+// verifyDiscordRequest checks a request's ed25519 signature over the
+// timestamp and body, and that the timestamp is as recent as Slack's must be
+func verifyDiscordRequest(r *http.Request, body []byte, now time.Time) bool {
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	return err == nil && ed25519.Verify(discordPublicKey, append([]byte(timestamp), body...), signature)
+}
+
+// discordIntegration handles POST /integrations/discord, the interactions
+// endpoint of a Discord application: the /poll command creates a poll with
+// a button per option, and the buttons vote
+func (s *Server) discordIntegration(w http.ResponseWriter, r *http.Request) {
+	if discordPublicKey == nil {
+		http.Error(w, "Discord integration is not configured", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, discordMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Discord checks that unsigned requests are refused before it accepts
+	// the endpoint
+	if !verifyDiscordRequest(r, body, time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	switch interaction.Type {
+	case discordPing:
+		writeDiscord(w, map[string]interface{}{"type": discordPong})
+	case discordCommand:
+		s.discordCommand(w, r, interaction)
+	case discordComponent:
+		s.discordVote(w, r, interaction)
+	default:
+		http.Error(w, "Unsupported interaction", http.StatusBadRequest)
+	}
+}
+
+// discordCommand creates a poll from the /poll command and answers with
+// it. The user gets the owner token in a follow-up only they can see.
+func (s *Server) discordCommand(w http.ResponseWriter, r *http.Request, in discordInteraction) {
+	req, ok := parsePollCommand(in.option("question") + "|" + in.option("options"))
+	if !ok {
+		writeDiscord(w, discordReply(discordCommandUsage))
+		return
+	}
+	if len(req.Options) > discordMaxButtonOptions {
+		writeDiscord(w, discordReply(discordTooManyOptions))
+		return
+	}
+
+	created, err := s.createPollAs(r, req, integrationID("discord-owner", in.GuildID, in.userID()))
+	if err != nil {
+		writeDiscord(w, discordReply("Couldn't create the poll: "+err.Error()))
+		return
+	}
+	requestLogger(r).Info("Poll created from Discord", "poll_id", created.ID, "guild", in.GuildID)
+
+	card, err := loadPollCard(created.ID)
+	if err != nil {
+		requestLogger(r).Error("Failed to load poll card", "poll_id", created.ID, "error", err)
+		http.Error(w, "Failed to create poll", http.StatusInternalServerError)
+		return
+	}
+	writeDiscord(w, map[string]interface{}{"type": discordMessage, "data": discordPollMessage(card)})
+
+	// Follow-ups go to the interaction's webhook, which takes them once
+	// the reply above is sent
+	notice := fmt.Sprintf("Poll created. Manage it with the owner token `%s`.", created.OwnerToken)
+	go discordFollowUp(in, notice)
+}
+
+// discordVote counts a click on a vote button and refreshes the poll's
+// message. Votes that aren't counted are explained to the voter alone.
+func (s *Server) discordVote(w http.ResponseWriter, r *http.Request, in discordInteraction) {
+	pollID, optionID, ok := strings.Cut(strings.TrimPrefix(in.Data.CustomID, discordVotePrefix), ":")
+	if !ok || !strings.HasPrefix(in.Data.CustomID, discordVotePrefix) {
+		http.Error(w, "Unknown component", http.StatusBadRequest)
+		return
+	}
+
+	status := chatVote(r, pollID, optionID, "discord:"+in.GuildID, integrationID("discord", in.GuildID, in.userID()))
+	if status != voteOK {
+		writeDiscord(w, discordReply(chatVoteMessage(status)))
+		return
+	}
+	card, err := loadPollCard(pollID)
+	if err != nil {
+		writeDiscord(w, discordReply("Your vote was counted."))
+		return
+	}
+	writeDiscord(w, map[string]interface{}{"type": discordUpdateMessage, "data": discordPollMessage(card)})
+}
+
+// discordPollMessage lays a poll out as a Discord message: the question
+// and counts as text, and a row of buttons per five options
+func discordPollMessage(card PollCard) map[string]interface{} {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n", discordEscape(card.Question))
+	for _, option := range card.Options {
+		label := discordEscape(strings.TrimSpace(option.Emoji + " " + option.Text))
+		if card.Hidden {
+			fmt.Fprintf(&b, "%s\n", label)
+			continue
+		}
+		fmt.Fprintf(&b, "%s\n`%s` %d (%.0f%%)\n", label, bar(option.Percent), option.Votes, option.Percent)
+	}
+	footer := fmt.Sprintf("%d votes", card.Total)
+	if card.Hidden {
+		footer = "Results are shown when the poll closes"
+	}
+	if card.Closed {
+		footer = "🔒 Closed · " + footer
+	}
+	if card.Link != "" {
+		footer += " · " + card.Link
+	}
+	b.WriteString("-# " + footer)
+
+	msg := map[string]interface{}{
+		"content":          truncateRunes(b.String(), discordMaxContent),
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+		"components":       []interface{}{},
+	}
+	if card.Closed {
+		return msg
+	}
+	var rows []interface{}
+	for start := 0; start < len(card.Options); start += discordButtonsPerRow {
+		end := start + discordButtonsPerRow
+		if end > len(card.Options) {
+			end = len(card.Options)
+		}
+		var buttons []interface{}
+		for _, option := range card.Options[start:end] {
+			buttons = append(buttons, map[string]interface{}{
+				"type":      discordComponentButton,
+				"style":     discordButtonPrimary,
+				"label":     truncateRunes(strings.TrimSpace(option.Emoji+" "+option.Text), discordMaxButtonLabel),
+				"custom_id": discordVotePrefix + card.PollID + ":" + option.ID,
+			})
+		}
+		rows = append(rows, map[string]interface{}{"type": discordComponentRow, "components": buttons})
+	}
+	msg["components"] = rows
+	return msg
+}
+
+// discordReply is an answer only the user who interacted sees
+func discordReply(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": discordMessage,
+		"data": map[string]interface{}{"content": text, "flags": discordEphemeral},
+	}
+}
+
+// discordFollowUp sends a message only the user who interacted sees
+func discordFollowUp(in discordInteraction, text string) {
+	body, _ := json.Marshal(map[string]interface{}{"content": text, "flags": discordEphemeral})
+	endpoint := fmt.Sprintf("%s/webhooks/%s/%s", discordAPIURL, in.ApplicationID, in.Token)
+	resp, err := notifyClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed to send Discord follow-up", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("Failed to send Discord follow-up", "status", resp.Status)
+	}
+}
+
+// discordEscape keeps text from being read as Discord markdown
+func discordEscape(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "~", `\~`, "|", `\|`, ">", `\>`, "#", `\#`,
+	).Replace(text)
+}
+
+// truncateRunes shortens text to at most n runes
+func truncateRunes(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:n-1]) + "…"
+}
+
+// writeDiscord writes the JSON response to an interaction
+func writeDiscord(w http.ResponseWriter, msg interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PollPatch is the body of PATCH /api/poll/{pollID}. Fields left out are
+// unchanged. Options are given like at creation, as texts or objects.
+// Replacing one works like PUT on it, so its metadata is replaced too.
+type PollPatch struct {
+	Question   *string                `json:"question"`
+	Options    map[string]OptionInput `json:"options"`     // option ID to its new text and metadata
+	AddOptions []OptionInput          `json:"add_options"` // appended, even once voting started
+}
+
+// patchPoll handles PATCH /api/poll/{pollID}. The question and existing
+// options can only be edited before anyone votes, since changing them
+// afterwards would misrepresent what votes were cast for; options can be
+// added until the poll closes. Clients are sent pollUpdated so they
+// refresh their ballot.
+func (s *Server) patchPoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	var patch PollPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if patch.Question == nil && len(patch.Options) == 0 && len(patch.AddOptions) == 0 {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+	if patch.Question != nil {
+		*patch.Question = normalizeText(*patch.Question)
+		if *patch.Question == "" {
+			http.Error(w, "Question must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+	for id, option := range patch.Options {
+		if err := (*OptionRequest)(&option).normalize(); err != nil {
+			http.Error(w, fmt.Sprintf("Option %s: %v", id, err), http.StatusBadRequest)
+			return
+		}
+		patch.Options[id] = option
+	}
+	for i := range patch.AddOptions {
+		if err := (*OptionRequest)(&patch.AddOptions[i]).normalize(); err != nil {
+			http.Error(w, fmt.Sprintf("New option %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if data["status"] == statusClosed {
+		http.Error(w, "Poll is closed", http.StatusConflict)
+		return
+	}
+	if (patch.Question != nil || len(patch.Options) > 0) && pollHasVotes(data) {
+		http.Error(w, "poll has votes; only add_options is allowed", http.StatusConflict)
+		return
+	}
+	quiz := pollTypeOf(data) == pollTypeQuiz
+	if pollTypeOf(data) == pollTypeText && (len(patch.Options) > 0 || len(patch.AddOptions) > 0) {
+		http.Error(w, "Open-text polls have no options", http.StatusBadRequest)
+		return
+	}
+	for id := range patch.Options {
+		if _, exists := data["option_"+id]; !exists {
+			http.Error(w, fmt.Sprintf("Option %s not found", id), http.StatusNotFound)
+			return
+		}
+	}
+
+	// Check the poll as it will be once patched
+	question := data["question"]
+	if patch.Question != nil {
+		question = *patch.Question
+	}
+	texts := parseOptions(data)
+	descriptions := make([]string, 0, len(texts)+len(patch.AddOptions))
+	correct := false
+	for id := range texts {
+		if option, ok := patch.Options[id]; ok {
+			texts[id] = option.Text
+			descriptions = append(descriptions, option.Description)
+			correct = correct || option.Correct
+		} else {
+			descriptions = append(descriptions, optionDescription(data, id))
+			correct = correct || data[correctKey(id)] == "1"
+		}
+	}
+	all := make([]string, 0, len(texts)+len(patch.AddOptions))
+	for _, text := range texts {
+		all = append(all, text)
+	}
+	for _, option := range patch.AddOptions {
+		all = append(all, option.Text)
+		descriptions = append(descriptions, option.Description)
+		correct = correct || option.Correct
+	}
+	if correct && !quiz {
+		http.Error(w, "Only quiz options can be correct", http.StatusBadRequest)
+		return
+	}
+	if quiz && !correct {
+		http.Error(w, "A quiz needs at least one correct option", http.StatusConflict)
+		return
+	}
+	if dup, found := findDuplicate(all); found {
+		http.Error(w, fmt.Sprintf("Duplicate option: %q", dup), http.StatusBadRequest)
+		return
+	}
+	if err := checkTextBudget(question, all, descriptions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// New options get IDs the same way addOption allocates them
+	var firstNew int64
+	if len(patch.AddOptions) > 0 {
+		store.SetPollFieldNX(pollID, "next_option", maxOptionIndex(data)+1)
+		next, err := store.IncrPollField(pollID, "next_option", int64(len(patch.AddOptions)))
+		if err != nil {
+			requestLogger(r).Error("Failed to allocate option IDs", "error", err)
+			http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+			return
+		}
+		firstNew = next - int64(len(patch.AddOptions))
+	}
+
+	set := map[string]interface{}{}
+	var remove []string
+	if patch.Question != nil {
+		set["question"] = question
+	}
+	for id, option := range patch.Options {
+		remove = setOption(set, remove, id, OptionRequest(option))
+	}
+	for i, option := range patch.AddOptions {
+		id := strconv.FormatInt(firstNew+int64(i), 10)
+		set["votes_"+id] = 0
+		remove = setOption(set, remove, id, OptionRequest(option))
+	}
+	// Edits other than new options are checked against votes again in the
+	// same step as the write, as one may have landed since the poll was
+	// loaded
+	unvoted := true
+	if patch.Question != nil || len(patch.Options) > 0 {
+		unvoted, err = store.UpdateUnvotedPoll(pollID, set, remove...)
+	} else {
+		err = store.UpdatePoll(pollID, set, remove...)
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to update poll", "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+	if !unvoted {
+		http.Error(w, "poll has votes; only add_options is allowed", http.StatusConflict)
+		return
+	}
+	requestLogger(r).Info("Poll edited", "question", patch.Question != nil, "edited_options", len(patch.Options), "added_options", len(patch.AddOptions))
+
+	if patch.Question != nil && data["owner_hash"] != "" {
+		createdAt, _ := strconv.ParseInt(data["created_at"], 10, 64)
+		expiresAt, _ := strconv.ParseInt(data["expires_at"], 10, 64)
+		indexCreatorPoll(data["owner_hash"], pollID, question, time.Unix(createdAt, 0), time.Duration(expiresAt-createdAt)*time.Second)
+	}
+	bumpConfigVersion(pollID)
+	broadcastPollUpdated(pollID)
+	if data["slack_ts"] != "" {
+		scheduleSlackUpdate(pollID)
+	}
+
+	updated, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pollUpdated(pollID, updated))
+}
+
+// pollHasVotes reports whether any ballot has been counted in a poll
+func pollHasVotes(data map[string]string) bool {
+	responses, _ := strconv.Atoi(data["responses"])
+	return responses > 0 || totalVotes(parseVotes(data)) > 0
+}
+
+// setOption adds the fields writing an option's text, metadata and
+// correct mark to set, and those clearing the metadata and mark it doesn't
+// have to remove, which it returns
+func setOption(set map[string]interface{}, remove []string, optionID string, option OptionRequest) []string {
+	set["option_"+optionID] = option.Text
+	if encoded := encodeOptionMeta(option.OptionMeta); encoded != "" {
+		set[optionMetaKey(optionID)] = encoded
+	} else {
+		remove = append(remove, optionMetaKey(optionID))
+	}
+	if option.Correct {
+		set[correctKey(optionID)] = "1"
+	} else {
+		remove = append(remove, correctKey(optionID))
+	}
+	return remove
+}
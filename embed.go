@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// embedFrameAncestors are the sites allowed to frame the embedded results
+// page, as a frame-ancestors source list; "*" allows any site
+var embedFrameAncestors = envString("EMBED_FRAME_ANCESTORS", "*")
+
+// requestBaseURL returns the address a request reached the server at:
+// PUBLIC_URL when it's set, otherwise the scheme and host of the request
+func requestBaseURL(r *http.Request) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if trustProxyHeaders {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// embedOption is an option as the results page renders it
+type embedOption struct {
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+	Emoji string `json:"emoji,omitempty"`
+	Color string `json:"color"`
+}
+
+// embedPage is what the embed templates are rendered with
+type embedPage struct {
+	PollID   string
+	Question string
+	Options  []embedOption
+	OpenText bool
+	Base     string
+	Frame    string // the results page's URL
+}
+
+// embedSnippetTemplate is the HTML to paste into a page: the results page
+// in an iframe, and a script that sizes the iframe to its content
+var embedSnippetTemplate = template.Must(template.New("snippet").Parse(
+	`<iframe src="{{.Frame}}" title="Poll results: {{.Question}}" data-pulse-embed="{{.PollID}}" style="width:100%;max-width:600px;height:320px;border:0" loading="lazy"></iframe>
+<script>
+window.addEventListener("message", function (e) {
+  if (e.origin !== {{.Base}} || !e.data || e.data.pulseEmbed !== {{.PollID}}) return;
+  document.querySelectorAll('iframe[data-pulse-embed="' + e.data.pulseEmbed + '"]').forEach(function (f) {
+    f.style.height = e.data.height + "px";
+  });
+});
+</script>
+`))
+
+// embedResultsTemplate is the results-only page shown in the iframe. It
+// follows the poll's Server-Sent Events stream, so it updates live and
+// honors the poll's results visibility.
+var embedResultsTemplate = template.Must(template.New("results").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Question}}</title>
+<style>
+  body { margin: 0; padding: 16px; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; color: #1f2937; background: #fff; }
+  h1 { font-size: 1.1em; margin: 0 0 12px; }
+  .row { margin-bottom: 10px; }
+  .label { display: flex; justify-content: space-between; font-size: 0.9em; margin-bottom: 4px; }
+  .track { background: #f3f4f6; border-radius: 6px; height: 12px; overflow: hidden; }
+  .fill { height: 100%; width: 0; transition: width 0.4s ease; }
+  .words span { display: inline-block; margin: 2px 6px; }
+  .footer { margin-top: 12px; font-size: 0.8em; color: #6b7280; display: flex; justify-content: space-between; }
+  .footer a { color: inherit; }
+</style>
+</head>
+<body>
+<h1>{{.Question}}</h1>
+<div id="results">
+{{- range .Options}}
+  <div class="row">
+    <div class="label"><span>{{if .Emoji}}{{.Emoji}} {{end}}{{.Text}}</span><span data-count="{{.ID}}"></span></div>
+    <div class="track"><div class="fill" data-bar="{{.ID}}" style="background: {{.Color}}"></div></div>
+  </div>
+{{- end}}
+</div>
+<div class="words" id="words"></div>
+<div class="footer"><span id="status"></span><a href="{{.Base}}/poll.html?id={{.PollID}}" target="_blank" rel="noopener">Vote on Pulse</a></div>
+<script>
+(function () {
+  var pollID = {{.PollID}};
+  var openText = {{.OpenText}};
+  var status = document.getElementById("status");
+
+  function resize() {
+    parent.postMessage({ pulseEmbed: pollID, height: document.documentElement.scrollHeight }, "*");
+  }
+
+  function showVotes(update) {
+    if (update.hidden) {
+      status.textContent = "Results are shown when the poll closes";
+      document.getElementById("results").style.opacity = 0.4;
+      return;
+    }
+    document.getElementById("results").style.opacity = 1;
+    var votes = update.votes || {};
+    var total = 0;
+    for (var id in votes) total += votes[id];
+    document.querySelectorAll("[data-bar]").forEach(function (bar) {
+      var id = bar.getAttribute("data-bar");
+      var count = votes[id] || 0;
+      var percent = total ? Math.round(count * 1000 / total) / 10 : 0;
+      bar.style.width = percent + "%";
+      document.querySelector('[data-count="' + id + '"]').textContent = count + " (" + percent + "%)";
+    });
+    status.textContent = total + (total === 1 ? " vote" : " votes");
+  }
+
+  function showWords(update) {
+    var words = document.getElementById("words");
+    words.textContent = "";
+    (update.words || []).forEach(function (w) {
+      var span = document.createElement("span");
+      span.textContent = w.word;
+      span.style.fontSize = Math.min(2, 0.8 + w.count / 10) + "em";
+      words.appendChild(span);
+    });
+    status.textContent = update.responses + (update.responses === 1 ? " response" : " responses");
+  }
+
+  var events = new EventSource("/api/poll/" + encodeURIComponent(pollID) + "/stream");
+  events.addEventListener("voteUpdate", function (e) {
+    if (!openText) showVotes(JSON.parse(e.data));
+    resize();
+  });
+  events.addEventListener("topWords", function (e) { showWords(JSON.parse(e.data)); resize(); });
+  events.addEventListener("pollUpdated", function () { location.reload(); });
+  events.addEventListener("pollClosed", function () { status.textContent += " · Closed"; });
+  ["pollDeleted", "pollExpired"].forEach(function (name) {
+    events.addEventListener(name, function () {
+      events.close();
+      status.textContent = name === "pollDeleted" ? "This poll was deleted" : "This poll has expired";
+    });
+  });
+  window.addEventListener("resize", resize);
+  resize();
+})();
+</script>
+</body>
+</html>
+`))
+
+// loadEmbedPage gathers what the embed templates need, or reports false
+// if the poll doesn't exist
+func loadEmbedPage(r *http.Request, pollID string) (embedPage, bool) {
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		return embedPage{}, false
+	}
+	base := requestBaseURL(r)
+	page := embedPage{
+		PollID:   pollID,
+		Question: data["question"],
+		OpenText: pollTypeOf(data) == pollTypeText,
+		Base:     base,
+		Frame:    fmt.Sprintf("%s/embed/%s/results", base, pollID),
+	}
+	for i, option := range parseOptionDetails(data, optionOrder(parseOptions(data), false, "", "")) {
+		page.Options = append(page.Options, embedOption{
+			ID:    option.ID,
+			Text:  option.Text,
+			Emoji: option.Emoji,
+			Color: optionColor(data, option.ID, i),
+		})
+	}
+	return page, true
+}
+
+// embedSnippet handles GET /embed/{pollID}, the HTML snippet that embeds
+// a poll's live results in another page
+func (s *Server) embedSnippet(w http.ResponseWriter, r *http.Request) {
+	page, ok := loadEmbedPage(r, mux.Vars(r)["pollID"])
+	if !ok {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	var b bytes.Buffer
+	if err := embedSnippetTemplate.Execute(&b, page); err != nil {
+		requestLogger(r).Error("Failed to render embed snippet", "error", err)
+		http.Error(w, "Failed to render snippet", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(b.Bytes())
+}
+
+// embedResults handles GET /embed/{pollID}/results, the results-only page
+// the snippet frames. It has no voting controls, so it may be framed by
+// the sites in EMBED_FRAME_ANCESTORS without risk of clickjacking.
+func (s *Server) embedResults(w http.ResponseWriter, r *http.Request) {
+	page, ok := loadEmbedPage(r, mux.Vars(r)["pollID"])
+	if !ok {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	var b bytes.Buffer
+	if err := embedResultsTemplate.Execute(&b, page); err != nil {
+		requestLogger(r).Error("Failed to render embedded results", "error", err)
+		http.Error(w, "Failed to render results", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.TrimSpace(embedFrameAncestors))
+	w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+	w.Write(b.Bytes())
+}
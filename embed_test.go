@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEmbedBarsUseOptionColors(t *testing.T) {
+	s := newTestServer(t)
+	req := testPollRequest()
+	req.Options[1].Color = "#e91e63"
+	poll := createTestPoll(t, s, req)
+
+	w := apiRequest(t, s, http.MethodGet, "/embed/"+poll.ID+"/results", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("embedded results: %d %s", w.Code, w.Body)
+	}
+	page := w.Body.String()
+	if !strings.Contains(page, "background: #e91e63") {
+		t.Errorf("the second option's color is missing from the embed bars:\n%s", page)
+	}
+	if !strings.Contains(page, "background: "+chartPalette[0]) {
+		t.Errorf("the first option lost its palette color:\n%s", page)
+	}
+}
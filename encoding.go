@@ -0,0 +1,52 @@
+package main
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	pulsepb "pulse/proto"
+)
+
+// WebSocket subprotocols a client can request at upgrade time
+const (
+	subprotocolJSON      = "pulse.json"
+	subprotocolProtobuf  = "pulse.protobuf"
+	subprotocolJSONBatch = "pulse.json.batch" // broadcasts coalesced into batch frames
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative proto/update.proto
+
+// marshalUpdateProto encodes an UpdateMessage as the protobuf message
+// generated from proto/update.proto. Map entries are written in key order,
+// so identical updates always encode identically.
+func marshalUpdateProto(msg UpdateMessage) []byte {
+	update := &pulsepb.UpdateMessage{
+		Type:          msg.Type,
+		Votes:         int64Counts(msg.Votes),
+		Hidden:        msg.Hidden,
+		Averages:      msg.Averages,
+		WeightedVotes: msg.WeightedVotes,
+	}
+	if len(msg.Distributions) > 0 {
+		update.Distributions = make(map[string]*pulsepb.Distribution, len(msg.Distributions))
+		for id, counts := range msg.Distributions {
+			update.Distributions[id] = &pulsepb.Distribution{Counts: int64Counts(counts)}
+		}
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(update)
+	if err != nil {
+		logger.Error("Failed to encode update as protobuf", "error", err)
+	}
+	return b
+}
+
+// int64Counts widens counts to the proto's int64 values
+func int64Counts(counts map[string]int) map[string]int64 {
+	if len(counts) == 0 {
+		return nil
+	}
+	wide := make(map[string]int64, len(counts))
+	for k, count := range counts {
+		wide[k] = int64(count)
+	}
+	return wide
+}
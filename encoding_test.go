@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pulsepb "pulse/proto"
+)
+
+func TestMarshalUpdateProto(t *testing.T) {
+	msg := UpdateMessage{
+		Type:          "voteUpdate",
+		Votes:         map[string]int{"0": 3, "1": 5},
+		WeightedVotes: map[string]int64{"0": 300, "1": 50},
+		Averages:      map[string]float64{"0": 4.5},
+		Distributions: map[string]map[string]int{"0": {"4": 1, "5": 1}},
+	}
+	encoded := marshalUpdateProto(msg)
+
+	var decoded pulsepb.UpdateMessage
+	if err := proto.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if decoded.Type != "voteUpdate" || decoded.Votes["1"] != 5 || decoded.Averages["0"] != 4.5 {
+		t.Errorf("decoded %v, want the counts and averages sent", &decoded)
+	}
+	if decoded.WeightedVotes["0"] != 300 || decoded.WeightedVotes["1"] != 50 {
+		t.Errorf("weighted votes %v, want 0:300 1:50", decoded.WeightedVotes)
+	}
+	if decoded.Distributions["0"].GetCounts()["5"] != 1 {
+		t.Errorf("distributions %v, want one 5 for option 0", decoded.Distributions)
+	}
+
+	// Map entries are sorted, so the same update encodes the same way
+	for i := 0; i < 10; i++ {
+		if again := marshalUpdateProto(msg); !bytes.Equal(again, encoded) {
+			t.Fatalf("encoding differs between runs: %x vs %x", again, encoded)
+		}
+	}
+}
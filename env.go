@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envString returns the value of an environment variable or a default
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns an integer environment variable or a default
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Warn("Invalid value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envFloat returns a floating-point environment variable or a default
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logger.Warn("Invalid value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// envBool returns a boolean environment variable or a default
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Warn("Invalid value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return b
+}
+
+// envDuration returns a duration environment variable (e.g. "30s") or a default
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warn("Invalid value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// pollTTLDefault is how long a poll lives when it doesn't ask for a
+	// lifetime; pollTTLMin and pollTTLMax bound expires_in_seconds
+	pollTTLDefault = envDuration("POLL_TTL_DEFAULT", 24*time.Hour)
+	pollTTLMin     = envDuration("POLL_TTL_MIN", time.Minute)
+	pollTTLMax     = envDuration("POLL_TTL_MAX", 7*24*time.Hour)
+
+	// expiryCheckInterval is how often polls watched on this instance are
+	// checked for expiry
+	expiryCheckInterval = envDuration("EXPIRY_CHECK_INTERVAL", 5*time.Second)
+)
+
+// pollTTL validates a requested lifetime in seconds, where 0 means the
+// default
+func pollTTL(seconds int) (time.Duration, error) {
+	if seconds == 0 {
+		return pollTTLDefault, nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if seconds < 0 || ttl < pollTTLMin || ttl > pollTTLMax {
+		return 0, fmt.Errorf("expires_in_seconds must be between %d and %d",
+			int(pollTTLMin/time.Second), int(pollTTLMax/time.Second))
+	}
+	return ttl, nil
+}
+
+// pollGone reports whether a broadcast means the poll no longer exists,
+// after which its viewers are disconnected
+func pollGone(eventType string) bool {
+	return eventType == "pollDeleted" || eventType == "pollExpired"
+}
+
+// runExpiryWatcher tells the viewers on this instance when their poll
+// expires. The store drops the keys on its own; since every instance checks
+// its own viewers, this needs no coordination and survives restarts. It
+// also closes those polls ahead of expiry in case their freeze
+// notification never arrived.
+func runExpiryWatcher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := freezeDue(hub.Rooms(), time.Now())
+		if err != nil {
+			logger.Error("Final results check failed", "error", err)
+		}
+		for _, pollID := range due {
+			freezePoll(pollID)
+		}
+
+		expired, err := expiredPolls(hub.Rooms(), time.Now())
+		if err != nil {
+			logger.Error("Expiry check failed", "error", err)
+			continue
+		}
+		for _, pollID := range expired {
+			logger.Info("Poll expired", "poll_id", pollID)
+			payload, _ := json.Marshal(PollEvent{Type: "pollExpired", PollID: pollID, Status: statusExpired})
+			hub.Broadcast(pollID, string(payload))
+		}
+	}
+}
+
+// expiredPolls returns the polls whose expires_at has passed or whose hash
+// is already gone
+func expiredPolls(pollIDs []string, now time.Time) ([]string, error) {
+	if len(pollIDs) == 0 {
+		return nil, nil
+	}
+
+	polls, err := store.GetPolls(pollIDs, "question", "expires_at")
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for i, data := range polls {
+		if _, exists := data["question"]; !exists {
+			expired = append(expired, pollIDs[i])
+			continue
+		}
+		if expiresAt, err := strconv.ParseInt(data["expires_at"], 10, 64); err == nil && now.Unix() >= expiresAt {
+			expired = append(expired, pollIDs[i])
+		}
+	}
+	return expired, nil
+}
+
+// setExpiry gives a poll and its companion keys a new lifetime and records
+// the new expires_at
+func setExpiry(pollID string, ttl time.Duration) {
+	store.ExpirePoll(pollID, ttl)
+	store.UpdatePoll(pollID, map[string]interface{}{"expires_at": time.Now().Add(ttl).Unix()})
+	kv.Expire(commentsKey(pollID), ttl)
+	kv.Expire(playersKey(pollID), ttl)
+	kv.Expire(voteTimesKey(pollID), ttl)
+	kv.Expire(auditKey(pollID), ttl)
+	kv.Expire(historyKey(pollID), ttl)
+	kv.Expire(invitesKey(pollID), ttl)
+	kv.Expire(ballotsKey(pollID), ttl)
+	kv.Expire(weightsKey(pollID), ttl)
+	kv.Expire(votersKey(pollID), ttl)
+	kv.Expire(questionsKey(pollID), ttl)
+	kv.Expire(questionVotesKey(pollID), ttl)
+	kv.Expire(questionVotersKey(pollID), ttl)
+	kv.Expire(pendingAnswersKey(pollID), ttl)
+	scheduleFreeze(pollID, ttl)
+	scheduleArchive(pollID, ttl)
+	if poll, err := pollFields(pollID, "join_code"); err == nil && poll["join_code"] != "" {
+		kv.Expire(joinCodeKey(poll["join_code"]), ttl)
+	}
+}
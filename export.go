@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportFlushEvery is how many rows are written between flushes, and how
+// many ballots are read from Redis at a time
+const exportFlushEvery = 100
+
+// exportTimeLayout is how vote times are written in CSV exports
+const exportTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// voteTimesKey records when each ballot in vote:<pollID> was cast, under
+// the same member
+func voteTimesKey(pollID string) string {
+	return fmt.Sprintf("votetimes:%s", pollID)
+}
+
+// recordVoteTime notes when member's ballot was cast or last changed. The
+// key expires with the poll.
+func recordVoteTime(state map[string]string, pollID, member string, at time.Time) error {
+	key := voteTimesKey(pollID)
+	return kv.Batch(func(b KeyBatch) {
+		b.HSet(key, map[string]interface{}{member: at.UnixMilli()})
+		if expiresAt, err := strconv.ParseInt(state["expires_at"], 10, 64); err == nil {
+			b.ExpireAt(key, time.Unix(expiresAt, 0))
+		}
+	})
+}
+
+// ExportedVote is one ballot in an export. Voters aren't identified.
+type ExportedVote struct {
+	VotedAt int64  `json:"votedAt,omitempty"` // Unix millis; missing if not recorded
+	Ballot  string `json:"ballot"`            // as stored, e.g. "0,2" or "0=4,1=2"
+	Segment string `json:"segment,omitempty"`
+}
+
+// scanVotes calls fn with each ballot of a poll, reading them a batch at a
+// time. Ballots come in no particular order.
+func scanVotes(r *http.Request, pollID string, fn func(ExportedVote) error) error {
+	if err := r.Context().Err(); err != nil {
+		return err
+	}
+	return store.ScanBallots(pollID, exportFlushEvery, func(ballots map[string]string) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		members := make([]string, 0, len(ballots))
+		for member := range ballots {
+			members = append(members, member)
+		}
+		times, err := kv.HMGet(voteTimesKey(pollID), members...)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			vote := ExportedVote{}
+			vote.Ballot, vote.Segment = splitBallot(ballots[member])
+			if at, ok := times[member]; ok {
+				vote.VotedAt, _ = strconv.ParseInt(at, 10, 64)
+			}
+			if err := fn(vote); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// exportPoll handles GET /api/poll/{pollID}/export?format=csv|json: the
+// per-option results followed by every ballot and when it was cast, where
+// that was recorded. The response is streamed: rows are written and flushed as they're
+// produced, without a Content-Length, so large exports never have to be
+// held in memory and a disconnected client stops the work.
+func (s *Server) exportPoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	summary, err := loadSummary(pollID)
+	if err != nil {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("poll-%s.%s", pollID, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "csv" {
+		err = streamCSV(w, r, summary)
+	} else {
+		err = streamJSON(w, r, summary)
+	}
+	if err != nil {
+		requestLogger(r).Warn("Export aborted", "error", err)
+	}
+}
+
+// streamCSV writes one row per option, then one per ballot
+func streamCSV(w http.ResponseWriter, r *http.Request, summary *PollSummary) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"question", summary.Question})
+	cw.Write([]string{"total_votes", strconv.Itoa(summary.Total)})
+	cw.Write([]string{"unique_voters", strconv.FormatInt(summary.UniqueVoters, 10)})
+	cw.Write([]string{})
+	cw.Write([]string{"option_id", "option", "votes", "percent"})
+
+	for i, result := range summary.Results {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		cw.Write([]string{
+			result.ID,
+			result.Text,
+			strconv.Itoa(result.Votes),
+			strconv.FormatFloat(result.Percent, 'f', 1, 64),
+		})
+		if (i+1)%exportFlushEvery == 0 {
+			flushCSV(w, cw)
+		}
+	}
+
+	flushCSV(w, cw)
+	cw.Write([]string{})
+	cw.Write([]string{"voted_at", "ballot", "segment"})
+	rows := 0
+	err := scanVotes(r, summary.PollID, func(vote ExportedVote) error {
+		votedAt := ""
+		if vote.VotedAt > 0 {
+			votedAt = time.UnixMilli(vote.VotedAt).UTC().Format(exportTimeLayout)
+		}
+		cw.Write([]string{votedAt, vote.Ballot, vote.Segment})
+		if rows++; rows%exportFlushEvery == 0 {
+			flushCSV(w, cw)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	flushCSV(w, cw)
+	return cw.Error()
+}
+
+// streamJSON writes the summary as a JSON object, encoding each result as
+// it goes rather than marshalling the whole document up front
+func streamJSON(w http.ResponseWriter, r *http.Request, summary *PollSummary) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	header, _ := json.Marshal(map[string]interface{}{
+		"pollId":       summary.PollID,
+		"question":     summary.Question,
+		"status":       summary.Status,
+		"total":        summary.Total,
+		"uniqueVoters": summary.UniqueVoters,
+		"winners":      summary.Winners,
+		"generatedAt":  summary.GeneratedAt,
+	})
+	// Reopen the header object to append the streamed results array
+	w.Write(header[:len(header)-1])
+	w.Write([]byte(`,"results":[`))
+
+	for i, result := range summary.Results {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			flush(w)
+		}
+	}
+
+	w.Write([]byte(`],"votes":[`))
+	rows := 0
+	err := scanVotes(r, summary.PollID, func(vote ExportedVote) error {
+		if rows > 0 {
+			w.Write([]byte(","))
+		}
+		if err := enc.Encode(vote); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushEvery == 0 {
+			flush(w)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("]}\n"))
+	flush(w)
+	return err
+}
+
+// flushCSV pushes buffered CSV rows to the client
+func flushCSV(w http.ResponseWriter, cw *csv.Writer) {
+	cw.Flush()
+	flush(w)
+}
+
+// flush sends buffered response data if the writer supports it
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
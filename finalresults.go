@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every poll ends on a finalResults broadcast: when its owner or schedule
+// closes it, and shortly before its TTL runs out. Expiry is caught on a
+// freeze:<pollID> key that expires finalResultsLead ahead of the poll,
+// since the poll's own data is gone by the time the store reports it
+// expired. On Redis that takes keyspace notifications.
+var (
+	// finalResultsLead is how long before a poll expires it is closed and
+	// its final results broadcast. Polls shorter than twice this are
+	// closed halfway through their lifetime.
+	finalResultsLead = envDuration("FINAL_RESULTS_LEAD", time.Minute)
+
+	// configureKeyspaceEvents turns on the expired-key notifications the
+	// freeze relies on with Redis at startup. Turn it off where CONFIG SET
+	// isn't allowed and set notify-keyspace-events to include "Ex" instead.
+	configureKeyspaceEvents = envBool("REDIS_CONFIGURE_KEYSPACE_EVENTS", true)
+)
+
+// FinalResults is broadcast once a poll is closed for good, so every screen
+// ends on the same numbers. Option polls carry the results snapshot,
+// rating polls each option's average and open-text polls their word cloud.
+type FinalResults struct {
+	Type     string             `json:"type"` // "finalResults"
+	PollID   string             `json:"pollId"`
+	PollType string             `json:"poll_type"`
+	Total    int                `json:"total"`   // votes, ballots on rating polls, or responses
+	Winners  []string           `json:"winners"` // option IDs, more than one on a tie
+	Results  *ResultsSnapshot   `json:"results,omitempty"`
+	Averages map[string]float64 `json:"averages,omitempty"`
+	Words    []WordCount        `json:"words,omitempty"`
+}
+
+// freezeKey expires finalResultsLead before its poll, which sets off the
+// poll's closing
+func freezeKey(pollID string) string {
+	return fmt.Sprintf("freeze:%s", pollID)
+}
+
+// freezeDelay is how long after it was given a lifetime of ttl a poll is
+// closed ahead of expiry
+func freezeDelay(ttl time.Duration) time.Duration {
+	return ttl - min(finalResultsLead, ttl/2)
+}
+
+// scheduleFreeze sets the key whose expiry closes a poll ahead of its TTL
+func scheduleFreeze(pollID string, ttl time.Duration) {
+	if err := kv.Set(freezeKey(pollID), "1", freezeDelay(ttl)); err != nil {
+		logger.Error("Failed to schedule final results", "poll_id", pollID, "error", err)
+	}
+}
+
+// runFreezeListener closes polls as their freeze keys expire. Expiry
+// notifications can be missed, so runExpiryWatcher also freezes the polls
+// that have viewers here.
+func runFreezeListener() {
+	for key := range kv.Expired(ctx, "freeze:") {
+		freezePoll(strings.TrimPrefix(key, "freeze:"))
+	}
+}
+
+// freezePoll closes a poll about to expire and broadcasts its final
+// results. It does nothing if the poll is gone or already closed, so of all
+// the instances notified only one goes on to broadcast the results.
+func freezePoll(pollID string) {
+	froze, err := store.ClosePoll(pollID)
+	if err != nil {
+		logger.Error("Failed to close expiring poll", "poll_id", pollID, "error", err)
+		return
+	}
+	if !froze {
+		return
+	}
+	bumpConfigVersion(pollID)
+	logger.Info("Poll status changed", "poll_id", pollID, "status", statusClosed, "reason", "expiring")
+	publishEvent(pollID, PollEvent{Type: "pollClosed", PollID: pollID, Status: statusClosed})
+	afterClose(pollID)
+}
+
+// freezeDue returns the polls whose freeze time has passed, reading it off
+// created_at and expires_at the way freezeDelay sets it
+func freezeDue(pollIDs []string, now time.Time) ([]string, error) {
+	if len(pollIDs) == 0 {
+		return nil, nil
+	}
+
+	polls, err := store.GetPolls(pollIDs, "status", "created_at", "expires_at")
+	if err != nil {
+		return nil, err
+	}
+
+	var due []string
+	for i, data := range polls {
+		if data["status"] == statusClosed {
+			continue
+		}
+		createdAt, err1 := strconv.ParseInt(data["created_at"], 10, 64)
+		expiresAt, err2 := strconv.ParseInt(data["expires_at"], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		ttl := time.Duration(expiresAt-createdAt) * time.Second
+		if freezeAt := time.Unix(createdAt, 0).Add(freezeDelay(ttl)); !now.Before(freezeAt) {
+			due = append(due, pollIDs[i])
+		}
+	}
+	return due, nil
+}
+
+// finalResults builds the finalResults message from a poll's data
+func finalResults(pollID string) (FinalResults, error) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		return FinalResults{}, err
+	}
+	if len(data) == 0 {
+		return FinalResults{}, errPollNotFound
+	}
+	final := FinalResults{Type: "finalResults", PollID: pollID, PollType: pollTypeOf(data), Winners: []string{}}
+
+	switch final.PollType {
+	case pollTypeText:
+		top := currentTopWords(pollID)
+		final.Total, final.Words = top.Responses, top.Words
+	case pollTypeRating:
+		final.Averages, _ = parseRatings(data)
+		ballots, err := store.CountBallots(pollID)
+		if err != nil {
+			return FinalResults{}, err
+		}
+		final.Total = int(ballots)
+		best := 0.0
+		for _, average := range final.Averages {
+			best = max(best, average)
+		}
+		for _, id := range optionOrder(parseOptions(data), false, pollID, "") {
+			if average, ok := final.Averages[id]; ok && average == best {
+				final.Winners = append(final.Winners, id)
+			}
+		}
+	default:
+		ballots, err := store.CountBallots(pollID)
+		if err != nil {
+			return FinalResults{}, err
+		}
+		results := buildResults(pollID, data, ballots)
+		final.Results = &results
+		final.Total = results.TotalVotes
+		final.Winners = results.Leading
+	}
+	return final, nil
+}
+
+// publishFinalResults broadcasts a closed poll's final results
+func publishFinalResults(pollID string) {
+	final, err := finalResults(pollID)
+	if err != nil {
+		logger.Error("Failed to build final results", "poll_id", pollID, "error", err)
+		return
+	}
+	publishEvent(pollID, final)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the store ping of a readiness check
+var readyTimeout = envDuration("READY_TIMEOUT", time.Second)
+
+// HealthStatus is the response of GET /health
+type HealthStatus struct {
+	Status  string `json:"status"`  // "ok" or "degraded"
+	Updates bool   `json:"updates"` // the updates stream is being received
+}
+
+// health handles GET /health. An instance that lost its updates stream
+// still serves requests, but its viewers stop seeing live counts, so it
+// answers 503 until the stream is back.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{Status: "ok", Updates: updatesHealthy.Load()}
+	code := http.StatusOK
+	if !status.Updates {
+		status.Status = "degraded"
+		code = http.StatusServiceUnavailable
+	}
+
+	writeProbe(w, code, status)
+}
+
+// Liveness is the response of GET /healthz
+type Liveness struct {
+	Status string `json:"status"` // always "ok"
+	Uptime int64  `json:"uptimeSeconds"`
+}
+
+// healthz handles GET /healthz, the liveness probe. It only shows the
+// process is up and serving; a store outage must not get every instance
+// restarted at once.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, Liveness{
+		Status: "ok",
+		Uptime: int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// Readiness is the response of GET /readyz
+type Readiness struct {
+	Status     string `json:"status"`               // "ready" or "unavailable"
+	Redis      bool   `json:"redis"`                // the store answered a ping
+	RedisError string `json:"redisError,omitempty"` // why it didn't
+	Updates    bool   `json:"updates"`              // the updates stream is being received
+}
+
+// readyz handles GET /readyz, the readiness probe: the instance can take
+// traffic once the store answers and live updates are flowing, and answers 503
+// otherwise so it is taken out of rotation until it recovers
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	status := Readiness{Status: "ready", Redis: true, Updates: updatesHealthy.Load()}
+
+	pingCtx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := kv.Ping(pingCtx); err != nil {
+		status.Redis = false
+		status.RedisError = err.Error()
+	}
+
+	code := http.StatusOK
+	if !status.Redis || !status.Updates {
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	writeProbe(w, code, status)
+}
+
+// writeProbe writes a health check response, which must never be cached
+func writeProbe(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
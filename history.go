@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// historyBucket is the width of the buckets vote history is kept in
+const historyBucket = time.Minute
+
+// historyKey holds a poll's vote history. Each bucket is a field named by
+// its start in Unix seconds, counting the ballots cast in it, plus a
+// "<start>:<optionID>" field per option that gained or lost votes. Changed
+// and retracted ballots count negatively, so the buckets add up to the
+// current totals.
+func historyKey(pollID string) string {
+	return fmt.Sprintf("history:%s", pollID)
+}
+
+// HistoryBucket is one minute of a poll's vote history
+type HistoryBucket struct {
+	Start   int64            `json:"start"`             // Unix seconds
+	Votes   int64            `json:"votes"`             // ballots cast, less those retracted
+	Total   int64            `json:"total"`             // ballots by the end of the bucket
+	Options map[string]int64 `json:"options,omitempty"` // votes each option gained
+}
+
+// VoteHistory is the body of GET /api/poll/{pollID}/history
+type VoteHistory struct {
+	PollID        string          `json:"pollId"`
+	BucketSeconds int             `json:"bucketSeconds"`
+	Buckets       []HistoryBucket `json:"buckets"` // oldest first, only those with activity
+}
+
+// storedChoices returns the options a stored ballot counts towards; open-
+// text ballots count towards none
+func storedChoices(data map[string]string, stored string) []string {
+	ballot, _ := splitBallot(stored)
+	switch pollTypeOf(data) {
+	case pollTypeText:
+		return nil
+	case pollTypeRating:
+		return ratedOptions(decodeRatings(ballot))
+	default:
+		return countedChoices(data, strings.Split(ballot, ","))
+	}
+}
+
+// recordHistory adds a ballot to the bucket of at: ballots is the change
+// in the number of ballots, choices the options that gained a vote and old
+// the stored ballot that was replaced or retracted, if any. The key
+// expires with the poll.
+func recordHistory(state map[string]string, pollID string, at time.Time, ballots int64, choices []string, old string) error {
+	start := strconv.FormatInt(at.Truncate(historyBucket).Unix(), 10)
+	key := historyKey(pollID)
+
+	return kv.Batch(func(b KeyBatch) {
+		if ballots != 0 {
+			b.HIncrBy(key, start, ballots)
+		}
+		if pollTypeOf(state) != pollTypeText {
+			for _, optionID := range choices {
+				b.HIncrBy(key, start+":"+optionID, 1)
+			}
+			if old != "" {
+				for _, optionID := range storedChoices(state, old) {
+					b.HIncrBy(key, start+":"+optionID, -1)
+				}
+			}
+		}
+		if expiresAt, err := strconv.ParseInt(state["expires_at"], 10, 64); err == nil {
+			b.ExpireAt(key, time.Unix(expiresAt, 0))
+		}
+	})
+}
+
+// getHistory handles GET /api/poll/{pollID}/history?since=<unix seconds>,
+// the votes over time of a poll in one-minute buckets. Buckets before
+// since are left out, but still count towards the running totals.
+func (s *Server) getHistory(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	var since int64
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "since must be a Unix timestamp", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if resultsHidden(r, pollID, data) {
+		http.Error(w, "Results are hidden", http.StatusForbidden)
+		return
+	}
+
+	history, err := loadHistory(pollID, since)
+	if err != nil {
+		requestLogger(r).Error("Failed to load vote history", "error", err)
+		http.Error(w, "Failed to load vote history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// loadHistory reads a poll's vote history, leaving out the buckets before
+// since
+func loadHistory(pollID string, since int64) (VoteHistory, error) {
+	fields, err := kv.HGetAll(historyKey(pollID))
+	if err != nil {
+		return VoteHistory{}, err
+	}
+
+	buckets := make(map[int64]*HistoryBucket)
+	for field, value := range fields {
+		startStr, optionID, perOption := strings.Cut(field, ":")
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		count, _ := strconv.ParseInt(value, 10, 64)
+		bucket := buckets[start]
+		if bucket == nil {
+			bucket = &HistoryBucket{Start: start}
+			buckets[start] = bucket
+		}
+		if !perOption {
+			bucket.Votes = count
+			continue
+		}
+		if count != 0 {
+			if bucket.Options == nil {
+				bucket.Options = make(map[string]int64)
+			}
+			bucket.Options[optionID] = count
+		}
+	}
+
+	history := VoteHistory{
+		PollID:        pollID,
+		BucketSeconds: int(historyBucket / time.Second),
+		Buckets:       make([]HistoryBucket, 0, len(buckets)),
+	}
+	starts := make([]int64, 0, len(buckets))
+	for start := range buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	var total int64
+	for _, start := range starts {
+		bucket := buckets[start]
+		total += bucket.Votes
+		bucket.Total = total
+		if start+int64(history.BucketSeconds) > since {
+			history.Buckets = append(history.Buckets, *bucket)
+		}
+	}
+	return history, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// subscriber is a viewer a Hub fans a poll's broadcasts out to: a WebSocket
+// connection or an SSE stream
+type subscriber interface {
+	// deliver hands the subscriber a broadcast for its poll. It is called
+	// outside the hub's lock and must not block.
+	deliver(b *broadcast)
+}
+
+// broadcast is one message fanned out to a poll's subscribers, decoded
+// once and shared by all of them
+type broadcast struct {
+	pollID  string
+	message []byte
+	update  UpdateMessage // every message has a Type; counts only voteUpdate
+
+	protoOnce sync.Once
+	proto     []byte
+}
+
+// protobuf returns the update encoded for protobuf clients, encoding it
+// at most once per broadcast
+func (b *broadcast) protobuf() []byte {
+	b.protoOnce.Do(func() { b.proto = marshalUpdateProto(b.update) })
+	return b.proto
+}
+
+// Hub keeps the subscribers of each poll on this instance, one room per
+// poll, and fans broadcasts out to them. Rooms are spread over shards by
+// poll ID, each with its own lock, so connections and broadcasts on
+// different polls don't wait on each other.
+type Hub struct {
+	shards []hubShard
+}
+
+// hubShards is the number of shards a Hub's rooms are spread over
+const hubShards = 64
+
+// hubShard holds the rooms of the polls whose IDs hash to it
+type hubShard struct {
+	mu    sync.RWMutex
+	rooms map[string]map[subscriber]bool
+}
+
+// hub holds every WebSocket client and SSE stream of this instance
+var hub = newHub()
+
+func newHub() *Hub {
+	return newShardedHub(hubShards)
+}
+
+// newShardedHub returns a Hub spreading its rooms over n shards
+func newShardedHub(n int) *Hub {
+	h := &Hub{shards: make([]hubShard, n)}
+	for i := range h.shards {
+		h.shards[i].rooms = make(map[string]map[subscriber]bool)
+	}
+	return h
+}
+
+// shard returns the shard of a poll's room, picked by the FNV-1a hash of
+// its ID
+func (h *Hub) shard(pollID string) *hubShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(pollID))
+	return &h.shards[hash.Sum32()%uint32(len(h.shards))]
+}
+
+// Register adds a subscriber to a poll's room. The store starts
+// delivering the poll's updates to this instance with its first one.
+func (h *Hub) Register(pollID string, sub subscriber) {
+	shard := h.shard(pollID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.rooms[pollID] == nil {
+		shard.rooms[pollID] = make(map[subscriber]bool)
+		store.Watch(pollID)
+	}
+	shard.rooms[pollID][sub] = true
+	if _, ok := sub.(*wsClient); ok {
+		wsConnections.WithLabelValues(pollID).Inc()
+	}
+}
+
+// Unregister removes a subscriber from a poll's room, dropping the room
+// and the poll's updates once it is empty
+func (h *Hub) Unregister(pollID string, sub subscriber) {
+	shard := h.shard(pollID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if !shard.rooms[pollID][sub] {
+		return
+	}
+	delete(shard.rooms[pollID], sub)
+	if _, ok := sub.(*wsClient); ok {
+		wsConnections.WithLabelValues(pollID).Dec()
+	}
+	if len(shard.rooms[pollID]) == 0 {
+		delete(shard.rooms, pollID)
+		wsConnections.DeleteLabelValues(pollID)
+		store.Unwatch(pollID)
+	}
+}
+
+// Subscribers returns a snapshot of a poll's room
+func (h *Hub) Subscribers(pollID string) []subscriber {
+	shard := h.shard(pollID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	subs := make([]subscriber, 0, len(shard.rooms[pollID]))
+	for sub := range shard.rooms[pollID] {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Count returns the number of subscribers of a poll
+func (h *Hub) Count(pollID string) int {
+	shard := h.shard(pollID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return len(shard.rooms[pollID])
+}
+
+// Rooms lists the polls with subscribers on this instance
+func (h *Hub) Rooms() []string {
+	var ids []string
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mu.RLock()
+		for pollID := range shard.rooms {
+			ids = append(ids, pollID)
+		}
+		shard.mu.RUnlock()
+	}
+	return ids
+}
+
+// All returns every subscriber on this instance
+func (h *Hub) All() []subscriber {
+	var subs []subscriber
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mu.RLock()
+		for _, room := range shard.rooms {
+			for sub := range room {
+				subs = append(subs, sub)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return subs
+}
+
+// Broadcast delivers a published message to every subscriber of a poll.
+// Subscribers queue what they are sent, so the room's lock is only held
+// to take a snapshot and a slow viewer never stalls the others.
+func (h *Hub) Broadcast(pollID string, message string) {
+	subs := h.Subscribers(pollID)
+	if len(subs) == 0 {
+		return
+	}
+
+	b := &broadcast{pollID: pollID, message: []byte(message)}
+	if err := json.Unmarshal(b.message, &b.update); err != nil {
+		logger.Error("Failed to unmarshal update message", "poll_id", pollID, "error", err)
+		return
+	}
+	for _, sub := range subs {
+		sub.deliver(b)
+	}
+
+	// The timestamp may come from another instance, so clock skew between
+	// servers shows up here; negative deltas are discarded
+	if b.update.ReceivedAt > 0 {
+		if latency := time.Since(time.Unix(0, b.update.ReceivedAt)); latency >= 0 {
+			voteBroadcastLatency.Observe(latency.Seconds())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// countingSubscriber counts the broadcasts delivered to it
+type countingSubscriber struct {
+	delivered *atomic.Int64
+}
+
+func (s countingSubscriber) deliver(b *broadcast) {
+	s.delivered.Add(1)
+}
+
+func TestHubRooms(t *testing.T) {
+	store = newTestRedisStore(t)
+	h := newHub()
+	var delivered atomic.Int64
+	a, b := countingSubscriber{&delivered}, countingSubscriber{new(atomic.Int64)}
+
+	h.Register("p1", a)
+	h.Register("p1", b)
+	h.Register("p2", a)
+	if got := h.Count("p1"); got != 2 {
+		t.Fatalf("Count(p1) = %d, want 2", got)
+	}
+	if got := len(h.Rooms()); got != 2 {
+		t.Fatalf("%d rooms, want 2", got)
+	}
+	if got := len(h.All()); got != 3 {
+		t.Fatalf("%d subscribers, want 3", got)
+	}
+
+	h.Broadcast("p2", `{"type":"voteUpdate","votes":{"0":1}}`)
+	if got := delivered.Load(); got != 1 {
+		t.Fatalf("%d broadcasts delivered, want 1", got)
+	}
+
+	h.Unregister("p1", a)
+	h.Unregister("p1", b)
+	if got := h.Count("p1"); got != 0 {
+		t.Fatalf("Count(p1) = %d after everyone left, want 0", got)
+	}
+	if got := len(h.Rooms()); got != 1 {
+		t.Fatalf("%d rooms, want 1", got)
+	}
+}
+
+// BenchmarkHub measures broadcasts to many polls from concurrent
+// goroutines, with viewers joining and leaving on the side, against a
+// single lock and against the sharded rooms. Run it with -cpu to see the
+// contention the shards remove.
+func BenchmarkHub(b *testing.B) {
+	store = newTestRedisStore(b)
+	const polls, viewers = 1000, 5
+	ids := make([]string, polls)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("poll%d", i)
+	}
+	message := `{"type":"voteUpdate","votes":{"0":12,"1":30}}`
+
+	for _, shards := range []int{1, hubShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			h := newShardedHub(shards)
+			var delivered atomic.Int64
+			for _, id := range ids {
+				for j := 0; j < viewers; j++ {
+					h.Register(id, countingSubscriber{&delivered})
+				}
+			}
+
+			var seed atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(1)) * 7919
+				churn := countingSubscriber{&delivered}
+				for pb.Next() {
+					i++
+					id := ids[i%polls]
+					if i%8 == 0 {
+						h.Register(id, churn)
+						h.Unregister(id, churn)
+						continue
+					}
+					h.Broadcast(id, message)
+				}
+			})
+			b.ReportMetric(float64(delivered.Load())/b.Elapsed().Seconds(), "deliveries/s")
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// votersKey maps the voters of an identified poll to who they said they
+// are, as JSON voterIdentity per voted-set member
+func votersKey(pollID string) string {
+	return fmt.Sprintf("voters:%s", pollID)
+}
+
+// voterIdentity is who cast a ballot on an identified poll
+type voterIdentity struct {
+	Name    string `json:"name"`
+	Account string `json:"account,omitempty"` // ID of the account signed in as
+}
+
+// IdentifiedVote is one voter's line in GET /api/poll/{pollID}/voters
+type IdentifiedVote struct {
+	Name     string         `json:"name"`
+	Account  string         `json:"account,omitempty"`
+	Choices  []string       `json:"choices,omitempty"` // option IDs the ballot counts for
+	Ratings  map[string]int `json:"ratings,omitempty"` // rating polls
+	Answer   string         `json:"answer,omitempty"`  // open-text polls
+	Segment  string         `json:"segment,omitempty"`
+	VotedAt  int64          `json:"voted_at,omitempty"` // Unix millis
+	Verified bool           `json:"verified"`           // the name is the account's, not typed in
+}
+
+// VoterBreakdown is the body of GET /api/poll/{pollID}/voters
+type VoterBreakdown struct {
+	Voters   []IdentifiedVote    `json:"voters"`    // by name
+	ByOption map[string][]string `json:"by_option"` // option ID to the names that voted for it
+}
+
+// identifyVoter works out who an identified poll's voter is: the account
+// they're signed in as, under its username, or else the name they gave.
+// ok is false if they're nobody.
+func identifyVoter(v voteRequest) (voterIdentity, bool, error) {
+	if v.Account != "" {
+		account, _, err := loadAccount(v.Account)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return voterIdentity{}, false, err
+		}
+		identity := voterIdentity{Name: account.Username, Account: v.Account}
+		if identity.Name == "" {
+			identity.Name = v.Name
+		}
+		return identity, identity.Name != "", nil
+	}
+	return voterIdentity{Name: v.Name}, v.Name != "", nil
+}
+
+// recordVoterIdentity remembers who cast an identified poll's ballot
+func recordVoterIdentity(state map[string]string, pollID, member string, identity voterIdentity) error {
+	encoded, _ := json.Marshal(identity)
+	key := votersKey(pollID)
+	return kv.Batch(func(b KeyBatch) {
+		b.HSet(key, map[string]interface{}{member: encoded})
+		if expiresAt, err := strconv.ParseInt(state["expires_at"], 10, 64); err == nil {
+			b.ExpireAt(key, time.Unix(expiresAt, 0))
+		}
+	})
+}
+
+// voterBreakdown handles GET /api/poll/{pollID}/voters, which tells the
+// owner of an identified poll who voted for what. Polls that aren't
+// identified never record it, so they only have anonymous tallies.
+func (s *Server) voterBreakdown(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if data["identified"] != "1" {
+		http.Error(w, "Poll is anonymous; only identified polls record who voted", http.StatusConflict)
+		return
+	}
+
+	identities, err := kv.HGetAll(votersKey(pollID))
+	if err != nil {
+		requestLogger(r).Error("Failed to load voters", "error", err)
+		http.Error(w, "Failed to load voters", http.StatusInternalServerError)
+		return
+	}
+	ballots, err := pollBallots(pollID)
+	if err != nil {
+		requestLogger(r).Error("Failed to load ballots", "error", err)
+		http.Error(w, "Failed to load voters", http.StatusInternalServerError)
+		return
+	}
+	times, err := kv.HGetAll(voteTimesKey(pollID))
+	if err != nil {
+		requestLogger(r).Error("Failed to load vote times", "error", err)
+		http.Error(w, "Failed to load voters", http.StatusInternalServerError)
+		return
+	}
+
+	breakdown := VoterBreakdown{Voters: []IdentifiedVote{}, ByOption: make(map[string][]string)}
+	for optionID := range parseOptions(data) {
+		breakdown.ByOption[optionID] = []string{}
+	}
+	for member, encoded := range identities {
+		stored, ok := ballots[member]
+		if !ok {
+			continue // retracted
+		}
+		var identity voterIdentity
+		if json.Unmarshal([]byte(encoded), &identity) != nil {
+			continue
+		}
+		ballot, segment := splitBallot(stored)
+		vote := IdentifiedVote{
+			Name:     identity.Name,
+			Account:  identity.Account,
+			Choices:  storedChoices(data, stored),
+			Segment:  segment,
+			Verified: identity.Account != "",
+		}
+		switch pollTypeOf(data) {
+		case pollTypeText:
+			vote.Answer = ballot
+		case pollTypeRating:
+			vote.Ratings = decodeRatings(ballot)
+		}
+		vote.VotedAt, _ = strconv.ParseInt(times[member], 10, 64)
+		breakdown.Voters = append(breakdown.Voters, vote)
+		for _, optionID := range vote.Choices {
+			if names, ok := breakdown.ByOption[optionID]; ok {
+				breakdown.ByOption[optionID] = append(names, identity.Name)
+			}
+		}
+	}
+	sort.Slice(breakdown.Voters, func(i, j int) bool {
+		a, b := breakdown.Voters[i], breakdown.Voters[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.VotedAt < b.VotedAt
+	})
+	for _, names := range breakdown.ByOption {
+		sort.Strings(names)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(breakdown)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chat integrations create polls and cast votes on behalf of the users of
+// a chat platform. They go through the same paths as the REST API, so the
+// same validation, limits and broadcasts apply.
+
+// publicURL is the address the server is reached at, such as
+// https://pulse.example.com, used to link to polls from outside the site.
+// Without it links are left out.
+var publicURL = strings.TrimSuffix(envString("PUBLIC_URL", ""), "/")
+
+// pollLink returns the absolute URL of a poll's page, or "" if PUBLIC_URL
+// isn't set
+func pollLink(pollID string) string {
+	if publicURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/poll.html?id=%s", publicURL, pollID)
+}
+
+// integrationID derives a stable identity for a chat user, so the same
+// user always gets the same owner token and voter identity. It's keyed
+// with the voter secret, so it can't be worked out from the user's ID.
+func integrationID(platform string, parts ...string) string {
+	mac := hmac.New(sha256.New, voterSecret)
+	mac.Write([]byte(platform))
+	for _, part := range parts {
+		mac.Write([]byte{0})
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// CreatedPoll is what creating a poll on behalf of a chat user returns
+type CreatedPoll struct {
+	ID         string `json:"id"`
+	OwnerToken string `json:"ownerToken"`
+}
+
+// createPollAs creates a poll on behalf of the chat user behind r, owned
+// by the given owner token, through the same checks as POST /api/poll
+func (s *Server) createPollAs(r *http.Request, req CreatePollRequest, ownerToken string) (CreatedPoll, error) {
+	if !createLimit.Allow(clientIP(r)) {
+		return CreatedPoll{}, createError(http.StatusTooManyRequests, "Too many polls created, try again later")
+	}
+	resp, err := s.newPoll(req, ownerToken, true, requestLogger(r))
+	if err != nil {
+		return CreatedPoll{}, err
+	}
+	return CreatedPoll{ID: resp["id"], OwnerToken: resp["ownerToken"]}, nil
+}
+
+// parsePollCommand reads a poll from chat command text, written as
+// "Question | Option 1 | Option 2 | ..."
+func parsePollCommand(text string) (CreatePollRequest, bool) {
+	parts := strings.Split(text, "|")
+	if len(parts) < 3 {
+		return CreatePollRequest{}, false
+	}
+	req := CreatePollRequest{Question: strings.TrimSpace(parts[0])}
+	for _, part := range parts[1:] {
+		if option := strings.TrimSpace(part); option != "" {
+			req.Options = append(req.Options, OptionInput{Text: option})
+		}
+	}
+	return req, req.Question != "" && len(req.Options) >= 2
+}
+
+// chatVoteMessages are the replies to votes a chat user casts that
+// weren't counted
+var chatVoteMessages = map[string]string{
+	voteDuplicate:   "You already voted in this poll.",
+	votePaused:      "Voting is paused.",
+	voteClosed:      "This poll is closed.",
+	voteNotOpen:     "Voting hasn't opened yet.",
+	voteRateLimited: "You're voting too fast, try again in a moment.",
+	voteDenied:      "This poll only takes votes from the voters it allows.",
+
+	voteCaptchaFailed:   "This poll takes votes on its page, which asks for a CAPTCHA.",
+	voteConfirmRequired: "This poll takes votes on its page, which asks you to confirm your choice.",
+}
+
+// chatVoteMessage returns the reply to a vote that wasn't counted
+func chatVoteMessage(status string) string {
+	if msg, ok := chatVoteMessages[status]; ok {
+		return msg
+	}
+	return fmt.Sprintf("Your vote couldn't be counted (%s).", status)
+}
+
+// chatVote casts a chat user's vote through handleVote. The user's
+// identity stands in for the client ID and, prefixed with the platform and
+// workspace, for the source address, so rate limits apply per user.
+func chatVote(r *http.Request, pollID, optionID, source, userID string) string {
+	return handleVote(voteRequest{
+		PollID:     pollID,
+		Option:     optionID,
+		ClientID:   signClientToken(pollID, userID, time.Now()).ClientID,
+		IP:         source + ":" + userID,
+		UserAgent:  r.UserAgent(),
+		ReceivedAt: time.Now(),
+		Chat:       true,
+		Log:        requestLogger(r),
+		Trace:      r.Context(),
+	})
+}
+
+// PollCard is what a chat message shows of a poll
+type PollCard struct {
+	PollID   string
+	Question string
+	Options  []CardOption
+	Total    int
+	Hidden   bool // counts are withheld until the poll closes
+	Closed   bool
+	Link     string
+}
+
+// CardOption is one option of a PollCard
+type CardOption struct {
+	ID      string
+	Text    string
+	Emoji   string
+	Votes   int
+	Percent float64
+}
+
+// loadPollCard builds the card of a poll, with its options in canonical
+// order so buttons don't move as votes come in
+func loadPollCard(pollID string) (PollCard, error) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		return PollCard{}, err
+	}
+	if len(data) == 0 {
+		return PollCard{}, fmt.Errorf("poll %s not found", pollID)
+	}
+	card := PollCard{
+		PollID:   pollID,
+		Question: data["question"],
+		Closed:   data["status"] == statusClosed,
+		Link:     pollLink(pollID),
+	}
+	card.Hidden = !card.Closed && resultsVisibilityOf(data) != visibilityAlways
+
+	options := parseOptions(data)
+	votes := parseVotes(data)
+	card.Total = totalVotes(votes)
+	for _, option := range parseOptionDetails(data, optionOrder(options, false, "", "")) {
+		entry := CardOption{ID: option.ID, Text: option.Text, Emoji: option.Emoji, Votes: votes[option.ID]}
+		if card.Total > 0 {
+			entry.Percent = float64(entry.Votes) * 100 / float64(card.Total)
+		}
+		card.Options = append(card.Options, entry)
+	}
+	return card, nil
+}
+
+// bar draws a percentage as a text bar for chat messages
+func bar(percent float64) string {
+	const width = 10
+	filled := int(percent/100*width + 0.5)
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
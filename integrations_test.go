@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChatVotesFromOneWorkspace(t *testing.T) {
+	s := newTestServer(t)
+	saved := abuse
+	abuse = newAbuseDetector()
+	abuse.block = true
+	t.Cleanup(func() { abuse = saved })
+
+	r := httptest.NewRequest("POST", "/api/integrations/slack", nil)
+	created, err := s.createPollAs(r, CreatePollRequest{
+		Question: "Lunch?",
+		Options:  []OptionInput{{Text: "Pizza"}, {Text: "Sushi"}},
+	}, integrationID("slack-owner", "T1", "U0"))
+	if err != nil {
+		t.Fatalf("createPollAs: %v", err)
+	}
+
+	// A busy workspace or guild is many users behind one platform, not
+	// one client stuffing the ballot
+	for _, source := range []struct{ platform, source string }{
+		{"slack", "slack:T1"},
+		{"discord", "discord:G1"},
+	} {
+		for i := 0; i < 2*abuse.maxClients; i++ {
+			user := integrationID(source.platform, source.source, fmt.Sprintf("U%d", i))
+			if status := chatVote(r, created.ID, "0", source.source, user); status != voteOK {
+				t.Fatalf("%s vote %d: %s, want %s", source.platform, i, status, voteOK)
+			}
+		}
+	}
+}
+
+func TestChatVotesOnGatedPolls(t *testing.T) {
+	s := newTestServer(t)
+	r := httptest.NewRequest("POST", "/api/integrations/slack", nil)
+	owner := integrationID("slack-owner", "T1", "U0")
+	user := integrationID("slack", "T1", "U1")
+
+	for _, gate := range []struct {
+		field string
+		want  string
+	}{
+		{"confirm_votes", voteConfirmRequired},
+		{"require_captcha", voteCaptchaFailed},
+	} {
+		created, err := s.createPollAs(r, CreatePollRequest{
+			Question: "Lunch?",
+			Options:  []OptionInput{{Text: "Pizza"}, {Text: "Sushi"}},
+		}, owner)
+		if err != nil {
+			t.Fatalf("createPollAs: %v", err)
+		}
+		if err := store.UpdatePoll(created.ID, map[string]interface{}{gate.field: "1"}); err != nil {
+			t.Fatalf("UpdatePoll: %v", err)
+		}
+		if status := chatVote(r, created.ID, "0", "slack:T1", user); status != gate.want {
+			t.Errorf("%s: Slack vote %s, want %s", gate.field, status, gate.want)
+		}
+		discordUser := integrationID("discord", "G1", "U1")
+		if status := chatVote(r, created.ID, "0", "discord:G1", discordUser); status != gate.want {
+			t.Errorf("%s: Discord vote %s, want %s", gate.field, status, gate.want)
+		}
+	}
+}
+
+func TestDiscordRequestsMustBeRecent(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	saved := discordPublicKey
+	discordPublicKey = public
+	t.Cleanup(func() { discordPublicKey = saved })
+
+	body := []byte(`{"type":1}`)
+	now := time.Now()
+	verified := func(signedAt time.Time) bool {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		r := httptest.NewRequest("POST", "/integrations/discord", nil)
+		r.Header.Set("X-Signature-Timestamp", timestamp)
+		r.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(private, append([]byte(timestamp), body...))))
+		return verifyDiscordRequest(r, body, now)
+	}
+	if !verified(now) {
+		t.Fatal("a fresh signed request was refused")
+	}
+	if verified(now.Add(-slackMaxSkew - time.Minute)) {
+		t.Error("a replayed request from outside the window was accepted")
+	}
+	if verified(now.Add(slackMaxSkew + time.Minute)) {
+		t.Error("a request from the future was accepted")
+	}
+}
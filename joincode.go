@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Join codes are short codes audiences type to find a poll, e.g. "K7QD".
+// They use the friendly alphabet in upper case, and start at the shortest
+// length, growing a character when that length keeps colliding.
+const (
+	joinCodeCharset   = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	minJoinCodeLength = 4
+	maxJoinCodeLength = 6
+)
+
+// joinCodePattern matches anything that could be a join code
+var joinCodePattern = regexp.MustCompile(`^[2-9A-HJKMNP-Z]{4,6}$`)
+
+// joinLimit keeps join codes, which are short enough to guess, from being
+// enumerated
+var joinLimit = newRateLimiter("join", "RATE_JOIN", 1, 20) // code lookups per IP
+
+// joinCodeKey maps a join code to its poll's ID
+func joinCodeKey(code string) string {
+	return fmt.Sprintf("join:%s", code)
+}
+
+// claimJoinCode gives a new poll a free join code that lasts as long as
+// the poll, and records it in the poll hash
+func claimJoinCode(pollID string, ttl time.Duration) (string, error) {
+	for length := minJoinCodeLength; length <= maxJoinCodeLength; length++ {
+		codes := idPolicy{charset: joinCodeCharset, length: length}
+		for attempt := 0; attempt < maxIDAttempts; attempt++ {
+			candidate := codes.Generate()
+			claimed, err := kv.SetNX(joinCodeKey(candidate), pollID, ttl)
+			if err != nil {
+				return "", err
+			}
+			if claimed {
+				return candidate, store.UpdatePoll(pollID, map[string]interface{}{"join_code": candidate})
+			}
+		}
+	}
+	return "", fmt.Errorf("no free join code after %d attempts per length", maxIDAttempts)
+}
+
+// releaseJoinCode frees a deleted poll's join code, unless it has since
+// been claimed by another poll
+func releaseJoinCode(pollID, code string) {
+	if code == "" {
+		return
+	}
+	key := joinCodeKey(code)
+	if owner, err := kv.Get(key); err == nil && owner == pollID {
+		kv.Del(key)
+	}
+}
+
+// normalizeJoinCode accepts codes typed in lower case or with spaces
+// and dashes, as people read them off a slide
+func normalizeJoinCode(raw string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(raw))
+}
+
+// joinPoll handles GET /api/join/{code}, which resolves a join code to
+// its poll
+func (s *Server) joinPoll(w http.ResponseWriter, r *http.Request) {
+	if !joinLimit.Allow(clientIP(r)) {
+		tooManyRequests(w, joinLimit, "Too many join attempts, try again later")
+		return
+	}
+	code := normalizeJoinCode(mux.Vars(r)["code"])
+	if !joinCodePattern.MatchString(code) {
+		http.Error(w, "No poll with this code", http.StatusNotFound)
+		return
+	}
+
+	pollID, err := kv.Get(joinCodeKey(code))
+	if err == errKeyNotFound {
+		http.Error(w, "No poll with this code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to look up join code", "error", err)
+		http.Error(w, "Failed to look up code", http.StatusInternalServerError)
+		return
+	}
+	data, err := store.GetPoll(pollID)
+	if err != nil || data["join_code"] != code {
+		http.Error(w, "No poll with this code", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":       pollID,
+		"url":      fmt.Sprintf("/poll.html?id=%s", pollID),
+		"question": data["question"],
+	})
+}
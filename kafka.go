@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	// kafkaBrokers is a comma-separated broker list; the producer is off
+	// when it is empty
+	kafkaBrokers = envString("KAFKA_BROKERS", "")
+	kafkaTopic   = envString("KAFKA_TOPIC", "pulse.votes")
+
+	// kafkaBuffer bounds how many events may wait for delivery; events
+	// beyond it are dropped rather than slowing down voting
+	kafkaBuffer = envInt("KAFKA_BUFFER", 10000)
+)
+
+// kafkaBatchSize is the most events sent to Kafka in one write
+const kafkaBatchSize = 100
+
+// VoteEvent is the record mirrored to Kafka for every recorded vote
+type VoteEvent struct {
+	PollID   string `json:"pollId"`
+	Option   string `json:"option"`
+	NewCount int64  `json:"newCount"`
+	Total    int    `json:"total"`
+	TS       int64  `json:"ts"`               // unix milliseconds
+	Seq      int64  `json:"seq"`              // per poll, increasing across instances
+	Score    int    `json:"score,omitempty"`  // rating polls
+	Revote   bool   `json:"revote,omitempty"` // the voter's earlier ballot was replaced
+}
+
+// voteEventSink delivers vote events to Kafka in the background
+type voteEventSink struct {
+	events chan VoteEvent
+	writer *kafka.Writer
+	done   chan struct{}
+}
+
+// voteEvents is nil when Kafka isn't configured
+var voteEvents = newVoteEventSink()
+
+// newVoteEventSink creates and starts the Kafka producer if KAFKA_BROKERS
+// is set
+func newVoteEventSink() *voteEventSink {
+	if kafkaBrokers == "" {
+		return nil
+	}
+
+	s := &voteEventSink{
+		events: make(chan VoteEvent, kafkaBuffer),
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      strings.Split(kafkaBrokers, ","),
+			Topic:        kafkaTopic,
+			Balancer:     &kafka.Hash{}, // keyed by poll, so each poll stays ordered
+			BatchSize:    kafkaBatchSize,
+			BatchTimeout: 100 * time.Millisecond,
+		}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	logger.Info("Mirroring vote events to Kafka", "topic", kafkaTopic)
+	return s
+}
+
+// Publish queues an event without blocking. It is a no-op when Kafka isn't
+// configured.
+func (s *voteEventSink) Publish(event VoteEvent) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		kafkaDroppedEventsTotal.Inc()
+	}
+}
+
+// run sends queued events to Kafka in batches until the queue is closed
+func (s *voteEventSink) run() {
+	defer close(s.done)
+
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	for event := range s.events {
+		batch = append(batch[:0], voteEventMessage(event))
+
+		// Pick up whatever else is already waiting
+	drain:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case event, ok := <-s.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, voteEventMessage(event))
+			default:
+				break drain
+			}
+		}
+
+		writeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.writer.WriteMessages(writeCtx, batch...); err != nil {
+			kafkaDeliveryFailuresTotal.Add(float64(len(batch)))
+			logger.Error("Failed to deliver vote events to Kafka", "events", len(batch), "error", err)
+		}
+		cancel()
+	}
+}
+
+// Close flushes the queued events and stops the producer
+func (s *voteEventSink) Close() {
+	if s == nil {
+		return
+	}
+	close(s.events)
+	<-s.done
+	s.writer.Close()
+}
+
+// voteEventMessage encodes an event as a Kafka message keyed by poll ID
+func voteEventMessage(event VoteEvent) kafka.Message {
+	value, _ := json.Marshal(event)
+	return kafka.Message{Key: []byte(event.PollID), Value: value}
+}
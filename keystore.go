@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// KeyStore is the storage behind the features outside PollStore: accounts,
+// templates, join codes, comments, Q&A, presence, rate limits, schedules
+// and the other companion keys of a poll. Its operations follow Redis's
+// data types, so the Redis backend maps them one to one, while the
+// in-memory and PostgreSQL backends keep the same keys themselves. A key
+// that doesn't exist reads as empty, writing to it creates it, and a hash,
+// set, sorted set or list left empty is deleted.
+type KeyStore interface {
+	// Get returns a string, or errKeyNotFound
+	Get(key string) (string, error)
+
+	// Set stores a string that expires after ttl, or never if it's 0
+	Set(key, value string, ttl time.Duration) error
+
+	// SetNX is Set unless the key exists, and reports whether it did
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+
+	// GetDel returns a string and deletes it, or errKeyNotFound
+	GetDel(key string) (string, error)
+
+	// Del deletes keys of any type
+	Del(keys ...string) error
+
+	// Expire gives a key a new lifetime; a key that doesn't exist is left
+	// alone
+	Expire(key string, ttl time.Duration) error
+
+	// TTL returns how long a key has left: -1 if it never expires and -2
+	// if it doesn't exist
+	TTL(key string) (time.Duration, error)
+
+	// HGet returns a hash field, or errKeyNotFound
+	HGet(key, field string) (string, error)
+
+	// HGetAll returns every field of a hash
+	HGetAll(key string) (map[string]string, error)
+
+	// HMGet returns the given fields of a hash, leaving out those not set
+	HMGet(key string, fields ...string) (map[string]string, error)
+
+	// HSet sets hash fields, formatting the values the way go-redis does
+	HSet(key string, values map[string]interface{}) error
+
+	// HSetNX sets a hash field unless it's set, and reports whether it did
+	HSetNX(key, field string, value interface{}) (bool, error)
+
+	// HDel removes hash fields and returns how many there were
+	HDel(key string, fields ...string) (int64, error)
+
+	// HLen returns how many fields a hash has
+	HLen(key string) (int64, error)
+
+	// HIncrBy adds by to a counter field and returns the new value
+	HIncrBy(key, field string, by int64) (int64, error)
+
+	// SAdd adds members to a set and returns how many weren't in it
+	SAdd(key string, members ...string) (int64, error)
+
+	// SRem removes members from a set and returns how many were in it
+	SRem(key string, members ...string) (int64, error)
+
+	// SIsMember reports whether member is in a set
+	SIsMember(key, member string) (bool, error)
+
+	// SMembers returns every member of a set
+	SMembers(key string) ([]string, error)
+
+	// ZAdd adds member to a sorted set, or changes its score
+	ZAdd(key, member string, score float64) error
+
+	// ZIncrBy adds by to member's score and returns the new one
+	ZIncrBy(key, member string, by float64) (float64, error)
+
+	// ZRem removes members from a sorted set and returns how many were in
+	// it
+	ZRem(key string, members ...string) (int64, error)
+
+	// ZScore returns member's score, or errKeyNotFound
+	ZScore(key, member string) (float64, error)
+
+	// ZCard returns how many members a sorted set has
+	ZCard(key string) (int64, error)
+
+	// ZRange returns the members from index start to stop, both included
+	// and negative counting from the end, lowest score first or highest
+	// first if reverse
+	ZRange(key string, start, stop int64, reverse bool) ([]ScoredMember, error)
+
+	// ZRangeByScore returns up to count members, or every one if count is
+	// 0, scoring at most max, lowest first
+	ZRangeByScore(key string, max float64, count int64) ([]string, error)
+
+	// ZPopMin removes and returns the count lowest scoring members
+	ZPopMin(key string, count int64) ([]ScoredMember, error)
+
+	// LRange returns the elements of a list from index start to stop,
+	// both included and negative counting from the end
+	LRange(key string, start, stop int64) ([]string, error)
+
+	// LLen returns how long a list is
+	LLen(key string) (int64, error)
+
+	// XRange returns up to count entries of a stream (all for 0), oldest
+	// first, starting after the entry with ID after, or at the beginning
+	// if it's ""
+	XRange(key, after string, count int64) ([]StreamEntry, error)
+
+	// TakeToken takes a token from a rate limiter's bucket and reports
+	// whether there was one; see takeTokenScript
+	TakeToken(key string, rate float64, burst int, now time.Time) (bool, error)
+
+	// SAddCapped adds member to a set unless that takes it over limit, or
+	// 0 for none, and extends the set's lifetime to at least ttl; see
+	// trackOwnerScript
+	SAddCapped(key, member string, limit int, ttl time.Duration) (bool, error)
+
+	// HSwap replaces a hash field, or removes it if value is "", as long
+	// as it still holds old, and reports whether it did; see
+	// decideAnswerScript
+	HSwap(key, field, old, value string) (bool, error)
+
+	// Batch applies the writes fn makes to b as one atomic step, except
+	// across the nodes of a Redis Cluster
+	Batch(fn func(b KeyBatch)) error
+
+	// Scan hands fn the keys starting with prefix a batch at a time,
+	// stopping once about limit were seen. It returns how many were and
+	// whether it stopped short.
+	Scan(prefix string, limit int, fn func(keys []string) error) (int, bool, error)
+
+	// Expired delivers the keys starting with prefix as they expire, until
+	// ctx is cancelled. Several instances may be told about the same key.
+	Expired(ctx context.Context, prefix string) <-chan string
+
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+}
+
+// KeyBatch collects the writes of a KeyStore batch
+type KeyBatch interface {
+	Set(key, value string, ttl time.Duration)
+	Del(keys ...string)
+	Expire(key string, ttl time.Duration)
+	ExpireAt(key string, at time.Time)
+	HSet(key string, values map[string]interface{})
+	HIncrBy(key, field string, by int64)
+	HDel(key string, fields ...string)
+	SAdd(key string, members ...string)
+	ZAdd(key, member string, score float64)
+	ZIncrBy(key, member string, by float64)
+	ZRem(key string, members ...string)
+	LPush(key, value string)
+	LTrim(key string, start, stop int64)
+	XAdd(key string, values map[string]interface{})
+}
+
+// ScoredMember is a member of a sorted set with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// StreamEntry is an entry of a stream
+type StreamEntry struct {
+	ID     string
+	Values map[string]string
+}
+
+// errKeyNotFound is returned for a key, field or member that doesn't exist
+var errKeyNotFound = errors.New("key not found")
+
+// kv is the key-value store used by the handlers; main sets it up along
+// with store
+var kv KeyStore
+
+// fieldString formats a field value the way go-redis writes it to a hash
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Duration:
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// fieldStrings formats every value of a field map
+func fieldStrings(fields map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(fields))
+	for field, value := range fields {
+		out[field] = fieldString(value)
+	}
+	return out
+}
+
+// expiryWatchers hands the keys a store expires itself to its Expired
+// subscriptions. The zero value is ready to use.
+type expiryWatchers struct {
+	mu       sync.Mutex
+	watchers map[*expiryWatcher]bool
+}
+
+// expiryWatcher is an Expired subscription
+type expiryWatcher struct {
+	ctx    context.Context
+	prefix string
+	out    chan string
+}
+
+// watch subscribes to the expired keys starting with prefix until ctx is
+// done
+func (e *expiryWatchers) watch(ctx context.Context, prefix string) <-chan string {
+	w := &expiryWatcher{ctx: ctx, prefix: prefix, out: make(chan string)}
+	e.mu.Lock()
+	if e.watchers == nil {
+		e.watchers = make(map[*expiryWatcher]bool)
+	}
+	e.watchers[w] = true
+	e.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		delete(e.watchers, w)
+		close(w.out)
+		e.mu.Unlock()
+	}()
+	return w.out
+}
+
+// notify hands expired keys to the subscriptions they match
+func (e *expiryWatchers) notify(keys []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, key := range keys {
+		for w := range e.watchers {
+			if !strings.HasPrefix(key, w.prefix) {
+				continue
+			}
+			select {
+			case w.out <- key:
+			case <-w.ctx.Done():
+			}
+		}
+	}
+}
+
+// redisKeys keeps the keys in Redis
+type redisKeys struct {
+	client redis.UniversalClient
+}
+
+// keyResult maps a nil reply to errKeyNotFound
+func keyResult[T any](value T, err error) (T, error) {
+	if err == redis.Nil {
+		return value, errKeyNotFound
+	}
+	return value, err
+}
+
+// interfaces converts members to the arguments go-redis takes
+func interfaces(members []string) []interface{} {
+	args := make([]interface{}, len(members))
+	for i, member := range members {
+		args[i] = member
+	}
+	return args
+}
+
+// scoredMembers converts a go-redis sorted set reply
+func scoredMembers(entries []redis.Z) []ScoredMember {
+	members := make([]ScoredMember, len(entries))
+	for i, entry := range entries {
+		members[i] = ScoredMember{Member: fmt.Sprint(entry.Member), Score: entry.Score}
+	}
+	return members
+}
+
+func (k *redisKeys) Get(key string) (string, error) {
+	return keyResult(k.client.Get(ctx, key).Result())
+}
+
+func (k *redisKeys) Set(key, value string, ttl time.Duration) error {
+	return k.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (k *redisKeys) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return k.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (k *redisKeys) GetDel(key string) (string, error) {
+	return keyResult(k.client.GetDel(ctx, key).Result())
+}
+
+func (k *redisKeys) Del(keys ...string) error {
+	// One key per command, since a cluster rejects multi-key commands
+	// spanning slots
+	pipe := k.client.Pipeline()
+	for _, key := range keys {
+		pipe.Unlink(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (k *redisKeys) Expire(key string, ttl time.Duration) error {
+	return k.client.PExpire(ctx, key, ttl).Err()
+}
+
+func (k *redisKeys) TTL(key string) (time.Duration, error) {
+	return k.client.PTTL(ctx, key).Result()
+}
+
+func (k *redisKeys) HGet(key, field string) (string, error) {
+	return keyResult(k.client.HGet(ctx, key, field).Result())
+}
+
+func (k *redisKeys) HGetAll(key string) (map[string]string, error) {
+	return k.client.HGetAll(ctx, key).Result()
+}
+
+func (k *redisKeys) HMGet(key string, fields ...string) (map[string]string, error) {
+	values, err := k.client.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(fields))
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			out[fields[i]] = value
+		}
+	}
+	return out, nil
+}
+
+func (k *redisKeys) HSet(key string, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return k.client.HSet(ctx, key, values).Err()
+}
+
+func (k *redisKeys) HSetNX(key, field string, value interface{}) (bool, error) {
+	return k.client.HSetNX(ctx, key, field, value).Result()
+}
+
+func (k *redisKeys) HDel(key string, fields ...string) (int64, error) {
+	return k.client.HDel(ctx, key, fields...).Result()
+}
+
+func (k *redisKeys) HLen(key string) (int64, error) {
+	return k.client.HLen(ctx, key).Result()
+}
+
+func (k *redisKeys) HIncrBy(key, field string, by int64) (int64, error) {
+	return k.client.HIncrBy(ctx, key, field, by).Result()
+}
+
+func (k *redisKeys) SAdd(key string, members ...string) (int64, error) {
+	return k.client.SAdd(ctx, key, interfaces(members)...).Result()
+}
+
+func (k *redisKeys) SRem(key string, members ...string) (int64, error) {
+	return k.client.SRem(ctx, key, interfaces(members)...).Result()
+}
+
+func (k *redisKeys) SIsMember(key, member string) (bool, error) {
+	return k.client.SIsMember(ctx, key, member).Result()
+}
+
+func (k *redisKeys) SMembers(key string) ([]string, error) {
+	return k.client.SMembers(ctx, key).Result()
+}
+
+func (k *redisKeys) ZAdd(key, member string, score float64) error {
+	return k.client.ZAdd(ctx, key, &redis.Z{Score: score, Member: member}).Err()
+}
+
+func (k *redisKeys) ZIncrBy(key, member string, by float64) (float64, error) {
+	return k.client.ZIncrBy(ctx, key, by, member).Result()
+}
+
+func (k *redisKeys) ZRem(key string, members ...string) (int64, error) {
+	return k.client.ZRem(ctx, key, interfaces(members)...).Result()
+}
+
+func (k *redisKeys) ZScore(key, member string) (float64, error) {
+	return keyResult(k.client.ZScore(ctx, key, member).Result())
+}
+
+func (k *redisKeys) ZCard(key string) (int64, error) {
+	return k.client.ZCard(ctx, key).Result()
+}
+
+func (k *redisKeys) ZRange(key string, start, stop int64, reverse bool) ([]ScoredMember, error) {
+	var entries []redis.Z
+	var err error
+	if reverse {
+		entries, err = k.client.ZRevRangeWithScores(ctx, key, start, stop).Result()
+	} else {
+		entries, err = k.client.ZRangeWithScores(ctx, key, start, stop).Result()
+	}
+	return scoredMembers(entries), err
+}
+
+func (k *redisKeys) ZRangeByScore(key string, max float64, count int64) ([]string, error) {
+	return k.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(max, 'f', -1, 64),
+		Count: count,
+	}).Result()
+}
+
+func (k *redisKeys) ZPopMin(key string, count int64) ([]ScoredMember, error) {
+	entries, err := k.client.ZPopMin(ctx, key, count).Result()
+	return scoredMembers(entries), err
+}
+
+func (k *redisKeys) LRange(key string, start, stop int64) ([]string, error) {
+	return k.client.LRange(ctx, key, start, stop).Result()
+}
+
+func (k *redisKeys) LLen(key string) (int64, error) {
+	return k.client.LLen(ctx, key).Result()
+}
+
+func (k *redisKeys) XRange(key, after string, count int64) ([]StreamEntry, error) {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	var messages []redis.XMessage
+	var err error
+	if count > 0 {
+		messages, err = k.client.XRangeN(ctx, key, start, "+", count).Result()
+	} else {
+		messages, err = k.client.XRange(ctx, key, start, "+").Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StreamEntry, len(messages))
+	for i, msg := range messages {
+		entries[i] = StreamEntry{ID: msg.ID, Values: make(map[string]string, len(msg.Values))}
+		for field, value := range msg.Values {
+			entries[i].Values[field] = fmt.Sprint(value)
+		}
+	}
+	return entries, nil
+}
+
+func (k *redisKeys) TakeToken(key string, rate float64, burst int, now time.Time) (bool, error) {
+	allowed, err := takeTokenScript.Run(ctx, k.client, []string{key}, rate, burst, now.UnixMilli()).Int()
+	return allowed == 1, err
+}
+
+func (k *redisKeys) SAddCapped(key, member string, limit int, ttl time.Duration) (bool, error) {
+	added, err := trackOwnerScript.Run(ctx, k.client, []string{key}, member, limit, ttl.Milliseconds()).Int()
+	return added == 1, err
+}
+
+func (k *redisKeys) HSwap(key, field, old, value string) (bool, error) {
+	swapped, err := decideAnswerScript.Run(ctx, k.client, []string{key}, field, old, value).Int()
+	return swapped == 1, err
+}
+
+func (k *redisKeys) Batch(fn func(b KeyBatch)) error {
+	pipe := k.client.TxPipeline()
+	fn(redisBatch{pipe})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (k *redisKeys) Scan(prefix string, limit int, fn func(keys []string) error) (int, bool, error) {
+	return scanKeys(k.client, prefix+"*", 500, limit, fn)
+}
+
+// expiredEvents is the keyspace notification channel for expired keys, in
+// every database
+const expiredEvents = "__keyevent@*__:expired"
+
+// Expired relies on keyspace notifications, which are fire-and-forget and,
+// on a cluster, only arrive from the node subscribed on
+func (k *redisKeys) Expired(ctx context.Context, prefix string) <-chan string {
+	if configureKeyspaceEvents {
+		if err := k.enableExpiredEvents(); err != nil {
+			logger.Warn("Failed to enable keyspace notifications", "error", err)
+		}
+	}
+	out := make(chan string)
+	sub := k.client.PSubscribe(ctx, expiredEvents)
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+	}()
+	go func() {
+		defer close(out)
+		for msg := range sub.Channel() {
+			if !strings.HasPrefix(msg.Payload, prefix) {
+				continue
+			}
+			select {
+			case out <- msg.Payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// enableExpiredEvents adds expired-key events to the notifications Redis
+// sends, keeping the ones already on
+func (k *redisKeys) enableExpiredEvents() error {
+	current, err := k.client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if len(current) == 2 {
+		flags, _ = current[1].(string)
+	}
+	// "A" stands for every event class, "x" included
+	keyevents := strings.ContainsRune(flags, 'E')
+	expired := strings.ContainsAny(flags, "xA")
+	if keyevents && expired {
+		return nil
+	}
+	if !keyevents {
+		flags += "E"
+	}
+	if !expired {
+		flags += "x"
+	}
+	return k.client.ConfigSet(ctx, "notify-keyspace-events", flags).Err()
+}
+
+func (k *redisKeys) Ping(ctx context.Context) error {
+	return k.client.Ping(ctx).Err()
+}
+
+// redisBatch queues a batch's writes on a transaction
+type redisBatch struct {
+	pipe redis.Pipeliner
+}
+
+func (b redisBatch) Set(key, value string, ttl time.Duration) {
+	b.pipe.Set(ctx, key, value, ttl)
+}
+
+func (b redisBatch) Del(keys ...string) {
+	for _, key := range keys {
+		b.pipe.Unlink(ctx, key)
+	}
+}
+
+func (b redisBatch) Expire(key string, ttl time.Duration) {
+	b.pipe.PExpire(ctx, key, ttl)
+}
+
+func (b redisBatch) ExpireAt(key string, at time.Time) {
+	b.pipe.ExpireAt(ctx, key, at)
+}
+
+func (b redisBatch) HSet(key string, values map[string]interface{}) {
+	if len(values) > 0 {
+		b.pipe.HSet(ctx, key, values)
+	}
+}
+
+func (b redisBatch) HIncrBy(key, field string, by int64) {
+	b.pipe.HIncrBy(ctx, key, field, by)
+}
+
+func (b redisBatch) HDel(key string, fields ...string) {
+	b.pipe.HDel(ctx, key, fields...)
+}
+
+func (b redisBatch) SAdd(key string, members ...string) {
+	b.pipe.SAdd(ctx, key, interfaces(members)...)
+}
+
+func (b redisBatch) ZAdd(key, member string, score float64) {
+	b.pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: member})
+}
+
+func (b redisBatch) ZIncrBy(key, member string, by float64) {
+	b.pipe.ZIncrBy(ctx, key, by, member)
+}
+
+func (b redisBatch) ZRem(key string, members ...string) {
+	b.pipe.ZRem(ctx, key, interfaces(members)...)
+}
+
+func (b redisBatch) LPush(key, value string) {
+	b.pipe.LPush(ctx, key, value)
+}
+
+func (b redisBatch) LTrim(key string, start, stop int64) {
+	b.pipe.LTrim(ctx, key, start, stop)
+}
+
+func (b redisBatch) XAdd(key string, values map[string]interface{}) {
+	b.pipe.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: values})
+}
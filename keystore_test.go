@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// eachKeyStore runs a test against every KeyStore, so the in-memory and
+// PostgreSQL stores keep behaving like Redis. PostgreSQL is only tested
+// with TEST_POSTGRES_URL set, and its key tables are emptied first.
+func eachKeyStore(t *testing.T, test func(t *testing.T, keys KeyStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryKeys())
+	})
+	t.Run("redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		test(t, &redisKeys{client: client})
+	})
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("TEST_POSTGRES_URL")
+		if url == "" {
+			t.Skip("TEST_POSTGRES_URL is not set")
+		}
+		db, err := pgxpool.New(ctx, url)
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		t.Cleanup(db.Close)
+		keys, err := newPostgresKeys(ctx, db)
+		if err != nil {
+			t.Fatalf("creating the tables: %v", err)
+		}
+		if _, err := db.Exec(ctx, "TRUNCATE kv_keys CASCADE"); err != nil {
+			t.Fatalf("emptying the tables: %v", err)
+		}
+		test(t, keys)
+	})
+}
+
+func TestKeyStoreStrings(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		if _, err := keys.Get("code"); err != errKeyNotFound {
+			t.Fatalf("Get of a missing key: %v, want errKeyNotFound", err)
+		}
+		if claimed, err := keys.SetNX("code", "p1", time.Hour); err != nil || !claimed {
+			t.Fatalf("first SetNX: %v, %v", claimed, err)
+		}
+		if claimed, _ := keys.SetNX("code", "p2", time.Hour); claimed {
+			t.Fatal("second SetNX claimed a taken key")
+		}
+		if ttl, _ := keys.TTL("code"); ttl <= 59*time.Minute {
+			t.Errorf("TTL = %v, want about an hour", ttl)
+		}
+		if value, err := keys.GetDel("code"); err != nil || value != "p1" {
+			t.Fatalf("GetDel = %q, %v; want p1", value, err)
+		}
+		if ttl, _ := keys.TTL("code"); ttl != -2 {
+			t.Errorf("TTL of a deleted key = %v, want -2", ttl)
+		}
+
+		keys.Set("plain", "x", 0)
+		if ttl, _ := keys.TTL("plain"); ttl != -1 {
+			t.Errorf("TTL of a key without expiry = %v, want -1", ttl)
+		}
+	})
+}
+
+func TestKeyStoreHashes(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		keys.HSet("h", map[string]interface{}{"a": 1, "b": true, "c": "x"})
+		if got, _ := keys.HMGet("h", "a", "b", "missing"); len(got) != 2 || got["a"] != "1" || got["b"] != "1" {
+			t.Fatalf("HMGet = %v, want a=1 b=1 and nothing for missing", got)
+		}
+		if n, _ := keys.HIncrBy("h", "a", 4); n != 5 {
+			t.Errorf("HIncrBy = %d, want 5", n)
+		}
+		if set, _ := keys.HSetNX("h", "c", "y"); set {
+			t.Error("HSetNX overwrote a field")
+		}
+
+		if swapped, _ := keys.HSwap("h", "c", "wrong", "y"); swapped {
+			t.Error("HSwap swapped from the wrong value")
+		}
+		if swapped, _ := keys.HSwap("h", "c", "x", "y"); !swapped {
+			t.Error("HSwap didn't swap from the current value")
+		}
+		if value, _ := keys.HGet("h", "c"); value != "y" {
+			t.Errorf("c = %q after the swap, want y", value)
+		}
+
+		if removed, _ := keys.HDel("h", "a", "b", "c"); removed != 3 {
+			t.Errorf("HDel removed %d, want 3", removed)
+		}
+		if _, err := keys.HGet("h", "c"); err != errKeyNotFound {
+			t.Errorf("HGet of a deleted field: %v, want errKeyNotFound", err)
+		}
+		if ttl, _ := keys.TTL("h"); ttl != -2 {
+			t.Error("an emptied hash still exists")
+		}
+	})
+}
+
+func TestKeyStoreSortedSets(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		keys.Batch(func(b KeyBatch) {
+			b.ZAdd("z", "c", 30)
+			b.ZAdd("z", "a", 10)
+			b.ZAdd("z", "b", 20)
+			b.ZIncrBy("z", "a", 15)
+		})
+		top, _ := keys.ZRange("z", 0, 1, true)
+		if len(top) != 2 || top[0] != (ScoredMember{"c", 30}) || top[1] != (ScoredMember{"a", 25}) {
+			t.Fatalf("reverse ZRange = %v, want c 30 then a 25", top)
+		}
+		if due, _ := keys.ZRangeByScore("z", 25, 0); len(due) != 2 || due[0] != "b" || due[1] != "a" {
+			t.Fatalf("ZRangeByScore up to 25 = %v, want [b a]", due)
+		}
+		if due, _ := keys.ZRangeByScore("z", 100, 1); len(due) != 1 || due[0] != "b" {
+			t.Fatalf("ZRangeByScore with count 1 = %v, want [b]", due)
+		}
+		if popped, _ := keys.ZPopMin("z", 1); len(popped) != 1 || popped[0].Member != "b" {
+			t.Fatalf("ZPopMin = %v, want b", popped)
+		}
+		if n, _ := keys.ZCard("z"); n != 2 {
+			t.Errorf("ZCard = %d after a pop, want 2", n)
+		}
+		if _, err := keys.ZScore("z", "b"); err != errKeyNotFound {
+			t.Errorf("ZScore of a popped member: %v, want errKeyNotFound", err)
+		}
+	})
+}
+
+func TestKeyStoreListsAndStreams(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		for _, comment := range []string{"one", "two", "three"} {
+			keys.Batch(func(b KeyBatch) {
+				b.LPush("l", comment)
+				b.LTrim("l", 0, 1)
+			})
+		}
+		if list, _ := keys.LRange("l", 0, -1); len(list) != 2 || list[0] != "three" || list[1] != "two" {
+			t.Fatalf("LRange = %v, want [three two]", list)
+		}
+
+		for _, action := range []string{"create", "close", "delete"} {
+			keys.Batch(func(b KeyBatch) {
+				b.XAdd("s", map[string]interface{}{"action": action})
+			})
+		}
+		first, _ := keys.XRange("s", "", 1)
+		if len(first) != 1 || first[0].Values["action"] != "create" {
+			t.Fatalf("first entry = %v, want create", first)
+		}
+		rest, _ := keys.XRange("s", first[0].ID, 0)
+		if len(rest) != 2 || rest[0].Values["action"] != "close" || rest[1].Values["action"] != "delete" {
+			t.Fatalf("entries after %s = %v, want close then delete", first[0].ID, rest)
+		}
+	})
+}
+
+func TestKeyStoreSAddCapped(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		if added, _ := keys.SAddCapped("owner", "p1", 2, time.Hour); !added {
+			t.Fatal("first member refused")
+		}
+		if added, _ := keys.SAddCapped("owner", "p2", 2, time.Minute); !added {
+			t.Fatal("second member refused")
+		}
+		if added, _ := keys.SAddCapped("owner", "p3", 2, time.Hour); added {
+			t.Fatal("third member taken over the cap")
+		}
+		if members, _ := keys.SMembers("owner"); len(members) != 2 {
+			t.Fatalf("members %v, want the first two", members)
+		}
+		if ttl, _ := keys.TTL("owner"); ttl <= 59*time.Minute {
+			t.Errorf("TTL = %v after a shorter member, want the longest", ttl)
+		}
+	})
+}
+
+func TestKeyStoreTakeToken(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			if allowed, err := keys.TakeToken("bucket", 1, 2, now); err != nil || !allowed {
+				t.Fatalf("token %d: %v, %v", i+1, allowed, err)
+			}
+		}
+		if allowed, _ := keys.TakeToken("bucket", 1, 2, now); allowed {
+			t.Fatal("took a token from an empty bucket")
+		}
+		if allowed, _ := keys.TakeToken("bucket", 1, 2, now.Add(time.Second)); !allowed {
+			t.Fatal("no token a second later at one per second")
+		}
+	})
+}
+
+func TestKeyStoreScan(t *testing.T) {
+	eachKeyStore(t, func(t *testing.T, keys KeyStore) {
+		keys.Set("session:a", "1", 0)
+		keys.Set("session:b", "1", 0)
+		keys.Set("other", "1", 0)
+		var found []string
+		scanned, truncated, err := keys.Scan("session:", 100, func(batch []string) error {
+			found = append(found, batch...)
+			return nil
+		})
+		if err != nil || truncated || scanned != 2 || len(found) != 2 {
+			t.Fatalf("Scan found %v (%d, truncated %v, %v), want the two sessions", found, scanned, truncated, err)
+		}
+	})
+}
+
+func TestMemoryKeysExpired(t *testing.T) {
+	keys := newMemoryKeys()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expired := keys.Expired(ctx, "freeze:")
+
+	keys.Set("freeze:p1", "1", time.Millisecond)
+	keys.Set("other", "1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := keys.Get("freeze:p1"); err != errKeyNotFound {
+		t.Fatalf("an expired key still reads: %v", err)
+	}
+
+	go keys.sweepOnce()
+	select {
+	case key := <-expired:
+		if key != "freeze:p1" {
+			t.Fatalf("got %q, want freeze:p1", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expiry not reported")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Poll lifecycle states
+const (
+	statusScheduled = "scheduled" // waiting for opens_at, no votes yet
+	statusActive    = "active"
+	statusPaused    = "paused"
+	statusClosing   = "closing" // close requested, late votes still accepted
+	statusClosed    = "closed"
+	statusDeleted   = "deleted" // only ever broadcast, never stored
+	statusExpired   = "expired" // only ever broadcast, never stored
+)
+
+// maxCloseGrace caps close_grace_seconds
+const maxCloseGrace = 300
+
+// PollEvent is broadcast to clients when a poll changes state
+type PollEvent struct {
+	Type   string `json:"type"`
+	PollID string `json:"pollId"`
+	Status string `json:"status"`
+	// ClosesAt is the unix time a closing poll becomes closed
+	ClosesAt int64 `json:"closesAt,omitempty"`
+}
+
+// pollStatus returns the lifecycle state of a poll. Polls created before
+// statuses existed have no field and are treated as active.
+func pollStatus(pollID string) (string, error) {
+	poll, err := pollFields(pollID, "status")
+	if err != nil {
+		return "", err
+	}
+	status := poll["status"]
+	if status == "" {
+		status = statusActive
+	}
+	return status, nil
+}
+
+// pausePoll handles POST /api/poll/{pollID}/pause
+func (s *Server) pausePoll(w http.ResponseWriter, r *http.Request) {
+	transitionPoll(w, r, statusActive, statusPaused, "pollPaused")
+}
+
+// resumePoll handles POST /api/poll/{pollID}/resume
+func (s *Server) resumePoll(w http.ResponseWriter, r *http.Request) {
+	transitionPoll(w, r, statusPaused, statusActive, "pollResumed")
+}
+
+// transitionPoll moves an owner's poll from one status to another and
+// broadcasts the change to connected clients
+func transitionPoll(w http.ResponseWriter, r *http.Request, from, to, event string) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	current, err := pollStatus(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if current != from {
+		http.Error(w, fmt.Sprintf("Poll is %s", current), http.StatusConflict)
+		return
+	}
+
+	setPollStatus(w, pollID, from, to, event)
+}
+
+// reopenPoll handles POST /api/poll/{pollID}/reopen. A closed poll takes
+// votes again, keeping its counts; archived polls and quizzes whose answer
+// was revealed stay closed. A scheduled close is dropped, so the poll
+// stays open until closed again.
+func (s *Server) reopenPoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	state, err := pollFields(pollID, "archived", "quiz_revealed", "status")
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if state["archived"] == "1" {
+		http.Error(w, "Poll is archived", http.StatusConflict)
+		return
+	}
+	if state["quiz_revealed"] == "1" {
+		http.Error(w, "Quiz answer was already revealed", http.StatusConflict)
+		return
+	}
+	if state["status"] == statusClosed {
+		if err := unscheduleClose(pollID); err != nil {
+			http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	transitionPoll(w, r, statusClosed, statusActive, "pollReopened")
+}
+
+// closePoll handles POST /api/poll/{pollID}/close. The owner can reopen a
+// closed poll.
+// Polls created with min_open_seconds can't be closed before that much
+// time has passed unless the owner passes ?force=true.
+//
+// Polls created with close_grace_seconds first move to closing, keep taking
+// votes for the grace window and are then closed by the scheduler. A second close
+// during the window is refused with 409, unless it passes ?force=true, which
+// ends the window immediately.
+func (s *Server) closePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	state, err := pollFields(pollID, "status", "created_at", "min_open_seconds", "close_grace_seconds")
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	switch state["status"] {
+	case statusClosed:
+		http.Error(w, "Poll is already closed", http.StatusConflict)
+		return
+	case statusClosing:
+		if !force {
+			http.Error(w, "Poll is already closing", http.StatusConflict)
+			return
+		}
+		// Cut the grace window short; when the window's end comes up the
+		// scheduler finds the poll closed and does nothing
+		if setPollStatus(w, pollID, statusClosing, statusClosed, "pollClosed") {
+			go afterClose(pollID)
+		}
+		return
+	}
+	current := state["status"]
+	if current == "" {
+		current = statusActive
+	}
+
+	if !force {
+		if remaining := minOpenRemaining(state["created_at"], state["min_open_seconds"], time.Now()); remaining > 0 {
+			http.Error(w, fmt.Sprintf("Poll must stay open for %d more seconds", int(remaining.Seconds()+0.5)), http.StatusConflict)
+			return
+		}
+	}
+
+	if grace, _ := strconv.Atoi(state["close_grace_seconds"]); grace > 0 && !force {
+		startClosing(w, pollID, current, time.Duration(grace)*time.Second)
+		return
+	}
+
+	if setPollStatus(w, pollID, current, statusClosed, "pollClosed") {
+		go afterClose(pollID)
+	}
+}
+
+// startClosing moves a poll from status from into its close grace window
+// and schedules the final close. The schedule is shared, so whichever
+// instance is up when the window ends closes the poll.
+func startClosing(w http.ResponseWriter, pollID, from string, grace time.Duration) {
+	closesAt := time.Now().Add(grace).Unix()
+	swapped, err := store.SwapPollStatus(pollID, from, statusClosing, map[string]interface{}{"closing_until": closesAt})
+	if err != nil {
+		logger.Error("Failed to update poll status", "poll_id", pollID, "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		statusChanged(w, pollID)
+		return
+	}
+
+	bumpConfigVersion(pollID)
+	logger.Info("Poll status changed", "poll_id", pollID, "status", statusClosing, "grace", grace)
+	publishEvent(pollID, PollEvent{Type: "pollClosing", PollID: pollID, Status: statusClosing, ClosesAt: closesAt})
+	if err := scheduleFinishClosing(pollID, closesAt); err != nil {
+		logger.Error("Failed to schedule the end of the grace window", "poll_id", pollID, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       pollID,
+		"status":   statusClosing,
+		"closesAt": closesAt,
+	})
+}
+
+// finishClosing ends a poll's grace window: it closes the poll, broadcasts
+// the final counts and sends the close notifications. It does nothing if
+// the poll was force-closed in the meantime.
+func finishClosing(pollID string) {
+	closed, err := store.SwapPollStatus(pollID, statusClosing, statusClosed, nil)
+	if err != nil {
+		logger.Error("Failed to finish closing poll", "poll_id", pollID, "error", err)
+		return
+	}
+	if !closed {
+		return
+	}
+
+	announceClosed(pollID)
+	publishEvent(pollID, currentUpdate(pollID))
+	afterClose(pollID)
+}
+
+// graceExpired reports whether a closing poll's window has run out, given
+// its closing_until hash value. Votes check it themselves, so one arriving
+// before the scheduler's next tick isn't counted.
+func graceExpired(closingUntil string, now time.Time) bool {
+	until, err := strconv.ParseInt(closingUntil, 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.Unix() >= until
+}
+
+// minOpenRemaining returns how long a poll must still stay open, given its
+// created_at and min_open_seconds hash values (either may be missing)
+func minOpenRemaining(createdAt, minOpen string, now time.Time) time.Duration {
+	created, err1 := strconv.ParseInt(createdAt, 10, 64)
+	seconds, err2 := strconv.Atoi(minOpen)
+	if err1 != nil || err2 != nil || seconds <= 0 {
+		return 0
+	}
+
+	openUntil := time.Unix(created, 0).Add(time.Duration(seconds) * time.Second)
+	if remaining := openUntil.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// afterClose runs what closing a poll sets off: broadcasting the final
+// results, revealing a quiz's answer, sending the close notifications and
+// showing the final counts in chat
+func afterClose(pollID string) {
+	publishFinalResults(pollID)
+	revealQuiz(pollID)
+	notifyClosed(pollID)
+	webhooksClosed(pollID)
+	scheduleSlackUpdate(pollID)
+}
+
+// markClosed closes a poll and broadcasts pollClosed
+func markClosed(pollID string) error {
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"status": statusClosed}); err != nil {
+		return err
+	}
+	announceClosed(pollID)
+	return nil
+}
+
+// announceClosed broadcasts pollClosed for a poll that was just closed
+func announceClosed(pollID string) {
+	bumpConfigVersion(pollID)
+	logger.Info("Poll status changed", "poll_id", pollID, "status", statusClosed)
+	publishEvent(pollID, PollEvent{Type: "pollClosed", PollID: pollID, Status: statusClosed})
+}
+
+// setPollStatus moves a poll from status from to status, broadcasts the
+// change and writes the response. A poll that left status from in the
+// meantime, say to a concurrent close, is answered with 409. It reports
+// whether the status was changed.
+func setPollStatus(w http.ResponseWriter, pollID, from, status, event string) bool {
+	swapped, err := store.SwapPollStatus(pollID, from, status, nil)
+	if err != nil {
+		logger.Error("Failed to update poll status", "poll_id", pollID, "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return false
+	}
+	if !swapped {
+		statusChanged(w, pollID)
+		return false
+	}
+
+	bumpConfigVersion(pollID)
+	logger.Info("Poll status changed", "poll_id", pollID, "status", status)
+	publishEvent(pollID, PollEvent{Type: event, PollID: pollID, Status: status})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     pollID,
+		"status": status,
+	})
+	return true
+}
+
+// statusChanged answers a status change that lost a race with another one
+func statusChanged(w http.ResponseWriter, pollID string) {
+	state, err := pollFields(pollID, "question", "status")
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(state) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	current := state["status"]
+	if current == "" {
+		current = statusActive
+	}
+	http.Error(w, fmt.Sprintf("Poll is %s", current), http.StatusConflict)
+}
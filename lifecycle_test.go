@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResumeAfterConcurrentClose(t *testing.T) {
+	s := newTestServer(t)
+	poll := createTestPoll(t, s, testPollRequest())
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/pause", poll.OwnerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("pause: %d %s", w.Code, w.Body)
+	}
+	// A close landing between the resume reading "paused" and writing
+	// "active" must not be undone
+	swapped, err := store.SwapPollStatus(poll.ID, statusPaused, statusClosed, nil)
+	if err != nil || !swapped {
+		t.Fatalf("closing the paused poll: %v, %v", swapped, err)
+	}
+	if swapped, err := store.SwapPollStatus(poll.ID, statusPaused, statusActive, nil); err != nil || swapped {
+		t.Fatalf("resuming the closed poll: swapped %v, %v", swapped, err)
+	}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/resume", poll.OwnerToken, nil); w.Code != http.StatusConflict {
+		t.Fatalf("resume after close: %d, want %d", w.Code, http.StatusConflict)
+	}
+	if status, _ := pollStatus(poll.ID); status != statusClosed {
+		t.Fatalf("status %s, want %s", status, statusClosed)
+	}
+}
+
+func TestSwapPollStatusWithoutStatus(t *testing.T) {
+	newTestServer(t)
+	if err := store.UpdatePoll("legacy", map[string]interface{}{"question": "Q"}); err != nil {
+		t.Fatalf("UpdatePoll: %v", err)
+	}
+	// Polls from before statuses existed are active
+	swapped, err := store.SwapPollStatus("legacy", statusActive, statusPaused, map[string]interface{}{"paused_by": "owner"})
+	if err != nil || !swapped {
+		t.Fatalf("pausing a poll without a status: %v, %v", swapped, err)
+	}
+	state, _ := pollFields("legacy", "status", "paused_by")
+	if state["status"] != statusPaused || state["paused_by"] != "owner" {
+		t.Fatalf("got %v", state)
+	}
+	if swapped, _ := store.SwapPollStatus("missing", statusActive, statusPaused, nil); swapped {
+		t.Fatal("swapped the status of a poll that doesn't exist")
+	}
+}
+
+func TestGraceWindowEndsOnAnyInstance(t *testing.T) {
+	s := newTestServer(t)
+	req := testPollRequest()
+	req.CloseGrace = 1
+	poll := createTestPoll(t, s, req)
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/close", poll.OwnerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("close: %d %s", w.Code, w.Body)
+	}
+	if status, _ := pollStatus(poll.ID); status != statusClosing {
+		t.Fatalf("status %s, want %s", status, statusClosing)
+	}
+
+	// Nothing in this process waits for the window: a scheduler pass
+	// after it ends, on this instance or another, closes the poll
+	if due := claimDue(graceScheduleKey, time.Now()); len(due) != 0 {
+		t.Fatalf("claimed %v before the window ended", due)
+	}
+	due := claimDue(graceScheduleKey, time.Now().Add(2*time.Second))
+	if len(due) != 1 || due[0] != poll.ID {
+		t.Fatalf("claimed %v, want [%s]", due, poll.ID)
+	}
+	finishClosing(poll.ID)
+	if status, _ := pollStatus(poll.ID); status != statusClosed {
+		t.Fatalf("status %s after the window, want %s", status, statusClosed)
+	}
+}
+
+func TestCloseBeforeMinOpen(t *testing.T) {
+	s := newTestServer(t)
+	req := testPollRequest()
+	req.MinOpen = 3600
+	poll := createTestPoll(t, s, req)
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/close", poll.OwnerToken, nil); w.Code != http.StatusConflict {
+		t.Fatalf("close before min_open_seconds: %d, want %d", w.Code, http.StatusConflict)
+	}
+	if status, _ := pollStatus(poll.ID); status != statusActive {
+		t.Fatalf("status %s after a refused close, want %s", status, statusActive)
+	}
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/close?force=true", poll.OwnerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("forced close before min_open_seconds: %d %s", w.Code, w.Body)
+	}
+	if status, _ := pollStatus(poll.ID); status != statusClosed {
+		t.Fatalf("status %s after a forced close, want %s", status, statusClosed)
+	}
+}
+
+func TestCloseAfterMinOpen(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/close", "/close?force=true"} {
+		req := testPollRequest()
+		req.MinOpen = 60
+		poll := createTestPoll(t, s, req)
+		// Created long enough ago
+		store.UpdatePoll(poll.ID, map[string]interface{}{"created_at": time.Now().Add(-time.Minute).Unix()})
+
+		if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+path, poll.OwnerToken, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s after min_open_seconds: %d %s", path, w.Code, w.Body)
+		}
+		if status, _ := pollStatus(poll.ID); status != statusClosed {
+			t.Fatalf("%s: status %s, want %s", path, status, statusClosed)
+		}
+	}
+}
+
+func TestMinOpenRemaining(t *testing.T) {
+	created := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		{created, time.Minute},
+		{created.Add(59 * time.Second), time.Second},
+		{created.Add(time.Minute), 0},
+		{created.Add(time.Hour), 0},
+	} {
+		if got := minOpenRemaining("1000", "60", tc.now); got != tc.want {
+			t.Errorf("at %v: %v, want %v", tc.now.Sub(created), got, tc.want)
+		}
+	}
+	if got := minOpenRemaining("1000", "", created); got != 0 {
+		t.Errorf("without min_open_seconds: %v, want 0", got)
+	}
+}
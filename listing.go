@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// PollListing is one entry of GET /api/polls
+type PollListing struct {
+	ID            string `json:"id"`
+	Question      string `json:"question"`
+	Status        string `json:"status"`
+	CreatedAt     int64  `json:"created_at,omitempty"`
+	Featured      bool   `json:"featured,omitempty"`
+	FeatureWeight int    `json:"feature_weight,omitempty"`
+	Archived      bool   `json:"archived,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"` // creator listings only
+}
+
+// PollListResponse is the body of GET /api/polls
+type PollListResponse struct {
+	Polls []PollListing `json:"polls"`
+}
+
+// featuredPollsKey is the Redis set of featured poll IDs, the only polls
+// the public listing shows
+const featuredPollsKey = "featured:polls"
+
+// listingCacheTTL is how long an instance reuses the public listing
+var listingCacheTTL = envDuration("LISTING_CACHE_TTL", 5*time.Second)
+
+// listingCache holds the public listing an instance built last, with and
+// without archived polls
+var listingCache struct {
+	sync.Mutex
+	builtAt map[bool]time.Time
+	polls   map[bool][]PollListing
+}
+
+// FeatureRequest is the optional body of POST /api/poll/{pollID}/feature
+type FeatureRequest struct {
+	Weight int `json:"weight"` // higher sorts first among featured polls
+}
+
+// listPolls handles GET /api/polls?limit=N, which lists the featured
+// polls, heaviest first. Archived polls are left out unless
+// ?include_archived=true. With ?mine=true it lists the requester's own
+// polls instead. Poll IDs are the links to vote with, so polls that
+// aren't featured never show up, and neither do private ones.
+func (s *Server) listPolls(w http.ResponseWriter, r *http.Request) {
+	if mine, _ := strconv.ParseBool(r.URL.Query().Get("mine")); mine {
+		s.listCreatorPolls(w, r)
+		return
+	}
+
+	limit := defaultListLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	includeArchived, _ := strconv.ParseBool(r.URL.Query().Get("include_archived"))
+
+	polls, err := cachedListing(includeArchived)
+	if err != nil {
+		requestLogger(r).Error("Failed to list polls", "error", err)
+		http.Error(w, "Failed to list polls", http.StatusInternalServerError)
+		return
+	}
+
+	if len(polls) > limit {
+		polls = polls[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PollListResponse{Polls: polls})
+}
+
+// sortListing orders polls by featured flag, then weight, then recency.
+// The ID is the final key so the order doesn't depend on set order.
+func sortListing(polls []PollListing) {
+	sort.SliceStable(polls, func(i, j int) bool {
+		a, b := polls[i], polls[j]
+		if a.Featured != b.Featured {
+			return a.Featured
+		}
+		if a.Featured && a.FeatureWeight != b.FeatureWeight {
+			return a.FeatureWeight > b.FeatureWeight
+		}
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+		return a.ID < b.ID
+	})
+}
+
+// cachedListing returns the public listing, sorted, building it at most
+// once per listingCacheTTL on each instance
+func cachedListing(includeArchived bool) ([]PollListing, error) {
+	listingCache.Lock()
+	defer listingCache.Unlock()
+	if time.Since(listingCache.builtAt[includeArchived]) < listingCacheTTL {
+		return listingCache.polls[includeArchived], nil
+	}
+
+	polls, err := featuredPolls(includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	sortListing(polls)
+	if listingCache.builtAt == nil {
+		listingCache.builtAt = make(map[bool]time.Time)
+		listingCache.polls = make(map[bool][]PollListing)
+	}
+	listingCache.builtAt[includeArchived] = time.Now()
+	listingCache.polls[includeArchived] = polls
+	return polls, nil
+}
+
+// forgetCachedListing makes the next listing on this instance start over,
+// after a poll was featured or unfeatured here
+func forgetCachedListing() {
+	listingCache.Lock()
+	listingCache.builtAt = nil
+	listingCache.polls = nil
+	listingCache.Unlock()
+}
+
+// featuredPolls loads the listing fields of the featured polls. Polls
+// that expired or were deleted are pruned from the set on the way.
+func featuredPolls(includeArchived bool) ([]PollListing, error) {
+	ids, err := kv.SMembers(featuredPollsKey)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	data, err := store.GetPolls(ids, append(listingFields, privateFields...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var polls []PollListing
+	var gone []string
+	for i, id := range ids {
+		listing, ok := parseListing(id, data[i])
+		if !ok || !listing.Featured {
+			gone = append(gone, id)
+			continue
+		}
+		if !privatePoll(data[i]) && (includeArchived || !listing.Archived) {
+			polls = append(polls, listing)
+		}
+	}
+	if len(gone) > 0 {
+		kv.SRem(featuredPollsKey, gone...)
+	}
+	return polls, nil
+}
+
+// privateFields are the poll fields that make a poll private
+var privateFields = []string{"require_invite", "voter_hash", "require_sign_in", "ballot_tokens", "hide_results"}
+
+// privatePoll reports whether a poll is meant only for the people its
+// links were shared with: polls taking votes by invite, voter link, ballot
+// token or sign-in, and polls hiding their results. They're never listed.
+func privatePoll(data map[string]string) bool {
+	return data["require_invite"] == "1" || data["voter_hash"] != "" || data["require_sign_in"] == "1" ||
+		data["ballot_tokens"] == "1" || data["hide_results"] == "1"
+}
+
+// listingFields are the poll fields a listing entry is built from
+var listingFields = []string{"question", "status", "created_at", "featured", "feature_weight", "archived"}
+
+// parseListing builds a listing entry from the listingFields of a poll,
+// skipping polls that expired between the scan and the fetch
+func parseListing(pollID string, data map[string]string) (PollListing, bool) {
+	if data["question"] == "" {
+		return PollListing{}, false
+	}
+	status := data["status"]
+	if status == "" {
+		status = statusActive
+	}
+
+	listing := PollListing{
+		ID:       pollID,
+		Question: data["question"],
+		Status:   status,
+		Featured: data["featured"] == "1",
+		Archived: data["archived"] == "1",
+	}
+	listing.CreatedAt, _ = strconv.ParseInt(data["created_at"], 10, 64)
+	listing.FeatureWeight, _ = strconv.Atoi(data["feature_weight"])
+	return listing, true
+}
+
+// featurePoll handles POST /api/poll/{pollID}/feature
+func (s *Server) featurePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	var req FeatureRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, _ := store.GetPoll(pollID)
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if privatePoll(data) {
+		http.Error(w, "Private polls can't be featured", http.StatusConflict)
+		return
+	}
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"featured": "1", "feature_weight": req.Weight}); err != nil {
+		requestLogger(r).Error("Failed to feature poll", "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+	if _, err := kv.SAdd(featuredPollsKey, pollID); err != nil {
+		requestLogger(r).Error("Failed to feature poll", "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+	forgetCachedListing()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":             pollID,
+		"featured":       true,
+		"feature_weight": req.Weight,
+	})
+}
+
+// unfeaturePoll handles POST /api/poll/{pollID}/unfeature
+func (s *Server) unfeaturePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	if data, _ := store.GetPoll(pollID); len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if err := store.UpdatePoll(pollID, nil, "featured", "feature_weight"); err != nil {
+		requestLogger(r).Error("Failed to unfeature poll", "error", err)
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+	kv.SRem(featuredPollsKey, pollID)
+	forgetCachedListing()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       pollID,
+		"featured": false,
+	})
+}
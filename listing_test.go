@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// listedPolls returns the IDs GET /api/polls lists
+func listedPolls(t *testing.T, s *Server) []string {
+	t.Helper()
+	forgetCachedListing()
+	w := apiRequest(t, s, http.MethodGet, "/api/polls", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	var resp PollListResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the listing: %v", err)
+	}
+	ids := make([]string, len(resp.Polls))
+	for i, poll := range resp.Polls {
+		ids[i] = poll.ID
+	}
+	return ids
+}
+
+func TestListingShowsOnlyFeaturedPolls(t *testing.T) {
+	s := newTestServer(t)
+	unlisted := createTestPoll(t, s, testPollRequest())
+	featured := createTestPoll(t, s, testPollRequest())
+	if ids := listedPolls(t, s); len(ids) != 0 {
+		t.Fatalf("listed %v before anything was featured", ids)
+	}
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+featured.ID+"/feature", featured.OwnerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("feature: %d %s", w.Code, w.Body)
+	}
+	if ids := listedPolls(t, s); len(ids) != 1 || ids[0] != featured.ID {
+		t.Fatalf("listed %v, want only %s and not %s", ids, featured.ID, unlisted.ID)
+	}
+
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+featured.ID+"/unfeature", featured.OwnerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("unfeature: %d %s", w.Code, w.Body)
+	}
+	if ids := listedPolls(t, s); len(ids) != 0 {
+		t.Fatalf("listed %v after unfeaturing", ids)
+	}
+}
+
+func TestListingLeavesOutPrivatePolls(t *testing.T) {
+	s := newTestServer(t)
+	for name, edit := range map[string]func(*CreatePollRequest){
+		"invite only":    func(req *CreatePollRequest) { req.InviteOnly = true },
+		"voter link":     func(req *CreatePollRequest) { req.VoterOnly = true },
+		"ballot tokens":  func(req *CreatePollRequest) { req.BallotTokens = true },
+		"hidden results": func(req *CreatePollRequest) { req.HideResults = true },
+	} {
+		req := testPollRequest()
+		edit(&req)
+		poll := createTestPoll(t, s, req)
+		if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/feature", poll.OwnerToken, nil); w.Code != http.StatusConflict {
+			t.Errorf("featuring a poll with %s: %d, want %d", name, w.Code, http.StatusConflict)
+		}
+		// Featured before it was made private
+		store.UpdatePoll(poll.ID, map[string]interface{}{"featured": "1"})
+		kv.SAdd(featuredPollsKey, poll.ID)
+	}
+	if ids := listedPolls(t, s); len(ids) != 0 {
+		t.Fatalf("listed private polls %v", ids)
+	}
+}
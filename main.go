@@ -2,165 +2,852 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	ctx      = context.Background()
-	rdb      *redis.Client
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins in development
-		},
+		CheckOrigin: checkOrigin,
+		// JSON is used unless the client asks for protobuf
+		Subprotocols: []string{subprotocolJSON, subprotocolProtobuf, subprotocolJSONBatch},
 	}
-
-	// WebSocket connection management
-	connections = make(map[string]map[*websocket.Conn]bool)
-	connMutex   sync.RWMutex
 )
 
+// wsClient wraps a WebSocket connection. Broadcasts and direct replies are
+// queued on send and written by the connection's write pump, so they
+// never write to the connection concurrently or wait for each other.
+type wsClient struct {
+	conn         *websocket.Conn
+	send         chan wsFrame
+	done         chan struct{} // closed when the write pump exits
+	fullSince    atomic.Int64  // when send last filled up, in Unix nanoseconds
+	evicted      atomic.Bool
+	protobuf     bool           // vote updates are sent as binary protobuf frames
+	batch        *updateBatch   // broadcasts are queued and flushed periodically
+	confirmVotes bool           // votes need a voteIntent/voteConfirm round-trip
+	pending      *pendingIntent // vote awaiting confirmation
+
+	// With reveal_after_vote, counts are withheld until this
+	// connection's client has voted
+	revealAfterVote bool
+	revealed        atomic.Bool
+
+	// With hide_results, counts are withheld until the poll closes, and
+	// again if it is reopened
+	hideResults atomic.Bool
+	blind       bool
+
+	// Everyone sees the final tally of a closed poll
+	pollClosed atomic.Bool
+
+	// Open-text polls send their word cloud along with the counts
+	openText bool
+
+	// Reactions sent in the current second, against reactionsPerSecond
+	reactionSecond int64
+	reactionCount  int
+
+	// With require_captcha, the first vote must carry a verified token
+	requireCaptcha bool
+	captchaPassed  atomic.Bool
+
+	// The signed voter cookie and fingerprint the connection opened with,
+	// for the lenient and strict dedup policies, and the account it signed
+	// in as, for require_sign_in polls
+	voterCookie string
+	fingerprint string
+	account     string
+
+	// log tags lines with the upgrade request's ID, IP and poll
+	log *slog.Logger
+}
+
+// writeJSON queues a JSON message for the client
+func (c *wsClient) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(websocket.TextMessage, data)
+}
+
+// writeText queues an already-encoded text message for the client
+func (c *wsClient) writeText(data []byte) error {
+	return c.enqueue(websocket.TextMessage, data)
+}
+
+// writeBinary queues an already-encoded binary message for the client
+func (c *wsClient) writeBinary(data []byte) error {
+	return c.enqueue(websocket.BinaryMessage, data)
+}
+
+// canSeeResults reports whether real vote counts may be sent to the client
+func (c *wsClient) canSeeResults() bool {
+	if c.hideResults.Load() {
+		return false
+	}
+	return !c.revealAfterVote || c.revealed.Load() || c.pollClosed.Load()
+}
+
+// afterVote reveals the results to a client on a reveal_after_vote poll as
+// soon as its vote is in (or turns out to have been in already)
+func (c *wsClient) afterVote(pollID, status string) {
+	if !c.revealAfterVote || (status != voteOK && status != voteDuplicate) {
+		return
+	}
+	if c.revealed.CompareAndSwap(false, true) {
+		sendCurrentVotes(c, pollID)
+	}
+}
+
+// sendUpdate sends vote counts in the format negotiated by the client
+func (c *wsClient) sendUpdate(msg UpdateMessage) error {
+	if c.protobuf {
+		return c.writeBinary(marshalUpdateProto(msg))
+	}
+	return c.writeJSON(msg)
+}
+
 // Poll represents a poll structure
 type Poll struct {
-	ID       string            `json:"id"`
-	Question string            `json:"question"`
-	Options  map[string]string `json:"options"`
-	Votes    map[string]int    `json:"votes"`
+	ID            string             `json:"id"`
+	Question      string             `json:"question"`
+	Status        string             `json:"status"`
+	Options       map[string]string  `json:"options"`
+	Order         []string           `json:"order"`          // option IDs in display order
+	OptionDetails []PollOption       `json:"option_details"` // options with their metadata, in display order
+	Votes         map[string]int     `json:"votes,omitempty"`
+	WeightedVotes map[string]int64   `json:"weighted_votes,omitempty"`
+	Averages      map[string]float64 `json:"averages,omitempty"`  // rating polls
+	Responses     int                `json:"responses,omitempty"` // open-text polls
+	TopWords      []WordCount        `json:"top_words,omitempty"`
+	ResultsHidden bool               `json:"results_hidden,omitempty"` // counts withheld from this requester
+	Visibility    string             `json:"results_visibility"`
+	ConfirmVotes  bool               `json:"confirm_votes,omitempty"`
+	AllowRevote   bool               `json:"allow_revote,omitempty"`
+	CreatedAt     int64              `json:"created_at,omitempty"`
+	MinOpen       int                `json:"min_open_seconds,omitempty"`
+	VoterOnly     bool               `json:"require_voter_token,omitempty"`
+	SignInOnly    bool               `json:"require_sign_in,omitempty"`
+	InviteOnly    bool               `json:"require_invite,omitempty"`
+	BallotTokens  bool               `json:"ballot_tokens,omitempty"`
+	Weighted      bool               `json:"weighted,omitempty"`
+	Identified    bool               `json:"identified,omitempty"`
+	Moderated     bool               `json:"moderated,omitempty"`
+	EmailOnly     bool               `json:"email_restricted,omitempty"` // only allowed_emails may vote
+	RevealAfter   bool               `json:"reveal_after_vote,omitempty"`
+	HideResults   bool               `json:"hide_results,omitempty"`
+	Captcha       bool               `json:"require_captcha,omitempty"`
+	Segments      []string           `json:"segments,omitempty"`
+	Shuffle       bool               `json:"shuffle_options,omitempty"`
+	CloseGrace    int                `json:"close_grace_seconds,omitempty"`
+	Dedup         string             `json:"dedup"`
+	LateVotes     int                `json:"late_votes,omitempty"` // accepted while closing
+	ExpiresAt     int64              `json:"expires_at,omitempty"`
+	OpensAt       int64              `json:"opens_at,omitempty"`
+	ClosesAt      int64              `json:"closes_at,omitempty"`
+	MaxChoices    int                `json:"max_choices,omitempty"` // set on multi-select polls
+	PollType      string             `json:"poll_type"`
+	Scale         *RatingScale       `json:"scale,omitempty"` // set on rating polls
+	Archived      bool               `json:"archived,omitempty"`
+	AuditLog      bool               `json:"audit_log,omitempty"`
+	JoinCode      string             `json:"join_code,omitempty"`
+
+	// Quiz polls reveal their answer once closed
+	CorrectOptions []string `json:"correct_options,omitempty"`
+	QuizSession    string   `json:"quiz_session,omitempty"`
 }
 
 // CreatePollRequest represents the request body for creating a poll
 type CreatePollRequest struct {
-	Question string   `json:"question"`
-	Options  []string `json:"options"`
+	Question     string        `json:"question"`
+	Options      []OptionInput `json:"options"` // texts, or objects with metadata
+	ConfirmVotes bool          `json:"confirm_votes"`
+	AllowRevote  bool          `json:"allow_revote"`     // voters may change or retract their vote
+	MinOpen      int           `json:"min_open_seconds"` // close is refused before this
+	VoterOnly    bool          `json:"require_voter_token"`
+	SignInOnly   bool          `json:"require_sign_in"`     // only signed-in accounts vote, once each
+	InviteOnly   bool          `json:"require_invite"`      // only one-time invite links vote
+	BallotTokens bool          `json:"ballot_tokens"`       // only single-use anonymous ballot tokens vote
+	Weighted     bool          `json:"weighted"`            // ballots count with their token's weight
+	Identified   bool          `json:"identified"`          // voters give a name or sign in; the owner sees who voted for what
+	Moderated    bool          `json:"moderated"`           // open-text answers and questions wait for the owner's approval
+	VoterEmails  []string      `json:"allowed_emails"`      // addresses and domains of the accounts that vote
+	RevealAfter  bool          `json:"reveal_after_vote"`   // voters only see counts once they voted
+	HideResults  bool          `json:"hide_results"`        // nobody sees counts until the poll closes
+	Visibility   string        `json:"results_visibility"`  // "always", "afterVote" or "afterClose", instead of the two above
+	Captcha      bool          `json:"require_captcha"`     // voters must pass a CAPTCHA first
+	NotifyURL    string        `json:"notify_url"`          // gets the results summary on close
+	NotifyEmail  string        `json:"notify_email"`        // gets the results summary on close
+	Segments     []string      `json:"segments"`            // allowed voter segments for breakdowns
+	Shuffle      bool          `json:"shuffle_options"`     // show each voter the options in their own order
+	CloseGrace   int           `json:"close_grace_seconds"` // late votes still count this long after close
+	ExpiresIn    int           `json:"expires_in_seconds"`  // poll lifetime, 0 for POLL_TTL_DEFAULT
+	MaxChoices   int           `json:"max_choices"`         // options one ballot may select, 0 or 1 for single-choice
+	PollType     string        `json:"poll_type"`           // "single" (default), "ranked", "rating", "text" or "quiz"
+	ScaleMin     int           `json:"scale_min"`           // rating polls, defaults to 1-5
+	ScaleMax     int           `json:"scale_max"`
+	Dedup        string        `json:"dedup"`              // "client" (default), "fingerprint", "lenient", "strict" or "off"
+	QuizSession  string        `json:"quiz_session"`       // quizzes of one session share a leaderboard
+	OpensAt      int64         `json:"opens_at"`           // Unix time votes open, 0 for now
+	ClosesAt     int64         `json:"closes_at"`          // Unix time the poll closes on its own
+	AuditLog     bool          `json:"audit_log"`          // keep a record of every accepted ballot
+	Webhooks     []string      `json:"webhooks"`           // get signed pollCreated, thresholdReached, pollClosed and finalResults events
+	Thresholds   []int         `json:"webhook_thresholds"` // vote totals that send thresholdReached
 }
 
-// VoteMessage represents a vote sent via WebSocket
+// VoteMessage represents a message sent by a client via WebSocket.
+// A message without a type is a plain vote.
 type VoteMessage struct {
-	Vote     string `json:"vote"`
-	ClientID string `json:"clientId"`
+	Type     string         `json:"type,omitempty"`
+	Vote     string         `json:"vote"`
+	Votes    []string       `json:"votes,omitempty"`   // multi-select ballot
+	Ratings  map[string]int `json:"ratings,omitempty"` // rating ballot
+	Answer   string         `json:"answer,omitempty"`  // open-text poll
+	ClientID string         `json:"clientId"`
+	Option   string         `json:"option,omitempty"`  // voteIntent
+	Options  []string       `json:"options,omitempty"` // multi-select voteIntent
+	Token    string         `json:"token,omitempty"`   // voteConfirm
+
+	VoterToken string `json:"voterToken,omitempty"`
+	Segment    string `json:"segment,omitempty"`
+	Player     string `json:"player,omitempty"` // name on a quiz leaderboard
+	Name       string `json:"name,omitempty"`   // voter's name on identified polls
+	Reaction   string `json:"reaction,omitempty"`
+
+	// CaptchaToken is the provider response token on require_captcha polls
+	CaptchaToken string `json:"captchaToken,omitempty"`
+
+	// MsgID is an optional client-chosen ID echoed in the direct response,
+	// so clients can match acks to in-flight messages
+	MsgID string `json:"msgId,omitempty"`
+}
+
+// voteRequest is a single ballot as received from a client
+type voteRequest struct {
+	PollID     string
+	Option     string
+	Options    []string       // multi-select ballot; Option is unused when set
+	Ratings    map[string]int // rating ballot, option ID -> score
+	Answer     string         // open-text poll
+	ClientID   string
+	IP         string
+	UserAgent  string
+	VoterToken string
+	Segment    string
+	Player     string // quiz polls
+	Name       string // identified polls, unless signed in
+	ReceivedAt time.Time
+
+	VoterCookie string // ID from the signed voter cookie
+	Fingerprint string // optional browser fingerprint
+	Account     string // ID of the account the voter is signed in as
+	Chat        bool   // cast from a chat integration; IP names the chat user
+
+	Log   *slog.Logger    // logger of the request the vote came in on
+	Trace context.Context // trace the vote is part of; nil starts a new one
+}
+
+// log returns the logger for lines about the vote, falling back to one
+// tagged with the poll and IP when the vote came without one
+func (v voteRequest) log() *slog.Logger {
+	if v.Log != nil {
+		return v.Log
+	}
+	return logger.With("poll_id", v.PollID, "remote_ip", v.IP)
 }
 
 // UpdateMessage represents vote count updates
 type UpdateMessage struct {
 	Type  string         `json:"type"`
 	Votes map[string]int `json:"votes"`
+
+	// Weighted polls: each option's weighted total, next to its raw count
+	WeightedVotes map[string]int64 `json:"weighted_votes,omitempty"`
+
+	// ReceivedAt is when the vote that caused this update reached the
+	// server (Unix nanoseconds); used to measure broadcast latency
+	ReceivedAt int64 `json:"receivedAt,omitempty"`
+
+	// Hidden is set when counts are withheld from this client
+	Hidden bool `json:"hidden,omitempty"`
+
+	// Rating polls: each option's average score, and how many ratings it
+	// got at each point of the scale. Votes holds the number of ratings.
+	Averages      map[string]float64        `json:"averages,omitempty"`
+	Distributions map[string]map[string]int `json:"distributions,omitempty"`
 }
 
+// hiddenUpdate is sent instead of real counts to clients that may not see
+// the results yet
+var hiddenUpdate = UpdateMessage{Type: "voteUpdate", Votes: map[string]int{}, Hidden: true}
+
+// VoteAck tells a client what happened to its vote
+type VoteAck struct {
+	Type    string         `json:"type"`
+	Status  string         `json:"status"`
+	Option  string         `json:"option,omitempty"`
+	Options []string       `json:"options,omitempty"` // multi-select ballot
+	Ratings map[string]int `json:"ratings,omitempty"` // rating ballot
+	MsgID   string         `json:"msgId,omitempty"`   // echoed from the client message
+}
+
+// Vote outcomes reported in VoteAck.Status
+const (
+	voteOK        = "ok"
+	voteDuplicate = "duplicate"
+	votePaused    = "paused"
+	voteClosed    = "closed"
+	voteBlocked   = "blocked"
+	voteDenied    = "unauthorized"
+	voteInvalid   = "invalid"
+	voteError     = "error"
+
+	voteConfirmRequired = "confirm_required"
+	voteExpired         = "expired"
+	voteCaptchaFailed   = "captcha_failed"
+	voteNotVoted        = "not_voted" // nothing to retract
+	voteNotOpen         = "not_open"  // scheduled poll before opens_at
+	voteRateLimited     = "rate_limited"
+	voteClientInvalid   = "invalid_client" // clientId wasn't issued by the server
+	voteClientExpired   = "client_expired" // clientId needs renewing
+	voteSignInRequired  = "sign_in_required"
+	voteNameRequired    = "name_required" // identified poll, no name or account
+	voteRejected        = "rejected"      // open-text answer with a blocked word
+)
+
 func main() {
-	// Initialize Redis client
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password
-		DB:       0,  // default DB
-	})
-
-	// Test Redis connection
-	_, err := rdb.Ping(ctx).Result()
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatal("Failed to connect to Redis:", err)
+		fatal("Failed to load config", "error", err)
 	}
-	log.Println("Connected to Redis")
 
-	// Start the pub/sub listener
-	go listenToPubSub()
+	// Initialize the store and the key store beside it
+	store, kv, err = newStore(cfg)
+	if err != nil {
+		fatal("Invalid store config", "error", err)
+	}
 
-	// Set up routes
-	r := mux.NewRouter()
+	// Test the connection
+	if err := kv.Ping(ctx); err != nil {
+		fatal("Failed to connect to the store", "store", cfg.Store, "error", err)
+	}
+	if cfg.Store == "" || cfg.Store == storeRedis {
+		logger.Info("Connected to Redis", "mode", cfg.RedisMode, "addr", cfg.RedisAddr)
+	}
 
-	// API routes
-	r.HandleFunc("/api/poll", createPoll).Methods("POST")
-	r.HandleFunc("/api/poll/{pollID}", getPoll).Methods("GET")
+	// Archive polls to PostgreSQL before they expire, if configured
+	pollArchive, err = newSQLArchive(archiveDatabaseURL)
+	if err != nil {
+		fatal("Failed to connect to the archive database", "error", err)
+	}
 
-	// WebSocket route
-	r.HandleFunc("/ws/{pollID}", handleWebSocket)
+	// Export traces when an OTLP endpoint is configured
+	flushTraces := setupTracing()
 
-	// Static file routes
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+	// Start relaying updates to this instance's viewers
+	go listenForUpdates()
 
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal("ListenAndServe:", err)
-	}
+	// Periodically clean up vote burst tracking state
+	go abuse.runSweeper(time.Minute)
+
+	// Tell viewers when their poll expires, closing it with its final
+	// results just before
+	go runExpiryWatcher(expiryCheckInterval)
+	go runFreezeListener()
+
+	// Copy polls into the archive shortly before they expire
+	go pollArchive.run(archiveInterval)
+
+	// Periodically drop keys left behind by expired polls
+	go runOrphanSweeper(orphanSweepInterval)
+
+	// Tell viewers how many people are watching
+	go runPresence(presenceInterval)
+
+	// Publish the rolling counts of viewers' reactions
+	go runReactions(reactionInterval)
+
+	// Publish the audience's top questions as they change
+	go runQuestions(questionsInterval)
+
+	// Open and close scheduled polls on time
+	go runScheduler(scheduleInterval)
+
+	// Keep viewers' countdowns to a scheduled close in sync
+	go runCountdown(countdownInterval)
+
+	// Set up routes
+	srv := NewServer()
+	httpSrv := &http.Server{Addr: cfg.ListenAddr, Handler: srv.routes()}
+
+	go func() {
+		logger.Info("Server starting", "addr", cfg.ListenAddr, "instance", instanceID, "tls", cfg.tlsMode())
+		if err := listenAndServe(httpSrv, cfg); err != nil && err != http.ErrServerClosed {
+			fatal("ListenAndServe failed", "error", err)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then shut down gracefully
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	logger.Info("Shutting down")
+	srv.shutdown(httpSrv)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flushTraces(flushCtx)
 }
 
-// generateID creates a random 6-character ID
+// generateID creates a random ID in the configured format (6 hex
+// characters by default). It is the default ID generator of a Server.
 func generateID() string {
-	bytes := make([]byte, 3)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+	return pollIDs.Generate()
 }
 
 // createPoll handles POST /api/poll
-func createPoll(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createPoll(w http.ResponseWriter, r *http.Request) {
+	if !createLimit.Allow(clientIP(r)) {
+		tooManyRequests(w, createLimit, "Too many polls created, try again later")
+		return
+	}
+
 	var req CreatePollRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	resp, err := s.newPoll(req, ownerTokenFromRequest(r), false, requestLogger(r))
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// createPollError is why a poll couldn't be created, with the status the
+// API answers with
+type createPollError struct {
+	status  int
+	message string
+}
+
+func (e *createPollError) Error() string {
+	return e.message
+}
+
+// createError returns a createPollError
+func createError(status int, message string) error {
+	return &createPollError{status: status, message: message}
+}
 
-	if req.Question == "" || len(req.Options) < 2 {
-		http.Error(w, "Question and at least 2 options required", http.StatusBadRequest)
+// writeCreateError writes the response to a poll that couldn't be created
+func writeCreateError(w http.ResponseWriter, err error) {
+	var cerr *createPollError
+	if !errors.As(err, &cerr) {
+		http.Error(w, "Failed to create poll", http.StatusInternalServerError)
 		return
 	}
+	http.Error(w, cerr.message, cerr.status)
+}
+
+// newPoll validates req and creates the poll for the owner of ownerToken:
+// a session token, an owner token to reuse, or "" for a fresh one. Polls
+// created for chat users pass integration, since their owner tokens stand
+// in for accounts even where creating a poll takes one. It returns the
+// POST /api/poll response, or a *createPollError.
+func (s *Server) newPoll(req CreatePollRequest, ownerToken string, integration bool, log *slog.Logger) (map[string]string, error) {
+	// Normalize text so visually identical input is stored identically
+	req.Question = normalizeText(req.Question)
+	options := make([]string, len(req.Options))
+	descriptions := make([]string, len(req.Options))
+	for i := range req.Options {
+		options[i] = normalizeText(req.Options[i].Text)
+		if err := req.Options[i].normalize(); err != nil {
+			return nil, createError(http.StatusBadRequest, fmt.Sprintf("Option %d: %v", i+1, err))
+		}
+		descriptions[i] = req.Options[i].Description
+	}
+
+	if req.PollType == pollTypeText {
+		// Voters answer in their own words instead
+		if req.Question == "" || len(options) > 0 {
+			return nil, createError(http.StatusBadRequest, "Open-text polls need a question and no options")
+		}
+	} else if req.Question == "" || len(options) < 2 {
+		return nil, createError(http.StatusBadRequest, "Question and at least 2 options required")
+	}
+	if dup, found := findDuplicate(options); found {
+		return nil, createError(http.StatusBadRequest, fmt.Sprintf("Duplicate option: %q", dup))
+	}
+	if err := checkTextBudget(req.Question, options, descriptions); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if req.MinOpen < 0 {
+		return nil, createError(http.StatusBadRequest, "min_open_seconds must not be negative")
+	}
+	if req.CloseGrace < 0 || req.CloseGrace > maxCloseGrace {
+		return nil, createError(http.StatusBadRequest, fmt.Sprintf("close_grace_seconds must be between 0 and %d", maxCloseGrace))
+	}
+	if err := validateMaxChoices(req.MaxChoices, len(options)); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if err := validatePollType(req.PollType, req.MaxChoices); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if req.PollType == pollTypeRating {
+		scaleMin, scaleMax, err := validateScale(req.ScaleMin, req.ScaleMax)
+		if err != nil {
+			return nil, createError(http.StatusBadRequest, err.Error())
+		}
+		req.ScaleMin, req.ScaleMax = scaleMin, scaleMax
+	}
+	ttl, err := pollTTL(req.ExpiresIn)
+	if err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	now := time.Now()
+	if err := validateSchedule(req.OpensAt, req.ClosesAt, now, now.Add(ttl)); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if req.OpensAt <= now.Unix() {
+		req.OpensAt = 0
+	}
+	if req.Captcha && !captchaConfigured() {
+		return nil, createError(http.StatusBadRequest, "CAPTCHA is not configured on this server")
+	}
+	if len(req.VoterEmails) > 0 {
+		if req.VoterEmails, err = normalizeAllowedEmails(req.VoterEmails); err != nil {
+			return nil, createError(http.StatusBadRequest, err.Error())
+		}
+		req.SignInOnly = true
+	}
+	if req.SignInOnly && !accountsEnabled {
+		return nil, createError(http.StatusBadRequest, "Accounts are not enabled on this server")
+	}
+	if req.InviteOnly && (req.VoterOnly || req.SignInOnly) {
+		return nil, createError(http.StatusBadRequest, "require_invite can't be combined with require_voter_token, require_sign_in or allowed_emails")
+	}
+	if req.BallotTokens && (req.VoterOnly || req.SignInOnly || req.InviteOnly || req.AllowRevote) {
+		return nil, createError(http.StatusBadRequest, "ballot_tokens can't be combined with require_voter_token, require_sign_in, allowed_emails, require_invite or allow_revote")
+	}
+	if err := validateWeighted(&req); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if req.Identified && req.BallotTokens {
+		return nil, createError(http.StatusBadRequest, "identified can't be combined with ballot_tokens, which are anonymous")
+	}
+	if err := applyResultsVisibility(&req); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateDedup(req.Dedup, req.AllowRevote); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if req.NotifyURL != "" {
+		if err := validateNotifyURL(req.NotifyURL); err != nil {
+			return nil, createError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if req.NotifyEmail != "" {
+		if err := validateNotifyEmail(req.NotifyEmail); err != nil {
+			return nil, createError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := validateWebhooks(req.Webhooks, req.Thresholds); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	segments, err := normalizeSegments(req.Segments)
+	if err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateQuiz(&req); err != nil {
+		return nil, createError(http.StatusBadRequest, err.Error())
+	}
+
+	// Signed-in creators' polls belong to their account. Others can reuse
+	// an owner token to manage several polls with it; otherwise a fresh
+	// one is issued. Only its hash is stored.
+	var ownerHash string
+	if accountsEnabled && isSessionToken(ownerToken) {
+		ownerHash = ownerHashFromToken(ownerToken)
+		if ownerHash == "" {
+			return nil, createError(http.StatusUnauthorized, "Session expired or invalid, sign in again")
+		}
+		ownerToken = ""
+	} else if accountsEnabled && !allowAnonymousPolls && !integration {
+		return nil, createError(http.StatusUnauthorized, "Sign in to create polls")
+	} else {
+		if ownerToken == "" {
+			ownerToken = newToken()
+		}
+		ownerHash = hashToken(ownerToken)
+	}
+
+	if maxPollsPerOwner > 0 {
+		count, err := ownerPollCount(ownerHash)
+		if err != nil {
+			log.Error("Failed to count owner polls", "error", err)
+			return nil, createError(http.StatusInternalServerError, "Failed to create poll")
+		}
+		if count >= maxPollsPerOwner {
+			return nil, createError(http.StatusTooManyRequests, fmt.Sprintf("Owner already has %d active polls", count))
+		}
+	}
 
-	// Generate unique poll ID
-	pollID := generateID()
-	pollKey := fmt.Sprintf("poll:%s", pollID)
+	if req.QuizSession != "" {
+		owned, err := claimQuizSession(req.QuizSession, ownerHash)
+		if err != nil {
+			log.Error("Failed to claim quiz session", "error", err)
+			return nil, createError(http.StatusInternalServerError, "Failed to create poll")
+		}
+		if !owned {
+			return nil, createError(http.StatusForbidden, "Quiz session belongs to another owner")
+		}
+	}
 
 	// Create Redis hash fields
 	fields := map[string]interface{}{
-		"question": req.Question,
+		"question":    req.Question,
+		"status":      statusActive,
+		"owner_hash":  ownerHash,
+		"created_at":  now.Unix(),
+		"expires_at":  now.Add(ttl).Unix(),
+		"ttl_seconds": int(ttl / time.Second),
+
+		"next_option": len(options),
 	}
 
-	for i, option := range req.Options {
+	for i, option := range options {
 		optionKey := fmt.Sprintf("option_%d", i)
 		voteKey := fmt.Sprintf("votes_%d", i)
 		fields[optionKey] = option
 		fields[voteKey] = 0
+		if meta := encodeOptionMeta(req.Options[i].OptionMeta); meta != "" {
+			fields[optionMetaKey(strconv.Itoa(i))] = meta
+		}
+		if req.Options[i].Correct {
+			fields[correctKey(strconv.Itoa(i))] = "1"
+		}
+	}
+	if req.QuizSession != "" {
+		fields["quiz_session"] = req.QuizSession
+	}
+	if req.OpensAt > 0 {
+		fields["status"] = statusScheduled
+		fields["opens_at"] = req.OpensAt
+	}
+	if req.ClosesAt > 0 {
+		fields["closes_at"] = req.ClosesAt
+	}
+	if req.ConfirmVotes {
+		fields["confirm_votes"] = "1"
+	}
+	if req.AllowRevote {
+		fields["allow_revote"] = "1"
+	}
+	if req.MaxChoices > 1 {
+		fields["max_choices"] = req.MaxChoices
+	}
+	if req.PollType != "" {
+		fields["poll_type"] = req.PollType
+	}
+	if req.PollType == pollTypeRating {
+		fields["scale_min"] = req.ScaleMin
+		fields["scale_max"] = req.ScaleMax
+	}
+	if req.MinOpen > 0 {
+		fields["min_open_seconds"] = req.MinOpen
+	}
+	if req.RevealAfter {
+		fields["reveal_after_vote"] = "1"
+	}
+	if req.CloseGrace > 0 {
+		fields["close_grace_seconds"] = req.CloseGrace
+	}
+	if req.Dedup != "" && req.Dedup != dedupClient {
+		fields["dedup"] = req.Dedup
+	}
+	if saltedDedup(req.Dedup) {
+		fields["dedup_salt"] = newToken()
+	}
+	if req.NotifyURL != "" {
+		fields["notify_url"] = req.NotifyURL
+	}
+	if req.NotifyEmail != "" {
+		fields["notify_email"] = req.NotifyEmail
+	}
+	if len(segments) > 0 {
+		encoded, _ := json.Marshal(segments)
+		fields["segments"] = string(encoded)
+	}
+	if req.Shuffle {
+		fields["shuffle_options"] = "1"
+	}
+	// Webhook payloads are signed with a secret handed to the creator, so
+	// unlike the tokens it's stored as is
+	var webhookSecret string
+	if len(req.Webhooks) > 0 {
+		encoded, _ := json.Marshal(req.Webhooks)
+		fields["webhooks"] = string(encoded)
+		webhookSecret = newToken()
+		fields["webhook_secret"] = webhookSecret
+	}
+	if len(req.Thresholds) > 0 {
+		encoded, _ := json.Marshal(req.Thresholds)
+		fields["webhook_thresholds"] = string(encoded)
+	}
+	if req.AuditLog {
+		fields["audit_log"] = "1"
+		fields["audit_salt"] = newToken()
+	}
+	if req.Captcha {
+		fields["require_captcha"] = "1"
+	}
+	if req.SignInOnly {
+		fields["require_sign_in"] = "1"
+	}
+	if len(req.VoterEmails) > 0 {
+		fields["allowed_emails"] = strings.Join(req.VoterEmails, ",")
+	}
+	if req.InviteOnly {
+		fields["require_invite"] = "1"
+	}
+	if req.BallotTokens {
+		fields["ballot_tokens"] = "1"
+	}
+	if req.Weighted {
+		fields["weighted"] = "1"
+	}
+	if req.Identified {
+		fields["identified"] = "1"
+	}
+	if req.Moderated {
+		fields["moderated"] = "1"
 	}
 
-	// Save to Redis
-	if err := rdb.HMSet(ctx, pollKey, fields).Err(); err != nil {
-		log.Printf("Failed to save poll: %v", err)
-		http.Error(w, "Failed to create poll", http.StatusInternalServerError)
-		return
+	// Blind polls hand out a spectator link that can watch the counts
+	// before the poll closes
+	var spectatorToken string
+	if req.HideResults {
+		fields["hide_results"] = "1"
+		spectatorToken = newToken()
+		fields["spectator_hash"] = hashToken(spectatorToken)
 	}
 
-	// Set expiration (24 hours)
-	rdb.Expire(ctx, pollKey, 24*time.Hour)
+	// Restricted polls hand out a separate voter link; the plain link
+	// only lets people watch
+	var voterToken string
+	if req.VoterOnly {
+		voterToken = newToken()
+		fields["voter_hash"] = hashToken(voterToken)
+	}
 
-	// Track voted clients in a separate set
-	votedKey := fmt.Sprintf("voted:%s", pollID)
-	rdb.Del(ctx, votedKey) // Clear any existing data
-	rdb.Expire(ctx, votedKey, 24*time.Hour)
+	// Generate unique poll ID; a collision with an existing poll is
+	// retried instead of overwriting it.
+	var pollID string
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		candidate := s.idGen()
+		created, err := store.CreatePoll(candidate, fields, ttl)
+		if err != nil {
+			log.Error("Failed to save poll", "error", err)
+			return nil, createError(http.StatusInternalServerError, "Failed to create poll")
+		}
+		if created {
+			pollID = candidate
+			break
+		}
+		log.Warn("Poll ID collision, retrying", "poll_id", candidate)
+	}
+	if pollID == "" {
+		log.Error("Failed to find a free poll ID", "attempts", maxIDAttempts)
+		return nil, createError(http.StatusInternalServerError, "Failed to create poll")
+	}
+	// The count above only turns most creations over the quota away
+	// early; taking the slot settles it
+	tracked, err := trackOwnerPoll(ownerHash, pollID, ttl)
+	if err != nil {
+		log.Error("Failed to track owner poll", "poll_id", pollID, "error", err)
+	}
+	if err == nil && !tracked {
+		if err := store.DeletePoll(pollID); err != nil {
+			log.Error("Failed to delete poll over the quota", "poll_id", pollID, "error", err)
+		}
+		return nil, createError(http.StatusTooManyRequests, fmt.Sprintf("Owner already has %d active polls", maxPollsPerOwner))
+	}
+	scheduleFreeze(pollID, ttl)
+	scheduleArchive(pollID, ttl)
+	indexCreatorPoll(ownerHash, pollID, req.Question, now, ttl)
+	joinCode, err := claimJoinCode(pollID, ttl)
+	if err != nil {
+		log.Error("Failed to claim join code", "poll_id", pollID, "error", err)
+	}
+	if err := schedulePoll(pollID, req.OpensAt, req.ClosesAt); err != nil {
+		log.Error("Failed to schedule poll", "poll_id", pollID, "error", err)
+	}
+	pollsCreated.Add(1)
+	pollsCreatedTotal.Inc()
+	if webhookSecret != "" {
+		data := map[string]string{
+			"question":       req.Question,
+			"webhooks":       fields["webhooks"].(string),
+			"webhook_secret": webhookSecret,
+		}
+		sendWebhooks(pollID, data, webhookEvent(webhookPollCreated, pollID, data))
+	}
 
 	// Return the poll ID
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	resp := map[string]string{
 		"id":  pollID,
 		"url": fmt.Sprintf("/poll.html?id=%s", pollID),
-	})
+	}
+	if ownerToken != "" {
+		resp["ownerToken"] = ownerToken
+	}
+	if joinCode != "" {
+		resp["joinCode"] = joinCode
+	}
+	if voterToken != "" {
+		resp["voterToken"] = voterToken
+		resp["voterUrl"] = fmt.Sprintf("/poll.html?id=%s&vt=%s", pollID, voterToken)
+	}
+	if spectatorToken != "" {
+		resp["spectatorToken"] = spectatorToken
+		resp["spectatorUrl"] = fmt.Sprintf("/poll.html?id=%s&st=%s", pollID, spectatorToken)
+	}
+	if webhookSecret != "" {
+		resp["webhookSecret"] = webhookSecret
+	}
+	return resp, nil
 }
 
 // getPoll handles GET /api/poll/{pollID}
-func getPoll(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getPoll(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pollID := vars["pollID"]
-	pollKey := fmt.Sprintf("poll:%s", pollID)
 
-	// Get all fields from Redis hash
-	data, err := rdb.HGetAll(ctx, pollKey).Result()
+	// Get all fields of the poll
+	data, err := store.GetPoll(pollID)
 	if err != nil || len(data) == 0 {
 		http.Error(w, "Poll not found", http.StatusNotFound)
 		return
@@ -170,20 +857,73 @@ func getPoll(w http.ResponseWriter, r *http.Request) {
 	poll := Poll{
 		ID:       pollID,
 		Question: data["question"],
-		Options:  make(map[string]string),
-		Votes:    make(map[string]int),
+		Status:   data["status"],
+
+		ConfirmVotes: data["confirm_votes"] == "1",
+		AllowRevote:  data["allow_revote"] == "1",
+		VoterOnly:    data["voter_hash"] != "",
+		SignInOnly:   data["require_sign_in"] == "1",
+		InviteOnly:   data["require_invite"] == "1",
+		BallotTokens: data["ballot_tokens"] == "1",
+		Weighted:     data["weighted"] == "1",
+		Identified:   data["identified"] == "1",
+		Moderated:    data["moderated"] == "1",
+		EmailOnly:    data["allowed_emails"] != "",
+		RevealAfter:  data["reveal_after_vote"] == "1",
+		HideResults:  data["hide_results"] == "1",
+		Captcha:      data["require_captcha"] == "1",
+		Shuffle:      data["shuffle_options"] == "1",
+		Archived:     data["archived"] == "1",
+		AuditLog:     data["audit_log"] == "1",
+		JoinCode:     data["join_code"],
+		Visibility:   resultsVisibilityOf(data),
+	}
+	fmt.Sscanf(data["created_at"], "%d", &poll.CreatedAt)
+	fmt.Sscanf(data["min_open_seconds"], "%d", &poll.MinOpen)
+	fmt.Sscanf(data["close_grace_seconds"], "%d", &poll.CloseGrace)
+	fmt.Sscanf(data["late_votes"], "%d", &poll.LateVotes)
+	fmt.Sscanf(data["expires_at"], "%d", &poll.ExpiresAt)
+	fmt.Sscanf(data["opens_at"], "%d", &poll.OpensAt)
+	fmt.Sscanf(data["closes_at"], "%d", &poll.ClosesAt)
+	if n := maxChoicesOf(data); n > 1 {
+		poll.MaxChoices = n
+	}
+	poll.PollType = pollTypeOf(data)
+	if poll.PollType == pollTypeRating {
+		poll.Scale = ratingScaleOf(data)
+	}
+	poll.Dedup = data["dedup"]
+	if poll.Dedup == "" {
+		poll.Dedup = dedupClient
+	}
+
+	if poll.Status == "" {
+		poll.Status = statusActive
 	}
 
 	// Extract options and votes
-	for key, value := range data {
-		if strings.HasPrefix(key, "option_") {
-			optionID := strings.TrimPrefix(key, "option_")
-			poll.Options[optionID] = value
-		} else if strings.HasPrefix(key, "votes_") {
-			optionID := strings.TrimPrefix(key, "votes_")
-			var votes int
-			fmt.Sscanf(value, "%d", &votes)
-			poll.Votes[optionID] = votes
+	poll.Options = parseOptions(data)
+	poll.Order = optionOrder(poll.Options, poll.Shuffle, pollID, clientIdentity(pollID, r.URL.Query().Get("clientId")))
+	poll.OptionDetails = parseOptionDetails(data, poll.Order)
+	poll.Segments = parseSegments(data["segments"])
+	poll.QuizSession = data["quiz_session"]
+	if data["quiz_revealed"] == "1" {
+		poll.CorrectOptions = correctOptions(data)
+	}
+
+	// Counts are withheld the same way the WebSocket withholds them
+	if resultsHidden(r, pollID, data) {
+		poll.ResultsHidden = true
+		poll.LateVotes = 0
+	} else {
+		poll.Votes = parseVotes(data)
+		poll.WeightedVotes = parseWeightedVotes(data)
+		if poll.PollType == pollTypeRating {
+			poll.Averages, _ = parseRatings(data)
+		}
+		if poll.PollType == pollTypeText {
+			fmt.Sscanf(data["responses"], "%d", &poll.Responses)
+			poll.TopWords, _ = store.TopWords(pollID, topWordsLimit)
 		}
 	}
 
@@ -192,111 +932,462 @@ func getPoll(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleWebSocket handles WebSocket connections
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pollID := vars["pollID"]
+	ip := clientIP(r)
+	userAgent := r.UserAgent()
 
-	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Upgrade HTTP connection to WebSocket, handing out a voter cookie on
+	// the way
+	header := http.Header{}
+	voterID := ensureVoterCookie(r, header)
+	conn, err := upgrader.Upgrade(w, r, header)
+	auditHandshake(r, pollID, err == nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
 	defer conn.Close()
+	client := &wsClient{
+		conn:     conn,
+		send:     make(chan wsFrame, wsSendBuffer),
+		done:     make(chan struct{}),
+		protobuf: conn.Subprotocol() == subprotocolProtobuf,
+
+		voterCookie: voterID,
+		fingerprint: requestFingerprint(r),
+		account:     accountFromRequest(r),
+		log:         requestLogger(r),
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	go client.writePump(quit)
+	client.keepAlive()
+	if conn.Subprotocol() == subprotocolJSONBatch {
+		client.batch = newUpdateBatch()
+		done := make(chan struct{})
+		defer close(done)
+		go client.runBatchFlusher(done)
+	}
+
+	// Load the per-poll settings that change how this connection behaves
+	settings, _ := store.GetPoll(pollID)
+	client.confirmVotes = settings["confirm_votes"] == "1"
+	client.revealAfterVote = settings["reveal_after_vote"] == "1"
+	client.requireCaptcha = settings["require_captcha"] == "1"
+	client.openText = pollTypeOf(settings) == pollTypeText
+
+	// Owners and spectators see the counts of blind polls; everyone else
+	// waits for the poll to close
+	privileged := privilegedViewer(r, settings)
+	client.blind = settings["hide_results"] == "1" && !privileged
+	client.hideResults.Store(client.blind && settings["status"] != statusClosed)
+	client.pollClosed.Store(settings["status"] == statusClosed)
 
-	// Add connection to the pool
-	connMutex.Lock()
-	if connections[pollID] == nil {
-		connections[pollID] = make(map[*websocket.Conn]bool)
+	// A returning voter identifies itself so it sees results right away
+	clientID := clientIdentity(pollID, r.URL.Query().Get("clientId"))
+	if privileged {
+		client.revealed.Store(true)
+	} else if client.revealAfterVote {
+		client.revealed.Store(hasVoted(settings, voteRequest{
+			PollID:      pollID,
+			ClientID:    clientID,
+			IP:          ip,
+			UserAgent:   userAgent,
+			VoterToken:  r.URL.Query().Get("vt"),
+			VoterCookie: client.voterCookie,
+			Fingerprint: client.fingerprint,
+			Account:     client.account,
+		}))
 	}
-	connections[pollID][conn] = true
-	connMutex.Unlock()
 
-	// Remove connection when done
+	// Join the poll's room, and leave it when done
+	hub.Register(pollID, client)
+	markPresence(pollID)
 	defer func() {
-		connMutex.Lock()
-		delete(connections[pollID], conn)
-		if len(connections[pollID]) == 0 {
-			delete(connections, pollID)
-		}
-		connMutex.Unlock()
+		hub.Unregister(pollID, client)
+		markPresence(pollID)
 	}()
 
-	// Send current vote counts to new connection
-	sendCurrentVotes(conn, pollID)
+	// Hand out the client's token, renewing the one it came with, then
+	// send the question and options and the current vote counts
+	client.writeJSON(issueClientToken(pollID, r.URL.Query().Get("clientId"), time.Now()))
+	if len(settings) > 0 {
+		client.writeJSON(pollInfo(pollID, settings, clientID))
+	}
+	if countdown, ok := pollCountdown(pollID, settings, time.Now()); ok {
+		client.writeJSON(countdown)
+	}
+	sendCurrentVotes(client, pollID)
+	if settings["status"] == statusClosed {
+		if final, err := finalResults(pollID); err == nil {
+			client.writeJSON(final)
+		}
+	}
+	if reactions, err := currentReactions(pollID, time.Now()); err == nil {
+		client.writeJSON(reactions)
+	}
+	if questions, err := currentQuestions(pollID); err == nil && questions.Total > 0 {
+		client.writeJSON(questions)
+	}
 
 	// Listen for messages from this client
 	for {
 		var msg VoteMessage
 		if err := conn.ReadJSON(&msg); err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				client.log.Warn("WebSocket error", "error", err)
 			}
 			break
 		}
+		s.dispatchWS(&wsMessage{
+			VoteMessage: msg,
+			client:      client,
+			pollID:      pollID,
+			ip:          ip,
+			userAgent:   userAgent,
+			receivedAt:  time.Now(),
+		})
+	}
+}
 
-		// Process vote
-		if msg.Vote != "" && msg.ClientID != "" {
-			handleVote(pollID, msg.Vote, msg.ClientID)
+// handleVote processes a vote and returns its outcome
+func handleVote(v voteRequest) (status string) {
+	traceCtx := v.Trace
+	if traceCtx == nil {
+		traceCtx = context.Background()
+	}
+	traceCtx, span := tracer.Start(traceCtx, "handleVote", trace.WithAttributes(attribute.String("poll.id", v.PollID)))
+	defer func() {
+		span.SetAttributes(attribute.String("vote.status", status))
+		if status == voteError {
+			span.SetStatus(codes.Error, status)
+		}
+		span.End()
+		if status != voteOK {
+			votesRejectedTotal.WithLabelValues(status).Inc()
 		}
+	}()
+	pollID, ip := v.PollID, v.IP
+	choices := v.choices()
+
+	// Only client IDs the server issued for this poll are trusted
+	clientID, status := verifyClientID(pollID, v.ClientID, time.Now())
+	if status != "" {
+		return status
 	}
-}
+	v.ClientID = clientID
+	l := v.log().With("client_id", clientID)
 
-// handleVote processes a vote
-func handleVote(pollID, optionID, clientID string) {
-	pollKey := fmt.Sprintf("poll:%s", pollID)
-	votedKey := fmt.Sprintf("voted:%s", pollID)
+	// Reject votes from sources flagged for ballot stuffing. Chat users
+	// all come from the platform's servers, each under their own name, so
+	// there's no source to flag.
+	if !v.Chat {
+		if abuse.Blocked(ip) {
+			abuseBlockedVotesTotal.Inc()
+			l.Info("Rejected vote from blocked IP")
+			return voteBlocked
+		}
+		if abuse.Record(ip, clientID) && abuse.block {
+			abuseBlockedVotesTotal.Inc()
+			return voteBlocked
+		}
+	}
+	if !voteIPLimit.Allow(ip) || !voteClientLimit.Allow(clientID) {
+		return voteRateLimited
+	}
 
-	// Check if client already voted
-	exists, err := rdb.SIsMember(ctx, votedKey, clientID).Result()
+	// Make sure the options exist and the poll is accepting votes
+	_, loadSpan := tracer.Start(traceCtx, "store.GetPoll")
+	state, err := store.GetPoll(pollID)
+	loadSpan.End()
 	if err != nil {
-		log.Printf("Error checking vote status: %v", err)
-		return
+		l.Error("Error loading poll state", "error", err)
+		return voteError
 	}
-	if exists {
-		log.Printf("Client %s already voted for poll %s", clientID, pollID)
-		return
+	if !validBallot(state, choices) || !validRatings(state, v.Ratings) || !validAnswer(state, v.Answer) {
+		return voteInvalid
+	}
+	ballot := encodeBallot(choices)
+	if len(v.Ratings) > 0 {
+		ballot = encodeRatings(v.Ratings)
+	}
+	openText := pollTypeOf(state) == pollTypeText
+	if openText {
+		answer, ok := moderateText(v.Answer)
+		if !ok {
+			return voteRejected
+		}
+		v.Answer, ballot = answer, answer
+	}
+	choices = countedChoices(state, choices)
+	late := false
+	if deadlinePassed(state["closes_at"], time.Now()) {
+		return voteClosed
+	}
+	switch state["status"] {
+	case statusScheduled:
+		if !deadlinePassed(state["opens_at"], time.Now()) {
+			return voteNotOpen
+		}
+	case statusPaused:
+		return votePaused
+	case statusClosed:
+		return voteClosed
+	case statusClosing:
+		if graceExpired(state["closing_until"], time.Now()) {
+			return voteClosed
+		}
+		late = true
+	}
+
+	// Chat users can't solve a CAPTCHA or confirm their choice, so the
+	// polls that ask for either only take votes on their page
+	if v.Chat && state["require_captcha"] == "1" {
+		return voteCaptchaFailed
+	}
+	if v.Chat && state["confirm_votes"] == "1" {
+		return voteConfirmRequired
+	}
+
+	// Restricted polls only take votes from the voters they allow
+	if status := voterAllowed(state, v); status != "" {
+		return status
+	}
+	// Identified polls record who the voter is, so they need to say
+	identified := state["identified"] == "1"
+	var identity voterIdentity
+	if identified {
+		var named bool
+		identity, named, err = identifyVoter(v)
+		if err != nil {
+			l.Error("Failed to identify voter", "error", err)
+			return voteError
+		}
+		if !named {
+			return voteNameRequired
+		}
 	}
 
-	// Increment vote count atomically
-	voteKey := fmt.Sprintf("votes_%s", optionID)
-	newCount, err := rdb.HIncrBy(ctx, pollKey, voteKey, 1).Result()
+	// Segments are optional, but must be one the poll defines
+	if v.Segment != "" {
+		if !segmentAllowed(state["segments"], v.Segment) {
+			return voteInvalid
+		}
+	}
+
+	// The counters this ballot bumps; the option totals come first, in
+	// ballot order, and one event sequence number per option comes last
+	counters := ballotCounters(state, choices, v.Ratings, v.Segment)
+	// Weighted polls also add the voter's weight to weighted totals
+	weight, err := voterWeight(state, v)
 	if err != nil {
-		log.Printf("Failed to increment vote: %v", err)
-		return
+		l.Error("Failed to load voter weight", "error", err)
+		return voteError
+	}
+	counters = append(counters, weightedCounters(state, choices, weight)...)
+	// Votes in the close grace window count, but are flagged so disputes
+	// about last-second votes can be settled
+	if late {
+		counters = append(counters, incr("late_votes"))
+	}
+	seqStart := len(counters)
+	if voteEvents != nil {
+		for range choices {
+			counters = append(counters, incr("event_seq"))
+		}
 	}
 
-	// Mark client as voted
-	rdb.SAdd(ctx, votedKey, clientID)
+	// Record the ballot unless this voter already voted; on allow_revote
+	// polls a second ballot replaces the first instead
+	members := voterIDs(state, v)
+	if len(members) == 0 {
+		return voteInvalid
+	}
+	member := members[0]
+	// A ballot token is spent last, once nothing else can refuse the ballot
+	ballotToken := state["ballot_tokens"] == "1"
+	if ballotToken {
+		unspent, err := spendBallot(pollID, v.VoterToken)
+		if err != nil {
+			l.Error("Failed to spend ballot token", "error", err)
+			return voteError
+		}
+		if !unspent {
+			return voteDenied
+		}
+	}
+	stored := storedBallot(ballot, v.Segment)
+	_, storeSpan := tracer.Start(traceCtx, "store.RecordVote")
+	values, recorded, err := store.RecordVote(pollID, members, stored, counters...)
+	storeSpan.End()
+	if err != nil {
+		l.Error("Failed to record vote", "error", err)
+		if ballotToken {
+			refundBallot(pollID, v.VoterToken)
+		}
+		return voteError
+	}
+	var replaced string
+	if !recorded {
+		if state["allow_revote"] != "1" {
+			l.Info("Duplicate vote rejected")
+			return voteDuplicate
+		}
+		replaced, values, err = store.ChangeVote(pollID, member, stored, func(old string) []Increment {
+			return undoCounters(state, old, weight)
+		}, counters...)
+		if err != nil {
+			l.Error("Failed to change vote", "error", err)
+			return voteError
+		}
+		l.Info("Vote changed")
+	}
+	votesRecorded.Add(1)
+	votesRecordedTotal.Inc()
+	votedAt := time.Now()
+	if err := recordVoteTime(state, pollID, member, votedAt); err != nil {
+		l.Warn("Failed to record vote time", "error", err)
+	}
+	newBallots := int64(1)
+	if replaced != "" {
+		newBallots = 0
+	}
+	if err := recordHistory(state, pollID, votedAt, newBallots, choices, replaced); err != nil {
+		l.Warn("Failed to record vote history", "error", err)
+	}
+	if recorded {
+		auditBallot(state, v, auditVote, member, stored, votedAt)
+	} else {
+		auditBallot(state, v, auditChange, member, stored, votedAt)
+	}
+	if pollTypeOf(state) == pollTypeQuiz {
+		recordQuizPlayer(state, member, v)
+	}
+	if identified {
+		if err := recordVoterIdentity(state, pollID, member, identity); err != nil {
+			l.Warn("Failed to record voter identity", "error", err)
+		}
+	}
+	if late {
+		l.Info("Late vote accepted while closing", "options", ballot)
+	}
 
-	log.Printf("Vote recorded: poll=%s, option=%s, newCount=%d", pollID, optionID, newCount)
+	l.Info("Vote recorded", "options", ballot, "new_count", values[0])
+
+	// Open-text answers feed the poll's word cloud instead of counts
+	if openText {
+		if replaced != "" {
+			previous, _ := splitBallot(replaced)
+			withdrawAnswer(pollID, member, previous)
+		}
+		submitAnswer(state, pollID, member, v.Answer)
+		words := currentTopWords(pollID)
+		publishEventContext(traceCtx, pollID, words)
+		if state["webhook_thresholds"] != "" {
+			checkThresholds(pollID, state, words.Responses)
+		}
+		return voteOK
+	}
 
 	// Get all current votes
-	votes := getCurrentVotes(pollID)
+	update := currentUpdate(pollID)
+	votes := update.Votes
 
-	// Publish update to Redis channel
-	updateMsg, _ := json.Marshal(UpdateMessage{
-		Type:  "voteUpdate",
-		Votes: votes,
-	})
+	// Mirror the vote to Kafka for analytics when configured, one event
+	// per selected option
+	if voteEvents != nil {
+		for i, optionID := range choices {
+			voteEvents.Publish(VoteEvent{
+				PollID:   pollID,
+				Option:   optionID,
+				NewCount: values[i],
+				Total:    totalVotes(votes),
+				TS:       time.Now().UnixMilli(),
+				Seq:      values[seqStart+i],
+				Score:    v.Ratings[optionID],
+				Revote:   replaced != "",
+			})
+		}
+	}
+
+	// Publish update to every instance
+	if !v.ReceivedAt.IsZero() {
+		update.ReceivedAt = v.ReceivedAt.UnixNano()
+	}
+	publishEventContext(traceCtx, pollID, update)
+	if state["webhook_thresholds"] != "" {
+		checkThresholds(pollID, state, totalVotes(votes))
+	}
+	if state["slack_ts"] != "" {
+		scheduleSlackUpdate(pollID)
+	}
+	return voteOK
+}
 
-	channel := fmt.Sprintf("updates:%s", pollID)
-	if err := rdb.Publish(ctx, channel, updateMsg).Err(); err != nil {
-		log.Printf("Failed to publish update: %v", err)
+// voterTokenValid reports whether a vote may be cast on a poll: polls
+// restricted with require_voter_token need the voter token
+func voterTokenValid(state map[string]string, token string) bool {
+	voterHash := state["voter_hash"]
+	if voterHash == "" {
+		return true
 	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(voterHash)) == 1
 }
 
-// getCurrentVotes gets all current vote counts for a poll
-func getCurrentVotes(pollID string) map[string]int {
-	pollKey := fmt.Sprintf("poll:%s", pollID)
-	data, err := rdb.HGetAll(ctx, pollKey).Result()
+// publishEvent sends a message to every client of a poll via the store
+func publishEvent(pollID string, event interface{}) {
+	publishEventContext(context.Background(), pollID, event)
+}
+
+// publishEventContext publishes an event as part of the trace in
+// traceCtx, which the instances broadcasting it continue
+func publishEventContext(traceCtx context.Context, pollID string, event interface{}) {
+	traceCtx, span := tracer.Start(traceCtx, "publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("poll.id", pollID)))
+	defer span.End()
+
+	payload, err := json.Marshal(event)
 	if err != nil {
-		return nil
+		logger.Error("Failed to encode event", "poll_id", pollID, "error", err)
+		return
+	}
+
+	if err := store.Publish(pollID, payload, traceMetadata(traceCtx)); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		logger.Error("Failed to publish update", "poll_id", pollID, "error", err)
+	}
+}
+
+// currentUpdate builds the voteUpdate message with a poll's current
+// counts
+func currentUpdate(pollID string) UpdateMessage {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		return UpdateMessage{Type: "voteUpdate"}
+	}
+	return voteUpdateFrom(data)
+}
+
+// voteUpdateFrom builds the voteUpdate message from a poll hash; rating
+// polls carry each option's average and distribution along with the
+// number of ratings
+func voteUpdateFrom(data map[string]string) UpdateMessage {
+	update := UpdateMessage{Type: "voteUpdate", Votes: parseVotes(data), WeightedVotes: parseWeightedVotes(data)}
+	if pollTypeOf(data) == pollTypeRating {
+		update.Averages, update.Distributions = parseRatings(data)
 	}
+	return update
+}
 
+// parseVotes extracts the vote counts from a poll hash
+func parseVotes(data map[string]string) map[string]int {
 	votes := make(map[string]int)
 	for key, value := range data {
-		if strings.HasPrefix(key, "votes_") {
+		// Per-segment counters ("votes_<id>:<segment>") aren't totals
+		if strings.HasPrefix(key, "votes_") && !strings.Contains(key, ":") {
 			optionID := strings.TrimPrefix(key, "votes_")
 			var count int
 			fmt.Sscanf(value, "%d", &count)
@@ -307,56 +1398,110 @@ func getCurrentVotes(pollID string) map[string]int {
 }
 
 // sendCurrentVotes sends current vote counts to a specific connection
-func sendCurrentVotes(conn *websocket.Conn, pollID string) {
-	votes := getCurrentVotes(pollID)
-	msg := UpdateMessage{
-		Type:  "voteUpdate",
-		Votes: votes,
+func sendCurrentVotes(client *wsClient, pollID string) {
+	if !client.canSeeResults() {
+		client.sendUpdate(hiddenUpdate)
+		return
 	}
-	conn.WriteJSON(msg)
-}
 
-// listenToPubSub subscribes to Redis pub/sub channels
-func listenToPubSub() {
-	pubsub := rdb.PSubscribe(ctx, "updates:*")
-	defer pubsub.Close()
+	client.sendUpdate(currentUpdate(pollID))
+	sendTopWords(client, pollID)
+}
 
-	ch := pubsub.Channel()
-	for msg := range ch {
-		// Extract poll ID from channel name
-		parts := strings.Split(msg.Channel, ":")
-		if len(parts) != 2 {
-			continue
+// listenForUpdates relays the updates published for any poll. The
+// subscription retries on its own, but should it ever end it is started
+// again, so live updates can't silently stop for good.
+func listenForUpdates() {
+	retry := backoff{min: updatesRetryMin, max: updatesRetryMax}
+	for {
+		for msg := range store.Subscribe(ctx) {
+			retry.reset()
+			// Broadcast to every viewer of this poll, continuing the
+			// trace of whatever published the update
+			_, span := tracer.Start(traceFromMetadata(msg.Meta), "broadcast",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("poll.id", msg.PollID),
+					attribute.Int("subscribers", hub.Count(msg.PollID)),
+				))
+			if strings.HasPrefix(msg.PollID, deckRoomPrefix) {
+				deckHub.Broadcast(msg.PollID, msg.Payload)
+			} else {
+				hub.Broadcast(msg.PollID, msg.Payload)
+			}
+			span.End()
 		}
-		pollID := parts[1]
-
-		// Broadcast to all connected clients for this poll
-		broadcastToClients(pollID, msg.Payload)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("Update subscription ended, resubscribing")
+		retry.wait(ctx)
 	}
 }
 
-// broadcastToClients sends a message to all WebSocket clients for a poll
-func broadcastToClients(pollID string, message string) {
-	connMutex.RLock()
-	conns := connections[pollID]
-	connMutex.RUnlock()
+// deliver sends a broadcast to the client, in the format it negotiated and
+// only as far as it may see the results
+func (c *wsClient) deliver(b *broadcast) {
+	eventType := b.update.Type
 
-	if conns == nil {
-		return
+	// Everyone sees the final tally once a poll closes; reopening hides
+	// the counts again from those who couldn't see them before
+	changed := false
+	if eventType == "pollClosed" {
+		changed = !c.canSeeResults()
+		c.hideResults.Store(false)
+		c.pollClosed.Store(true)
+	}
+	if eventType == "pollReopened" {
+		visible := c.canSeeResults()
+		c.hideResults.Store(c.blind)
+		c.pollClosed.Store(false)
+		changed = visible != c.canSeeResults()
+	}
+	// After a reset, reveal_after_vote clients have to vote again to see
+	// the counts
+	if eventType == "pollReset" {
+		visible := c.canSeeResults()
+		c.revealed.Store(false)
+		changed = visible != c.canSeeResults()
+	}
+	// sendCurrentVotes sends the placeholder to clients hidden again
+	if changed {
+		defer sendCurrentVotes(c, b.pollID)
 	}
 
-	var update UpdateMessage
-	if err := json.Unmarshal([]byte(message), &update); err != nil {
-		log.Printf("Failed to unmarshal update message: %v", err)
+	// Deleted and expired polls are gone for good, so their viewers are sent away
+	// right after the notice, bypassing any batch
+	if pollGone(eventType) {
+		c.writeText(b.message)
+		c.close(websocket.CloseNormalClosure, eventType)
 		return
 	}
 
-	connMutex.RLock()
-	defer connMutex.RUnlock()
+	// The word cloud is withheld along with the counts
+	if eventType == "topWords" && !c.canSeeResults() {
+		return
+	}
 
-	for conn := range conns {
-		if err := conn.WriteJSON(update); err != nil {
-			log.Printf("Failed to send update to client: %v", err)
+	var err error
+	if c.batch != nil {
+		payload := b.message
+		if eventType == "voteUpdate" && !c.canSeeResults() {
+			payload, _ = json.Marshal(hiddenUpdate)
 		}
+		c.batch.add(b.pollID, eventType, payload)
+		return
+	}
+	if eventType == "voteUpdate" && !c.canSeeResults() {
+		err = c.sendUpdate(hiddenUpdate)
+	} else if c.protobuf && eventType == "voteUpdate" {
+		// Protobuf clients get vote updates as binary frames; every other
+		// message is forwarded as JSON text
+		err = c.writeBinary(b.protobuf())
+	} else {
+		err = c.writeText(b.message)
+	}
+	if err != nil {
+		c.log.Debug("Failed to send update to client", "error", err)
 	}
 }
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often the in-memory store deletes expired
+// keys and reports them to Expired. Until then they already read as gone.
+const memorySweepInterval = time.Second
+
+// memoryKeys keeps the keys in process memory, for local development and
+// tests. Nothing is persisted or shared with other instances.
+type memoryKeys struct {
+	mu   sync.Mutex
+	keys map[string]*memoryEntry
+
+	expired expiryWatchers
+}
+
+// memoryEntry is one key; only the field of its type is used
+type memoryEntry struct {
+	str    string
+	hash   map[string]string
+	set    map[string]bool
+	zset   map[string]float64
+	list   []string // head first
+	stream []StreamEntry
+
+	// expiresAt is zero for a key that doesn't expire
+	expiresAt time.Time
+}
+
+func newMemoryKeys() *memoryKeys {
+	m := &memoryKeys{keys: make(map[string]*memoryEntry)}
+	go m.sweep(memorySweepInterval)
+	return m
+}
+
+// The lowercase methods expect the caller to hold mu
+
+// get returns a key unless it doesn't exist or expired
+func (m *memoryKeys) get(key string) *memoryEntry {
+	e := m.keys[key]
+	if e == nil || (!e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt)) {
+		return nil
+	}
+	return e
+}
+
+// create returns a key, replacing it if it expired
+func (m *memoryKeys) create(key string) *memoryEntry {
+	e := m.get(key)
+	if e == nil {
+		e = &memoryEntry{}
+		m.keys[key] = e
+	}
+	return e
+}
+
+// hash returns a key's hash, creating it
+func (m *memoryKeys) hash(key string) map[string]string {
+	e := m.create(key)
+	if e.hash == nil {
+		e.hash = make(map[string]string)
+	}
+	return e.hash
+}
+
+// set returns a key's set, creating it
+func (m *memoryKeys) set(key string) map[string]bool {
+	e := m.create(key)
+	if e.set == nil {
+		e.set = make(map[string]bool)
+	}
+	return e.set
+}
+
+// zset returns a key's sorted set, creating it
+func (m *memoryKeys) zset(key string) map[string]float64 {
+	e := m.create(key)
+	if e.zset == nil {
+		e.zset = make(map[string]float64)
+	}
+	return e.zset
+}
+
+// dropIfEmpty deletes a key whose hash, set, sorted set or list was
+// emptied, like Redis does
+func (m *memoryKeys) dropIfEmpty(key string) {
+	e := m.keys[key]
+	if e != nil && len(e.hash) == 0 && len(e.set) == 0 && len(e.zset) == 0 && len(e.list) == 0 && len(e.stream) == 0 && e.str == "" {
+		delete(m.keys, key)
+	}
+}
+
+// expireAt gives a key a deadline, deleting it if that has passed
+func (m *memoryKeys) expireAt(key string, at time.Time) {
+	e := m.get(key)
+	if e == nil {
+		return
+	}
+	if !time.Now().Before(at) {
+		delete(m.keys, key)
+		return
+	}
+	e.expiresAt = at
+}
+
+// ttl is TTL for a key
+func (m *memoryKeys) ttl(key string) time.Duration {
+	e := m.get(key)
+	switch {
+	case e == nil:
+		return -2
+	case e.expiresAt.IsZero():
+		return -1
+	}
+	return time.Until(e.expiresAt)
+}
+
+func (m *memoryKeys) setString(key, value string, ttl time.Duration) {
+	m.keys[key] = &memoryEntry{str: value}
+	if ttl > 0 {
+		m.keys[key].expiresAt = time.Now().Add(ttl)
+	}
+}
+
+func (m *memoryKeys) hset(key string, values map[string]interface{}) {
+	if len(values) == 0 {
+		return
+	}
+	hash := m.hash(key)
+	for field, value := range values {
+		hash[field] = fieldString(value)
+	}
+}
+
+func (m *memoryKeys) hexists(key, field string) bool {
+	e := m.get(key)
+	if e == nil {
+		return false
+	}
+	_, exists := e.hash[field]
+	return exists
+}
+
+func (m *memoryKeys) hdel(key string, fields ...string) int64 {
+	e := m.get(key)
+	if e == nil {
+		return 0
+	}
+	var removed int64
+	for _, field := range fields {
+		if _, ok := e.hash[field]; ok {
+			delete(e.hash, field)
+			removed++
+		}
+	}
+	m.dropIfEmpty(key)
+	return removed
+}
+
+func (m *memoryKeys) hincrBy(key, field string, by int64) (int64, error) {
+	hash := m.hash(key)
+	n := int64(0)
+	if current, ok := hash[field]; ok {
+		var err error
+		if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+			m.dropIfEmpty(key)
+			return 0, fmt.Errorf("hash value is not an integer")
+		}
+	}
+	n += by
+	hash[field] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (m *memoryKeys) sadd(key string, members ...string) int64 {
+	set := m.set(key)
+	var added int64
+	for _, member := range members {
+		if !set[member] {
+			set[member] = true
+			added++
+		}
+	}
+	m.dropIfEmpty(key)
+	return added
+}
+
+func (m *memoryKeys) srem(key string, members ...string) int64 {
+	e := m.get(key)
+	if e == nil {
+		return 0
+	}
+	var removed int64
+	for _, member := range members {
+		if e.set[member] {
+			delete(e.set, member)
+			removed++
+		}
+	}
+	m.dropIfEmpty(key)
+	return removed
+}
+
+func (m *memoryKeys) zrem(key string, members ...string) int64 {
+	e := m.get(key)
+	if e == nil {
+		return 0
+	}
+	var removed int64
+	for _, member := range members {
+		if _, ok := e.zset[member]; ok {
+			delete(e.zset, member)
+			removed++
+		}
+	}
+	m.dropIfEmpty(key)
+	return removed
+}
+
+// sorted returns a sorted set's members by score, then member, like
+// Redis orders them
+func (m *memoryKeys) sorted(key string) []ScoredMember {
+	e := m.get(key)
+	if e == nil {
+		return nil
+	}
+	members := make([]ScoredMember, 0, len(e.zset))
+	for member, score := range e.zset {
+		members = append(members, ScoredMember{Member: member, Score: score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+	return members
+}
+
+// rangeBounds turns Redis's inclusive, possibly negative start and stop
+// into slice bounds of a sequence of n
+func rangeBounds(start, stop int64, n int) (int, int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	start = max(start, 0)
+	stop = min(stop, int64(n)-1)
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+func (m *memoryKeys) lpush(key, value string) {
+	e := m.create(key)
+	e.list = append([]string{value}, e.list...)
+}
+
+func (m *memoryKeys) ltrim(key string, start, stop int64) {
+	e := m.get(key)
+	if e == nil {
+		return
+	}
+	lo, hi := rangeBounds(start, stop, len(e.list))
+	e.list = append([]string(nil), e.list[lo:hi]...)
+	m.dropIfEmpty(key)
+}
+
+// streamID splits a stream entry ID into its milliseconds and sequence
+func streamID(id string) (int64, int64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseInt(msPart, 10, 64)
+	seq, _ := strconv.ParseInt(seqPart, 10, 64)
+	return ms, seq
+}
+
+// nextStreamID is the ID of an entry added now after the entry last, or
+// to an empty stream if last is ""
+func nextStreamID(last string) string {
+	ms, seq := time.Now().UnixMilli(), int64(0)
+	if last != "" {
+		lastMS, lastSeq := streamID(last)
+		if ms <= lastMS {
+			ms, seq = lastMS, lastSeq+1
+		}
+	}
+	return fmt.Sprintf("%d-%d", ms, seq)
+}
+
+func (m *memoryKeys) xadd(key string, values map[string]interface{}) string {
+	e := m.create(key)
+	last := ""
+	if n := len(e.stream); n > 0 {
+		last = e.stream[n-1].ID
+	}
+	id := nextStreamID(last)
+	e.stream = append(e.stream, StreamEntry{ID: id, Values: fieldStrings(values)})
+	return id
+}
+
+// scan hands fn the live keys starting with prefix, batch at a time
+func (m *memoryKeys) scan(prefix string, batch, limit int, fn func(keys []string) error) (int, bool, error) {
+	m.mu.Lock()
+	var keys []string
+	for key := range m.keys {
+		if strings.HasPrefix(key, prefix) && m.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	m.mu.Unlock()
+
+	scanned := 0
+	for len(keys) > 0 {
+		n := min(batch, len(keys))
+		if err := fn(keys[:n]); err != nil {
+			return scanned, false, err
+		}
+		scanned += n
+		keys = keys[n:]
+		if scanned >= limit {
+			return scanned, len(keys) > 0, nil
+		}
+	}
+	return scanned, false, nil
+}
+
+// sweep deletes expired keys and reports them to Expired
+func (m *memoryKeys) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.sweepOnce()
+	}
+}
+
+func (m *memoryKeys) sweepOnce() {
+	m.mu.Lock()
+	var expired []string
+	for key := range m.keys {
+		if m.get(key) == nil {
+			delete(m.keys, key)
+			expired = append(expired, key)
+		}
+	}
+	m.mu.Unlock()
+	m.expired.notify(expired)
+}
+
+func (m *memoryKeys) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	if e == nil {
+		return "", errKeyNotFound
+	}
+	return e.str, nil
+}
+
+func (m *memoryKeys) Set(key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setString(key, value, ttl)
+	return nil
+}
+
+func (m *memoryKeys) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.get(key) != nil {
+		return false, nil
+	}
+	m.setString(key, value, ttl)
+	return true, nil
+}
+
+func (m *memoryKeys) GetDel(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	if e == nil {
+		return "", errKeyNotFound
+	}
+	delete(m.keys, key)
+	return e.str, nil
+}
+
+func (m *memoryKeys) Del(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.keys, key)
+	}
+	return nil
+}
+
+func (m *memoryKeys) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireAt(key, time.Now().Add(ttl))
+	return nil
+}
+
+func (m *memoryKeys) TTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ttl(key), nil
+}
+
+func (m *memoryKeys) HGet(key, field string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key); e != nil {
+		if value, ok := e.hash[field]; ok {
+			return value, nil
+		}
+	}
+	return "", errKeyNotFound
+}
+
+func (m *memoryKeys) HGetAll(key string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]string)
+	if e := m.get(key); e != nil {
+		for field, value := range e.hash {
+			out[field] = value
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryKeys) HMGet(key string, fields ...string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]string, len(fields))
+	if e := m.get(key); e != nil {
+		for _, field := range fields {
+			if value, ok := e.hash[field]; ok {
+				out[field] = value
+			}
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryKeys) HSet(key string, values map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hset(key, values)
+	return nil
+}
+
+func (m *memoryKeys) HSetNX(key, field string, value interface{}) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := m.hash(key)
+	if _, ok := hash[field]; ok {
+		return false, nil
+	}
+	hash[field] = fieldString(value)
+	return true, nil
+}
+
+func (m *memoryKeys) HDel(key string, fields ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hdel(key, fields...), nil
+}
+
+func (m *memoryKeys) HLen(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key); e != nil {
+		return int64(len(e.hash)), nil
+	}
+	return 0, nil
+}
+
+func (m *memoryKeys) HIncrBy(key, field string, by int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hincrBy(key, field, by)
+}
+
+func (m *memoryKeys) SAdd(key string, members ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sadd(key, members...), nil
+}
+
+func (m *memoryKeys) SRem(key string, members ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.srem(key, members...), nil
+}
+
+func (m *memoryKeys) SIsMember(key, member string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	return e != nil && e.set[member], nil
+}
+
+func (m *memoryKeys) SMembers(key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var members []string
+	if e := m.get(key); e != nil {
+		for member := range e.set {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *memoryKeys) ZAdd(key, member string, score float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zset(key)[member] = score
+	return nil
+}
+
+func (m *memoryKeys) ZIncrBy(key, member string, by float64) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zset := m.zset(key)
+	zset[member] += by
+	return zset[member], nil
+}
+
+func (m *memoryKeys) ZRem(key string, members ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.zrem(key, members...), nil
+}
+
+func (m *memoryKeys) ZScore(key, member string) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key); e != nil {
+		if score, ok := e.zset[member]; ok {
+			return score, nil
+		}
+	}
+	return 0, errKeyNotFound
+}
+
+func (m *memoryKeys) ZCard(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key); e != nil {
+		return int64(len(e.zset)), nil
+	}
+	return 0, nil
+}
+
+func (m *memoryKeys) ZRange(key string, start, stop int64, reverse bool) ([]ScoredMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := m.sorted(key)
+	if reverse {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	lo, hi := rangeBounds(start, stop, len(members))
+	return members[lo:hi], nil
+}
+
+func (m *memoryKeys) ZRangeByScore(key string, max float64, count int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var members []string
+	for _, entry := range m.sorted(key) {
+		if entry.Score > max || (count > 0 && int64(len(members)) == count) {
+			break
+		}
+		members = append(members, entry.Member)
+	}
+	return members, nil
+}
+
+func (m *memoryKeys) ZPopMin(key string, count int64) ([]ScoredMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := m.sorted(key)
+	members = members[:min(int64(len(members)), count)]
+	for _, entry := range members {
+		m.zrem(key, entry.Member)
+	}
+	return members, nil
+}
+
+func (m *memoryKeys) LRange(key string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	lo, hi := rangeBounds(start, stop, len(e.list))
+	return append([]string(nil), e.list[lo:hi]...), nil
+}
+
+func (m *memoryKeys) LLen(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key); e != nil {
+		return int64(len(e.list)), nil
+	}
+	return 0, nil
+}
+
+func (m *memoryKeys) XRange(key, after string, count int64) ([]StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	var entries []StreamEntry
+	afterMS, afterSeq := streamID(after)
+	for _, entry := range e.stream {
+		if count > 0 && int64(len(entries)) == count {
+			break
+		}
+		if after != "" {
+			ms, seq := streamID(entry.ID)
+			if ms < afterMS || (ms == afterMS && seq <= afterSeq) {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *memoryKeys) TakeToken(key string, rate float64, burst int, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var bucket map[string]string
+	if e := m.get(key); e != nil {
+		bucket = e.hash
+	}
+	fields, lifetime, allowed := takeToken(bucket, rate, burst, now)
+	m.hset(key, fields)
+	m.expireAt(key, now.Add(lifetime))
+	return allowed, nil
+}
+
+func (m *memoryKeys) SAddCapped(key, member string, limit int, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existed := m.get(key) != nil
+	m.sadd(key, member)
+	if limit > 0 && len(m.get(key).set) > limit {
+		m.srem(key, member)
+		return false, nil
+	}
+	if !existed || m.ttl(key) < ttl {
+		m.expireAt(key, time.Now().Add(ttl))
+	}
+	return true, nil
+}
+
+func (m *memoryKeys) HSwap(key, field, old, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(key)
+	if e == nil {
+		return false, nil
+	}
+	if current, ok := e.hash[field]; !ok || current != old {
+		return false, nil
+	}
+	if value == "" {
+		m.hdel(key, field)
+	} else {
+		e.hash[field] = value
+	}
+	return true, nil
+}
+
+func (m *memoryKeys) Batch(fn func(b KeyBatch)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(memoryBatch{m})
+	return nil
+}
+
+func (m *memoryKeys) Scan(prefix string, limit int, fn func(keys []string) error) (int, bool, error) {
+	return m.scan(prefix, 500, limit, fn)
+}
+
+func (m *memoryKeys) Expired(ctx context.Context, prefix string) <-chan string {
+	return m.expired.watch(ctx, prefix)
+}
+
+func (m *memoryKeys) Ping(ctx context.Context) error {
+	return nil
+}
+
+// memoryBatch applies a batch's writes as they're made, under the lock
+// Batch holds
+type memoryBatch struct {
+	m *memoryKeys
+}
+
+func (b memoryBatch) Set(key, value string, ttl time.Duration) {
+	b.m.setString(key, value, ttl)
+}
+
+func (b memoryBatch) Del(keys ...string) {
+	for _, key := range keys {
+		delete(b.m.keys, key)
+	}
+}
+
+func (b memoryBatch) Expire(key string, ttl time.Duration) {
+	b.m.expireAt(key, time.Now().Add(ttl))
+}
+
+func (b memoryBatch) ExpireAt(key string, at time.Time) {
+	b.m.expireAt(key, at)
+}
+
+func (b memoryBatch) HSet(key string, values map[string]interface{}) {
+	b.m.hset(key, values)
+}
+
+func (b memoryBatch) HIncrBy(key, field string, by int64) {
+	b.m.hincrBy(key, field, by)
+}
+
+func (b memoryBatch) HDel(key string, fields ...string) {
+	b.m.hdel(key, fields...)
+}
+
+func (b memoryBatch) SAdd(key string, members ...string) {
+	b.m.sadd(key, members...)
+}
+
+func (b memoryBatch) ZAdd(key, member string, score float64) {
+	b.m.zset(key)[member] = score
+}
+
+func (b memoryBatch) ZIncrBy(key, member string, by float64) {
+	b.m.zset(key)[member] += by
+}
+
+func (b memoryBatch) ZRem(key string, members ...string) {
+	b.m.zrem(key, members...)
+}
+
+func (b memoryBatch) LPush(key, value string) {
+	b.m.lpush(key, value)
+}
+
+func (b memoryBatch) LTrim(key string, start, stop int64) {
+	b.m.ltrim(key, start, stop)
+}
+
+func (b memoryBatch) XAdd(key string, values map[string]interface{}) {
+	b.m.xadd(key, values)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps polls in process memory, in the same keys as the Redis
+// store: a hash per poll, a set of its voters, a hash of their ballots and
+// a sorted set for its word cloud. Updates only reach this instance's
+// viewers.
+type memoryStore struct {
+	keys *memoryKeys
+
+	// watched are the polls Subscribe delivers the updates of, and subs
+	// the running Subscribe calls
+	watchMu sync.Mutex
+	watched map[string]bool
+	subs    map[*memorySubscription]bool
+}
+
+// newMemoryStore builds the in-memory store, for local development and
+// tests, along with the key store it shares its keys with. Nothing is
+// persisted.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		keys:    newMemoryKeys(),
+		watched: make(map[string]bool),
+		subs:    make(map[*memorySubscription]bool),
+	}
+}
+
+func (s *memoryStore) CreatePoll(id string, fields map[string]interface{}, ttl time.Duration) (bool, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pollKey := fmt.Sprintf("poll:%s", id)
+	if m.get(pollKey) != nil {
+		return false, nil
+	}
+	m.hset(pollKey, fields)
+	if ttl > 0 {
+		m.expireAt(pollKey, time.Now().Add(ttl))
+	}
+
+	// Clear ballots left behind by an earlier poll with the same ID
+	for _, prefix := range ballotPrefixes {
+		delete(m.keys, prefix+id)
+	}
+	return true, nil
+}
+
+func (s *memoryStore) GetPoll(id string) (map[string]string, error) {
+	return s.keys.HGetAll(fmt.Sprintf("poll:%s", id))
+}
+
+func (s *memoryStore) GetPolls(ids []string, fields ...string) ([]map[string]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	polls := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		var err error
+		if len(fields) == 0 {
+			polls[i], err = s.keys.HGetAll(fmt.Sprintf("poll:%s", id))
+		} else {
+			polls[i], err = s.keys.HMGet(fmt.Sprintf("poll:%s", id), fields...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return polls, nil
+}
+
+func (s *memoryStore) ScanPolls(limit int, fn func(ids []string) error) (int, bool, error) {
+	return s.keys.scan("poll:", 1000, limit, func(keys []string) error {
+		ids := make([]string, len(keys))
+		for i, key := range keys {
+			ids[i] = strings.TrimPrefix(key, "poll:")
+		}
+		return fn(ids)
+	})
+}
+
+func (s *memoryStore) UpdatePoll(id string, set map[string]interface{}, remove ...string) error {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pollKey := fmt.Sprintf("poll:%s", id)
+	m.hset(pollKey, set)
+	m.hdel(pollKey, remove...)
+	return nil
+}
+
+func (s *memoryStore) UpdateUnvotedPoll(id string, set map[string]interface{}, remove ...string) (bool, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pollKey := fmt.Sprintf("poll:%s", id)
+	if m.get(pollKey) == nil {
+		return false, nil
+	}
+	if e := m.get(fmt.Sprintf("vote:%s", id)); e != nil && len(e.hash) > 0 {
+		return false, nil
+	}
+	m.hset(pollKey, set)
+	m.hdel(pollKey, remove...)
+	return true, nil
+}
+
+func (s *memoryStore) SetPollFieldNX(id, field string, value interface{}) (bool, error) {
+	return s.keys.HSetNX(fmt.Sprintf("poll:%s", id), field, value)
+}
+
+func (s *memoryStore) IncrPollField(id, field string, by int64) (int64, error) {
+	return s.keys.HIncrBy(fmt.Sprintf("poll:%s", id), field, by)
+}
+
+func (s *memoryStore) ClosePoll(id string) (bool, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(fmt.Sprintf("poll:%s", id))
+	if e == nil || e.hash["status"] == statusClosed {
+		return false, nil
+	}
+	e.hash["status"] = statusClosed
+	return true, nil
+}
+
+func (s *memoryStore) SwapPollStatus(id, from, to string, set map[string]interface{}) (bool, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pollKey := fmt.Sprintf("poll:%s", id)
+	e := m.get(pollKey)
+	if e == nil {
+		return false, nil
+	}
+	status := e.hash["status"]
+	if status == "" {
+		status = statusActive
+	}
+	if status != from {
+		return false, nil
+	}
+	m.hset(pollKey, set)
+	e.hash["status"] = to
+	return true, nil
+}
+
+func (s *memoryStore) PollTTL(id string) (time.Duration, error) {
+	return s.keys.TTL(fmt.Sprintf("poll:%s", id))
+}
+
+func (s *memoryStore) ExpirePoll(id string, ttl time.Duration) error {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	at := time.Now().Add(ttl)
+	m.expireAt(fmt.Sprintf("poll:%s", id), at)
+	m.expireAt(fmt.Sprintf("voted:%s", id), at)
+	m.expireAt(fmt.Sprintf("vote:%s", id), at)
+	m.expireAt(wordsKey(id), at)
+	return nil
+}
+
+func (s *memoryStore) HasVoted(id, member string) (bool, error) {
+	return s.keys.SIsMember(fmt.Sprintf("voted:%s", id), member)
+}
+
+// applyIncrements applies increments to a poll, negated if undo is set,
+// and returns the new values. Undoing skips counters that are gone, as the
+// Redis store does. The caller holds the lock.
+func (s *memoryStore) applyIncrements(id string, increments []Increment, undo bool) ([]int64, error) {
+	pollKey := fmt.Sprintf("poll:%s", id)
+	values := make([]int64, len(increments))
+	for i, inc := range increments {
+		by := inc.By
+		if undo {
+			if !s.keys.hexists(pollKey, inc.Field) {
+				continue
+			}
+			by = -by
+		}
+		var err error
+		if values[i], err = s.keys.hincrBy(pollKey, inc.Field, by); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (s *memoryStore) RecordVote(id string, members []string, ballot string, increments ...Increment) ([]int64, bool, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.get(fmt.Sprintf("poll:%s", id)) == nil {
+		return nil, false, errPollNotFound
+	}
+	votedKey := fmt.Sprintf("voted:%s", id)
+	if e := m.get(votedKey); e != nil {
+		for _, member := range members {
+			if e.set[member] {
+				return nil, false, nil
+			}
+		}
+	}
+	m.sadd(votedKey, members...)
+	m.hset(fmt.Sprintf("vote:%s", id), map[string]interface{}{members[0]: ballot})
+	values, err := s.applyIncrements(id, increments, false)
+	return values, true, err
+}
+
+func (s *memoryStore) ChangeVote(id, member, ballot string, undo func(old string) []Increment, increments ...Increment) (string, []int64, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.get(fmt.Sprintf("poll:%s", id)) == nil {
+		return "", nil, errPollNotFound
+	}
+	ballotsKey := fmt.Sprintf("vote:%s", id)
+	old := ""
+	if e := m.get(ballotsKey); e != nil {
+		old = e.hash[member]
+	}
+	m.hset(ballotsKey, map[string]interface{}{member: ballot})
+	if old != "" {
+		if _, err := s.applyIncrements(id, undo(old), true); err != nil {
+			return old, nil, err
+		}
+	}
+	values, err := s.applyIncrements(id, increments, false)
+	if err != nil {
+		return old, nil, err
+	}
+	m.sadd(fmt.Sprintf("voted:%s", id), member)
+	return old, values, nil
+}
+
+func (s *memoryStore) RetractVote(id, member string, undo func(old string) []Increment) (string, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ballotsKey := fmt.Sprintf("vote:%s", id)
+	e := m.get(ballotsKey)
+	if e == nil || e.hash[member] == "" {
+		return "", nil
+	}
+	old := e.hash[member]
+	m.hdel(ballotsKey, member)
+	m.srem(fmt.Sprintf("voted:%s", id), member)
+	_, err := s.applyIncrements(id, undo(old), true)
+	return old, err
+}
+
+func (s *memoryStore) GetBallots(id string) ([]string, error) {
+	ballots, err := s.keys.HGetAll(fmt.Sprintf("vote:%s", id))
+	values := make([]string, 0, len(ballots))
+	for _, ballot := range ballots {
+		values = append(values, ballot)
+	}
+	return values, err
+}
+
+func (s *memoryStore) GetBallot(id, member string) (string, error) {
+	ballot, err := s.keys.HGet(fmt.Sprintf("vote:%s", id), member)
+	if err == errKeyNotFound {
+		return "", nil
+	}
+	return ballot, err
+}
+
+func (s *memoryStore) ScanBallots(id string, batch int, fn func(ballots map[string]string) error) error {
+	all, err := s.keys.HGetAll(fmt.Sprintf("vote:%s", id))
+	if err != nil {
+		return err
+	}
+	ballots := make(map[string]string, min(batch, len(all)))
+	for member, ballot := range all {
+		ballots[member] = ballot
+		if len(ballots) == batch {
+			if err := fn(ballots); err != nil {
+				return err
+			}
+			ballots = make(map[string]string, batch)
+		}
+	}
+	if len(ballots) > 0 {
+		return fn(ballots)
+	}
+	return nil
+}
+
+func (s *memoryStore) CountBallots(id string) (int64, error) {
+	return s.keys.HLen(fmt.Sprintf("vote:%s", id))
+}
+
+func (s *memoryStore) CountVoters(id string) (int64, error) {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(fmt.Sprintf("voted:%s", id)); e != nil {
+		return int64(len(e.set)), nil
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) CountWords(id string, words []string, by int64) error {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := wordsKey(id)
+	for _, word := range words {
+		m.zset(key)[word] += float64(by)
+	}
+	if by < 0 {
+		for _, word := range words {
+			if m.zset(key)[word] <= 0 {
+				m.zrem(key, word)
+			}
+		}
+	}
+	if ttl := m.ttl(fmt.Sprintf("poll:%s", id)); ttl > 0 {
+		m.expireAt(key, time.Now().Add(ttl))
+	}
+	return nil
+}
+
+func (s *memoryStore) TopWords(id string, limit int) ([]WordCount, error) {
+	entries, err := s.keys.ZRange(wordsKey(id), 0, int64(limit)-1, true)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]WordCount, len(entries))
+	for i, entry := range entries {
+		words[i] = WordCount{Word: entry.Member, Count: int64(entry.Score)}
+	}
+	return words, nil
+}
+
+func (s *memoryStore) DeletePoll(id string) error {
+	keys := []string{fmt.Sprintf("poll:%s", id)}
+	for _, prefix := range companionPrefixes {
+		keys = append(keys, prefix+id)
+	}
+	return s.keys.Del(keys...)
+}
+
+func (s *memoryStore) ResetVotes(id string) error {
+	m := s.keys
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.get(fmt.Sprintf("poll:%s", id))
+	if e == nil {
+		return errPollNotFound
+	}
+	for field := range e.hash {
+		zero, remove := resetAction(field)
+		if zero {
+			e.hash[field] = "0"
+		} else if remove {
+			delete(e.hash, field)
+		}
+	}
+	for _, prefix := range ballotPrefixes {
+		delete(m.keys, prefix+id)
+	}
+	return nil
+}
+
+// memorySubscription queues the updates of one Subscribe call, so Publish
+// never waits on its reader
+type memorySubscription struct {
+	mu    sync.Mutex
+	queue []PollMessage
+	ready chan struct{}
+}
+
+func (s *memoryStore) Publish(id string, payload []byte, meta map[string]string) error {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if !s.watched[id] {
+		return nil
+	}
+	msg := PollMessage{PollID: id, Payload: string(payload), Meta: meta}
+	for sub := range s.subs {
+		sub.mu.Lock()
+		sub.queue = append(sub.queue, msg)
+		sub.mu.Unlock()
+		select {
+		case sub.ready <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Watch(id string) {
+	s.watchMu.Lock()
+	s.watched[id] = true
+	s.watchMu.Unlock()
+}
+
+func (s *memoryStore) Unwatch(id string) {
+	s.watchMu.Lock()
+	delete(s.watched, id)
+	s.watchMu.Unlock()
+}
+
+func (s *memoryStore) Subscribe(ctx context.Context) <-chan PollMessage {
+	out := make(chan PollMessage)
+	sub := &memorySubscription{ready: make(chan struct{}, 1)}
+	s.watchMu.Lock()
+	s.subs[sub] = true
+	s.watchMu.Unlock()
+	updatesHealthy.Store(true)
+
+	go func() {
+		defer close(out)
+		defer updatesHealthy.Store(false)
+		defer func() {
+			s.watchMu.Lock()
+			delete(s.subs, sub)
+			s.watchMu.Unlock()
+		}()
+		for {
+			select {
+			case <-sub.ready:
+			case <-ctx.Done():
+				return
+			}
+			sub.mu.Lock()
+			queue := sub.queue
+			sub.queue = nil
+			sub.mu.Unlock()
+			for _, msg := range queue {
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
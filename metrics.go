@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, exposed on /metrics
+var (
+	abuseFlagsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_abuse_flags_total",
+		Help: "Number of times a source IP crossed the vote burst threshold.",
+	})
+	abuseBlockedVotesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_abuse_blocked_votes_total",
+		Help: "Votes rejected because the source IP was temporarily blocked.",
+	})
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_rate_limited_total",
+		Help: "Requests rejected by a rate limit, by limit.",
+	}, []string{"limit"})
+	wsHandshakesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_ws_handshakes_total",
+		Help: "WebSocket upgrade attempts, by whether the handshake was accepted.",
+	}, []string{"accepted"})
+	wsSlowClientEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_ws_slow_client_evictions_total",
+		Help: "WebSocket connections dropped because their send buffer stayed full.",
+	})
+	voteBroadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pulse_vote_broadcast_latency_seconds",
+		Help:    "Time from a vote arriving on a WebSocket to its update being written to subscribers.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+	kafkaDeliveryFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_kafka_delivery_failures_total",
+		Help: "Vote events that could not be written to Kafka.",
+	})
+	kafkaDroppedEventsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_kafka_dropped_events_total",
+		Help: "Vote events dropped because the Kafka buffer was full.",
+	})
+	pollsCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_polls_created_total",
+		Help: "Polls created on this instance.",
+	})
+	votesRecordedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_votes_recorded_total",
+		Help: "Votes recorded on this instance, including changed votes.",
+	})
+	votesRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_votes_rejected_total",
+		Help: "Votes rejected on this instance, by reason; duplicate votes have reason \"duplicate\".",
+	}, []string{"reason"})
+	wsConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pulse_ws_connections",
+		Help: "Open WebSocket connections on this instance, by poll. A poll's series is removed once nobody on this instance watches it.",
+	}, []string{"poll"})
+	redisErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_redis_errors_total",
+		Help: "Redis commands that failed, by command.",
+	}, []string{"command"})
+)
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Text the audience submits, open-text answers and Q&A questions, goes
+// through moderation before it reaches other viewers: words on the
+// blocklist are masked or the text refused, and on moderated polls it
+// waits for the owner's approval.
+var (
+	// blockedWords are matched as whole words, ignoring case
+	blockedWords = loadBlockedWords()
+
+	// moderationFilter is what happens to text with a blocked word:
+	// "mask" stars the word out, "reject" refuses the text
+	moderationFilter = envString("MODERATION_FILTER", "mask")
+)
+
+// ModerationItem is a submission waiting for approval on a moderated poll
+type ModerationItem struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"` // "question" or "answer"
+	Text        string `json:"text"`
+	Author      string `json:"author,omitempty"`
+	SubmittedAt int64  `json:"submittedAt"`
+}
+
+// pendingAnswer is an open-text answer held back from the word cloud.
+// Rejected answers are kept, so withdrawing one doesn't take words out of
+// the cloud that it never added.
+type pendingAnswer struct {
+	Member      string `json:"member"` // the voter, as in vote:<pollID>
+	Text        string `json:"text"`
+	SubmittedAt int64  `json:"submittedAt"`
+	Rejected    bool   `json:"rejected,omitempty"`
+}
+
+// pendingAnswersKey is the hash of a moderated poll's answers that weren't
+// approved, awaiting approval or rejected, by answerItemID
+func pendingAnswersKey(pollID string) string {
+	return fmt.Sprintf("modanswers:%s", pollID)
+}
+
+// answerItemID is the moderation ID of a voter's answer. A voter has one
+// answer at a time, so a changed answer replaces the pending one.
+func answerItemID(member string) string {
+	return hashToken(member)[:16]
+}
+
+// decideAnswerScript replaces a pending answer, or deletes it when the
+// replacement is empty, unless the voter changed it since it was read
+//
+// KEYS: the pending answers hash
+// ARGV: item ID, the answer as read, the replacement
+var decideAnswerScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`)
+
+// loadBlockedWords reads the blocklist from MODERATION_WORDS, comma
+// separated, and MODERATION_WORDS_FILE, one word per line
+func loadBlockedWords() map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Split(envString("MODERATION_WORDS", ""), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			words[word] = true
+		}
+	}
+	path := envString("MODERATION_WORDS_FILE", "")
+	if path == "" {
+		return words
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fatal("Failed to open moderation word list", "path", path, "error", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fatal("Failed to read moderation word list", "path", path, "error", err)
+	}
+	return words
+}
+
+// moderateText filters text through the blocklist. It returns the text
+// with blocked words starred out, or false when MODERATION_FILTER=reject
+// and the text has one.
+func moderateText(text string) (string, bool) {
+	if len(blockedWords) == 0 {
+		return text, true
+	}
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+	runes := []rune(text)
+	found := false
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		if blockedWords[strings.ToLower(string(runes[start:end]))] {
+			found = true
+			for i := start; i < end; i++ {
+				runes[i] = '*'
+			}
+		}
+		start = end
+	}
+	if !found {
+		return text, true
+	}
+	if moderationFilter == "reject" {
+		return "", false
+	}
+	return string(runes), true
+}
+
+// submitAnswer adds a voter's answer to an open-text poll's word cloud,
+// or on a moderated poll queues it for approval
+func submitAnswer(state map[string]string, pollID, member, answer string) {
+	if state["moderated"] != "1" {
+		countAnswer(pollID, answer, 1)
+		return
+	}
+	encoded, _ := json.Marshal(pendingAnswer{Member: member, Text: answer, SubmittedAt: time.Now().Unix()})
+	key := pendingAnswersKey(pollID)
+	ttl, _ := store.PollTTL(pollID)
+	err := kv.Batch(func(b KeyBatch) {
+		b.HSet(key, map[string]interface{}{answerItemID(member): encoded})
+		if ttl > 0 {
+			b.Expire(key, ttl)
+		}
+	})
+	if err != nil {
+		logger.Error("Failed to queue answer for approval", "poll_id", pollID, "error", err)
+	}
+}
+
+// withdrawAnswer takes a changed or retracted answer out of the word
+// cloud, or out of the moderation queue if it never made it in
+func withdrawAnswer(pollID, member, answer string) {
+	if removed, _ := kv.HDel(pendingAnswersKey(pollID), answerItemID(member)); removed > 0 {
+		return
+	}
+	countAnswer(pollID, answer, -1)
+}
+
+// moderationQueue handles GET /api/poll/{pollID}/moderation, the
+// submissions of a moderated poll awaiting approval, oldest first
+func (s *Server) moderationQueue(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	questions, err := loadQuestions(pollID, true)
+	if err != nil {
+		requestLogger(r).Error("Failed to load questions", "error", err)
+		http.Error(w, "Failed to load moderation queue", http.StatusInternalServerError)
+		return
+	}
+	answers, err := kv.HGetAll(pendingAnswersKey(pollID))
+	if err != nil {
+		requestLogger(r).Error("Failed to load pending answers", "error", err)
+		http.Error(w, "Failed to load moderation queue", http.StatusInternalServerError)
+		return
+	}
+
+	items := []ModerationItem{}
+	for _, q := range questions {
+		if q.Pending {
+			items = append(items, ModerationItem{ID: q.ID, Kind: "question", Text: q.Text, Author: q.Author, SubmittedAt: q.CreatedAt})
+		}
+	}
+	for id, encoded := range answers {
+		var answer pendingAnswer
+		if json.Unmarshal([]byte(encoded), &answer) == nil && !answer.Rejected {
+			items = append(items, ModerationItem{ID: id, Kind: "answer", Text: answer.Text, SubmittedAt: answer.SubmittedAt})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].SubmittedAt != items[j].SubmittedAt {
+			return items[i].SubmittedAt < items[j].SubmittedAt
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pending": items})
+}
+
+// approveSubmission handles POST /api/poll/{pollID}/moderation/{itemID}/approve,
+// which lets a pending question or answer through to the audience
+func (s *Server) approveSubmission(w http.ResponseWriter, r *http.Request) {
+	s.decideSubmission(w, r, true)
+}
+
+// rejectSubmission handles POST /api/poll/{pollID}/moderation/{itemID}/reject.
+// A rejected question is deleted; a rejected answer still counts as a
+// response but never reaches the word cloud.
+func (s *Server) rejectSubmission(w http.ResponseWriter, r *http.Request) {
+	s.decideSubmission(w, r, false)
+}
+
+// decideSubmission approves or rejects a pending submission
+func (s *Server) decideSubmission(w http.ResponseWriter, r *http.Request, approve bool) {
+	vars := mux.Vars(r)
+	pollID, itemID := vars["pollID"], vars["itemID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	q, err := loadQuestion(pollID, itemID)
+	if err != nil && err != errKeyNotFound {
+		requestLogger(r).Error("Failed to load question", "error", err)
+		http.Error(w, "Failed to moderate submission", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		if !q.Pending {
+			http.Error(w, "Submission isn't awaiting approval", http.StatusNotFound)
+			return
+		}
+		if err := decideQuestion(pollID, q, approve); err != nil {
+			requestLogger(r).Error("Failed to moderate question", "error", err)
+			http.Error(w, "Failed to moderate submission", http.StatusInternalServerError)
+			return
+		}
+		requestLogger(r).Info("Question moderated", "question_id", q.ID, "approved", approve)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	encoded, err := kv.HGet(pendingAnswersKey(pollID), itemID)
+	if err == errKeyNotFound {
+		http.Error(w, "Submission isn't awaiting approval", http.StatusNotFound)
+		return
+	}
+	var answer pendingAnswer
+	if err == nil {
+		err = json.Unmarshal([]byte(encoded), &answer)
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load pending answer", "error", err)
+		http.Error(w, "Failed to moderate submission", http.StatusInternalServerError)
+		return
+	}
+	if answer.Rejected {
+		http.Error(w, "Submission isn't awaiting approval", http.StatusNotFound)
+		return
+	}
+	// Approved answers leave the queue; rejected ones stay, marked. Either
+	// way only the answer that was read is decided, in case the voter
+	// changed it meanwhile.
+	replacement := ""
+	if !approve {
+		answer.Rejected = true
+		rejected, _ := json.Marshal(answer)
+		replacement = string(rejected)
+	}
+	decided, err := kv.HSwap(pendingAnswersKey(pollID), itemID, encoded, replacement)
+	if err != nil {
+		requestLogger(r).Error("Failed to moderate answer", "error", err)
+		http.Error(w, "Failed to moderate submission", http.StatusInternalServerError)
+		return
+	}
+	if !decided {
+		http.Error(w, "Submission changed; reload the moderation queue", http.StatusConflict)
+		return
+	}
+	if approve {
+		countAnswer(pollID, answer.Text, 1)
+		publishEvent(pollID, currentTopWords(pollID))
+	}
+	requestLogger(r).Info("Answer moderated", "item_id", itemID, "approved", approve)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decideQuestion shows an approved question to the audience, or deletes a
+// rejected one
+func decideQuestion(pollID string, q Question, approve bool) error {
+	if approve {
+		q.Pending = false
+		encoded, _ := json.Marshal(q)
+		if err := kv.HSet(questionsKey(pollID), map[string]interface{}{q.ID: encoded}); err != nil {
+			return err
+		}
+		markQuestions(pollID)
+		return nil
+	}
+	return kv.Batch(func(b KeyBatch) {
+		b.HDel(questionsKey(pollID), q.ID)
+		b.ZRem(questionVotesKey(pollID), q.ID)
+	})
+}
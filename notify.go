@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTP settings for result emails. Email delivery is disabled unless
+// SMTP_HOST is set.
+var (
+	smtpHost     = envString("SMTP_HOST", "")
+	smtpPort     = envString("SMTP_PORT", "587")
+	smtpUser     = envString("SMTP_USER", "")
+	smtpPassword = envString("SMTP_PASSWORD", "")
+	smtpFrom     = envString("SMTP_FROM", "pulse@localhost")
+
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// ClosedNotification is the JSON body POSTed to a poll's notify_url
+type ClosedNotification struct {
+	Event   string       `json:"event"`
+	Summary *PollSummary `json:"summary"`
+	Text    string       `json:"text"`
+}
+
+// validateNotifyURL checks a webhook URL given at creation. Like
+// webhooks, it may only point at a public address.
+func validateNotifyURL(raw string) error {
+	return validateOutboundURL("notify_url", raw)
+}
+
+// validateNotifyEmail checks an email address given at creation
+func validateNotifyEmail(raw string) error {
+	if _, err := mail.ParseAddress(raw); err != nil {
+		return fmt.Errorf("notify_email is not a valid address")
+	}
+	if smtpHost == "" {
+		return fmt.Errorf("email notifications are not configured on this server")
+	}
+	return nil
+}
+
+// notifyClosed delivers the final results summary to the poll's webhook
+// and/or email address, if any were set at creation
+func notifyClosed(pollID string) {
+	targets, err := pollFields(pollID, "notify_url", "notify_email")
+	if err != nil {
+		logger.Error("Failed to load notification settings", "poll_id", pollID, "error", err)
+		return
+	}
+	webhook, email := targets["notify_url"], targets["notify_email"]
+	if webhook == "" && email == "" {
+		return
+	}
+
+	summary, err := loadSummary(pollID)
+	if err != nil {
+		logger.Error("Failed to build summary", "poll_id", pollID, "error", err)
+		return
+	}
+
+	if webhook != "" {
+		if err := postSummary(webhook, summary); err != nil {
+			logger.Error("Failed to deliver results webhook", "poll_id", pollID, "error", err)
+		}
+	}
+	if email != "" {
+		if err := emailSummary(email, summary); err != nil {
+			logger.Error("Failed to email results", "poll_id", pollID, "error", err)
+		}
+	}
+}
+
+// postSummary sends the summary to a webhook URL, through the client that
+// keeps webhooks off internal addresses
+func postSummary(webhook string, summary *PollSummary) error {
+	body, err := json.Marshal(ClosedNotification{
+		Event:   "pollClosed",
+		Summary: summary,
+		Text:    summary.Text(),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := outboundClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// emailSummary sends the summary as a plain-text email
+func emailSummary(to string, summary *PollSummary) error {
+	if smtpHost == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Results: "+summary.Question))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(summary.Text())
+
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
+	}
+	return smtp.SendMail(smtpHost+":"+smtpPort, auth, smtpFrom, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Signing in with an identity provider over OpenID Connect, such as
+// Google, Microsoft Entra ID (Azure AD), Okta or Keycloak, is enabled by
+// OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_CLIENT_SECRET, on top of ACCOUNTS.
+// Each provider subject gets an account of its own; OIDC_ALLOWED_DOMAINS
+// keeps out everyone whose email isn't at one of the organization's
+// domains, and PASSWORD_ACCOUNTS=false leaves the provider the only way in.
+var (
+	oidcIssuer         = envString("OIDC_ISSUER", "")
+	oidcClientID       = envString("OIDC_CLIENT_ID", "")
+	oidcClientSecret   = envString("OIDC_CLIENT_SECRET", "")
+	oidcRedirectURL    = envString("OIDC_REDIRECT_URL", "") // defaults to <base URL>/api/auth/oidc/callback
+	oidcScopes         = strings.Fields(envString("OIDC_SCOPES", "openid email profile"))
+	oidcProviderName   = envString("OIDC_PROVIDER_NAME", "SSO") // shown on the sign-in button
+	oidcAllowedDomains = toSet(strings.Fields(strings.ToLower(strings.ReplaceAll(envString("OIDC_ALLOWED_DOMAINS", ""), ",", " "))))
+	passwordAccounts   = envBool("PASSWORD_ACCOUNTS", true)
+)
+
+// oidcStateTTL is how long a sign-in may take at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcEnabled reports whether signing in with the identity provider is
+// configured
+func oidcEnabled() bool {
+	return accountsEnabled && oidcIssuer != "" && oidcClientID != ""
+}
+
+// oidcProvider is the provider's discovered configuration. Discovery is
+// retried on the next sign-in until it succeeds.
+var oidcProvider struct {
+	sync.Mutex
+	provider *oidc.Provider
+}
+
+func loadOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+	if oidcProvider.provider != nil {
+		return oidcProvider.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, oidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider.provider = provider
+	return provider, nil
+}
+
+// oidcConfig is the OAuth2 client of the provider, redirecting back to
+// the server the request reached
+func oidcConfig(r *http.Request, provider *oidc.Provider) *oauth2.Config {
+	redirect := oidcRedirectURL
+	if redirect == "" {
+		redirect = requestBaseURL(r) + "/api/auth/oidc/callback"
+	}
+	return &oauth2.Config{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       oidcScopes,
+	}
+}
+
+// oidcStateKey holds a sign-in in progress, as JSON oidcState, until the
+// provider redirects back with its state
+func oidcStateKey(state string) string {
+	return fmt.Sprintf("oidcstate:%s", state)
+}
+
+// oidcState is what's kept of a sign-in while the user is at the provider
+type oidcState struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+	ReturnTo string `json:"return_to"`
+}
+
+// oidcSubjectKey maps a provider subject to its account's ID. Subjects
+// are only unique per issuer, so the key covers both.
+func oidcSubjectKey(issuer, subject string) string {
+	return fmt.Sprintf("oidc:%s", hashToken(issuer+"\x00"+subject))
+}
+
+// oidcClaims are the ID token claims accounts are made from
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"` // left out by some providers
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// displayName picks what an account made from the claims is called
+func (c oidcClaims) displayName(subject string) string {
+	for _, name := range []string{c.PreferredUsername, c.Email, c.Name} {
+		if name = normalizeText(name); name != "" {
+			return name
+		}
+	}
+	return subject
+}
+
+// emailAllowed reports whether OIDC_ALLOWED_DOMAINS lets the claims in.
+// The email has to be verified, unless the provider doesn't say.
+func (c oidcClaims) emailAllowed() bool {
+	if len(oidcAllowedDomains) == 0 {
+		return true
+	}
+	if c.EmailVerified != nil && !*c.EmailVerified {
+		return false
+	}
+	at := strings.LastIndex(c.Email, "@")
+	return at > 0 && oidcAllowedDomains[strings.ToLower(c.Email[at+1:])]
+}
+
+// safeReturnPath keeps sign-ins from redirecting off the site. The
+// fragment is dropped, since the session is handed over in it.
+func safeReturnPath(path string) string {
+	path, _, _ = strings.Cut(path, "#")
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return "/"
+	}
+	return path
+}
+
+// oidcLogin handles GET /api/auth/oidc/login?return_to=<path>, which sends
+// the browser to the identity provider to sign in
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	if !authLimit.Allow(clientIP(r)) {
+		tooManyRequests(w, authLimit, "Too many attempts, try again later")
+		return
+	}
+	provider, err := loadOIDCProvider(r.Context())
+	if err != nil {
+		requestLogger(r).Error("Failed to discover identity provider", "issuer", oidcIssuer, "error", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := newToken()
+	pending := oidcState{
+		Nonce:    newToken(),
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: safeReturnPath(r.URL.Query().Get("return_to")),
+	}
+	encoded, _ := json.Marshal(pending)
+	if err := kv.Set(oidcStateKey(state), string(encoded), oidcStateTTL); err != nil {
+		requestLogger(r).Error("Failed to save sign-in state", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	target := oidcConfig(r, provider).AuthCodeURL(state, oidc.Nonce(pending.Nonce), oauth2.S256ChallengeOption(pending.Verifier))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallback handles GET /api/auth/oidc/callback, where the provider
+// sends the browser back. The account of the provider subject is signed
+// in, and created on its first sign-in. The session is handed to the
+// page in the URL fragment, which isn't sent to servers or in referrers.
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	encoded, err := kv.GetDel(oidcStateKey(query.Get("state")))
+	if err == errKeyNotFound || query.Get("state") == "" {
+		http.Error(w, "Sign-in expired or already used, try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load sign-in state", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	var pending oidcState
+	json.Unmarshal([]byte(encoded), &pending)
+	if reason := query.Get("error"); reason != "" {
+		requestLogger(r).Info("Identity provider refused sign-in", "error", reason)
+		http.Error(w, "Sign-in was cancelled or refused", http.StatusForbidden)
+		return
+	}
+
+	provider, err := loadOIDCProvider(r.Context())
+	if err != nil {
+		requestLogger(r).Error("Failed to discover identity provider", "issuer", oidcIssuer, "error", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	token, err := oidcConfig(r, provider).Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(pending.Verifier))
+	if err != nil {
+		requestLogger(r).Warn("Failed to redeem sign-in code", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != pending.Nonce {
+		requestLogger(r).Warn("Rejected ID token", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusForbidden)
+		return
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		requestLogger(r).Warn("Failed to read ID token claims", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusForbidden)
+		return
+	}
+	if !claims.emailAllowed() {
+		requestLogger(r).Info("Refused sign-in from outside the allowed domains")
+		http.Error(w, "This account isn't allowed to sign in here", http.StatusForbidden)
+		return
+	}
+
+	account, err := oidcAccount(idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		requestLogger(r).Error("Failed to load account", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	session, err := issueSession(account, time.Now())
+	if err != nil {
+		requestLogger(r).Error("Failed to sign session token", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Signed in with identity provider", "account_id", account.ID)
+
+	payload, _ := json.Marshal(session)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, pending.ReturnTo+"#session="+url.QueryEscape(base64.RawURLEncoding.EncodeToString(payload)), http.StatusFound)
+}
+
+// oidcAccount returns the account of a provider subject, creating it on
+// its first sign-in. The name and email are refreshed from the claims; an
+// email the provider says is unverified isn't kept, since polls restricted
+// with allowed_emails trust it.
+func oidcAccount(issuer, subject string, claims oidcClaims) (Account, error) {
+	key := oidcSubjectKey(issuer, subject)
+	created, err := kv.SetNX(key, newToken(), 0)
+	if err != nil {
+		return Account{}, err
+	}
+	id, err := kv.Get(key)
+	if err != nil {
+		return Account{}, err
+	}
+
+	fields := map[string]interface{}{
+		"username": claims.displayName(subject),
+		"email":    strings.ToLower(claims.Email),
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		fields["email"] = ""
+	}
+	if created {
+		fields["created_at"] = time.Now().Unix()
+		fields["issuer"] = issuer
+	}
+	if err := kv.HSet(accountKey(id), fields); err != nil {
+		return Account{}, err
+	}
+	account, _, err := loadAccount(id)
+	return account, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"unicode/utf8"
+)
+
+// Limits on option metadata
+const (
+	maxImageURLBytes    = 2048
+	maxEmojiRunes       = 8 // room for ZWJ sequences and skin tones
+	maxDescriptionBytes = 280
+)
+
+// colorPattern matches the CSS hex colors options may be given
+var colorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// OptionMeta is the optional presentation of an option beyond its text
+type OptionMeta struct {
+	ImageURL    string `json:"image_url,omitempty"`
+	Emoji       string `json:"emoji,omitempty"`
+	Color       string `json:"color,omitempty"` // #rgb or #rrggbb
+	Description string `json:"description,omitempty"`
+}
+
+// PollOption is an option with its metadata, as returned by the API
+type PollOption struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	OptionMeta
+}
+
+// OptionInput is an option of a poll being created: either just its text
+// or an object with the text and metadata
+type OptionInput struct {
+	Text    string `json:"text"`
+	Correct bool   `json:"correct"` // quiz polls
+	OptionMeta
+}
+
+// UnmarshalJSON accepts a plain string as well as an option object
+func (o *OptionInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*o = OptionInput{Text: text}
+		return nil
+	}
+	type plain OptionInput
+	return json.Unmarshal(data, (*plain)(o))
+}
+
+// optionMetaKey is the hash field holding an option's metadata as JSON;
+// options without metadata have none
+func optionMetaKey(optionID string) string {
+	return "optmeta_" + optionID
+}
+
+// normalize cleans up metadata like option text and checks it
+func (m *OptionMeta) normalize() error {
+	m.ImageURL = normalizeText(m.ImageURL)
+	m.Emoji = normalizeText(m.Emoji)
+	m.Color = normalizeText(m.Color)
+	m.Description = normalizeText(m.Description)
+
+	if m.ImageURL != "" {
+		u, err := url.Parse(m.ImageURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("image_url must be an http(s) URL")
+		}
+		if len(m.ImageURL) > maxImageURLBytes {
+			return fmt.Errorf("image_url must be at most %d bytes", maxImageURLBytes)
+		}
+	}
+	if utf8.RuneCountInString(m.Emoji) > maxEmojiRunes {
+		return fmt.Errorf("emoji must be at most %d characters", maxEmojiRunes)
+	}
+	if m.Color != "" && !colorPattern.MatchString(m.Color) {
+		return fmt.Errorf("color must be a hex color like #1e90ff")
+	}
+	if len(m.Description) > maxDescriptionBytes {
+		return fmt.Errorf("description must be at most %d bytes", maxDescriptionBytes)
+	}
+	return nil
+}
+
+// encodeOptionMeta is how metadata is kept in the poll hash; empty
+// metadata isn't stored
+func encodeOptionMeta(m OptionMeta) string {
+	if m == (OptionMeta{}) {
+		return ""
+	}
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// optionMeta decodes the metadata kept with an option, empty if it has
+// none
+func optionMeta(data map[string]string, optionID string) OptionMeta {
+	var meta OptionMeta
+	if raw := data[optionMetaKey(optionID)]; raw != "" {
+		json.Unmarshal([]byte(raw), &meta)
+	}
+	return meta
+}
+
+// optionDescription returns the description kept with an option, if any
+func optionDescription(data map[string]string, optionID string) string {
+	return optionMeta(data, optionID).Description
+}
+
+// parseOptionDetails returns a poll's options with their metadata, in the
+// given order
+func parseOptionDetails(data map[string]string, order []string) []PollOption {
+	details := make([]PollOption, 0, len(order))
+	for _, id := range order {
+		text, ok := data["option_"+id]
+		if !ok {
+			continue
+		}
+		details = append(details, PollOption{ID: id, Text: text, OptionMeta: optionMeta(data, id)})
+	}
+	return details
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// OptionRequest represents the body for adding or editing an option.
+// Editing replaces the metadata and the correct mark too, so fields left
+// out are cleared.
+type OptionRequest struct {
+	Text    string `json:"text"`
+	Correct bool   `json:"correct"` // quiz polls
+	OptionMeta
+}
+
+// PollUpdated is broadcast when a poll's question or options change. The
+// same message, typed pollInfo, is the first thing a WebSocket is sent
+// about its poll.
+type PollUpdated struct {
+	Type     string            `json:"type"`
+	Question string            `json:"question"`
+	Options  map[string]string `json:"options"`
+	Details  []PollOption      `json:"option_details"` // in display order
+}
+
+// pollInfo builds the pollInfo message for a connecting client, with the
+// options in the order that client sees them
+func pollInfo(pollID string, data map[string]string, clientID string) PollUpdated {
+	options := parseOptions(data)
+	order := optionOrder(options, data["shuffle_options"] == "1", pollID, clientID)
+	return PollUpdated{
+		Type:     "pollInfo",
+		Question: data["question"],
+		Options:  options,
+		Details:  parseOptionDetails(data, order),
+	}
+}
+
+// addOption handles POST /api/poll/{pollID}/options. Adding an option is
+// allowed even after voting started since it doesn't change existing ones.
+func (s *Server) addOption(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	req, ok := decodeOption(w, r)
+	if !ok {
+		return
+	}
+	text, meta := req.Text, req.OptionMeta
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if data["status"] == statusClosed {
+		http.Error(w, "Poll is closed", http.StatusConflict)
+		return
+	}
+	if pollTypeOf(data) == pollTypeText {
+		http.Error(w, "Open-text polls have no options", http.StatusBadRequest)
+		return
+	}
+	if req.Correct && pollTypeOf(data) != pollTypeQuiz {
+		http.Error(w, "Only quiz options can be correct", http.StatusBadRequest)
+		return
+	}
+	if optionTaken(data, text, "") {
+		http.Error(w, fmt.Sprintf("Duplicate option: %q", text), http.StatusBadRequest)
+		return
+	}
+	if err := checkTextBudget(data["question"], optionTexts(data, text, ""), optionDescriptions(data, meta.Description, "")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Polls created before next_option existed get it seeded from their
+	// highest option index
+	store.SetPollFieldNX(pollID, "next_option", maxOptionIndex(data)+1)
+	next, err := store.IncrPollField(pollID, "next_option", 1)
+	if err != nil {
+		requestLogger(r).Error("Failed to allocate option ID", "error", err)
+		http.Error(w, "Failed to add option", http.StatusInternalServerError)
+		return
+	}
+	optionID := strconv.FormatInt(next-1, 10)
+
+	fields := map[string]interface{}{"option_" + optionID: text, "votes_" + optionID: 0}
+	if encoded := encodeOptionMeta(meta); encoded != "" {
+		fields[optionMetaKey(optionID)] = encoded
+	}
+	if req.Correct {
+		fields[correctKey(optionID)] = "1"
+	}
+	if err := store.UpdatePoll(pollID, fields); err != nil {
+		requestLogger(r).Error("Failed to add option", "error", err)
+		http.Error(w, "Failed to add option", http.StatusInternalServerError)
+		return
+	}
+
+	bumpConfigVersion(pollID)
+	broadcastPollUpdated(pollID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PollOption{ID: optionID, Text: text, OptionMeta: meta})
+}
+
+// editOption handles PUT /api/poll/{pollID}/options/{optionID}
+func (s *Server) editOption(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pollID, optionID := vars["pollID"], vars["optionID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	req, ok := decodeOption(w, r)
+	if !ok {
+		return
+	}
+	text, meta := req.Text, req.OptionMeta
+
+	data, ok := loadMutablePoll(w, r, pollID, optionID)
+	if !ok {
+		return
+	}
+	quiz := pollTypeOf(data) == pollTypeQuiz
+	if req.Correct && !quiz {
+		http.Error(w, "Only quiz options can be correct", http.StatusBadRequest)
+		return
+	}
+	if quiz && !req.Correct && !keepsCorrectOption(data, optionID) {
+		http.Error(w, "A quiz needs at least one correct option", http.StatusConflict)
+		return
+	}
+	if optionTaken(data, text, optionID) {
+		http.Error(w, fmt.Sprintf("Duplicate option: %q", text), http.StatusBadRequest)
+		return
+	}
+	if err := checkTextBudget(data["question"], optionTexts(data, text, optionID), optionDescriptions(data, meta.Description, optionID)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	set := map[string]interface{}{}
+	remove := setOption(set, nil, optionID, req)
+	updated, err := updateMutablePoll(r, pollID, set, remove...)
+	if err != nil {
+		requestLogger(r).Error("Failed to edit option", "option_id", optionID, "error", err)
+		http.Error(w, "Failed to edit option", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "poll has votes", http.StatusConflict)
+		return
+	}
+
+	bumpConfigVersion(pollID)
+	broadcastPollUpdated(pollID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PollOption{ID: optionID, Text: text, OptionMeta: meta})
+}
+
+// removeOption handles DELETE /api/poll/{pollID}/options/{optionID}.
+// Force-removing an option with votes discards those votes. The ballots
+// naming it are kept; undoing them skips its counters, which are gone.
+func (s *Server) removeOption(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pollID, optionID := vars["pollID"], vars["optionID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+
+	data, ok := loadMutablePoll(w, r, pollID, optionID)
+	if !ok {
+		return
+	}
+	if countOptions(data) <= 2 {
+		http.Error(w, "A poll needs at least 2 options", http.StatusConflict)
+		return
+	}
+	if pollTypeOf(data) == pollTypeQuiz && !keepsCorrectOption(data, optionID) {
+		http.Error(w, "A quiz needs at least one correct option", http.StatusConflict)
+		return
+	}
+
+	fields := []string{"option_" + optionID, "votes_" + optionID, optionMetaKey(optionID), correctKey(optionID),
+		ratingSumKey(optionID), weightedVoteKey(optionID)}
+	for _, segment := range parseSegments(data["segments"]) {
+		fields = append(fields, segmentVoteKey(optionID, segment))
+	}
+	if pollTypeOf(data) == pollTypeRating {
+		scaleMin, scaleMax := scaleOf(data)
+		for score := scaleMin; score <= scaleMax; score++ {
+			fields = append(fields, ratingDistKey(optionID, score))
+		}
+	}
+	updated, err := updateMutablePoll(r, pollID, nil, fields...)
+	if err != nil {
+		requestLogger(r).Error("Failed to remove option", "option_id", optionID, "error", err)
+		http.Error(w, "Failed to remove option", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "poll has votes", http.StatusConflict)
+		return
+	}
+
+	bumpConfigVersion(pollID)
+	broadcastPollUpdated(pollID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMutablePoll loads a poll whose existing option is about to change.
+// Option text is locked once anyone has voted, since changing it would
+// misrepresent what those votes were cast for; ?force=true overrides this.
+func loadMutablePoll(w http.ResponseWriter, r *http.Request, pollID, optionID string) (map[string]string, bool) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return nil, false
+	}
+	if _, exists := data["option_"+optionID]; !exists {
+		http.Error(w, "Option not found", http.StatusNotFound)
+		return nil, false
+	}
+	if data["status"] == statusClosed {
+		http.Error(w, "Poll is closed", http.StatusConflict)
+		return nil, false
+	}
+
+	if !forced(r) && totalVotes(parseVotes(data)) > 0 {
+		http.Error(w, "poll has votes", http.StatusConflict)
+		return nil, false
+	}
+	return data, true
+}
+
+// updateMutablePoll writes a change to a poll's existing options. Unless
+// forced, it reports false without writing if a vote landed since
+// loadMutablePoll checked.
+func updateMutablePoll(r *http.Request, pollID string, set map[string]interface{}, remove ...string) (bool, error) {
+	if forced(r) {
+		return true, store.UpdatePoll(pollID, set, remove...)
+	}
+	return store.UpdateUnvotedPoll(pollID, set, remove...)
+}
+
+// forced reports whether a request overrides the lock on voted options
+// with ?force=true
+func forced(r *http.Request) bool {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	return force
+}
+
+// decodeOption reads the option from the body, with its text and
+// metadata normalized and validated
+func decodeOption(w http.ResponseWriter, r *http.Request) (OptionRequest, bool) {
+	var req OptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return OptionRequest{}, false
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return OptionRequest{}, false
+	}
+	return req, true
+}
+
+// normalize cleans up the option's text and metadata and checks them
+func (o *OptionRequest) normalize() error {
+	o.Text = normalizeText(o.Text)
+	if o.Text == "" {
+		return fmt.Errorf("option text required")
+	}
+	return o.OptionMeta.normalize()
+}
+
+// broadcastPollUpdated tells clients to refresh the question and options
+func broadcastPollUpdated(pollID string) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		logger.Error("Failed to load poll for update broadcast", "poll_id", pollID, "error", err)
+		return
+	}
+	publishEvent(pollID, pollUpdated(pollID, data))
+}
+
+// pollUpdated builds the pollUpdated message, with the options in
+// canonical order
+func pollUpdated(pollID string, data map[string]string) PollUpdated {
+	options := parseOptions(data)
+	return PollUpdated{
+		Type:     "pollUpdated",
+		Question: data["question"],
+		Options:  options,
+		Details:  parseOptionDetails(data, optionOrder(options, false, pollID, "")),
+	}
+}
+
+// parseOptions extracts the option texts from a poll hash
+func parseOptions(data map[string]string) map[string]string {
+	options := make(map[string]string)
+	for key, value := range data {
+		if strings.HasPrefix(key, "option_") {
+			options[strings.TrimPrefix(key, "option_")] = value
+		}
+	}
+	return options
+}
+
+// optionTaken reports whether another option (other than exceptID) already
+// has the given text once normalized
+func optionTaken(data map[string]string, text, exceptID string) bool {
+	for id, existing := range parseOptions(data) {
+		if id != exceptID && normalizeText(existing) == text {
+			return true
+		}
+	}
+	return false
+}
+
+// optionTexts returns the poll's option texts as they would be after
+// setting text, either as a new option or in place of replacedID
+func optionTexts(data map[string]string, text, replacedID string) []string {
+	texts := []string{text}
+	for id, option := range parseOptions(data) {
+		if id != replacedID {
+			texts = append(texts, option)
+		}
+	}
+	return texts
+}
+
+// optionDescriptions is optionTexts for the options' descriptions
+func optionDescriptions(data map[string]string, description, replacedID string) []string {
+	descriptions := []string{description}
+	for id := range parseOptions(data) {
+		if id != replacedID {
+			descriptions = append(descriptions, optionDescription(data, id))
+		}
+	}
+	return descriptions
+}
+
+// countOptions returns how many options a poll hash has
+func countOptions(data map[string]string) int {
+	return len(parseOptions(data))
+}
+
+// maxOptionIndex returns the highest numeric option ID in a poll hash
+func maxOptionIndex(data map[string]string) int {
+	max := -1
+	for id := range parseOptions(data) {
+		if n, err := strconv.Atoi(id); err == nil && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// totalVotes sums vote counts
+func totalVotes(votes map[string]int) int {
+	total := 0
+	for _, count := range votes {
+		total += count
+	}
+	return total
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOptionsEditableBeforeFirstVote(t *testing.T) {
+	s := newTestServer(t)
+	poll := createTestPoll(t, s, testPollRequest())
+
+	w := apiRequest(t, s, http.MethodPut, "/api/poll/"+poll.ID+"/options/0", poll.OwnerToken, OptionRequest{Text: "Pasta"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit before any vote: %d %s", w.Code, w.Body)
+	}
+	question := "Dinner?"
+	if w := apiRequest(t, s, http.MethodPatch, "/api/poll/"+poll.ID, poll.OwnerToken, PollPatch{Question: &question}); w.Code != http.StatusOK {
+		t.Fatalf("patch before any vote: %d %s", w.Code, w.Body)
+	}
+	data, _ := store.GetPoll(poll.ID)
+	if data["option_0"] != "Pasta" || data["question"] != "Dinner?" {
+		t.Fatalf("got option %q and question %q after editing", data["option_0"], data["question"])
+	}
+}
+
+func TestOptionsLockedAfterFirstVote(t *testing.T) {
+	s := newTestServer(t)
+	poll := createTestPoll(t, s, testPollRequest())
+	if w := castTestVote(t, s, poll.ID, "0"); w.Code != http.StatusOK {
+		t.Fatalf("vote: %d %s", w.Code, w.Body)
+	}
+
+	if w := apiRequest(t, s, http.MethodPut, "/api/poll/"+poll.ID+"/options/0", poll.OwnerToken, OptionRequest{Text: "Pasta"}); w.Code != http.StatusConflict {
+		t.Errorf("edit after a vote: %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := apiRequest(t, s, http.MethodDelete, "/api/poll/"+poll.ID+"/options/1", poll.OwnerToken, nil); w.Code != http.StatusConflict {
+		t.Errorf("remove after a vote: %d, want %d", w.Code, http.StatusConflict)
+	}
+	patch := PollPatch{Options: map[string]OptionInput{"0": {Text: "Pasta"}}}
+	if w := apiRequest(t, s, http.MethodPatch, "/api/poll/"+poll.ID, poll.OwnerToken, patch); w.Code != http.StatusConflict {
+		t.Errorf("patch after a vote: %d, want %d", w.Code, http.StatusConflict)
+	}
+	if data, _ := store.GetPoll(poll.ID); data["option_0"] != "Pizza" {
+		t.Fatalf("option 0 is %q after the refused edits, want %q", data["option_0"], "Pizza")
+	}
+
+	// Adding options stays allowed, and the owner can override the lock
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/options", poll.OwnerToken, OptionRequest{Text: "Tacos"}); w.Code >= 300 {
+		t.Errorf("add after a vote: %d %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, s, http.MethodPut, "/api/poll/"+poll.ID+"/options/0?force=true", poll.OwnerToken, OptionRequest{Text: "Pasta"}); w.Code >= 300 {
+		t.Errorf("forced edit after a vote: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestForcedRemovalThenRetract(t *testing.T) {
+	s := newTestServer(t)
+	req := testPollRequest()
+	req.Options = append(req.Options, OptionInput{Text: "Tacos"})
+	req.AllowRevote = true
+	poll := createTestPoll(t, s, req)
+
+	w := apiRequest(t, s, http.MethodGet, "/api/poll/"+poll.ID+"/token", "", nil)
+	var token ClientToken
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatalf("decoding the client token: %v", err)
+	}
+	vote := RESTVoteRequest{Option: "2", ClientID: token.ClientID}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll/"+poll.ID+"/vote", "", vote); w.Code != http.StatusOK {
+		t.Fatalf("vote: %d %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, s, http.MethodDelete, "/api/poll/"+poll.ID+"/options/2?force=true", poll.OwnerToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("forced removal: %d %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, s, http.MethodDelete, "/api/poll/"+poll.ID+"/vote", "", vote); w.Code != http.StatusOK {
+		t.Fatalf("retract: %d %s", w.Code, w.Body)
+	}
+	if data, _ := store.GetPoll(poll.ID); data["votes_2"] != "" {
+		t.Errorf("votes_2 is %q after retracting a vote for the removed option, want it gone", data["votes_2"])
+	}
+}
+
+func TestUndoSkipsRemovedCounters(t *testing.T) {
+	eachPollStore(t, func(t *testing.T, s PollStore) {
+		s.CreatePoll("p1", map[string]interface{}{"question": "Lunch?", "votes_0": 0, "votes_1": 0}, time.Hour)
+		if _, recorded, err := s.RecordVote("p1", []string{"m"}, "1", incr("votes_1")); err != nil || !recorded {
+			t.Fatalf("RecordVote: %v, %v", recorded, err)
+		}
+		// Removing the option between loading the poll and revoting
+		s.UpdatePoll("p1", nil, "votes_1")
+		undo := func(string) []Increment { return []Increment{incr("votes_1")} }
+		if _, _, err := s.ChangeVote("p1", "m", "0", undo, incr("votes_0")); err != nil {
+			t.Fatalf("ChangeVote: %v", err)
+		}
+		data, _ := s.GetPoll("p1")
+		if _, exists := data["votes_1"]; exists || data["votes_0"] != "1" {
+			t.Fatalf("after the revote votes_0 = %q and votes_1 = %q, want 1 and no field", data["votes_0"], data["votes_1"])
+		}
+	})
+}
+
+func TestUpdateUnvotedPoll(t *testing.T) {
+	eachPollStore(t, func(t *testing.T, s PollStore) {
+		s.CreatePoll("p1", map[string]interface{}{"question": "Lunch?", "option_0": "Pizza", "votes_0": 0}, time.Hour)
+		if updated, err := s.UpdateUnvotedPoll("p1", map[string]interface{}{"option_0": "Pasta"}); err != nil || !updated {
+			t.Fatalf("update before any vote: %v, %v", updated, err)
+		}
+		s.RecordVote("p1", []string{"m"}, "0", incr("votes_0"))
+		if updated, err := s.UpdateUnvotedPoll("p1", nil, "option_0"); err != nil || updated {
+			t.Fatalf("update after a vote: %v, %v; want it refused", updated, err)
+		}
+		if data, _ := s.GetPoll("p1"); data["option_0"] != "Pasta" {
+			t.Errorf("option_0 is %q, want the edit from before the vote only", data["option_0"])
+		}
+		if updated, _ := s.UpdateUnvotedPoll("missing", map[string]interface{}{"question": "?"}); updated {
+			t.Error("updated a poll that doesn't exist")
+		}
+	})
+}
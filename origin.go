@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// allowedOrigins lists the origins of other sites that may open
+	// WebSockets and call the REST API from a browser, from the
+	// comma-separated ALLOWED_ORIGINS. An entry like https://*.example.com
+	// allows every subdomain. The server's own origin is always allowed.
+	allowedOrigins = parseOrigins(envString("ALLOWED_ORIGINS", ""))
+
+	// allowAllOrigins lets any site in, for local development only
+	allowAllOrigins = envBool("ALLOW_ALL_ORIGINS", false)
+
+	// originAuditLog enables a log line per WebSocket handshake
+	originAuditLog = envBool("ORIGIN_AUDIT_LOG", true)
+
+	// originAuditRate caps audit log lines per second; the rest are
+	// summarised so a flood of connections can't flood the logs
+	originAuditRate = envInt("ORIGIN_AUDIT_RATE", 20)
+
+	originAudit = &logSampler{limit: originAuditRate}
+)
+
+// corsHeaders are the request headers browsers may send cross-origin
+var corsHeaders = strings.Join([]string{
+	"Content-Type", "Authorization", "X-Admin-Token", "X-Owner-Token", "X-Spectator-Token",
+	fingerprintHeader, requestIDHeader, "traceparent", "tracestate",
+}, ", ")
+
+// corsMaxAge is how long browsers may cache a preflight response
+const corsMaxAge = 10 * time.Minute
+
+// originPattern is one entry of ALLOWED_ORIGINS
+type originPattern struct {
+	scheme string
+	host   string // with the port, if any
+	suffix bool   // host is a domain whose subdomains match
+}
+
+// parseOrigins reads ALLOWED_ORIGINS, skipping entries that aren't an
+// origin
+func parseOrigins(list string) []originPattern {
+	var patterns []originPattern
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			logger.Warn("Ignoring invalid entry in ALLOWED_ORIGINS", "value", entry)
+			continue
+		}
+		p := originPattern{scheme: strings.ToLower(u.Scheme), host: strings.ToLower(u.Host)}
+		if rest, ok := strings.CutPrefix(p.host, "*."); ok {
+			p.host, p.suffix = rest, true
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// matches reports whether an origin fits the pattern
+func (p originPattern) matches(u *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, p.scheme) {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if p.suffix {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// originAllowed reports whether a browser on origin may talk to the
+// server. Requests without an Origin header don't come from a page in a
+// browser, so there is nothing to check.
+func originAllowed(r *http.Request, origin string) bool {
+	if origin == "" || allowAllOrigins {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, p := range allowedOrigins {
+		if p.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin decides whether a WebSocket handshake may proceed: the page
+// opening it must be served by this server or an allowed origin, so other
+// sites can't vote on behalf of their visitors
+func checkOrigin(r *http.Request) bool {
+	return originAllowed(r, r.Header.Get("Origin"))
+}
+
+// withCORS lets pages on allowed origins call the REST API. Other
+// cross-origin callers get no CORS headers, so their browser withholds the
+// response.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && originAllowed(r, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join([]string{requestIDHeader, "Retry-After", "ETag"}, ", "))
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers CORS preflight requests; withCORS has already added
+// the headers if the origin is allowed
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditHandshake records the origin and source of a WebSocket upgrade attempt
+func auditHandshake(r *http.Request, pollID string, accepted bool) {
+	wsHandshakesTotal.WithLabelValues(strconv.FormatBool(accepted)).Inc()
+	if !originAuditLog {
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = "-"
+	}
+	originAudit.Info(requestLogger(r), "WebSocket handshake", "origin", origin, "accepted", accepted)
+}
+
+// logSampler lets through at most limit log lines per second and reports
+// how many were dropped once the next second starts
+type logSampler struct {
+	limit int
+
+	mu         sync.Mutex
+	second     int64
+	count      int
+	suppressed int
+}
+
+// Info logs the message to l unless this second's budget is used up
+func (s *logSampler) Info(l *slog.Logger, msg string, args ...any) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	if now != s.second {
+		if s.suppressed > 0 {
+			logger.Info("Similar log lines suppressed", "lines", s.suppressed)
+		}
+		s.second, s.count, s.suppressed = now, 0, 0
+	}
+	if s.limit > 0 && s.count >= s.limit {
+		s.suppressed++
+		s.mu.Unlock()
+		return
+	}
+	s.count++
+	s.mu.Unlock()
+
+	l.Info(msg, args...)
+}
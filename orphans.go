@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+var (
+	// orphanSweepInterval is how often companion keys of expired polls are
+	// cleaned up; 0 disables the sweeper
+	orphanSweepInterval = envDuration("ORPHAN_SWEEP_INTERVAL", 10*time.Minute)
+
+	// orphanSweepLimit bounds how many keys one sweep may scan
+	orphanSweepLimit = envInt("ORPHAN_SWEEP_LIMIT", 10000)
+)
+
+// companionPrefixes are the per-poll keys that should not outlive poll:<id>
+var companionPrefixes = []string{"voted:", "vote:", "comments:", "words:", "presence:", "players:", "votetimes:", "audit:", "history:", "invites:", "ballots:", "weights:", "voters:", "reactions:", "questions:", "qvotes:", "qvoters:", "modanswers:", "freeze:"}
+
+// runOrphanSweeper periodically deletes companion keys whose poll is gone
+func runOrphanSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if reclaimed, err := sweepOrphans(orphanSweepLimit); err != nil {
+			logger.Error("Orphan sweep failed", "error", err)
+		} else if reclaimed > 0 {
+			logger.Info("Orphan sweep reclaimed keys", "keys", reclaimed)
+		}
+	}
+}
+
+// sweepOrphans scans up to limit companion keys and unlinks the ones whose
+// poll no longer exists. On Redis, SCAN and UNLINK keep it responsive
+// while it runs.
+func sweepOrphans(limit int) (int, error) {
+	reclaimed, scanned := 0, 0
+	for _, prefix := range companionPrefixes {
+		if scanned >= limit {
+			break
+		}
+		n, _, err := kv.Scan(prefix, limit-scanned, func(keys []string) error {
+			n, err := unlinkOrphans(prefix, keys)
+			reclaimed += n
+			return err
+		})
+		scanned += n
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// unlinkOrphans deletes the keys among a scanned batch whose poll is gone
+func unlinkOrphans(prefix string, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	pollIDs := make([]string, len(keys))
+	for i, key := range keys {
+		pollIDs[i] = strings.TrimPrefix(key, prefix)
+	}
+	polls, err := store.GetPolls(pollIDs, "question")
+	if err != nil {
+		return 0, err
+	}
+
+	var orphans []string
+	for i, data := range polls {
+		if len(data) == 0 {
+			orphans = append(orphans, keys[i])
+		}
+	}
+	if len(orphans) == 0 {
+		return 0, nil
+	}
+
+	return len(orphans), kv.Del(orphans...)
+}
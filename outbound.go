@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhooks and notify_url are URLs anyone creating a poll can set, so they
+// go out through outboundClient, which only connects to public addresses
+// and doesn't follow redirects. The check runs on the address actually
+// dialed, after DNS, so a hostname can't be pointed at an internal one
+// between validation and delivery.
+var (
+	// outboundAllowlist, when set, is the only hosts and networks
+	// outbound requests may reach. They are trusted, so it can let
+	// webhooks reach internal addresses.
+	outboundAllowlist = parseOutboundList(envString("WEBHOOK_ALLOWLIST", ""))
+
+	// outboundDenylist is hosts and networks outbound requests never
+	// reach, on top of the private addresses
+	outboundDenylist = parseOutboundList(envString("WEBHOOK_DENYLIST", ""))
+
+	outboundClient = newOutboundClient()
+)
+
+// errOutboundRefused is why a host or address was refused
+var errOutboundRefused = errors.New("not a public address, or refused by WEBHOOK_ALLOWLIST or WEBHOOK_DENYLIST")
+
+// blockedNetworks are refused on top of what netip classifies as private,
+// loopback, link-local, multicast or unspecified
+var blockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which maps onto IPv4
+}
+
+// outboundList is the hosts and networks of WEBHOOK_ALLOWLIST or
+// WEBHOOK_DENYLIST. A host also matches its subdomains.
+type outboundList struct {
+	hosts    []string
+	networks []netip.Prefix
+}
+
+// parseOutboundList reads a comma-separated list of hostnames, addresses
+// and CIDR networks
+func parseOutboundList(raw string) outboundList {
+	var list outboundList
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			list.networks = append(list.networks, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			list.networks = append(list.networks, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			list.hosts = append(list.hosts, strings.TrimPrefix(entry, "."))
+		}
+	}
+	return list
+}
+
+func (l outboundList) empty() bool {
+	return len(l.hosts) == 0 && len(l.networks) == 0
+}
+
+// matchHost reports whether a hostname is on the list
+func (l outboundList) matchHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, entry := range l.hosts {
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr reports whether an address is on the list
+func (l outboundList) matchAddr(addr netip.Addr) bool {
+	for _, network := range l.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddr reports whether addr is an ordinary internet address
+func publicAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkOutboundHost checks the host of a URL before anything is dialed,
+// so creation can refuse what delivery would. A hostname's addresses are
+// only known, and checked, when dialing.
+func checkOutboundHost(host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return checkOutboundAddr(host, addr.Unmap())
+	}
+	switch {
+	case outboundDenylist.matchHost(host):
+	case outboundAllowlist.matchHost(host):
+		return nil
+	// A hostname may still resolve into an allowed network
+	case len(outboundAllowlist.hosts) > 0 && len(outboundAllowlist.networks) == 0:
+	case strings.EqualFold(strings.TrimSuffix(host, "."), "localhost"):
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s: %w", host, errOutboundRefused)
+}
+
+// checkOutboundAddr checks an address about to be dialed for host
+func checkOutboundAddr(host string, addr netip.Addr) error {
+	switch {
+	case outboundDenylist.matchHost(host), outboundDenylist.matchAddr(addr):
+	case outboundAllowlist.matchHost(host), outboundAllowlist.matchAddr(addr):
+		return nil
+	case outboundAllowlist.empty() && publicAddr(addr):
+		return nil
+	}
+	return fmt.Errorf("%s (%s): %w", host, addr, errOutboundRefused)
+}
+
+// validateOutboundURL checks a user-supplied URL at creation; name is the
+// request field it came in
+func validateOutboundURL(name, raw string) error {
+	if !httpURL(raw) {
+		return fmt.Errorf("%s must be an http(s) URL", name)
+	}
+	u, _ := url.Parse(raw)
+	if err := checkOutboundHost(u.Hostname()); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// outboundHostKey carries the hostname being dialed to the dialer's
+// Control, which otherwise only sees the resolved address
+type outboundHostKey struct{}
+
+// newOutboundClient returns the client for user-supplied URLs. It dials
+// directly, without any proxy from the environment, so the address
+// checked is the one connected to.
+func newOutboundClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		ControlContext: func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+			host, _ := ctx.Value(outboundHostKey{}).(string)
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkOutboundAddr(host, addrPort.Addr().Unmap())
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(context.WithValue(ctx, outboundHostKey{}, host), network, address)
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		// A redirect could point anywhere; it's reported as the 3xx it is
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// newToken creates a random secret token
+func newToken() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// hashToken returns the SHA-256 hex digest of a token. Only digests are
+// stored in Redis so a leaked dump doesn't hand out management access.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownerTokenFromRequest extracts the owner token from the Authorization
+// header ("Bearer <token>") or the X-Owner-Token header
+func ownerTokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("X-Owner-Token")
+}
+
+// ownerHashFromRequest returns the owner the request acts as: the account
+// of its session token, or the hash of its owner token. It's empty when
+// the request carries neither, or an invalid session token.
+func ownerHashFromRequest(r *http.Request) string {
+	return ownerHashFromToken(ownerTokenFromRequest(r))
+}
+
+// ownerHashFromToken returns the owner a session or owner token acts as,
+// like ownerHashFromRequest
+func ownerHashFromToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if accountsEnabled && isSessionToken(token) {
+		claims, ok := parseSession(token)
+		if !ok {
+			return ""
+		}
+		return accountOwnerHash(claims.Subject)
+	}
+	return hashToken(token)
+}
+
+// ownerMatches reports whether the request acts as the owner stored as
+// storedHash, in constant time. An empty digest never matches.
+func ownerMatches(r *http.Request, storedHash string) bool {
+	owner := ownerHashFromRequest(r)
+	if owner == "" || storedHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(owner), []byte(storedHash)) == 1
+}
+
+// requireOwner checks that the request carries the poll's owner token, or
+// a session of the account that owns it.
+// It writes the error response and returns false when the check fails.
+func requireOwner(w http.ResponseWriter, r *http.Request, pollID string) bool {
+	data, err := pollFields(pollID, "owner_hash", "question")
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return false
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return false
+	}
+	stored, ok := data["owner_hash"]
+	if !ok {
+		http.Error(w, "Poll has no owner", http.StatusForbidden)
+		return false
+	}
+
+	token := ownerTokenFromRequest(r)
+	if token == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return false
+	}
+	if accountsEnabled && isSessionToken(token) && ownerHashFromRequest(r) == "" {
+		http.Error(w, "Session expired or invalid, sign in again", http.StatusUnauthorized)
+		return false
+	}
+	if !ownerMatches(r, stored) {
+		http.Error(w, "Invalid owner token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// tokenMatches reports whether token hashes to the stored digest, in
+// constant time. An empty digest never matches.
+func tokenMatches(token, storedHash string) bool {
+	if storedHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(storedHash)) == 1
+}
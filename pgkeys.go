@@ -0,0 +1,913 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// With STORE=postgres the key store is kept in PostgreSQL too, so
+// accounts, templates, join codes, comments, schedules and the rest are
+// shared by every instance and survive a restart. A key is a row of
+// kv_keys holding its expiry; its hash fields, set or sorted set members,
+// list items and stream entries are rows of kv_entries, and a string is
+// the entry with an empty field.
+
+// pgKeysSweepInterval is how often expired keys are deleted and reported
+// to Expired. Until then they already read as gone.
+const pgKeysSweepInterval = time.Second
+
+// pgKeysSchema creates the key tables on startup. List items are ordered
+// by score, and stream entries by score, the milliseconds of their ID,
+// then its sequence.
+const pgKeysSchema = `
+CREATE TABLE IF NOT EXISTS kv_keys (
+	key        TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS kv_keys_expires_at ON kv_keys (expires_at);
+CREATE TABLE IF NOT EXISTS kv_entries (
+	key   TEXT NOT NULL REFERENCES kv_keys ON DELETE CASCADE,
+	field TEXT NOT NULL,
+	value TEXT NOT NULL DEFAULT '',
+	score DOUBLE PRECISION NOT NULL DEFAULT 0,
+	PRIMARY KEY (key, field)
+);
+CREATE INDEX IF NOT EXISTS kv_entries_score ON kv_entries (key, score)`
+
+// pgKeyLive matches the keys k that haven't expired
+const pgKeyLive = "(k.expires_at IS NULL OR k.expires_at > now())"
+
+// pgLiveEntries selects from the entries e of the key $1, if it hasn't
+// expired
+const pgLiveEntries = " FROM kv_entries e JOIN kv_keys k ON k.key = e.key WHERE e.key = $1 AND " + pgKeyLive
+
+// pgStreamOrder orders stream entries by ID
+const pgStreamOrder = "e.score, split_part(e.field, '-', 2)::bigint"
+
+// postgresKeys keeps the keys in PostgreSQL
+type postgresKeys struct {
+	db      *pgxpool.Pool
+	expired expiryWatchers
+}
+
+// newPostgresKeys creates the key tables and starts the sweeper
+func newPostgresKeys(connectCtx context.Context, db *pgxpool.Pool) (*postgresKeys, error) {
+	if _, err := db.Exec(connectCtx, pgKeysSchema); err != nil {
+		return nil, err
+	}
+	k := &postgresKeys{db: db}
+	go k.sweep(pgKeysSweepInterval)
+	return k, nil
+}
+
+// pgKeyTx is a transaction over the keys. A write locks its key's row
+// first, which serializes the writes to a key the way Redis runs one
+// command at a time.
+type pgKeyTx struct {
+	tx pgx.Tx
+
+	// expired are the keys found expired on the way, reported to Expired
+	// once the transaction commits
+	expired []string
+}
+
+// update runs fn in a transaction
+func (k *postgresKeys) update(fn func(q *pgKeyTx) error) error {
+	tx, err := k.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	q := &pgKeyTx{tx: tx}
+	if err := fn(q); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	k.expired.notify(q.expired)
+	return nil
+}
+
+// lock locks a key's row and reports whether the key exists, deleting it
+// if it expired
+func (q *pgKeyTx) lock(key string) (bool, error) {
+	var expired bool
+	err := q.tx.QueryRow(ctx, "SELECT expires_at IS NOT NULL AND expires_at <= now() FROM kv_keys WHERE key = $1 FOR UPDATE", key).Scan(&expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if expired {
+		if _, err := q.tx.Exec(ctx, "DELETE FROM kv_keys WHERE key = $1", key); err != nil {
+			return false, err
+		}
+		q.expired = append(q.expired, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+// create locks a key's row, creating the key if it doesn't exist
+func (q *pgKeyTx) create(key string) error {
+	exists, err := q.lock(key)
+	if err != nil || exists {
+		return err
+	}
+	// A concurrent creation wins the insert, and the update then waits
+	// for its lock
+	_, err = q.tx.Exec(ctx, "INSERT INTO kv_keys (key) VALUES ($1) ON CONFLICT (key) DO UPDATE SET expires_at = kv_keys.expires_at", key)
+	return err
+}
+
+// dropIfEmpty deletes a key left without entries, like Redis does
+func (q *pgKeyTx) dropIfEmpty(key string) error {
+	_, err := q.tx.Exec(ctx, "DELETE FROM kv_keys WHERE key = $1 AND NOT EXISTS (SELECT 1 FROM kv_entries WHERE key = $1)", key)
+	return err
+}
+
+// ttl is TTL for a locked key
+func (q *pgKeyTx) ttl(key string) (time.Duration, error) {
+	var expiresAt *time.Time
+	err := q.tx.QueryRow(ctx, "SELECT expires_at FROM kv_keys WHERE key = $1", key).Scan(&expiresAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return -2, nil
+	case err != nil:
+		return 0, err
+	case expiresAt == nil:
+		return -1, nil
+	}
+	return time.Until(*expiresAt), nil
+}
+
+// expireAt gives a key a deadline, deleting it if that has passed
+func (q *pgKeyTx) expireAt(key string, at time.Time) error {
+	exists, err := q.lock(key)
+	if err != nil || !exists {
+		return err
+	}
+	if !time.Now().Before(at) {
+		_, err = q.tx.Exec(ctx, "DELETE FROM kv_keys WHERE key = $1", key)
+		return err
+	}
+	_, err = q.tx.Exec(ctx, "UPDATE kv_keys SET expires_at = $2 WHERE key = $1", key, at)
+	return err
+}
+
+func (q *pgKeyTx) set(key, value string, ttl time.Duration) error {
+	if err := q.create(key); err != nil {
+		return err
+	}
+	if _, err := q.tx.Exec(ctx, "DELETE FROM kv_entries WHERE key = $1", key); err != nil {
+		return err
+	}
+	if _, err := q.tx.Exec(ctx, "UPDATE kv_keys SET expires_at = $2 WHERE key = $1", key, pgExpiry(ttl)); err != nil {
+		return err
+	}
+	_, err := q.tx.Exec(ctx, "INSERT INTO kv_entries (key, field, value) VALUES ($1, '', $2)", key, value)
+	return err
+}
+
+func (q *pgKeyTx) del(keys ...string) error {
+	for _, key := range keys {
+		if _, err := q.lock(key); err != nil {
+			return err
+		}
+	}
+	_, err := q.tx.Exec(ctx, "DELETE FROM kv_keys WHERE key = ANY($1)", keys)
+	return err
+}
+
+// entries reads a locked key's fields and values
+func (q *pgKeyTx) entries(key string) (map[string]string, error) {
+	rows, err := q.tx.Query(ctx, "SELECT field, value FROM kv_entries WHERE key = $1", key)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+// collectEntries reads rows of fields and values into a map
+func collectEntries(rows pgx.Rows) (map[string]string, error) {
+	entries := make(map[string]string)
+	var field, value string
+	_, err := pgx.ForEachRow(rows, []any{&field, &value}, func() error {
+		entries[field] = value
+		return nil
+	})
+	return entries, err
+}
+
+func (q *pgKeyTx) hset(key string, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if err := q.create(key); err != nil {
+		return err
+	}
+	fields, strs := make([]string, 0, len(values)), make([]string, 0, len(values))
+	for field, value := range values {
+		fields = append(fields, field)
+		strs = append(strs, fieldString(value))
+	}
+	_, err := q.tx.Exec(ctx, `
+		INSERT INTO kv_entries (key, field, value) SELECT $1, unnest($2::text[]), unnest($3::text[])
+		ON CONFLICT (key, field) DO UPDATE SET value = EXCLUDED.value`,
+		key, fields, strs)
+	return err
+}
+
+// remove deletes fields or members of a key
+func (q *pgKeyTx) remove(key string, fields ...string) (int64, error) {
+	exists, err := q.lock(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	tag, err := q.tx.Exec(ctx, "DELETE FROM kv_entries WHERE key = $1 AND field = ANY($2)", key, fields)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), q.dropIfEmpty(key)
+}
+
+func (q *pgKeyTx) hincrBy(key, field string, by int64) (int64, error) {
+	if err := q.create(key); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := q.tx.QueryRow(ctx, `
+		INSERT INTO kv_entries (key, field, value) VALUES ($1, $2, $3::bigint::text)
+		ON CONFLICT (key, field) DO UPDATE SET value = (kv_entries.value::bigint + $3::bigint)::text
+		RETURNING value::bigint`,
+		key, field, by).Scan(&n)
+	return n, err
+}
+
+func (q *pgKeyTx) sadd(key string, members ...string) (int64, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	if err := q.create(key); err != nil {
+		return 0, err
+	}
+	tag, err := q.tx.Exec(ctx, "INSERT INTO kv_entries (key, field) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING", key, members)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (q *pgKeyTx) zincrBy(key, member string, by float64, replace bool) (float64, error) {
+	if err := q.create(key); err != nil {
+		return 0, err
+	}
+	update := "kv_entries.score + EXCLUDED.score"
+	if replace {
+		update = "EXCLUDED.score"
+	}
+	var score float64
+	err := q.tx.QueryRow(ctx, `
+		INSERT INTO kv_entries (key, field, score) VALUES ($1, $2, $3)
+		ON CONFLICT (key, field) DO UPDATE SET score = `+update+`
+		RETURNING score`,
+		key, member, by).Scan(&score)
+	return score, err
+}
+
+// count is how many entries a locked key has
+func (q *pgKeyTx) count(key string) (int, error) {
+	var n int
+	err := q.tx.QueryRow(ctx, "SELECT count(*) FROM kv_entries WHERE key = $1", key).Scan(&n)
+	return n, err
+}
+
+// lpush adds an item ahead of the list's first, which has the lowest score
+func (q *pgKeyTx) lpush(key, value string) error {
+	if err := q.create(key); err != nil {
+		return err
+	}
+	_, err := q.tx.Exec(ctx, `
+		INSERT INTO kv_entries (key, field, value, score)
+		SELECT $1, (COALESCE(min(score), 0) - 1)::text, $2, COALESCE(min(score), 0) - 1
+		FROM kv_entries WHERE key = $1`,
+		key, value)
+	return err
+}
+
+func (q *pgKeyTx) ltrim(key string, start, stop int64) error {
+	exists, err := q.lock(key)
+	if err != nil || !exists {
+		return err
+	}
+	n, err := q.count(key)
+	if err != nil {
+		return err
+	}
+	lo, hi := rangeBounds(start, stop, n)
+	_, err = q.tx.Exec(ctx, `
+		DELETE FROM kv_entries WHERE key = $1 AND field IN (
+			SELECT field FROM (
+				SELECT field, row_number() OVER (ORDER BY score) - 1 AS rank FROM kv_entries WHERE key = $1
+			) ranked WHERE rank < $2 OR rank >= $3
+		)`,
+		key, lo, hi)
+	if err != nil {
+		return err
+	}
+	return q.dropIfEmpty(key)
+}
+
+func (q *pgKeyTx) xadd(key string, values map[string]interface{}) error {
+	if err := q.create(key); err != nil {
+		return err
+	}
+	var last string
+	err := q.tx.QueryRow(ctx, "SELECT e.field FROM kv_entries e WHERE e.key = $1 ORDER BY "+pgStreamOrder+" DESC LIMIT 1", key).Scan(&last)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	id := nextStreamID(last)
+	ms, _ := streamID(id)
+	encoded, _ := json.Marshal(fieldStrings(values))
+	_, err = q.tx.Exec(ctx, "INSERT INTO kv_entries (key, field, value, score) VALUES ($1, $2, $3, $4)", key, id, string(encoded), float64(ms))
+	return err
+}
+
+func (k *postgresKeys) Get(key string) (string, error) {
+	var value string
+	err := k.db.QueryRow(ctx, "SELECT e.value"+pgLiveEntries+" AND e.field = ''", key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errKeyNotFound
+	}
+	return value, err
+}
+
+func (k *postgresKeys) Set(key, value string, ttl time.Duration) error {
+	return k.update(func(q *pgKeyTx) error {
+		return q.set(key, value, ttl)
+	})
+}
+
+func (k *postgresKeys) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	set := false
+	err := k.update(func(q *pgKeyTx) error {
+		exists, err := q.lock(key)
+		if err != nil || exists {
+			return err
+		}
+		set = true
+		return q.set(key, value, ttl)
+	})
+	return set, err
+}
+
+func (k *postgresKeys) GetDel(key string) (string, error) {
+	var value string
+	err := k.update(func(q *pgKeyTx) error {
+		exists, err := q.lock(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errKeyNotFound
+		}
+		err = q.tx.QueryRow(ctx, "SELECT value FROM kv_entries WHERE key = $1 AND field = ''", key).Scan(&value)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return q.del(key)
+	})
+	return value, err
+}
+
+func (k *postgresKeys) Del(keys ...string) error {
+	return k.update(func(q *pgKeyTx) error {
+		return q.del(keys...)
+	})
+}
+
+func (k *postgresKeys) Expire(key string, ttl time.Duration) error {
+	return k.update(func(q *pgKeyTx) error {
+		return q.expireAt(key, time.Now().Add(ttl))
+	})
+}
+
+// TTL follows Redis' PTTL, like PollTTL
+func (k *postgresKeys) TTL(key string) (time.Duration, error) {
+	var expiresAt *time.Time
+	err := k.db.QueryRow(ctx, "SELECT k.expires_at FROM kv_keys k WHERE k.key = $1 AND "+pgKeyLive, key).Scan(&expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if expiresAt == nil {
+		return -1, nil
+	}
+	return time.Until(*expiresAt).Truncate(time.Millisecond), nil
+}
+
+func (k *postgresKeys) HGet(key, field string) (string, error) {
+	var value string
+	err := k.db.QueryRow(ctx, "SELECT e.value"+pgLiveEntries+" AND e.field = $2", key, field).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errKeyNotFound
+	}
+	return value, err
+}
+
+func (k *postgresKeys) HGetAll(key string) (map[string]string, error) {
+	rows, err := k.db.Query(ctx, "SELECT e.field, e.value"+pgLiveEntries, key)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+func (k *postgresKeys) HMGet(key string, fields ...string) (map[string]string, error) {
+	rows, err := k.db.Query(ctx, "SELECT e.field, e.value"+pgLiveEntries+" AND e.field = ANY($2)", key, fields)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+func (k *postgresKeys) HSet(key string, values map[string]interface{}) error {
+	return k.update(func(q *pgKeyTx) error {
+		return q.hset(key, values)
+	})
+}
+
+func (k *postgresKeys) HSetNX(key, field string, value interface{}) (bool, error) {
+	set := false
+	err := k.update(func(q *pgKeyTx) error {
+		if err := q.create(key); err != nil {
+			return err
+		}
+		tag, err := q.tx.Exec(ctx, "INSERT INTO kv_entries (key, field, value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", key, field, fieldString(value))
+		set = tag.RowsAffected() == 1
+		return err
+	})
+	return set, err
+}
+
+func (k *postgresKeys) HDel(key string, fields ...string) (int64, error) {
+	return k.removeEntries(key, fields...)
+}
+
+// removeEntries is HDel, SRem and ZRem
+func (k *postgresKeys) removeEntries(key string, fields ...string) (int64, error) {
+	var removed int64
+	err := k.update(func(q *pgKeyTx) error {
+		var err error
+		removed, err = q.remove(key, fields...)
+		return err
+	})
+	return removed, err
+}
+
+// countEntries is HLen, ZCard and LLen
+func (k *postgresKeys) countEntries(key string) (int64, error) {
+	var n int64
+	err := k.db.QueryRow(ctx, "SELECT count(*)"+pgLiveEntries, key).Scan(&n)
+	return n, err
+}
+
+func (k *postgresKeys) HLen(key string) (int64, error) {
+	return k.countEntries(key)
+}
+
+func (k *postgresKeys) HIncrBy(key, field string, by int64) (int64, error) {
+	var n int64
+	err := k.update(func(q *pgKeyTx) error {
+		var err error
+		n, err = q.hincrBy(key, field, by)
+		return err
+	})
+	return n, err
+}
+
+func (k *postgresKeys) SAdd(key string, members ...string) (int64, error) {
+	var added int64
+	err := k.update(func(q *pgKeyTx) error {
+		var err error
+		added, err = q.sadd(key, members...)
+		return err
+	})
+	return added, err
+}
+
+func (k *postgresKeys) SRem(key string, members ...string) (int64, error) {
+	return k.removeEntries(key, members...)
+}
+
+func (k *postgresKeys) SIsMember(key, member string) (bool, error) {
+	var found bool
+	err := k.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1"+pgLiveEntries+" AND e.field = $2)", key, member).Scan(&found)
+	return found, err
+}
+
+func (k *postgresKeys) SMembers(key string) ([]string, error) {
+	rows, err := k.db.Query(ctx, "SELECT e.field"+pgLiveEntries, key)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (k *postgresKeys) ZAdd(key, member string, score float64) error {
+	return k.update(func(q *pgKeyTx) error {
+		_, err := q.zincrBy(key, member, score, true)
+		return err
+	})
+}
+
+func (k *postgresKeys) ZIncrBy(key, member string, by float64) (float64, error) {
+	var score float64
+	err := k.update(func(q *pgKeyTx) error {
+		var err error
+		score, err = q.zincrBy(key, member, by, false)
+		return err
+	})
+	return score, err
+}
+
+func (k *postgresKeys) ZRem(key string, members ...string) (int64, error) {
+	return k.removeEntries(key, members...)
+}
+
+func (k *postgresKeys) ZScore(key, member string) (float64, error) {
+	var score float64
+	err := k.db.QueryRow(ctx, "SELECT e.score"+pgLiveEntries+" AND e.field = $2", key, member).Scan(&score)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errKeyNotFound
+	}
+	return score, err
+}
+
+func (k *postgresKeys) ZCard(key string) (int64, error) {
+	return k.countEntries(key)
+}
+
+// rankBounds is rangeBounds for a key in the database, which only has to
+// be counted when start or stop counts from the end
+func (k *postgresKeys) rankBounds(key string, start, stop int64) (int, int, error) {
+	n := int64(math.MaxInt32)
+	if start < 0 || stop < 0 {
+		var err error
+		if n, err = k.countEntries(key); err != nil {
+			return 0, 0, err
+		}
+	}
+	lo, hi := rangeBounds(start, stop, int(n))
+	return lo, hi, nil
+}
+
+func (k *postgresKeys) ZRange(key string, start, stop int64, reverse bool) ([]ScoredMember, error) {
+	lo, hi, err := k.rankBounds(key, start, stop)
+	if err != nil || lo == hi {
+		return nil, err
+	}
+	order := "e.score, e.field"
+	if reverse {
+		order = "e.score DESC, e.field DESC"
+	}
+	rows, err := k.db.Query(ctx, "SELECT e.field, e.score"+pgLiveEntries+" ORDER BY "+order+" OFFSET $2 LIMIT $3", key, lo, hi-lo)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[ScoredMember])
+}
+
+func (k *postgresKeys) ZRangeByScore(key string, max float64, count int64) ([]string, error) {
+	var limit *int64
+	if count > 0 {
+		limit = &count
+	}
+	rows, err := k.db.Query(ctx, "SELECT e.field"+pgLiveEntries+" AND e.score <= $2 ORDER BY e.score, e.field LIMIT $3", key, max, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (k *postgresKeys) ZPopMin(key string, count int64) ([]ScoredMember, error) {
+	var popped []ScoredMember
+	err := k.update(func(q *pgKeyTx) error {
+		exists, err := q.lock(key)
+		if err != nil || !exists {
+			return err
+		}
+		rows, err := q.tx.Query(ctx, `
+			DELETE FROM kv_entries WHERE key = $1 AND field IN (
+				SELECT field FROM kv_entries WHERE key = $1 ORDER BY score, field LIMIT $2
+			) RETURNING field, score`,
+			key, count)
+		if err != nil {
+			return err
+		}
+		if popped, err = pgx.CollectRows(rows, pgx.RowToStructByPos[ScoredMember]); err != nil {
+			return err
+		}
+		return q.dropIfEmpty(key)
+	})
+	sort.Slice(popped, func(i, j int) bool {
+		if popped[i].Score != popped[j].Score {
+			return popped[i].Score < popped[j].Score
+		}
+		return popped[i].Member < popped[j].Member
+	})
+	return popped, err
+}
+
+func (k *postgresKeys) LRange(key string, start, stop int64) ([]string, error) {
+	lo, hi, err := k.rankBounds(key, start, stop)
+	if err != nil || lo == hi {
+		return nil, err
+	}
+	rows, err := k.db.Query(ctx, "SELECT e.value"+pgLiveEntries+" ORDER BY e.score OFFSET $2 LIMIT $3", key, lo, hi-lo)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (k *postgresKeys) LLen(key string) (int64, error) {
+	return k.countEntries(key)
+}
+
+func (k *postgresKeys) XRange(key, after string, count int64) ([]StreamEntry, error) {
+	afterMS, afterSeq := int64(-1), int64(-1)
+	if after != "" {
+		afterMS, afterSeq = streamID(after)
+	}
+	var limit *int64
+	if count > 0 {
+		limit = &count
+	}
+	rows, err := k.db.Query(ctx, `SELECT e.field, e.value`+pgLiveEntries+`
+		AND (e.score, split_part(e.field, '-', 2)::bigint) > ($2::float8, $3::bigint)
+		ORDER BY `+pgStreamOrder+` LIMIT $4`,
+		key, float64(afterMS), afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	var entries []StreamEntry
+	var id, encoded string
+	_, err = pgx.ForEachRow(rows, []any{&id, &encoded}, func() error {
+		entry := StreamEntry{ID: id}
+		if err := json.Unmarshal([]byte(encoded), &entry.Values); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (k *postgresKeys) TakeToken(key string, rate float64, burst int, now time.Time) (bool, error) {
+	allowed := false
+	err := k.update(func(q *pgKeyTx) error {
+		if err := q.create(key); err != nil {
+			return err
+		}
+		bucket, err := q.entries(key)
+		if err != nil {
+			return err
+		}
+		var fields map[string]interface{}
+		var lifetime time.Duration
+		fields, lifetime, allowed = takeToken(bucket, rate, burst, now)
+		if err := q.hset(key, fields); err != nil {
+			return err
+		}
+		return q.expireAt(key, now.Add(lifetime))
+	})
+	return allowed, err
+}
+
+func (k *postgresKeys) SAddCapped(key, member string, limit int, ttl time.Duration) (bool, error) {
+	added := false
+	err := k.update(func(q *pgKeyTx) error {
+		existed, err := q.lock(key)
+		if err != nil {
+			return err
+		}
+		if _, err := q.sadd(key, member); err != nil {
+			return err
+		}
+		n, err := q.count(key)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && n > limit {
+			_, err := q.remove(key, member)
+			return err
+		}
+		added = true
+		current, err := q.ttl(key)
+		if err != nil {
+			return err
+		}
+		if !existed || current < ttl {
+			return q.expireAt(key, time.Now().Add(ttl))
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (k *postgresKeys) HSwap(key, field, old, value string) (bool, error) {
+	swapped := false
+	err := k.update(func(q *pgKeyTx) error {
+		exists, err := q.lock(key)
+		if err != nil || !exists {
+			return err
+		}
+		var current string
+		err = q.tx.QueryRow(ctx, "SELECT value FROM kv_entries WHERE key = $1 AND field = $2", key, field).Scan(&current)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && current != old) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		swapped = true
+		if value == "" {
+			_, err = q.remove(key, field)
+			return err
+		}
+		_, err = q.tx.Exec(ctx, "UPDATE kv_entries SET value = $3 WHERE key = $1 AND field = $2", key, field, value)
+		return err
+	})
+	return swapped, err
+}
+
+func (k *postgresKeys) Batch(fn func(b KeyBatch)) error {
+	return k.update(func(q *pgKeyTx) error {
+		b := &pgKeyBatch{q: q}
+		fn(b)
+		return b.err
+	})
+}
+
+func (k *postgresKeys) Scan(prefix string, limit int, fn func(keys []string) error) (int, bool, error) {
+	scanned, after := 0, ""
+	for {
+		rows, err := k.db.Query(ctx, "SELECT k.key FROM kv_keys k WHERE starts_with(k.key, $1) AND k.key > $2 AND "+pgKeyLive+" ORDER BY k.key LIMIT $3", prefix, after, pgBatchSize)
+		if err != nil {
+			return scanned, false, err
+		}
+		keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return scanned, false, err
+		}
+		if len(keys) == 0 {
+			return scanned, false, nil
+		}
+		scanned += len(keys)
+		if err := fn(keys); err != nil {
+			return scanned, false, err
+		}
+		if len(keys) < pgBatchSize {
+			return scanned, false, nil
+		}
+		if scanned >= limit {
+			return scanned, true, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// Expired reports each expired key once, to the instance that finds it
+// expired
+func (k *postgresKeys) Expired(ctx context.Context, prefix string) <-chan string {
+	return k.expired.watch(ctx, prefix)
+}
+
+func (k *postgresKeys) Ping(ctx context.Context) error {
+	return k.db.Ping(ctx)
+}
+
+// sweep deletes expired keys and reports them to Expired
+func (k *postgresKeys) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := k.sweepOnce(); err != nil {
+			logger.Error("Failed to sweep expired keys", "error", err)
+		}
+	}
+}
+
+func (k *postgresKeys) sweepOnce() error {
+	rows, err := k.db.Query(ctx, "DELETE FROM kv_keys WHERE expires_at <= now() RETURNING key")
+	if err != nil {
+		return err
+	}
+	expired, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	k.expired.notify(expired)
+	return nil
+}
+
+// pgKeyBatch runs a batch's writes in its transaction, skipping the rest
+// after the first error
+type pgKeyBatch struct {
+	q   *pgKeyTx
+	err error
+}
+
+func (b *pgKeyBatch) do(op func() error) {
+	if b.err == nil {
+		b.err = op()
+	}
+}
+
+func (b *pgKeyBatch) Set(key, value string, ttl time.Duration) {
+	b.do(func() error { return b.q.set(key, value, ttl) })
+}
+
+func (b *pgKeyBatch) Del(keys ...string) {
+	b.do(func() error { return b.q.del(keys...) })
+}
+
+func (b *pgKeyBatch) Expire(key string, ttl time.Duration) {
+	b.do(func() error { return b.q.expireAt(key, time.Now().Add(ttl)) })
+}
+
+func (b *pgKeyBatch) ExpireAt(key string, at time.Time) {
+	b.do(func() error { return b.q.expireAt(key, at) })
+}
+
+func (b *pgKeyBatch) HSet(key string, values map[string]interface{}) {
+	b.do(func() error { return b.q.hset(key, values) })
+}
+
+func (b *pgKeyBatch) HIncrBy(key, field string, by int64) {
+	b.do(func() error {
+		_, err := b.q.hincrBy(key, field, by)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) HDel(key string, fields ...string) {
+	b.do(func() error {
+		_, err := b.q.remove(key, fields...)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) SAdd(key string, members ...string) {
+	b.do(func() error {
+		_, err := b.q.sadd(key, members...)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) ZAdd(key, member string, score float64) {
+	b.do(func() error {
+		_, err := b.q.zincrBy(key, member, score, true)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) ZIncrBy(key, member string, by float64) {
+	b.do(func() error {
+		_, err := b.q.zincrBy(key, member, by, false)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) ZRem(key string, members ...string) {
+	b.do(func() error {
+		_, err := b.q.remove(key, members...)
+		return err
+	})
+}
+
+func (b *pgKeyBatch) LPush(key, value string) {
+	b.do(func() error { return b.q.lpush(key, value) })
+}
+
+func (b *pgKeyBatch) LTrim(key string, start, stop int64) {
+	b.do(func() error { return b.q.ltrim(key, start, stop) })
+}
+
+func (b *pgKeyBatch) XAdd(key string, values map[string]interface{}) {
+	b.do(func() error { return b.q.xadd(key, values) })
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// With STORE=postgres, polls, voters, ballots and word clouds are kept in
+// PostgreSQL and updates fan out with LISTEN/NOTIFY, for deployments
+// without Redis. The features that don't go through PollStore keep their
+// keys in PostgreSQL as well, in the tables of pgkeys.go.
+var (
+	// pgSweepInterval is how often expired polls and old updates are
+	// deleted
+	pgSweepInterval = envDuration("POSTGRES_SWEEP_INTERVAL", time.Minute)
+)
+
+// pgUpdatesChannel is the NOTIFY channel announcing new rows of
+// poll_updates
+const pgUpdatesChannel = "poll_updates"
+
+// pgBatchSize is how many rows a scan or catch-up reads at a time
+const pgBatchSize = 1000
+
+// pgSchema creates the tables on startup. A poll's fields are a JSON object
+// of strings, like the Redis hash; updates are kept in a table so a
+// notification only has to carry the ID of one.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS polls (
+	id         TEXT PRIMARY KEY,
+	fields     JSONB NOT NULL,
+	expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS polls_expires_at ON polls (expires_at);
+CREATE TABLE IF NOT EXISTS poll_voters (
+	poll_id TEXT NOT NULL,
+	member  TEXT NOT NULL,
+	PRIMARY KEY (poll_id, member)
+);
+CREATE TABLE IF NOT EXISTS poll_ballots (
+	poll_id TEXT NOT NULL,
+	member  TEXT NOT NULL,
+	ballot  TEXT NOT NULL,
+	PRIMARY KEY (poll_id, member)
+);
+CREATE TABLE IF NOT EXISTS poll_words (
+	poll_id TEXT NOT NULL,
+	word    TEXT NOT NULL,
+	count   BIGINT NOT NULL,
+	PRIMARY KEY (poll_id, word)
+);
+CREATE TABLE IF NOT EXISTS poll_updates (
+	id         BIGSERIAL PRIMARY KEY,
+	poll_id    TEXT NOT NULL,
+	payload    TEXT NOT NULL,
+	meta       JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// pgLive matches the polls that haven't expired. Expired ones linger until
+// the next sweep, but are never read.
+const pgLive = "(expires_at IS NULL OR expires_at > now())"
+
+// postgresStore keeps polls in PostgreSQL
+type postgresStore struct {
+	db *pgxpool.Pool
+
+	// keys holds the companion keys of the features outside PollStore,
+	// which DeletePoll and ResetVotes clear along with the poll
+	keys KeyStore
+
+	// watched are the polls Subscribe delivers the updates of
+	watchMu sync.Mutex
+	watched map[string]bool
+}
+
+// newPostgresStore connects to PostgreSQL, creates the tables and starts
+// the sweeper, returning the store and the key store for everything else
+func newPostgresStore(url string) (PollStore, KeyStore, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	db, err := pgxpool.New(connectCtx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := db.Exec(connectCtx, pgSchema); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	keys, err := newPostgresKeys(connectCtx, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	s := &postgresStore{db: db, keys: keys, watched: make(map[string]bool)}
+	go s.sweep(pgSweepInterval)
+	return s, keys, nil
+}
+
+// pgExpiry is the expires_at of a poll given a lifetime of ttl, or nil for
+// none
+func pgExpiry(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	at := time.Now().Add(ttl)
+	return &at
+}
+
+func (s *postgresStore) CreatePoll(id string, fields map[string]interface{}, ttl time.Duration) (bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// An expired poll that wasn't swept yet gives up its ID
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO polls (id, fields, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET fields = EXCLUDED.fields, expires_at = EXCLUDED.expires_at
+		WHERE polls.expires_at <= now()`,
+		id, fieldStrings(fields), pgExpiry(ttl))
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	// Clear ballots left behind by an earlier poll with the same ID
+	if err := deletePollRows(tx, []string{id}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, s.keys.Del(ballotKeys(id)...)
+}
+
+// deletePollRows deletes the voters, ballots and words of polls
+func deletePollRows(tx pgx.Tx, ids []string) error {
+	for _, table := range []string{"poll_voters", "poll_ballots", "poll_words"} {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE poll_id = ANY($1)", ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) GetPoll(id string) (map[string]string, error) {
+	fields := map[string]string{}
+	err := s.db.QueryRow(ctx, "SELECT fields FROM polls WHERE id = $1 AND "+pgLive, id).Scan(&fields)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return map[string]string{}, nil
+	}
+	return fields, err
+}
+
+func (s *postgresStore) GetPolls(ids []string, fields ...string) ([]map[string]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := s.db.Query(ctx, "SELECT id, fields FROM polls WHERE id = ANY($1) AND "+pgLive, ids)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]map[string]string, len(ids))
+	for rows.Next() {
+		var id string
+		var data map[string]string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found[id] = data
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	polls := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		polls[i] = make(map[string]string)
+		data := found[id]
+		if len(fields) == 0 {
+			for field, value := range data {
+				polls[i][field] = value
+			}
+			continue
+		}
+		for _, field := range fields {
+			if value, ok := data[field]; ok {
+				polls[i][field] = value
+			}
+		}
+	}
+	return polls, nil
+}
+
+func (s *postgresStore) ScanPolls(limit int, fn func(ids []string) error) (int, bool, error) {
+	scanned, after := 0, ""
+	for {
+		rows, err := s.db.Query(ctx, "SELECT id FROM polls WHERE id > $1 AND "+pgLive+" ORDER BY id LIMIT $2", after, pgBatchSize)
+		if err != nil {
+			return scanned, false, err
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return scanned, false, err
+		}
+		if len(ids) == 0 {
+			return scanned, false, nil
+		}
+		scanned += len(ids)
+		if err := fn(ids); err != nil {
+			return scanned, false, err
+		}
+		if len(ids) < pgBatchSize {
+			return scanned, false, nil
+		}
+		if scanned >= limit {
+			return scanned, true, nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func (s *postgresStore) UpdatePoll(id string, set map[string]interface{}, remove ...string) error {
+	if remove == nil {
+		remove = []string{}
+	}
+	_, err := s.db.Exec(ctx, "UPDATE polls SET fields = (fields || $2::jsonb) - $3::text[] WHERE id = $1 AND "+pgLive,
+		id, fieldStrings(set), remove)
+	return err
+}
+
+// UpdateUnvotedPoll holds the poll's row while checking for ballots, so a
+// vote, which holds it too, can't land in between
+func (s *postgresStore) UpdateUnvotedPoll(id string, set map[string]interface{}, remove ...string) (bool, error) {
+	if remove == nil {
+		remove = []string{}
+	}
+	tx, err := s.lockPoll(id)
+	if errors.Is(err, errPollNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var voted bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM poll_ballots WHERE poll_id = $1)", id).Scan(&voted)
+	if err != nil || voted {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE polls SET fields = (fields || $2::jsonb) - $3::text[] WHERE id = $1",
+		id, fieldStrings(set), remove); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (s *postgresStore) SetPollFieldNX(id, field string, value interface{}) (bool, error) {
+	tag, err := s.db.Exec(ctx, `
+		UPDATE polls SET fields = jsonb_set(fields, ARRAY[$2::text], to_jsonb($3::text))
+		WHERE id = $1 AND fields->($2::text) IS NULL AND `+pgLive,
+		id, field, fieldString(value))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// pgIncr adds by to a counter field of a locked or updatable poll row and
+// returns the new value
+func pgIncr(q interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}, id, field string, by int64) (int64, error) {
+	var value int64
+	err := q.QueryRow(ctx, `
+		UPDATE polls SET fields = jsonb_set(fields, ARRAY[$2::text],
+			to_jsonb((COALESCE((fields->>($2::text))::bigint, 0) + $3::bigint)::text))
+		WHERE id = $1 AND `+pgLive+`
+		RETURNING (fields->>($2::text))::bigint`,
+		id, field, by).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errPollNotFound
+	}
+	return value, err
+}
+
+func (s *postgresStore) IncrPollField(id, field string, by int64) (int64, error) {
+	return pgIncr(s.db, id, field, by)
+}
+
+func (s *postgresStore) ClosePoll(id string) (bool, error) {
+	tag, err := s.db.Exec(ctx, `
+		UPDATE polls SET fields = fields || jsonb_build_object('status', $2::text)
+		WHERE id = $1 AND fields->>'status' IS DISTINCT FROM $2::text AND `+pgLive,
+		id, statusClosed)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *postgresStore) SwapPollStatus(id, from, to string, set map[string]interface{}) (bool, error) {
+	tag, err := s.db.Exec(ctx, `
+		UPDATE polls SET fields = fields || $4::jsonb || jsonb_build_object('status', $3::text)
+		WHERE id = $1 AND COALESCE(NULLIF(fields->>'status', ''), $5::text) = $2 AND `+pgLive,
+		id, from, to, fieldStrings(set), statusActive)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PollTTL follows Redis' PTTL: -2ns for a poll that doesn't exist and
+// -1ns for one that doesn't expire
+func (s *postgresStore) PollTTL(id string) (time.Duration, error) {
+	var expiresAt *time.Time
+	err := s.db.QueryRow(ctx, "SELECT expires_at FROM polls WHERE id = $1 AND "+pgLive, id).Scan(&expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if expiresAt == nil {
+		return -1, nil
+	}
+	return time.Until(*expiresAt).Truncate(time.Millisecond), nil
+}
+
+// ExpirePoll only has to move the poll's expiry, since its voters,
+// ballots and words are swept with it
+func (s *postgresStore) ExpirePoll(id string, ttl time.Duration) error {
+	_, err := s.db.Exec(ctx, "UPDATE polls SET expires_at = $2 WHERE id = $1 AND "+pgLive, id, pgExpiry(ttl))
+	return err
+}
+
+func (s *postgresStore) HasVoted(id, member string) (bool, error) {
+	var voted bool
+	err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM poll_voters WHERE poll_id = $1 AND member = $2)", id, member).Scan(&voted)
+	return voted, err
+}
+
+// lockPoll starts a transaction holding a poll's row, which serializes the
+// votes of a poll the way a Lua script does in Redis
+func (s *postgresStore) lockPoll(id string) (pgx.Tx, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked string
+	err = tx.QueryRow(ctx, "SELECT id FROM polls WHERE id = $1 AND "+pgLive+" FOR UPDATE", id).Scan(&locked)
+	if err != nil {
+		tx.Rollback(ctx)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errPollNotFound
+		}
+		return nil, err
+	}
+	return tx, nil
+}
+
+// applyIncrements applies increments to a locked poll, negated if undo is
+// set, and returns the new values. Undoing skips counters that are gone,
+// as the Redis store does.
+func applyIncrements(tx pgx.Tx, id string, increments []Increment, undo bool) ([]int64, error) {
+	values := make([]int64, len(increments))
+	for i, inc := range increments {
+		by := inc.By
+		if undo {
+			var exists bool
+			if err := tx.QueryRow(ctx, "SELECT fields->($2::text) IS NOT NULL FROM polls WHERE id = $1", id, inc.Field).Scan(&exists); err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			by = -by
+		}
+		value, err := pgIncr(tx, id, inc.Field, by)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (s *postgresStore) RecordVote(id string, members []string, ballot string, increments ...Increment) ([]int64, bool, error) {
+	tx, err := s.lockPoll(id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var voted bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM poll_voters WHERE poll_id = $1 AND member = ANY($2))", id, members).Scan(&voted)
+	if err != nil || voted {
+		return nil, false, err
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO poll_voters (poll_id, member) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING", id, members); err != nil {
+		return nil, false, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO poll_ballots (poll_id, member, ballot) VALUES ($1, $2, $3)
+		ON CONFLICT (poll_id, member) DO UPDATE SET ballot = EXCLUDED.ballot`,
+		id, members[0], ballot); err != nil {
+		return nil, false, err
+	}
+	values, err := applyIncrements(tx, id, increments, false)
+	if err != nil {
+		return nil, false, err
+	}
+	return values, true, tx.Commit(ctx)
+}
+
+func (s *postgresStore) ChangeVote(id, member, ballot string, undo func(old string) []Increment, increments ...Increment) (string, []int64, error) {
+	tx, err := s.lockPoll(id)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var old string
+	err = tx.QueryRow(ctx, "SELECT ballot FROM poll_ballots WHERE poll_id = $1 AND member = $2", id, member).Scan(&old)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO poll_ballots (poll_id, member, ballot) VALUES ($1, $2, $3)
+		ON CONFLICT (poll_id, member) DO UPDATE SET ballot = EXCLUDED.ballot`,
+		id, member, ballot); err != nil {
+		return "", nil, err
+	}
+	if old != "" {
+		if _, err := applyIncrements(tx, id, undo(old), true); err != nil {
+			return "", nil, err
+		}
+	}
+	values, err := applyIncrements(tx, id, increments, false)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO poll_voters (poll_id, member) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, member); err != nil {
+		return "", nil, err
+	}
+	return old, values, tx.Commit(ctx)
+}
+
+func (s *postgresStore) RetractVote(id, member string, undo func(old string) []Increment) (string, error) {
+	tx, err := s.lockPoll(id)
+	if errors.Is(err, errPollNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var old string
+	err = tx.QueryRow(ctx, "DELETE FROM poll_ballots WHERE poll_id = $1 AND member = $2 RETURNING ballot", id, member).Scan(&old)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := applyIncrements(tx, id, undo(old), true); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM poll_voters WHERE poll_id = $1 AND member = $2", id, member); err != nil {
+		return "", err
+	}
+	return old, tx.Commit(ctx)
+}
+
+func (s *postgresStore) GetBallots(id string) ([]string, error) {
+	rows, err := s.db.Query(ctx, "SELECT ballot FROM poll_ballots WHERE poll_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (s *postgresStore) GetBallot(id, member string) (string, error) {
+	var ballot string
+	err := s.db.QueryRow(ctx, "SELECT ballot FROM poll_ballots WHERE poll_id = $1 AND member = $2", id, member).Scan(&ballot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return ballot, err
+}
+
+func (s *postgresStore) ScanBallots(id string, batch int, fn func(ballots map[string]string) error) error {
+	after := ""
+	for {
+		rows, err := s.db.Query(ctx, `
+			SELECT member, ballot FROM poll_ballots WHERE poll_id = $1 AND member > $2
+			ORDER BY member LIMIT $3`, id, after, batch)
+		if err != nil {
+			return err
+		}
+		ballots := make(map[string]string, batch)
+		var member, ballot string
+		_, err = pgx.ForEachRow(rows, []any{&member, &ballot}, func() error {
+			ballots[member] = ballot
+			after = member
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(ballots) > 0 {
+			if err := fn(ballots); err != nil {
+				return err
+			}
+		}
+		if len(ballots) < batch {
+			return nil
+		}
+	}
+}
+
+func (s *postgresStore) CountBallots(id string) (int64, error) {
+	var count int64
+	err := s.db.QueryRow(ctx, "SELECT count(*) FROM poll_ballots WHERE poll_id = $1", id).Scan(&count)
+	return count, err
+}
+
+func (s *postgresStore) CountVoters(id string) (int64, error) {
+	var count int64
+	err := s.db.QueryRow(ctx, "SELECT count(*) FROM poll_voters WHERE poll_id = $1", id).Scan(&count)
+	return count, err
+}
+
+func (s *postgresStore) CountWords(id string, words []string, by int64) error {
+	// One row per word, since an upsert can't touch a row twice
+	counts := make(map[string]int64, len(words))
+	for _, word := range words {
+		counts[word] += by
+	}
+	unique := make([]string, 0, len(counts))
+	deltas := make([]int64, 0, len(counts))
+	for word, delta := range counts {
+		unique = append(unique, word)
+		deltas = append(deltas, delta)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO poll_words (poll_id, word, count)
+		SELECT $1, word, delta FROM unnest($2::text[], $3::bigint[]) AS t (word, delta)
+		ON CONFLICT (poll_id, word) DO UPDATE SET count = poll_words.count + EXCLUDED.count`,
+		id, unique, deltas); err != nil {
+		return err
+	}
+	if by < 0 {
+		if _, err := tx.Exec(ctx, "DELETE FROM poll_words WHERE poll_id = $1 AND count <= 0", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) TopWords(id string, limit int) ([]WordCount, error) {
+	// Ties are broken the way ZREVRANGE breaks them, by byte order
+	rows, err := s.db.Query(ctx, `
+		SELECT word, count FROM poll_words WHERE poll_id = $1
+		ORDER BY count DESC, word COLLATE "C" DESC LIMIT $2`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	words := []WordCount{}
+	var word WordCount
+	_, err = pgx.ForEachRow(rows, []any{&word.Word, &word.Count}, func() error {
+		words = append(words, word)
+		return nil
+	})
+	return words, err
+}
+
+func (s *postgresStore) DeletePoll(id string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "DELETE FROM polls WHERE id = $1", id); err != nil {
+		return err
+	}
+	if err := deletePollRows(tx, []string{id}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	keys := make([]string, len(companionPrefixes))
+	for i, prefix := range companionPrefixes {
+		keys[i] = prefix + id
+	}
+	return s.keys.Del(keys...)
+}
+
+func (s *postgresStore) ResetVotes(id string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var fields map[string]string
+	err = tx.QueryRow(ctx, "SELECT fields FROM polls WHERE id = $1 AND "+pgLive+" FOR UPDATE", id).Scan(&fields)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errPollNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for field := range fields {
+		zero, remove := resetAction(field)
+		if zero {
+			fields[field] = "0"
+		} else if remove {
+			delete(fields, field)
+		}
+	}
+	if _, err := tx.Exec(ctx, "UPDATE polls SET fields = $2 WHERE id = $1", id, fields); err != nil {
+		return err
+	}
+	if err := deletePollRows(tx, []string{id}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// The rest of the ballot keys belong to features in the key store
+	return s.keys.Del(ballotKeys(id)...)
+}
+
+func (s *postgresStore) Publish(id string, payload []byte, meta map[string]string) error {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	// The notification carries the row's ID rather than the payload,
+	// which could exceed NOTIFY's 8000 bytes
+	_, err := s.db.Exec(ctx, `
+		WITH inserted AS (
+			INSERT INTO poll_updates (poll_id, payload, meta) VALUES ($1, $2, $3) RETURNING id
+		)
+		SELECT pg_notify($4, id::text) FROM inserted`,
+		id, string(payload), meta, pgUpdatesChannel)
+	return err
+}
+
+func (s *postgresStore) Watch(id string) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.watched[id] = true
+}
+
+func (s *postgresStore) Unwatch(id string) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	delete(s.watched, id)
+}
+
+// watchedPolls lists the watched polls
+func (s *postgresStore) watchedPolls() []string {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	ids := make([]string, 0, len(s.watched))
+	for id := range s.watched {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *postgresStore) Subscribe(ctx context.Context) <-chan PollMessage {
+	out := make(chan PollMessage)
+	go func() {
+		defer close(out)
+		defer updatesHealthy.Store(false)
+
+		// The first connection replays updatesReplay back; later ones
+		// pick up after the last update delivered
+		last := int64(-1)
+		retry := backoff{min: updatesRetryMin, max: updatesRetryMax}
+		for ctx.Err() == nil {
+			err := s.listen(ctx, &last, out)
+			if ctx.Err() != nil {
+				return
+			}
+			updatesHealthy.Store(false)
+			logger.Error("Listening for updates failed, retrying", "error", err)
+			retry.wait(ctx)
+		}
+	}()
+	return out
+}
+
+// listen delivers updates on one connection until it fails
+func (s *postgresStore) listen(ctx context.Context, last *int64, out chan<- PollMessage) error {
+	pooled, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection is left listening, so it isn't handed back to the
+	// pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgUpdatesChannel); err != nil {
+		return err
+	}
+	if *last < 0 {
+		err := conn.QueryRow(ctx, "SELECT COALESCE(max(id), 0) FROM poll_updates WHERE created_at < now() - $1 * interval '1 second'",
+			updatesReplay.Seconds()).Scan(last)
+		if err != nil {
+			return err
+		}
+	}
+	if !updatesHealthy.Swap(true) {
+		logger.Info("Listening for updates in PostgreSQL")
+	}
+
+	notified := int64(0)
+	for {
+		if err := s.deliverUpdates(ctx, conn, last, notified, out); err != nil {
+			return err
+		}
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		// IDs are taken before their insert commits, so an update can
+		// be notified after a later one was delivered
+		notified, _ = strconv.ParseInt(notification.Payload, 10, 64)
+	}
+}
+
+// deliverUpdates sends out the updates of watched polls after last, and
+// the notified one if it committed out of order. Updates of other polls
+// are skipped over.
+func (s *postgresStore) deliverUpdates(ctx context.Context, conn *pgx.Conn, last *int64, notified int64, out chan<- PollMessage) error {
+	defer func(notified int64) { *last = max(*last, notified) }(notified)
+	for {
+		rows, err := conn.Query(ctx, `
+			SELECT id, poll_id, payload, meta FROM poll_updates
+			WHERE (id > $1 OR id = $2) AND poll_id = ANY($3) ORDER BY id LIMIT $4`,
+			*last, notified, s.watchedPolls(), pgBatchSize)
+		if err != nil {
+			return err
+		}
+		var messages []PollMessage
+		var id int64
+		var msg PollMessage
+		_, err = pgx.ForEachRow(rows, []any{&id, &msg.PollID, &msg.Payload, &msg.Meta}, func() error {
+			messages = append(messages, msg)
+			msg.Meta = nil
+			*last = max(*last, id)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		notified = 0
+		if len(messages) < pgBatchSize {
+			return nil
+		}
+	}
+}
+
+// sweep deletes expired polls with their voters, ballots and words, and
+// keeps the latest UPDATES_STREAM_MAXLEN updates
+func (s *postgresStore) sweep(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := s.sweepOnce(); err != nil {
+			logger.Error("Failed to sweep PostgreSQL", "error", err)
+		}
+	}
+}
+
+func (s *postgresStore) sweepOnce() error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, "DELETE FROM polls WHERE expires_at <= now() RETURNING id")
+	if err != nil {
+		return err
+	}
+	expired, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if len(expired) > 0 {
+		if err := deletePollRows(tx, expired); err != nil {
+			return err
+		}
+		logger.Info("Swept expired polls", "count", len(expired))
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM poll_updates WHERE id <= (SELECT max(id) FROM poll_updates) - $1", updatesMaxLen); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
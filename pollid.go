@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"math"
+)
+
+// Poll ID alphabets selectable with POLL_ID_CHARSET
+var idCharsets = map[string]string{
+	"hex":    "0123456789abcdef",
+	"base32": "abcdefghijklmnopqrstuvwxyz234567",
+	// friendly leaves out characters that are easy to confuse when read
+	// aloud or typed from a screen: 0/o, 1/l/i
+	"friendly": "23456789abcdefghjkmnpqrstuvwxyz",
+}
+
+// Bounds on POLL_ID_LENGTH
+const (
+	minIDLength = 4
+	maxIDLength = 32
+)
+
+// idPolicy describes the format of generated poll IDs
+type idPolicy struct {
+	charset string
+	length  int
+}
+
+// pollIDs is the ID format used by generateID
+var pollIDs = newIDPolicy()
+
+// newIDPolicy reads POLL_ID_CHARSET and POLL_ID_LENGTH, falling back to
+// 6 hex characters on invalid values, and warns when IDs are likely to
+// collide at the expected number of live polls
+func newIDPolicy() idPolicy {
+	p := idPolicy{charset: idCharsets["hex"], length: 6}
+
+	name := envString("POLL_ID_CHARSET", "hex")
+	if charset, ok := idCharsets[name]; ok {
+		p.charset = charset
+	} else {
+		logger.Warn("Invalid value, using default", "key", "POLL_ID_CHARSET", "value", name, "default", "hex")
+	}
+
+	length := envInt("POLL_ID_LENGTH", 6)
+	if length >= minIDLength && length <= maxIDLength {
+		p.length = length
+	} else {
+		logger.Warn("POLL_ID_LENGTH out of range, using default", "value", length, "min", minIDLength, "max", maxIDLength, "default", 6)
+	}
+
+	expected := envInt("POLL_ID_EXPECTED_POLLS", 100000)
+	if chance := p.collisionChance(expected); chance > 0.01 {
+		logger.Warn("Poll IDs are short enough to collide often; consider a longer POLL_ID_LENGTH",
+			"entropy_bits", int(p.entropyBits()), "expected_polls", expected, "collision_percent", math.Round(chance*1000)/10)
+	}
+	return p
+}
+
+// entropyBits is the number of random bits in one ID
+func (p idPolicy) entropyBits() float64 {
+	return float64(p.length) * math.Log2(float64(len(p.charset)))
+}
+
+// collisionChance estimates how likely a fresh ID is to hit one of live
+// existing polls. createPoll retries collisions up to maxIDAttempts times.
+func (p idPolicy) collisionChance(live int) float64 {
+	return float64(live) / math.Pow(2, p.entropyBits())
+}
+
+// Generate returns a random ID. Bytes that would bias the distribution
+// towards the start of the alphabet are discarded.
+func (p idPolicy) Generate() string {
+	n := len(p.charset)
+	limit := 256 - 256%n
+
+	id := make([]byte, 0, p.length)
+	buf := make([]byte, p.length*2)
+	for len(id) < p.length {
+		rand.Read(buf)
+		for _, b := range buf {
+			if int(b) < limit && len(id) < p.length {
+				id = append(id, p.charset[int(b)%n])
+			}
+		}
+	}
+	return string(id)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// presenceInterval is how often changed viewer counts are published
+	presenceInterval = envDuration("PRESENCE_INTERVAL", time.Second)
+
+	// presenceTTL is how long an instance's viewer counts last without a
+	// refresh, so the viewers of a crashed instance stop being counted
+	presenceTTL = envDuration("PRESENCE_TTL", 30*time.Second)
+)
+
+// Presence tells viewers how many WebSocket and SSE clients are watching a
+// poll across all instances
+type Presence struct {
+	Type    string `json:"type"` // "presence"
+	PollID  string `json:"pollId"`
+	Viewers int    `json:"viewers"`
+}
+
+// presenceKey holds a poll's viewer count per instance, each as
+// "<count>:<unix millis of the last refresh>"
+func presenceKey(pollID string) string {
+	return fmt.Sprintf("presence:%s", pollID)
+}
+
+// dirtyPresence collects the polls whose local viewer count changed since
+// the last publish, so a burst of connections is announced once
+var dirtyPresence = struct {
+	sync.Mutex
+	polls map[string]bool
+}{polls: make(map[string]bool)}
+
+// markPresence notes that a client connected to or left a poll
+func markPresence(pollID string) {
+	dirtyPresence.Lock()
+	dirtyPresence.polls[pollID] = true
+	dirtyPresence.Unlock()
+}
+
+// runPresence publishes viewer counts that changed on this instance, and
+// refreshes this instance's counts well within presenceTTL
+func runPresence(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastRefresh := time.Now()
+	for range ticker.C {
+		dirtyPresence.Lock()
+		dirty := dirtyPresence.polls
+		dirtyPresence.polls = make(map[string]bool)
+		dirtyPresence.Unlock()
+
+		for pollID := range dirty {
+			if total, _, err := updatePresence(pollID, hub.Count(pollID)); err == nil {
+				publishEvent(pollID, Presence{Type: "presence", PollID: pollID, Viewers: total})
+			}
+		}
+
+		// Refreshing also drops other instances' stale counts, which is
+		// the only way a crashed instance's viewers leave the total
+		if time.Since(lastRefresh) < presenceTTL/3 {
+			continue
+		}
+		lastRefresh = time.Now()
+		for _, pollID := range hub.Rooms() {
+			if dirty[pollID] {
+				continue
+			}
+			if total, pruned, err := updatePresence(pollID, hub.Count(pollID)); err == nil && pruned {
+				publishEvent(pollID, Presence{Type: "presence", PollID: pollID, Viewers: total})
+			}
+		}
+	}
+}
+
+// updatePresence records this instance's viewer count of a poll and
+// returns the total across instances, and whether stale counts were
+// dropped from it
+func updatePresence(pollID string, viewers int) (int, bool, error) {
+	key := presenceKey(pollID)
+	now := time.Now()
+	var err error
+	if viewers > 0 {
+		err = kv.HSet(key, map[string]interface{}{instanceID: fmt.Sprintf("%d:%d", viewers, now.UnixMilli())})
+		kv.Expire(key, presenceTTL)
+	} else {
+		_, err = kv.HDel(key, instanceID)
+	}
+	if err != nil {
+		logger.Error("Failed to update presence", "poll_id", pollID, "error", err)
+		return 0, false, err
+	}
+
+	entries, err := kv.HGetAll(key)
+	if err != nil {
+		logger.Error("Failed to load presence", "poll_id", pollID, "error", err)
+		return 0, false, err
+	}
+	total := 0
+	var stale []string
+	for instance, entry := range entries {
+		countStr, tsStr, _ := strings.Cut(entry, ":")
+		count, _ := strconv.Atoi(countStr)
+		ts, _ := strconv.ParseInt(tsStr, 10, 64)
+		if now.Sub(time.UnixMilli(ts)) > presenceTTL {
+			stale = append(stale, instance)
+			continue
+		}
+		total += count
+	}
+	if len(stale) > 0 {
+		kv.HDel(key, stale...)
+	}
+	return total, len(stale) > 0, nil
+}
+
+// leavePresence withdraws this instance's viewers from the counts of the
+// given polls when it shuts down
+func leavePresence(pollIDs []string) {
+	for _, pollID := range pollIDs {
+		if total, _, err := updatePresence(pollID, 0); err == nil {
+			publishEvent(pollID, Presence{Type: "presence", PollID: pollID, Viewers: total})
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Sizes of QR codes, in pixels
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// pollQR handles GET /api/poll/{pollID}/qr?format=png|svg&size=<pixels>,
+// a QR code of the poll page's URL for audiences to scan. The URL starts
+// with PUBLIC_URL when it's set, otherwise with the address of the request.
+func (s *Server) pollQR(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	size := defaultQRSize
+	if raw := r.URL.Query().Get("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	code, err := qrcode.New(fmt.Sprintf("%s/poll.html?id=%s", requestBaseURL(r), pollID), qrcode.Medium)
+	if err != nil {
+		requestLogger(r).Error("Failed to encode QR code", "poll_id", pollID, "error", err)
+		http.Error(w, "Failed to create QR code", http.StatusInternalServerError)
+		return
+	}
+
+	// The code only changes with the base URL, which is part of the request
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(renderQRSVG(code.Bitmap(), size))
+		return
+	}
+	png, err := code.PNG(size)
+	if err != nil {
+		requestLogger(r).Error("Failed to render QR code", "poll_id", pollID, "error", err)
+		http.Error(w, "Failed to create QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// renderQRSVG draws a QR code's modules, quiet zone included, as an SVG
+// of the given size. The dark modules are one path, run by run along
+// each row, to keep the document small.
+func renderQRSVG(bitmap [][]bool, size int) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		size, size, len(bitmap), len(bitmap))
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/>` + "\n")
+	b.WriteString(`<path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	b.WriteString(`"/>` + "\n</svg>\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// maxQuestionsPerPoll is how many questions the audience can ask on a
+	// poll, hidden ones included
+	maxQuestionsPerPoll = envInt("MAX_QUESTIONS_PER_POLL", 500)
+
+	// topQuestions is how many questions the live broadcast carries
+	topQuestions = envInt("QUESTIONS_TOP", 20)
+
+	// questionsInterval is how often changed questions are published
+	questionsInterval = envDuration("QUESTIONS_INTERVAL", time.Second)
+
+	// maxQuestionLength is how long a question may be, in characters
+	maxQuestionLength = envInt("MAX_QUESTION_LENGTH", 300)
+)
+
+// questionLimit keeps one client from flooding the questions
+var questionLimit = newRateLimiter("question", "RATE_QUESTIONS", 0.1, 3) // questions asked per client ID
+
+// Question is one audience question of a poll's Q&A. Hidden questions,
+// and on moderated polls those awaiting approval, are only shown to the
+// owner.
+type Question struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	Author    string `json:"author,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	Upvotes   int64  `json:"upvotes"`
+	Answered  bool   `json:"answered"`
+	Hidden    bool   `json:"hidden,omitempty"`
+	Pending   bool   `json:"pending,omitempty"` // awaiting approval
+}
+
+// AskRequest is the body of POST /api/poll/{pollID}/questions
+type AskRequest struct {
+	Text     string `json:"text"`
+	Author   string `json:"author"`
+	ClientID string `json:"clientId"`
+}
+
+// UpvoteRequest is the body of POST
+// /api/poll/{pollID}/questions/{questionID}/upvote
+type UpvoteRequest struct {
+	ClientID string `json:"clientId"`
+}
+
+// ModerateQuestionRequest is the body of PATCH
+// /api/poll/{pollID}/questions/{questionID}; fields left out don't change
+type ModerateQuestionRequest struct {
+	Answered *bool `json:"answered"`
+	Hidden   *bool `json:"hidden"`
+}
+
+// QuestionsUpdate tells viewers a poll's top questions: open ones by
+// upvotes, most first, then answered ones
+type QuestionsUpdate struct {
+	Type      string     `json:"type"` // "questions"
+	PollID    string     `json:"pollId"`
+	Questions []Question `json:"questions"`
+	Total     int        `json:"total"` // visible questions, beyond the top ones
+}
+
+// questionsKey is the hash of a poll's questions, question ID to JSON
+// Question without its upvotes
+func questionsKey(pollID string) string {
+	return fmt.Sprintf("questions:%s", pollID)
+}
+
+// questionVotesKey is the sorted set of a poll's question IDs by upvotes
+func questionVotesKey(pollID string) string {
+	return fmt.Sprintf("qvotes:%s", pollID)
+}
+
+// questionVotersKey is the set of who upvoted what on a poll, as
+// "<question ID>:<voter>", so each client upvotes a question once
+func questionVotersKey(pollID string) string {
+	return fmt.Sprintf("qvoters:%s", pollID)
+}
+
+// dirtyQuestions collects the polls whose questions changed on this
+// instance since the last publish, so a burst of upvotes is announced once
+var dirtyQuestions = struct {
+	sync.Mutex
+	polls map[string]bool
+}{polls: make(map[string]bool)}
+
+// markQuestions notes that a poll's questions changed
+func markQuestions(pollID string) {
+	dirtyQuestions.Lock()
+	dirtyQuestions.polls[pollID] = true
+	dirtyQuestions.Unlock()
+}
+
+// runQuestions publishes the top questions of the polls whose questions
+// changed on this instance
+func runQuestions(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dirtyQuestions.Lock()
+		dirty := dirtyQuestions.polls
+		dirtyQuestions.polls = make(map[string]bool)
+		dirtyQuestions.Unlock()
+
+		for pollID := range dirty {
+			update, err := currentQuestions(pollID)
+			if err != nil {
+				logger.Error("Failed to load questions", "poll_id", pollID, "error", err)
+				continue
+			}
+			publishEvent(pollID, update)
+		}
+	}
+}
+
+// loadQuestions returns a poll's questions with their upvotes, open ones
+// by upvotes then age, then answered ones the same way. Hidden and pending
+// questions are left out unless withHidden is set.
+func loadQuestions(pollID string, withHidden bool) ([]Question, error) {
+	stored, err := kv.HGetAll(questionsKey(pollID))
+	if err != nil {
+		return nil, err
+	}
+	votes, err := kv.ZRange(questionVotesKey(pollID), 0, -1, false)
+	if err != nil {
+		return nil, err
+	}
+	upvotes := make(map[string]int64, len(votes))
+	for _, z := range votes {
+		upvotes[z.Member] = int64(z.Score)
+	}
+
+	questions := make([]Question, 0, len(stored))
+	for _, encoded := range stored {
+		var q Question
+		if json.Unmarshal([]byte(encoded), &q) != nil || ((q.Hidden || q.Pending) && !withHidden) {
+			continue
+		}
+		q.Upvotes = upvotes[q.ID]
+		questions = append(questions, q)
+	}
+	sort.Slice(questions, func(i, j int) bool {
+		a, b := questions[i], questions[j]
+		if a.Answered != b.Answered {
+			return !a.Answered
+		}
+		if a.Upvotes != b.Upvotes {
+			return a.Upvotes > b.Upvotes
+		}
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+		return a.ID < b.ID
+	})
+	return questions, nil
+}
+
+// currentQuestions returns the update viewers are sent with a poll's top
+// questions
+func currentQuestions(pollID string) (QuestionsUpdate, error) {
+	questions, err := loadQuestions(pollID, false)
+	if err != nil {
+		return QuestionsUpdate{}, err
+	}
+	update := QuestionsUpdate{Type: "questions", PollID: pollID, Questions: questions, Total: len(questions)}
+	if len(questions) > topQuestions {
+		update.Questions = questions[:topQuestions]
+	}
+	return update, nil
+}
+
+// loadQuestion returns one of a poll's questions, without its upvotes, or
+// errKeyNotFound if there's no such question
+func loadQuestion(pollID, questionID string) (Question, error) {
+	encoded, err := kv.HGet(questionsKey(pollID), questionID)
+	if err != nil {
+		return Question{}, err
+	}
+	var q Question
+	err = json.Unmarshal([]byte(encoded), &q)
+	return q, err
+}
+
+// askQuestion handles POST /api/poll/{pollID}/questions, which adds an
+// audience question to the poll's Q&A. Questions are open whether or not
+// the poll takes votes, and live as long as the poll.
+func (s *Server) askQuestion(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	var req AskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	q := Question{Text: normalizeText(req.Text), Author: playerName(req.Author)}
+	if q.Text == "" || len([]rune(q.Text)) > maxQuestionLength {
+		http.Error(w, fmt.Sprintf("Question must be 1-%d characters", maxQuestionLength), http.StatusBadRequest)
+		return
+	}
+	text, textOK := moderateText(q.Text)
+	author, authorOK := moderateText(q.Author)
+	if !textOK || !authorOK {
+		http.Error(w, "Question contains blocked words", http.StatusBadRequest)
+		return
+	}
+	q.Text, q.Author = text, author
+	voter, status := verifyClientID(pollID, req.ClientID, time.Now())
+	if status != "" {
+		http.Error(w, "Valid clientId required", voteHTTPStatus[status])
+		return
+	}
+	if !questionLimit.Allow(voter) {
+		tooManyRequests(w, questionLimit, "Too many questions, try again later")
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	count, err := kv.HLen(questionsKey(pollID))
+	if err != nil {
+		requestLogger(r).Error("Failed to count questions", "error", err)
+		http.Error(w, "Failed to store question", http.StatusInternalServerError)
+		return
+	}
+	if count >= int64(maxQuestionsPerPoll) {
+		http.Error(w, fmt.Sprintf("A poll may have at most %d questions", maxQuestionsPerPoll), http.StatusConflict)
+		return
+	}
+	ttl, err := store.PollTTL(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+
+	q.ID = newToken()[:12]
+	q.CreatedAt = time.Now().Unix()
+	q.Pending = data["moderated"] == "1"
+	encoded, _ := json.Marshal(q)
+	err = kv.Batch(func(b KeyBatch) {
+		b.HSet(questionsKey(pollID), map[string]interface{}{q.ID: encoded})
+		b.ZAdd(questionVotesKey(pollID), q.ID, 0)
+		if ttl > 0 {
+			b.Expire(questionsKey(pollID), ttl)
+			b.Expire(questionVotesKey(pollID), ttl)
+		}
+	})
+	if err != nil {
+		requestLogger(r).Error("Failed to store question", "error", err)
+		http.Error(w, "Failed to store question", http.StatusInternalServerError)
+		return
+	}
+	if !q.Pending {
+		markQuestions(pollID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(q)
+}
+
+// getQuestions handles GET /api/poll/{pollID}/questions, every question
+// sorted as in the broadcast. The owner (or an admin) also gets the hidden
+// ones.
+func (s *Server) getQuestions(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	questions, err := loadQuestions(pollID, isAdmin(r) || ownerMatches(r, data["owner_hash"]))
+	if err != nil {
+		requestLogger(r).Error("Failed to load questions", "error", err)
+		http.Error(w, "Failed to load questions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"questions": questions})
+}
+
+// upvoteQuestion handles POST /api/poll/{pollID}/questions/{questionID}/upvote.
+// Each client upvotes a question once; a second upvote is answered 409.
+func (s *Server) upvoteQuestion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pollID, questionID := vars["pollID"], vars["questionID"]
+
+	var req UpvoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	voter, status := verifyClientID(pollID, req.ClientID, time.Now())
+	if status != "" {
+		http.Error(w, "Valid clientId required", voteHTTPStatus[status])
+		return
+	}
+
+	q, err := loadQuestion(pollID, questionID)
+	if err == errKeyNotFound || (err == nil && (q.Hidden || q.Pending)) {
+		http.Error(w, "Question not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load question", "error", err)
+		http.Error(w, "Failed to upvote question", http.StatusInternalServerError)
+		return
+	}
+
+	upvotersKey := questionVotersKey(pollID)
+	added, err := kv.SAdd(upvotersKey, questionID+":"+voter)
+	if err != nil {
+		requestLogger(r).Error("Failed to record upvote", "error", err)
+		http.Error(w, "Failed to upvote question", http.StatusInternalServerError)
+		return
+	}
+	if added == 0 {
+		http.Error(w, "Already upvoted", http.StatusConflict)
+		return
+	}
+	upvotes, err := kv.ZIncrBy(questionVotesKey(pollID), questionID, 1)
+	if err != nil {
+		kv.SRem(upvotersKey, questionID+":"+voter)
+		requestLogger(r).Error("Failed to count upvote", "error", err)
+		http.Error(w, "Failed to upvote question", http.StatusInternalServerError)
+		return
+	}
+	if ttl, err := kv.TTL(questionsKey(pollID)); err == nil && ttl > 0 {
+		kv.Expire(upvotersKey, ttl)
+	}
+	markQuestions(pollID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": questionID, "upvotes": int64(upvotes)})
+}
+
+// moderateQuestion handles PATCH /api/poll/{pollID}/questions/{questionID},
+// which lets the owner (or an admin) mark a question answered or hide it
+// from the audience
+func (s *Server) moderateQuestion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pollID, questionID := vars["pollID"], vars["questionID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	var req ModerateQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Answered == nil && req.Hidden == nil {
+		http.Error(w, "answered or hidden is required", http.StatusBadRequest)
+		return
+	}
+
+	q, err := loadQuestion(pollID, questionID)
+	if err == errKeyNotFound {
+		http.Error(w, "Question not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load question", "error", err)
+		http.Error(w, "Failed to update question", http.StatusInternalServerError)
+		return
+	}
+	if req.Answered != nil {
+		q.Answered = *req.Answered
+	}
+	if req.Hidden != nil {
+		q.Hidden = *req.Hidden
+	}
+	encoded, _ := json.Marshal(q)
+	if err := kv.HSet(questionsKey(pollID), map[string]interface{}{q.ID: encoded}); err != nil {
+		requestLogger(r).Error("Failed to update question", "error", err)
+		http.Error(w, "Failed to update question", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Question moderated", "question_id", q.ID, "answered", q.Answered, "hidden", q.Hidden)
+	markQuestions(pollID)
+
+	upvotes, _ := kv.ZScore(questionVotesKey(pollID), q.ID)
+	q.Upvotes = int64(upvotes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Quiz polls mark some options correct. The answer stays secret while the
+// poll is open; closing it reveals the answer and scores every ballot.
+// Quizzes created with the same quiz_session add up on one leaderboard,
+// so a run of them makes a trivia game.
+var quizSessionTTL = envDuration("QUIZ_SESSION_TTL", 7*24*time.Hour)
+
+const (
+	maxPlayerNameRunes     = 32
+	defaultLeaderboardSize = 20
+	maxLeaderboardSize     = 100
+)
+
+// quizSessionPattern is what a quiz session name may look like
+var quizSessionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// correctKey is the hash field marking an option of a quiz correct
+func correctKey(optionID string) string {
+	return "correct_" + optionID
+}
+
+// playersKey maps the voters of a quiz to the players they score for
+func playersKey(pollID string) string {
+	return fmt.Sprintf("players:%s", pollID)
+}
+
+// quizSessionKey holds a session's owner and its players' names and
+// answer counts; quizScoresKey ranks its players by score
+func quizSessionKey(session string) string {
+	return fmt.Sprintf("quizsession:%s", session)
+}
+
+func quizScoresKey(session string) string {
+	return fmt.Sprintf("quizscores:%s", session)
+}
+
+// validateQuiz checks the quiz settings of a poll at creation: a quiz
+// needs a correct option, and one a multi-select ballot can pick in full
+func validateQuiz(req *CreatePollRequest) error {
+	correct := 0
+	for _, option := range req.Options {
+		if option.Correct {
+			correct++
+		}
+	}
+	if req.PollType != pollTypeQuiz {
+		if correct > 0 || req.QuizSession != "" {
+			return fmt.Errorf("correct options and quiz_session need poll_type %q", pollTypeQuiz)
+		}
+		return nil
+	}
+	if correct == 0 {
+		return fmt.Errorf("a quiz needs at least one correct option")
+	}
+	if req.MaxChoices > 1 && correct > req.MaxChoices {
+		return fmt.Errorf("a quiz can't have more correct options than max_choices")
+	}
+	if req.QuizSession != "" && !quizSessionPattern.MatchString(req.QuizSession) {
+		return fmt.Errorf("quiz_session must be 1-64 letters, digits, '-' or '_'")
+	}
+	return nil
+}
+
+// claimQuizSession reports whether ownerHash may add quizzes to a session.
+// A session belongs to whoever created its first quiz, so players can't
+// score themselves in someone else's game.
+func claimQuizSession(session, ownerHash string) (bool, error) {
+	key := quizSessionKey(session)
+	if _, err := kv.HSetNX(key, "owner_hash", ownerHash); err != nil {
+		return false, err
+	}
+	kv.Expire(key, quizSessionTTL)
+	stored, err := kv.HGet(key, "owner_hash")
+	return stored == ownerHash, err
+}
+
+// correctOptions returns the correct options of a quiz in creation order
+func correctOptions(data map[string]string) []string {
+	var ids []string
+	for id := range parseOptions(data) {
+		if data[correctKey(id)] == "1" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return optionIndex(ids[i]) < optionIndex(ids[j]) })
+	return ids
+}
+
+// keepsCorrectOption reports whether a quiz still has a correct option
+// other than optionID, which is about to lose its mark or be removed
+func keepsCorrectOption(data map[string]string, optionID string) bool {
+	for _, id := range correctOptions(data) {
+		if id != optionID {
+			return true
+		}
+	}
+	return false
+}
+
+// answeredCorrectly reports whether a ballot gets a quiz right: on a
+// single-choice quiz any correct option will do, while a multi-select
+// ballot has to pick exactly the correct ones
+func answeredCorrectly(data map[string]string, choices []string) bool {
+	if len(choices) == 0 {
+		return false
+	}
+	for _, optionID := range choices {
+		if data[correctKey(optionID)] != "1" {
+			return false
+		}
+	}
+	return maxChoicesOf(data) == 1 || len(choices) == len(correctOptions(data))
+}
+
+// recordQuizPlayer remembers who cast a quiz ballot, so their score
+// follows them from quiz to quiz of the session. Players are known by
+// their voter cookie, and may give a name for the leaderboard.
+func recordQuizPlayer(state map[string]string, member string, v voteRequest) {
+	player := v.VoterCookie
+	if player == "" {
+		player = member
+	}
+	ttl, err := store.PollTTL(v.PollID)
+	if err != nil {
+		v.log().Warn("Failed to record quiz player", "error", err)
+		return
+	}
+
+	key := playersKey(v.PollID)
+	err = kv.Batch(func(b KeyBatch) {
+		b.HSet(key, map[string]interface{}{member: player})
+		if ttl > 0 {
+			b.Expire(key, ttl)
+		}
+		if session := state["quiz_session"]; session != "" && v.Player != "" {
+			b.HSet(quizSessionKey(session), map[string]interface{}{"name_" + player: v.Player})
+		}
+	})
+	if err != nil {
+		v.log().Warn("Failed to record quiz player", "error", err)
+	}
+}
+
+// playerName cleans up the name a player gave with their ballot
+func playerName(name string) string {
+	name = normalizeText(name)
+	for utf8.RuneCountInString(name) > maxPlayerNameRunes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// QuizResults is broadcast when a quiz closes, revealing its answer
+type QuizResults struct {
+	Type           string   `json:"type"` // "quizResults"
+	PollID         string   `json:"pollId"`
+	CorrectOptions []string `json:"correctOptions"`
+	Answered       int      `json:"answered"` // ballots cast
+	Correct        int      `json:"correct"`  // ballots that got it right
+	Session        string   `json:"session,omitempty"`
+}
+
+// revealQuiz scores a closed quiz and broadcasts its answer. Only the
+// first close does so; a revealed quiz can't be reopened, so its scores
+// are final.
+func revealQuiz(pollID string) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		logger.Error("Failed to load quiz", "poll_id", pollID, "error", err)
+		return
+	}
+	if pollTypeOf(data) != pollTypeQuiz {
+		return
+	}
+	first, err := store.SetPollFieldNX(pollID, "quiz_revealed", "1")
+	if err != nil {
+		logger.Error("Failed to reveal quiz", "poll_id", pollID, "error", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	ballots, err := pollBallots(pollID)
+	if err != nil {
+		logger.Error("Failed to load quiz ballots", "poll_id", pollID, "error", err)
+		return
+	}
+	players, err := kv.HGetAll(playersKey(pollID))
+	if err != nil {
+		logger.Error("Failed to load quiz players", "poll_id", pollID, "error", err)
+		return
+	}
+
+	session := data["quiz_session"]
+	results := QuizResults{
+		Type:           "quizResults",
+		PollID:         pollID,
+		CorrectOptions: correctOptions(data),
+		Answered:       len(ballots),
+		Session:        session,
+	}
+	err = kv.Batch(func(b KeyBatch) {
+		for member, stored := range ballots {
+			ballot, _ := splitBallot(stored)
+			right := answeredCorrectly(data, strings.Split(ballot, ","))
+			if right {
+				results.Correct++
+			}
+			if session == "" {
+				continue
+			}
+			player := players[member]
+			if player == "" {
+				player = member
+			}
+			points := 0.0
+			if right {
+				points = 1
+			}
+			b.ZIncrBy(quizScoresKey(session), player, points)
+			b.HIncrBy(quizSessionKey(session), "answered_"+player, 1)
+		}
+		if session != "" {
+			b.Expire(quizScoresKey(session), quizSessionTTL)
+			b.Expire(quizSessionKey(session), quizSessionTTL)
+		}
+	})
+	if err != nil {
+		logger.Error("Failed to score quiz", "poll_id", pollID, "error", err)
+	}
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"quiz_correct": results.Correct}); err != nil {
+		logger.Error("Failed to score quiz", "poll_id", pollID, "error", err)
+	}
+
+	logger.Info("Quiz revealed", "poll_id", pollID, "answered", results.Answered, "correct", results.Correct)
+	publishEvent(pollID, results)
+}
+
+// QuizAnswer is the body of GET /api/poll/{pollID}/answer
+type QuizAnswer struct {
+	CorrectOptions []string `json:"correct_options"`
+	Answered       bool     `json:"answered"`          // the requester cast a ballot
+	Choices        []string `json:"choices,omitempty"` // what they picked
+	Correct        bool     `json:"correct"`
+}
+
+// quizAnswer handles GET /api/poll/{pollID}/answer?clientId=, telling a
+// player whether they got a closed quiz right. The voter is identified
+// the same way as for a vote.
+func (s *Server) quizAnswer(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if pollTypeOf(data) != pollTypeQuiz {
+		http.Error(w, "Poll is not a quiz", http.StatusBadRequest)
+		return
+	}
+	if data["quiz_revealed"] != "1" {
+		http.Error(w, "The answer is revealed when the quiz closes", http.StatusConflict)
+		return
+	}
+
+	answer := QuizAnswer{CorrectOptions: correctOptions(data)}
+	ids := voterIDs(data, voteRequest{
+		PollID:      pollID,
+		ClientID:    clientIdentity(pollID, r.URL.Query().Get("clientId")),
+		IP:          clientIP(r),
+		UserAgent:   r.UserAgent(),
+		VoterCookie: voterCookie(r),
+		Fingerprint: requestFingerprint(r),
+		Account:     accountFromRequest(r),
+	})
+	if data["dedup"] != dedupOff && len(ids) > 0 && ids[0] != "" {
+		stored, err := store.GetBallot(pollID, ids[0])
+		if err != nil {
+			requestLogger(r).Error("Failed to load ballot", "error", err)
+			http.Error(w, "Failed to load ballot", http.StatusInternalServerError)
+			return
+		}
+		if stored != "" {
+			ballot, _ := splitBallot(stored)
+			answer.Answered = true
+			answer.Choices = strings.Split(ballot, ",")
+			answer.Correct = answeredCorrectly(data, answer.Choices)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(answer)
+}
+
+// LeaderboardEntry is one player's line on a quiz session's leaderboard.
+// Players who gave no name are listed under a stable pseudonym.
+type LeaderboardEntry struct {
+	Rank     int    `json:"rank"` // shared by tied players
+	Player   string `json:"player"`
+	Score    int    `json:"score"`
+	Answered int    `json:"answered"`
+}
+
+// Leaderboard is the body of GET /api/quiz/{session}/leaderboard
+type Leaderboard struct {
+	Session string             `json:"session"`
+	Players []LeaderboardEntry `json:"players"`
+}
+
+// quizLeaderboard handles GET /api/quiz/{session}/leaderboard?limit=N,
+// ranking the players of a session by how many quizzes they got right
+func (s *Server) quizLeaderboard(w http.ResponseWriter, r *http.Request) {
+	session := mux.Vars(r)["session"]
+	if !quizSessionPattern.MatchString(session) {
+		http.Error(w, "Quiz session not found", http.StatusNotFound)
+		return
+	}
+	limit := defaultLeaderboardSize
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxLeaderboardSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLeaderboardSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	scores, err := kv.ZRange(quizScoresKey(session), 0, int64(limit)-1, true)
+	var info map[string]string
+	if err == nil {
+		info, err = kv.HGetAll(quizSessionKey(session))
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load leaderboard", "session", session, "error", err)
+		http.Error(w, "Failed to load leaderboard", http.StatusInternalServerError)
+		return
+	}
+	if len(info) == 0 {
+		http.Error(w, "Quiz session not found", http.StatusNotFound)
+		return
+	}
+
+	board := Leaderboard{Session: session, Players: []LeaderboardEntry{}}
+	for i, entry := range scores {
+		player := entry.Member
+		line := LeaderboardEntry{Rank: i + 1, Player: info["name_"+player], Score: int(entry.Score)}
+		if line.Player == "" {
+			line.Player = "Player " + hashToken(player)[:6]
+		}
+		line.Answered, _ = strconv.Atoi(info["answered_"+player])
+		if i > 0 && line.Score == board.Players[i-1].Score {
+			line.Rank = board.Players[i-1].Rank
+		}
+		board.Players = append(board.Players, line)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(board)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxPollsPerOwner caps how many live polls one owner token may have.
+// Zero or less disables the limit.
+var maxPollsPerOwner = envInt("MAX_POLLS_PER_OWNER", 20)
+
+// ownerPollsKey is the Redis set of poll IDs created with an owner token
+func ownerPollsKey(ownerHash string) string {
+	return fmt.Sprintf("polls:%s", ownerHash)
+}
+
+// ownerPollCount returns how many of an owner's polls still exist. Polls
+// that expired or were deleted are pruned from the owner's set on the way.
+func ownerPollCount(ownerHash string) (int, error) {
+	key := ownerPollsKey(ownerHash)
+	ids, err := kv.SMembers(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	polls, err := store.GetPolls(ids, "question")
+	if err != nil {
+		return 0, err
+	}
+
+	live := 0
+	var gone []string
+	for i, data := range polls {
+		if len(data) > 0 {
+			live++
+		} else {
+			gone = append(gone, ids[i])
+		}
+	}
+	if len(gone) > 0 {
+		kv.SRem(key, gone...)
+	}
+	return live, nil
+}
+
+// trackOwnerScript adds a poll to its owner's set unless that takes the
+// set over the cap, and extends the set's lifetime to the poll's. Adding
+// and counting in one step keeps concurrent creations from both taking the
+// last slot.
+//
+// KEYS: the owner's set
+// ARGV: poll ID, cap (0 for none), poll lifetime in milliseconds
+var trackOwnerScript = redis.NewScript(`
+local existed = redis.call('EXISTS', KEYS[1])
+redis.call('SADD', KEYS[1], ARGV[1])
+local cap = tonumber(ARGV[2])
+if cap > 0 and redis.call('SCARD', KEYS[1]) > cap then
+	redis.call('SREM', KEYS[1], ARGV[1])
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if existed == 0 or redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// trackOwnerPoll records a new poll against its owner and reports whether
+// it fits in the owner's quota. The set lives as long as the owner's
+// longest-lived poll, so a short poll doesn't take the others' slots with
+// it when it expires.
+func trackOwnerPoll(ownerHash, pollID string, ttl time.Duration) (bool, error) {
+	limit := maxPollsPerOwner
+	if limit < 0 {
+		limit = 0
+	}
+	return kv.SAddCapped(ownerPollsKey(ownerHash), pollID, limit, ttl)
+}
+
+// untrackOwnerPoll frees a deleted poll's slot in its owner's quota
+func untrackOwnerPoll(ownerHash, pollID string) {
+	kv.SRem(ownerPollsKey(ownerHash), pollID)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withPollQuota sets maxPollsPerOwner for one test
+func withPollQuota(t *testing.T, limit int) {
+	t.Helper()
+	saved := maxPollsPerOwner
+	maxPollsPerOwner = limit
+	t.Cleanup(func() { maxPollsPerOwner = saved })
+}
+
+func TestOwnerPollQuota(t *testing.T) {
+	s := newTestServer(t)
+	withPollQuota(t, 2)
+	owner := newToken()
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		w := apiRequest(t, s, http.MethodPost, "/api/poll", owner, testPollRequest())
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll %d: %d %s", i+1, w.Code, w.Body)
+		}
+		var created CreatedPoll
+		json.NewDecoder(w.Body).Decode(&created)
+		ids = append(ids, created.ID)
+	}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll", owner, testPollRequest()); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("poll over the quota: %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// Deleting a poll frees its slot
+	if w := apiRequest(t, s, http.MethodDelete, "/api/poll/"+ids[0], owner, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll", owner, testPollRequest()); w.Code != http.StatusOK {
+		t.Fatalf("poll after a delete: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTrackOwnerPollAtCap(t *testing.T) {
+	newTestServer(t)
+	withPollQuota(t, 1)
+
+	if tracked, err := trackOwnerPoll("owner", "p1", time.Hour); err != nil || !tracked {
+		t.Fatalf("first poll: %v, %v", tracked, err)
+	}
+	// A creation that got past the count before the first was tracked
+	if tracked, err := trackOwnerPoll("owner", "p2", time.Hour); err != nil || tracked {
+		t.Fatalf("second poll: tracked %v, %v", tracked, err)
+	}
+	if ids, _ := kv.SMembers(ownerPollsKey("owner")); len(ids) != 1 || ids[0] != "p1" {
+		t.Fatalf("owner set %v, want [p1]", ids)
+	}
+}
+
+func TestTrackOwnerPollKeepsLongestLifetime(t *testing.T) {
+	newTestServer(t)
+	withPollQuota(t, 0)
+
+	trackOwnerPoll("owner", "long", 24*time.Hour)
+	trackOwnerPoll("owner", "short", time.Minute)
+	ttl, err := kv.TTL(ownerPollsKey("owner"))
+	if err != nil {
+		t.Fatalf("TTL: %v", err)
+	}
+	if ttl < 23*time.Hour {
+		t.Fatalf("owner set expires in %v after a short poll, want the long poll's day", ttl)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Poll types selectable with poll_type
+const (
+	pollTypeSingle = "single" // one option, or up to max_choices
+	pollTypeRanked = "ranked" // an ordered list, tabulated by instant runoff
+	pollTypeRating = "rating" // a score per option, averaged
+	pollTypeText   = "text"   // free-text answers, aggregated into a word cloud
+	pollTypeQuiz   = "quiz"   // like single, with correct options revealed on close
+)
+
+// validatePollType checks the poll_type given at creation
+func validatePollType(pollType string, maxChoices int) error {
+	switch pollType {
+	case "", pollTypeSingle, pollTypeQuiz:
+		return nil
+	case pollTypeRanked, pollTypeRating, pollTypeText:
+		if maxChoices > 1 {
+			return fmt.Errorf("max_choices can't be combined with %s polls", pollType)
+		}
+		return nil
+	}
+	return fmt.Errorf("poll_type must be %q, %q, %q, %q or %q", pollTypeSingle, pollTypeRanked, pollTypeRating, pollTypeText, pollTypeQuiz)
+}
+
+// pollTypeOf returns a poll's type; polls without one are single-choice
+func pollTypeOf(data map[string]string) string {
+	if pollType := data["poll_type"]; pollType != "" {
+		return pollType
+	}
+	return pollTypeSingle
+}
+
+// RunoffRound is one round of instant-runoff tabulation
+type RunoffRound struct {
+	Round      int            `json:"round"`
+	Counts     map[string]int `json:"counts"`               // option ID -> ballots, among options still in the race
+	Exhausted  int            `json:"exhausted"`            // ballots ranking no remaining option
+	Eliminated string         `json:"eliminated,omitempty"` // dropped after this round
+	Winner     string         `json:"winner,omitempty"`
+	Tied       []string       `json:"tied,omitempty"` // set when the race ends without a winner
+}
+
+// instantRunoff tabulates ranked ballots. Each round counts every ballot
+// for its highest-ranked option still in the race; an option with more
+// than half of the non-exhausted ballots wins, otherwise the last-placed
+// option is eliminated. Ties for last place are broken by the earlier
+// rounds' counts, most recent first, then by eliminating the option
+// added last. Options are given in canonical order.
+func instantRunoff(options []string, ballots [][]string) []RunoffRound {
+	remaining := make(map[string]bool, len(options))
+	for _, id := range options {
+		remaining[id] = true
+	}
+
+	var rounds []RunoffRound
+	for n := 1; len(remaining) > 0; n++ {
+		round := RunoffRound{Round: n, Counts: make(map[string]int, len(remaining))}
+		for id := range remaining {
+			round.Counts[id] = 0
+		}
+		for _, ballot := range ballots {
+			counted := false
+			for _, id := range ballot {
+				if remaining[id] {
+					round.Counts[id]++
+					counted = true
+					break
+				}
+			}
+			if !counted {
+				round.Exhausted++
+			}
+		}
+
+		active := len(ballots) - round.Exhausted
+		leader, losers := rankRound(options, remaining, round.Counts)
+		switch {
+		case len(remaining) == 1 || (active > 0 && round.Counts[leader]*2 > active):
+			round.Winner = leader
+		case len(losers) == len(remaining):
+			round.Tied = losers
+		default:
+			round.Eliminated = breakTie(losers, rounds)
+			delete(remaining, round.Eliminated)
+		}
+
+		rounds = append(rounds, round)
+		if round.Eliminated == "" {
+			break
+		}
+	}
+	return rounds
+}
+
+// rankRound returns the option with the most ballots in a round, and the
+// options sharing the fewest, both in canonical order
+func rankRound(options []string, remaining map[string]bool, counts map[string]int) (string, []string) {
+	var leader string
+	var losers []string
+	for _, id := range options {
+		if !remaining[id] {
+			continue
+		}
+		if leader == "" || counts[id] > counts[leader] {
+			leader = id
+		}
+		if len(losers) == 0 || counts[id] < counts[losers[0]] {
+			losers = []string{id}
+		} else if counts[id] == counts[losers[0]] {
+			losers = append(losers, id)
+		}
+	}
+	return leader, losers
+}
+
+// breakTie picks which of the options tied for last place is eliminated
+func breakTie(tied []string, earlier []RunoffRound) string {
+	for i := len(earlier) - 1; i >= 0 && len(tied) > 1; i-- {
+		counts := earlier[i].Counts
+		lowest := counts[tied[0]]
+		for _, id := range tied[1:] {
+			if counts[id] < lowest {
+				lowest = counts[id]
+			}
+		}
+		var next []string
+		for _, id := range tied {
+			if counts[id] == lowest {
+				next = append(next, id)
+			}
+		}
+		tied = next
+	}
+	return tied[len(tied)-1]
+}
+
+// pollRunoff handles GET /api/poll/{pollID}/runoff for ranked polls. The
+// rounds are streamed as newline-delimited JSON, one per line, ending with
+// the round that found a winner or a tie.
+func (s *Server) pollRunoff(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if pollTypeOf(data) != pollTypeRanked {
+		http.Error(w, "Poll is not ranked", http.StatusBadRequest)
+		return
+	}
+	if resultsHidden(r, pollID, data) {
+		http.Error(w, "Results are hidden", http.StatusForbidden)
+		return
+	}
+
+	stored, err := store.GetBallots(pollID)
+	if err != nil {
+		requestLogger(r).Error("Failed to load ballots", "error", err)
+		http.Error(w, "Failed to load ballots", http.StatusInternalServerError)
+		return
+	}
+	ballots := make([][]string, 0, len(stored))
+	for _, ballot := range stored {
+		ranking, _ := splitBallot(ballot)
+		ballots = append(ballots, strings.Split(ranking, ","))
+	}
+
+	options := optionOrder(parseOptions(data), false, pollID, "")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, round := range instantRunoff(options, ballots) {
+		if err := r.Context().Err(); err != nil {
+			return
+		}
+		if err := enc.Encode(round); err != nil {
+			return
+		}
+		flush(w)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimiter is a token bucket per subject (an IP or client ID): up to
+// burst requests at once, refilled at rate per second. Buckets live in
+// the key store, so a limit holds across every instance.
+type rateLimiter struct {
+	name  string
+	rate  float64
+	burst int
+}
+
+// Rate limits, each configured with <PREFIX>_RATE (requests per second,
+// 0 disables it) and <PREFIX>_BURST
+var (
+	createLimit     = newRateLimiter("create", "RATE_CREATE", 0.1, 10)        // polls created per IP
+	voteIPLimit     = newRateLimiter("vote_ip", "RATE_VOTE_IP", 20, 100)      // votes per IP, generous for shared networks
+	voteClientLimit = newRateLimiter("vote_client", "RATE_VOTE_CLIENT", 1, 5) // votes per client ID
+	wsMessageLimit  = newRateLimiter("ws", "RATE_WS_MESSAGES", 50, 200)       // WebSocket messages per IP
+)
+
+// newRateLimiter creates a limiter configured from the environment
+func newRateLimiter(name, prefix string, rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		name:  name,
+		rate:  envFloat(prefix+"_RATE", rate),
+		burst: envInt(prefix+"_BURST", burst),
+	}
+}
+
+// takeTokenScript refills a bucket for the time since it was last used and
+// takes one token if there is one. Idle buckets expire once they would be
+// full again.
+//
+// KEYS: the bucket
+// ARGV: rate per second, burst, now in milliseconds
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return allowed
+`)
+
+// takeToken is takeTokenScript for the stores that run it themselves: it
+// returns the bucket's new fields and lifetime, and whether a token was
+// taken
+func takeToken(bucket map[string]string, rate float64, burst int, now time.Time) (map[string]interface{}, time.Duration, bool) {
+	ms := now.UnixMilli()
+	tokens, err := strconv.ParseFloat(bucket["tokens"], 64)
+	if err != nil {
+		tokens = float64(burst)
+	}
+	ts, err := strconv.ParseInt(bucket["ts"], 10, 64)
+	if err != nil {
+		ts = ms
+	}
+	tokens = math.Min(float64(burst), tokens+float64(max(0, ms-ts))*rate/1000)
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	lifetime := time.Duration(math.Ceil(float64(burst)/rate*1000)) * time.Millisecond
+	return map[string]interface{}{"tokens": tokens, "ts": ms}, lifetime, allowed
+}
+
+// Allow takes a token from subject's bucket and reports whether the
+// request may go ahead. Store errors let requests through, so an outage
+// doesn't also stop voting.
+func (l *rateLimiter) Allow(subject string) bool {
+	if l.rate <= 0 || l.burst <= 0 {
+		return true
+	}
+	key := fmt.Sprintf("ratelimit:%s:%s", l.name, subject)
+	allowed, err := kv.TakeToken(key, l.rate, l.burst, time.Now())
+	if err != nil {
+		logger.Warn("Rate limiter unavailable", "limiter", l.name, "error", err)
+		return true
+	}
+	if !allowed {
+		rateLimitedTotal.WithLabelValues(l.name).Inc()
+		return false
+	}
+	return true
+}
+
+// retryAfter is the Retry-After value for a rejected request: the time
+// until the next token, rounded up to whole seconds
+func (l *rateLimiter) retryAfter() string {
+	return strconv.Itoa(int(math.Ceil(1 / l.rate)))
+}
+
+// tooManyRequests rejects an HTTP request that went over a limit
+func tooManyRequests(w http.ResponseWriter, l *rateLimiter, message string) {
+	w.Header().Set("Retry-After", l.retryAfter())
+	http.Error(w, message, http.StatusTooManyRequests)
+}
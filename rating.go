@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bounds of a rating poll's scale; 1-5 stars unless the poll picks its
+// own, e.g. 0-10 for NPS
+const (
+	defaultScaleMin = 1
+	defaultScaleMax = 5
+	maxScaleValue   = 100
+)
+
+// validateScale checks the scale of a rating poll at creation, filling in
+// the default when none was given
+func validateScale(scaleMin, scaleMax int) (int, int, error) {
+	if scaleMin == 0 && scaleMax == 0 {
+		return defaultScaleMin, defaultScaleMax, nil
+	}
+	if scaleMin < 0 || scaleMax > maxScaleValue || scaleMin >= scaleMax {
+		return 0, 0, fmt.Errorf("scale must satisfy 0 <= scale_min < scale_max <= %d", maxScaleValue)
+	}
+	return scaleMin, scaleMax, nil
+}
+
+// scaleOf returns a rating poll's scale
+func scaleOf(data map[string]string) (int, int) {
+	scaleMin, err1 := strconv.Atoi(data["scale_min"])
+	scaleMax, err2 := strconv.Atoi(data["scale_max"])
+	if err1 != nil || err2 != nil {
+		return defaultScaleMin, defaultScaleMax
+	}
+	return scaleMin, scaleMax
+}
+
+// RatingScale is the range a rating poll's scores lie in
+type RatingScale struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// ratingScaleOf returns a rating poll's scale for API responses
+func ratingScaleOf(data map[string]string) *RatingScale {
+	scaleMin, scaleMax := scaleOf(data)
+	return &RatingScale{Min: scaleMin, Max: scaleMax}
+}
+
+// ratingSumKey and ratingDistKey are the hash fields of a rated option; its
+// number of ratings is kept in votes_<id> like any other count
+func ratingSumKey(optionID string) string {
+	return "rsum_" + optionID
+}
+
+func ratingDistKey(optionID string, score int) string {
+	return fmt.Sprintf("rdist_%s:%d", optionID, score)
+}
+
+// validRatings reports whether a ballot's scores fit the poll: a rating
+// poll's ballot must score every option it picks on the poll's scale, and
+// other polls take no scores
+func validRatings(data map[string]string, ratings map[string]int) bool {
+	if pollTypeOf(data) != pollTypeRating {
+		return len(ratings) == 0
+	}
+	if len(ratings) == 0 {
+		return false
+	}
+	scaleMin, scaleMax := scaleOf(data)
+	for optionID, score := range ratings {
+		if _, ok := data["option_"+optionID]; !ok || score < scaleMin || score > scaleMax {
+			return false
+		}
+	}
+	return true
+}
+
+// ratedOptions returns the options of a rating ballot in a stable order
+func ratedOptions(ratings map[string]int) []string {
+	ids := make([]string, 0, len(ratings))
+	for optionID := range ratings {
+		ids = append(ids, optionID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// encodeRatings is how a rating ballot is kept in vote:<pollID>
+func encodeRatings(ratings map[string]int) string {
+	parts := make([]string, 0, len(ratings))
+	for _, optionID := range ratedOptions(ratings) {
+		parts = append(parts, fmt.Sprintf("%s=%d", optionID, ratings[optionID]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// decodeRatings reads a rating ballot back from vote:<pollID>
+func decodeRatings(ballot string) map[string]int {
+	ratings := make(map[string]int)
+	for _, part := range strings.Split(ballot, ",") {
+		optionID, score, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(score); err == nil {
+			ratings[optionID] = n
+		}
+	}
+	return ratings
+}
+
+// parseRatings computes each option's average score, rounded to two
+// decimals, and its distribution over the whole scale. Options nobody
+// rated yet have no average.
+func parseRatings(data map[string]string) (map[string]float64, map[string]map[string]int) {
+	scaleMin, scaleMax := scaleOf(data)
+	votes := parseVotes(data)
+	averages := make(map[string]float64)
+	distributions := make(map[string]map[string]int)
+
+	for optionID := range parseOptions(data) {
+		dist := make(map[string]int, scaleMax-scaleMin+1)
+		for score := scaleMin; score <= scaleMax; score++ {
+			count, _ := strconv.Atoi(data[ratingDistKey(optionID, score)])
+			dist[strconv.Itoa(score)] = count
+		}
+		distributions[optionID] = dist
+
+		if count := votes[optionID]; count > 0 {
+			sum, _ := strconv.Atoi(data[ratingSumKey(optionID)])
+			averages[optionID] = math.Round(float64(sum)/float64(count)*100) / 100
+		}
+	}
+	return averages, distributions
+}
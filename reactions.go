@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// reactionKinds are the reactions viewers can send, in the order the
+	// pages show them
+	reactionKinds = strings.Fields(envString("REACTIONS", "👍 ❤️ 😮"))
+
+	// reactionsPerSecond caps how many reactions one connection can send
+	// each second; the rest are dropped
+	reactionsPerSecond = envInt("REACTIONS_PER_SECOND", 3)
+
+	// reactionInterval is how often polls with recent reactions have their
+	// rolling counts published
+	reactionInterval = envDuration("REACTION_INTERVAL", time.Second)
+
+	// reactionWindow is how far back the rolling counts reach
+	reactionWindow = envDuration("REACTION_WINDOW", 10*time.Second)
+)
+
+// Reactions tells viewers how many of each reaction a poll got across all
+// instances over the last window_seconds
+type Reactions struct {
+	Type    string         `json:"type"` // "reactions"
+	PollID  string         `json:"pollId"`
+	Counts  map[string]int `json:"counts"`
+	Window  int            `json:"window_seconds"`
+	Allowed []string       `json:"allowed"`
+}
+
+// reactionsKey holds a poll's recent reactions, counted per second in
+// fields "<unix seconds>:<reaction>"
+func reactionsKey(pollID string) string {
+	return fmt.Sprintf("reactions:%s", pollID)
+}
+
+// reactionPublishKey is held by the instance publishing a poll's reaction
+// counts for the current interval, so viewers get them once, not once per
+// instance that saw a reaction
+func reactionPublishKey(pollID string) string {
+	return fmt.Sprintf("reactions_tick:%s", pollID)
+}
+
+// activeReactions collects the polls that had reactions on this instance
+// within the window, so their counts are published until they decay to
+// nothing
+var activeReactions = struct {
+	sync.Mutex
+	polls map[string]bool
+}{polls: make(map[string]bool)}
+
+// reactionAllowed reports whether a reaction is one viewers can send
+func reactionAllowed(reaction string) bool {
+	for _, kind := range reactionKinds {
+		if kind == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// allowReaction counts a reaction against the connection's cap for the
+// current second. A connection's messages are handled one at a time, so
+// the counter needs no lock.
+func (c *wsClient) allowReaction(now time.Time) bool {
+	if second := now.Unix(); second != c.reactionSecond {
+		c.reactionSecond = second
+		c.reactionCount = 0
+	}
+	if c.reactionCount >= reactionsPerSecond {
+		return false
+	}
+	c.reactionCount++
+	return true
+}
+
+// recordReaction adds a reaction to its poll's count for the current
+// second
+func recordReaction(pollID, reaction string, now time.Time) error {
+	key := reactionsKey(pollID)
+	err := kv.Batch(func(b KeyBatch) {
+		b.HIncrBy(key, fmt.Sprintf("%d:%s", now.Unix(), reaction), 1)
+		b.Expire(key, reactionWindow+time.Minute)
+	})
+	if err != nil {
+		return err
+	}
+	activeReactions.Lock()
+	activeReactions.polls[pollID] = true
+	activeReactions.Unlock()
+	return nil
+}
+
+// currentReactions returns a poll's rolling reaction counts as viewers are
+// sent them
+func currentReactions(pollID string, now time.Time) (Reactions, error) {
+	counts, err := rollingReactions(pollID, now)
+	if err != nil {
+		return Reactions{}, err
+	}
+	return Reactions{
+		Type:    "reactions",
+		PollID:  pollID,
+		Counts:  counts,
+		Window:  int(reactionWindow / time.Second),
+		Allowed: reactionKinds,
+	}, nil
+}
+
+// rollingReactions sums a poll's reactions over the window, dropping the
+// seconds that fell out of it
+func rollingReactions(pollID string, now time.Time) (map[string]int, error) {
+	key := reactionsKey(pollID)
+	buckets, err := kv.HGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(reactionKinds))
+	for _, kind := range reactionKinds {
+		counts[kind] = 0
+	}
+	since := now.Add(-reactionWindow).Unix()
+	var stale []string
+	for field, value := range buckets {
+		secondStr, reaction, _ := strings.Cut(field, ":")
+		second, _ := strconv.ParseInt(secondStr, 10, 64)
+		if second <= since {
+			stale = append(stale, field)
+			continue
+		}
+		if _, ok := counts[reaction]; ok {
+			n, _ := strconv.Atoi(value)
+			counts[reaction] += n
+		}
+	}
+	if len(stale) > 0 {
+		kv.HDel(key, stale...)
+	}
+	return counts, nil
+}
+
+// runReactions publishes the rolling reaction counts of the polls that
+// had reactions on this instance, until they have none left in the window
+func runReactions(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		activeReactions.Lock()
+		polls := make([]string, 0, len(activeReactions.polls))
+		for pollID := range activeReactions.polls {
+			polls = append(polls, pollID)
+		}
+		activeReactions.Unlock()
+
+		for _, pollID := range polls {
+			reactions, err := currentReactions(pollID, now)
+			if err != nil {
+				logger.Error("Failed to load reactions", "poll_id", pollID, "error", err)
+				continue
+			}
+			total := 0
+			for _, n := range reactions.Counts {
+				total += n
+			}
+			if total == 0 {
+				activeReactions.Lock()
+				delete(activeReactions.polls, pollID)
+				activeReactions.Unlock()
+			}
+			claimed, err := kv.SetNX(reactionPublishKey(pollID), instanceID, interval*9/10)
+			if err != nil || !claimed {
+				continue
+			}
+			publishEvent(pollID, reactions)
+		}
+	}
+}
+
+// wsReaction records a viewer's reaction. Reactions over the connection's
+// cap are dropped with an error reply; accepted ones aren't acknowledged,
+// as they show up in the next rolling count.
+func (s *Server) wsReaction(m *wsMessage) {
+	if !reactionAllowed(m.Reaction) {
+		m.client.writeJSON(WSError{Type: "error", Reason: "invalid_reaction", MsgID: m.MsgID})
+		return
+	}
+	if !m.client.allowReaction(m.receivedAt) {
+		rateLimitedTotal.WithLabelValues("reaction").Inc()
+		m.client.writeJSON(WSError{Type: "error", Reason: "rate_limited", MsgID: m.MsgID})
+		return
+	}
+	if err := recordReaction(m.pollID, m.Reaction, m.receivedAt); err != nil {
+		m.client.log.Error("Failed to record reaction", "error", err)
+		m.client.writeJSON(WSError{Type: "error", Reason: "error", MsgID: m.MsgID})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// resetVotes handles POST /api/poll/{pollID}/reset, which zeroes a poll's
+// counts and forgets who voted, so it can be run again, say after a
+// rehearsal or for the next session. The question, options, settings and
+// comments are kept. Viewers get pollReset, then the zeroed counts.
+func (s *Server) resetVotes(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	// Revealing a quiz scored its players, which a reset can't take back
+	if data["quiz_revealed"] == "1" {
+		http.Error(w, "Quiz answers were already revealed and scored", http.StatusConflict)
+		return
+	}
+
+	if err := store.ResetVotes(pollID); err == errPollNotFound {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		requestLogger(r).Error("Failed to reset votes", "error", err)
+		http.Error(w, "Failed to reset votes", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Votes reset")
+	auditResetVotes(data, pollID, time.Now())
+
+	publishEvent(pollID, PollEvent{Type: "pollReset", PollID: pollID, Status: data["status"]})
+	publishEvent(pollID, currentUpdate(pollID))
+	if pollTypeOf(data) == pollTypeText {
+		publishEvent(pollID, currentTopWords(pollID))
+	}
+	if data["slack_ts"] != "" {
+		scheduleSlackUpdate(pollID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditResetVotes notes a reset in the audit log of a poll that keeps
+// one, so the ballots before it can be told from those after
+func auditResetVotes(state map[string]string, pollID string, at time.Time) {
+	if state["audit_log"] != "1" {
+		return
+	}
+	values := map[string]interface{}{"action": auditReset, "at": at.UnixMilli()}
+	err := kv.Batch(func(b KeyBatch) {
+		b.XAdd(auditKey(pollID), values)
+	})
+	if err != nil {
+		logger.Error("Failed to write audit log", "poll_id", pollID, "action", auditReset, "error", err)
+	}
+}
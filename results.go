@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ResultsOption is one option's line in GET /api/poll/{pollID}/results
+type ResultsOption struct {
+	ID      string  `json:"id"`
+	Text    string  `json:"text"`
+	Votes   int     `json:"votes"`
+	Weight  int64   `json:"weight,omitempty"` // weighted polls
+	Percent float64 `json:"percent"`
+	Rank    int     `json:"rank"` // 1 for the leaders; tied options share a rank
+}
+
+// ResultsSnapshot is the body of GET /api/poll/{pollID}/results: the counts
+// with the math done, so every client shows the same numbers
+type ResultsSnapshot struct {
+	PollID       string          `json:"pollId"`
+	Question     string          `json:"question"`
+	Status       string          `json:"status"`
+	PollType     string          `json:"poll_type"`
+	Options      []ResultsOption `json:"options"` // in creation order
+	TotalVotes   int             `json:"total_votes"`
+	TotalBallots int64           `json:"total_ballots"`
+	TotalWeight  int64           `json:"total_weight,omitempty"`
+	Leading      []string        `json:"leading"` // IDs of the options in front, more than one on a tie
+	Tie          bool            `json:"tie"`
+	Final        bool            `json:"final"` // the poll is closed
+	GeneratedAt  int64           `json:"generated_at"`
+}
+
+// roundedPercents turns counts into percentages with one decimal that add
+// up to exactly 100, by the largest remainder method: each count gets its
+// rounded-down share, and the tenths left over go to the largest
+// remainders, earlier counts first on a tie
+func roundedPercents(counts []int64, total int64) []float64 {
+	percents := make([]float64, len(counts))
+	if total <= 0 {
+		return percents
+	}
+	tenths := make([]int64, len(counts))
+	remainders := make([]int64, len(counts))
+	left := int64(1000)
+	for i, count := range counts {
+		tenths[i] = count * 1000 / total
+		remainders[i] = count * 1000 % total
+		left -= tenths[i]
+	}
+	order := make([]int, len(counts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order {
+		if left <= 0 {
+			break
+		}
+		if remainders[i] > 0 {
+			tenths[i]++
+			left--
+		}
+	}
+	for i := range tenths {
+		percents[i] = float64(tenths[i]) / 10
+	}
+	return percents
+}
+
+// buildResults computes a poll's results from its hash. Weighted polls
+// are ranked by weight; ranked polls by first preferences, with the
+// runoff at /runoff.
+func buildResults(pollID string, data map[string]string, ballots int64) ResultsSnapshot {
+	results := ResultsSnapshot{
+		PollID:       pollID,
+		Question:     data["question"],
+		Status:       data["status"],
+		PollType:     pollTypeOf(data),
+		Options:      []ResultsOption{},
+		TotalBallots: ballots,
+		Leading:      []string{},
+		GeneratedAt:  time.Now().Unix(),
+	}
+	if results.Status == "" {
+		results.Status = statusActive
+	}
+	results.Final = results.Status == statusClosed
+
+	options := parseOptions(data)
+	votes := parseVotes(data)
+	weighted := parseWeightedVotes(data)
+	tallies := make([]int64, 0, len(options))
+	var total int64
+	for _, id := range optionOrder(options, false, pollID, "") {
+		option := ResultsOption{ID: id, Text: options[id], Votes: votes[id]}
+		tally := int64(option.Votes)
+		if weighted != nil {
+			option.Weight = weighted[id]
+			tally = option.Weight
+		}
+		results.Options = append(results.Options, option)
+		results.TotalVotes += option.Votes
+		tallies = append(tallies, tally)
+		total += tally
+	}
+	if weighted != nil {
+		results.TotalWeight = total
+	}
+
+	for i, percent := range roundedPercents(tallies, total) {
+		results.Options[i].Percent = percent
+	}
+	for i, tally := range tallies {
+		rank := 1
+		for _, other := range tallies {
+			if other > tally {
+				rank++
+			}
+		}
+		results.Options[i].Rank = rank
+		if rank == 1 && tally > 0 {
+			results.Leading = append(results.Leading, results.Options[i].ID)
+		}
+	}
+	results.Tie = len(results.Leading) > 1
+	return results
+}
+
+// pollResults handles GET /api/poll/{pollID}/results, a snapshot of the
+// counts with percentages, totals and the leading option. Counts are
+// withheld the same way GET /api/poll/{pollID} withholds them.
+func (s *Server) pollResults(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	switch pollTypeOf(data) {
+	case pollTypeRating, pollTypeText:
+		http.Error(w, fmt.Sprintf("%s polls have no option totals; GET /api/poll/%s has their results", pollTypeOf(data), pollID), http.StatusConflict)
+		return
+	}
+	if resultsHidden(r, pollID, data) {
+		http.Error(w, "Results are hidden", http.StatusForbidden)
+		return
+	}
+
+	ballots, err := store.CountBallots(pollID)
+	if err != nil {
+		requestLogger(r).Error("Failed to count ballots", "error", err)
+		http.Error(w, "Failed to load results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(buildResults(pollID, data, ballots))
+}
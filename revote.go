@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// undoCounters returns the counters a stored ballot added to, so a revote
+// or retraction can revert them. Options removed since the ballot was cast
+// are skipped, as their counters went with them.
+func undoCounters(data map[string]string, stored string, weight int64) []Increment {
+	ballot, segment := splitBallot(stored)
+
+	var ratings map[string]int
+	if pollTypeOf(data) == pollTypeRating {
+		ratings = decodeRatings(ballot)
+	}
+	choices := storedChoices(data, stored)
+
+	existing := choices[:0]
+	for _, optionID := range choices {
+		if _, ok := data["option_"+optionID]; ok {
+			existing = append(existing, optionID)
+		}
+	}
+	return append(ballotCounters(data, existing, ratings, segment), weightedCounters(data, existing, weight)...)
+}
+
+// retractVote withdraws a voter's ballot on an allow_revote poll and
+// returns the outcome. Like votes, retractions are only taken while the
+// poll accepts votes.
+func retractVote(v voteRequest) string {
+	pollID := v.PollID
+	clientID, status := verifyClientID(pollID, v.ClientID, time.Now())
+	if status != "" {
+		return status
+	}
+	v.ClientID = clientID
+
+	state, err := store.GetPoll(pollID)
+	if err != nil {
+		v.log().Error("Error loading poll state", "error", err)
+		return voteError
+	}
+	if len(state) == 0 || state["allow_revote"] != "1" {
+		return voteInvalid
+	}
+	if deadlinePassed(state["closes_at"], time.Now()) {
+		return voteClosed
+	}
+	switch state["status"] {
+	case statusScheduled:
+		if !deadlinePassed(state["opens_at"], time.Now()) {
+			return voteNotOpen
+		}
+	case statusPaused:
+		return votePaused
+	case statusClosed:
+		return voteClosed
+	case statusClosing:
+		if graceExpired(state["closing_until"], time.Now()) {
+			return voteClosed
+		}
+	}
+	if status := voterAllowed(state, v); status != "" {
+		return status
+	}
+
+	member := voterIDs(state, v)[0]
+	weight, err := voterWeight(state, v)
+	if err != nil {
+		v.log().Error("Failed to load voter weight", "error", err)
+		return voteError
+	}
+	old, err := store.RetractVote(pollID, member, func(old string) []Increment {
+		return undoCounters(state, old, weight)
+	})
+	if err != nil {
+		v.log().Error("Failed to retract vote", "client_id", v.ClientID, "error", err)
+		return voteError
+	}
+	if old == "" {
+		return voteNotVoted
+	}
+	kv.HDel(voteTimesKey(pollID), member)
+	kv.HDel(votersKey(pollID), member)
+	if err := recordHistory(state, pollID, time.Now(), -1, nil, old); err != nil {
+		v.log().Warn("Failed to record vote history", "error", err)
+	}
+	auditBallot(state, v, auditRetract, member, old, time.Now())
+	v.log().Info("Vote retracted", "client_id", v.ClientID)
+
+	if pollTypeOf(state) == pollTypeText {
+		answer, _ := splitBallot(old)
+		withdrawAnswer(pollID, member, answer)
+		publishEvent(pollID, currentTopWords(pollID))
+		return voteOK
+	}
+	publishEvent(pollID, currentUpdate(pollID))
+	return voteOK
+}
+
+// wsRetract withdraws the client's vote and tells it how it went
+func (s *Server) wsRetract(m *wsMessage) {
+	ack := VoteAck{Type: "retractAck", MsgID: m.MsgID}
+	if m.ClientID == "" {
+		ack.Status = voteInvalid
+		m.client.writeJSON(ack)
+		return
+	}
+	ack.Status = retractVote(voteRequest{
+		PollID:     m.pollID,
+		ClientID:   m.ClientID,
+		IP:         m.ip,
+		UserAgent:  m.userAgent,
+		VoterToken: m.VoterToken,
+		Account:    m.client.account,
+		Log:        m.client.log,
+	})
+	m.client.writeJSON(ack)
+}
+
+// unvotePoll handles DELETE /api/poll/{pollID}/vote, the REST counterpart
+// of the retract message. The body identifies the voter like a REST vote.
+func (s *Server) unvotePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	var req RESTVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	status := voteInvalid
+	if req.ClientID != "" {
+		status = retractVote(voteRequest{
+			PollID:     pollID,
+			ClientID:   req.ClientID,
+			IP:         clientIP(r),
+			UserAgent:  r.UserAgent(),
+			VoterToken: req.VoterToken,
+			Account:    accountFromRequest(r),
+			Log:        requestLogger(r),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(voteHTTPStatus[status])
+	json.NewEncoder(w).Encode(VoteAck{Type: "retractAck", Status: status})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Polls due to open or close, and closing polls whose grace window ends,
+// are kept in sorted sets scored by their deadline, so every instance can
+// find the due ones with one query
+const (
+	openScheduleKey  = "schedule:open"
+	closeScheduleKey = "schedule:close"
+	graceScheduleKey = "schedule:grace"
+)
+
+// scheduleInterval is how often the scheduler looks for due polls. Votes
+// check the deadlines themselves, so a late tick never lets one through.
+var scheduleInterval = envDuration("SCHEDULE_CHECK_INTERVAL", time.Second)
+
+// validateSchedule checks opens_at and closes_at at creation. A time in
+// the past means now, and both have to fall within the poll's lifetime.
+func validateSchedule(opensAt, closesAt int64, now, expiresAt time.Time) error {
+	if opensAt < 0 || closesAt < 0 {
+		return fmt.Errorf("opens_at and closes_at must be Unix timestamps")
+	}
+	if opensAt > 0 && opensAt >= expiresAt.Unix() {
+		return fmt.Errorf("opens_at must be before the poll expires")
+	}
+	if closesAt == 0 {
+		return nil
+	}
+	if closesAt <= now.Unix() || closesAt <= opensAt {
+		return fmt.Errorf("closes_at must be in the future and after opens_at")
+	}
+	if closesAt > expiresAt.Unix() {
+		return fmt.Errorf("closes_at must not be after the poll expires")
+	}
+	return nil
+}
+
+// schedulePoll queues a new poll's opening and closing
+func schedulePoll(pollID string, opensAt, closesAt int64) error {
+	return kv.Batch(func(b KeyBatch) {
+		if opensAt > 0 {
+			b.ZAdd(openScheduleKey, pollID, float64(opensAt))
+		}
+		if closesAt > 0 {
+			b.ZAdd(closeScheduleKey, pollID, float64(closesAt))
+		}
+	})
+}
+
+// unscheduleClose drops a poll's scheduled close
+func unscheduleClose(pollID string) error {
+	if err := store.UpdatePoll(pollID, nil, "closes_at"); err != nil {
+		return err
+	}
+	_, err := kv.ZRem(closeScheduleKey, pollID)
+	return err
+}
+
+// scheduleFinishClosing queues the end of a closing poll's grace window
+func scheduleFinishClosing(pollID string, closesAt int64) error {
+	return kv.ZAdd(graceScheduleKey, pollID, float64(closesAt))
+}
+
+// deadlinePassed reports whether a poll's opens_at or closes_at hash value
+// has been reached; a missing one never is
+func deadlinePassed(deadline string, now time.Time) bool {
+	at, err := strconv.ParseInt(deadline, 10, 64)
+	return err == nil && at > 0 && now.Unix() >= at
+}
+
+// runScheduler opens and closes polls as their deadlines come up. Every
+// instance runs it; removing a due poll from its set is what claims it,
+// so each transition happens exactly once.
+func runScheduler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		for _, pollID := range claimDue(openScheduleKey, now) {
+			openScheduled(pollID)
+		}
+		for _, pollID := range claimDue(closeScheduleKey, now) {
+			closeScheduled(pollID)
+		}
+		for _, pollID := range claimDue(graceScheduleKey, now) {
+			finishClosing(pollID)
+		}
+	}
+}
+
+// claimDue removes the polls whose deadline has passed from a schedule
+// and returns those this instance removed
+func claimDue(key string, now time.Time) []string {
+	due, err := kv.ZRangeByScore(key, float64(now.Unix()), 0)
+	if err != nil {
+		logger.Error("Schedule check failed", "schedule", key, "error", err)
+		return nil
+	}
+
+	var claimed []string
+	for _, pollID := range due {
+		removed, err := kv.ZRem(key, pollID)
+		if err != nil {
+			logger.Error("Failed to claim scheduled poll", "poll_id", pollID, "error", err)
+			continue
+		}
+		if removed == 1 {
+			claimed = append(claimed, pollID)
+		}
+	}
+	return claimed
+}
+
+// openScheduled opens a poll that was waiting for its opens_at. Polls the
+// owner closed or deleted in the meantime are left alone.
+func openScheduled(pollID string) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		logger.Error("Failed to open scheduled poll", "poll_id", pollID, "error", err)
+		return
+	}
+	if data["status"] != statusScheduled {
+		return
+	}
+	if err := store.UpdatePoll(pollID, map[string]interface{}{"status": statusActive}); err != nil {
+		logger.Error("Failed to open scheduled poll", "poll_id", pollID, "error", err)
+		return
+	}
+	bumpConfigVersion(pollID)
+	logger.Info("Poll status changed", "poll_id", pollID, "status", statusActive, "scheduled", true)
+	publishEvent(pollID, PollEvent{Type: "pollOpened", PollID: pollID, Status: statusActive})
+}
+
+// closeScheduled closes a poll at its closes_at, like an owner's close
+// without a grace window. Countdowns are brought to zero first.
+func closeScheduled(pollID string) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		logger.Error("Failed to close scheduled poll", "poll_id", pollID, "error", err)
+		return
+	}
+	if len(data) == 0 || data["status"] == statusClosed {
+		return
+	}
+	closesAt, _ := strconv.ParseInt(data["closes_at"], 10, 64)
+	publishEvent(pollID, countdownFor(pollID, closesAt, time.Now()))
+	if err := markClosed(pollID); err != nil {
+		logger.Error("Failed to close scheduled poll", "poll_id", pollID, "error", err)
+		return
+	}
+	publishEvent(pollID, currentUpdate(pollID))
+	afterClose(pollID)
+}
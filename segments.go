@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on the segments a poll may define
+const (
+	maxSegments      = 20
+	maxSegmentLength = 50
+)
+
+// SegmentsResponse is the option x segment cross-tab of a poll
+type SegmentsResponse struct {
+	Segments []string                  `json:"segments"`
+	Options  map[string]string         `json:"options"`
+	Totals   map[string]int            `json:"totals"`
+	CrossTab map[string]map[string]int `json:"crossTab"` // option ID -> segment -> votes
+}
+
+// normalizeSegments validates the allowed segments given at creation
+func normalizeSegments(segments []string) ([]string, error) {
+	if len(segments) > maxSegments {
+		return nil, fmt.Errorf("At most %d segments allowed", maxSegments)
+	}
+	normalized := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		segment = normalizeText(segment)
+		if segment == "" || len([]rune(segment)) > maxSegmentLength {
+			return nil, fmt.Errorf("Segments must be 1-%d characters", maxSegmentLength)
+		}
+		normalized = append(normalized, segment)
+	}
+	if dup, found := findDuplicate(normalized); found {
+		return nil, fmt.Errorf("Duplicate segment: %q", dup)
+	}
+	return normalized, nil
+}
+
+// parseSegments decodes the allowed segments stored on a poll
+func parseSegments(raw string) []string {
+	var segments []string
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &segments)
+	}
+	return segments
+}
+
+// segmentAllowed reports whether a vote's segment is in the poll's set
+func segmentAllowed(raw, segment string) bool {
+	for _, allowed := range parseSegments(raw) {
+		if allowed == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentVoteKey is the hash field counting votes for an option by segment
+func segmentVoteKey(optionID, segment string) string {
+	return fmt.Sprintf("votes_%s:%s", optionID, segment)
+}
+
+// parseSegmentVotes extracts per-segment counts from a poll hash
+func parseSegmentVotes(data map[string]string) map[string]map[string]int {
+	crossTab := make(map[string]map[string]int)
+	for key, value := range data {
+		if !strings.HasPrefix(key, "votes_") {
+			continue
+		}
+		optionID, segment, found := strings.Cut(strings.TrimPrefix(key, "votes_"), ":")
+		if !found {
+			continue
+		}
+		if crossTab[optionID] == nil {
+			crossTab[optionID] = make(map[string]int)
+		}
+		var count int
+		fmt.Sscanf(value, "%d", &count)
+		crossTab[optionID][segment] = count
+	}
+	return crossTab
+}
+
+// getSegments handles GET /api/poll/{pollID}/segments
+func (s *Server) getSegments(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if resultsHidden(r, pollID, data) {
+		http.Error(w, "Results are hidden", http.StatusForbidden)
+		return
+	}
+
+	resp := SegmentsResponse{
+		Segments: parseSegments(data["segments"]),
+		Options:  parseOptions(data),
+		Totals:   parseVotes(data),
+		CrossTab: parseSegmentVotes(data),
+	}
+	if resp.Segments == nil {
+		resp.Segments = []string{}
+	}
+
+	// Fill in zeros so every option has every segment
+	for optionID := range resp.Options {
+		if resp.CrossTab[optionID] == nil {
+			resp.CrossTab[optionID] = make(map[string]int)
+		}
+		for _, segment := range resp.Segments {
+			if _, ok := resp.CrossTab[optionID][segment]; !ok {
+				resp.CrossTab[optionID][segment] = 0
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
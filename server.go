@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxIDAttempts bounds how many IDs createPoll tries before giving up
+const maxIDAttempts = 5
+
+// Server holds the HTTP handlers and their dependencies
+type Server struct {
+	// idGen produces candidate poll IDs. Tests can swap in a
+	// deterministic sequence, including deliberate collisions.
+	idGen func() string
+
+	// wsHandlers maps WebSocket message types to their handlers
+	wsHandlers map[string]wsHandler
+}
+
+// NewServer creates a Server with the default dependencies
+func NewServer() *Server {
+	s := &Server{
+		idGen: generateID,
+	}
+	s.registerWSHandlers()
+	return s
+}
+
+// routes builds the HTTP router
+func (s *Server) routes() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(withRequestLogger, withTracing, withCORS)
+
+	// CORS preflights, for any path
+	r.Methods(http.MethodOptions).HandlerFunc(s.preflight)
+
+	// API routes
+	r.HandleFunc("/api/poll", s.createPoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}", s.getPoll).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}", s.deletePoll).Methods("DELETE")
+	r.HandleFunc("/api/poll/{pollID}", s.patchPoll).Methods("PATCH")
+	r.HandleFunc("/api/poll/{pollID}/vote", s.votePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/vote", s.unvotePoll).Methods("DELETE")
+	r.HandleFunc("/api/poll/{pollID}/token", s.getClientToken).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/stream", s.streamPoll).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/config", s.getPollConfig).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/pause", s.pausePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/resume", s.resumePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/close", s.closePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/reopen", s.reopenPoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/archive", s.archivePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/reset", s.resetVotes).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/invites", s.createInvites).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/ballots", s.createBallots).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/weights", s.setWeights).Methods("PUT")
+	r.HandleFunc("/api/poll/{pollID}/voters", s.voterBreakdown).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/options", s.addOption).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/options/{optionID}", s.editOption).Methods("PUT")
+	r.HandleFunc("/api/poll/{pollID}/options/{optionID}", s.removeOption).Methods("DELETE")
+	r.HandleFunc("/api/poll/{pollID}/runoff", s.pollRunoff).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/results", s.pollResults).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/segments", s.getSegments).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/export", s.exportPoll).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/audit", s.getAuditLog).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/history", s.getHistory).Methods("GET")
+	r.HandleFunc("/api/archive/{pollID}", s.getArchivedPoll).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/chart.svg", s.pollChart).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/qr", s.pollQR).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/comments", s.addComment).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/comments", s.getComments).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/questions", s.askQuestion).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/questions", s.getQuestions).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/questions/{questionID}/upvote", s.upvoteQuestion).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/questions/{questionID}", s.moderateQuestion).Methods("PATCH")
+	r.HandleFunc("/api/poll/{pollID}/moderation", s.moderationQueue).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/moderation/{itemID}/approve", s.approveSubmission).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/moderation/{itemID}/reject", s.rejectSubmission).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/feature", s.featurePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/unfeature", s.unfeaturePoll).Methods("POST")
+	r.HandleFunc("/api/poll/{pollID}/answer", s.quizAnswer).Methods("GET")
+	r.HandleFunc("/api/poll/{pollID}/duplicate", s.duplicatePoll).Methods("POST")
+	r.HandleFunc("/api/quiz/{session}/leaderboard", s.quizLeaderboard).Methods("GET")
+	r.HandleFunc("/api/join/{code}", s.joinPoll).Methods("GET")
+	r.HandleFunc("/api/deck", s.createDeck).Methods("POST")
+	r.HandleFunc("/api/deck/{code}", s.getDeck).Methods("GET")
+	r.HandleFunc("/api/deck/{code}/next", s.advanceDeck).Methods("POST")
+	r.HandleFunc("/api/templates", s.saveTemplate).Methods("POST")
+	r.HandleFunc("/api/templates", s.listTemplates).Methods("GET")
+	r.HandleFunc("/api/templates/{templateID}", s.deleteTemplate).Methods("DELETE")
+	r.HandleFunc("/api/templates/{templateID}/poll", s.createPollFromTemplate).Methods("POST")
+	r.HandleFunc("/api/polls", s.listPolls).Methods("GET")
+	r.HandleFunc("/api/polls/results", s.bulkResults).Methods("POST")
+	r.HandleFunc("/api/admin/metrics/summary", s.adminSummary).Methods("GET")
+
+	// Accounts
+	r.HandleFunc("/api/auth/register", s.register).Methods("POST")
+	r.HandleFunc("/api/auth/login", s.login).Methods("POST")
+	r.HandleFunc("/api/auth/me", s.currentAccount).Methods("GET")
+	r.HandleFunc("/api/auth/config", s.authConfig).Methods("GET")
+	r.HandleFunc("/api/auth/oidc/login", s.oidcLogin).Methods("GET")
+	r.HandleFunc("/api/auth/oidc/callback", s.oidcCallback).Methods("GET")
+
+	// Chat integrations
+	r.HandleFunc("/integrations/slack", s.slackIntegration).Methods("POST")
+	r.HandleFunc("/integrations/discord", s.discordIntegration).Methods("POST")
+
+	// Embeddable results
+	r.HandleFunc("/embed/{pollID}", s.embedSnippet).Methods("GET")
+	r.HandleFunc("/embed/{pollID}/results", s.embedResults).Methods("GET")
+
+	// WebSocket route
+	r.HandleFunc("/ws/{pollID}", s.handleWebSocket)
+	r.HandleFunc("/ws/deck/{code}", s.followDeck)
+
+	// Health routes
+	r.HandleFunc("/health", s.health).Methods("GET")
+	r.HandleFunc("/healthz", s.healthz).Methods("GET")
+	r.HandleFunc("/readyz", s.readyz).Methods("GET")
+
+	// Metrics route
+	r.Handle("/metrics", promhttp.Handler())
+
+	// Static file routes
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+
+	return r
+}
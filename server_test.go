@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestServer points the store at a fresh in-memory store and returns a
+// Server to create polls with
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := newMemoryStore()
+	store, kv = s, s.keys
+	return NewServer()
+}
+
+// apiRequest sends a request through the server's routes, as the owner of
+// ownerToken unless it's empty, and returns the response
+func apiRequest(t *testing.T, s *Server, method, path, ownerToken string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("encoding %s %s: %v", method, path, err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &payload)
+	r.Header.Set("Content-Type", "application/json")
+	if ownerToken != "" {
+		r.Header.Set("X-Owner-Token", ownerToken)
+	}
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+// createTestPoll creates a poll through POST /api/poll
+func createTestPoll(t *testing.T, s *Server, req CreatePollRequest) CreatedPoll {
+	t.Helper()
+	w := apiRequest(t, s, http.MethodPost, "/api/poll", "", req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("creating a poll: %d %s", w.Code, w.Body)
+	}
+	var created CreatedPoll
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding the created poll: %v", err)
+	}
+	return created
+}
+
+// testPollRequest is a plain two-option poll
+func testPollRequest() CreatePollRequest {
+	return CreatePollRequest{
+		Question: "Lunch?",
+		Options:  []OptionInput{{Text: "Pizza"}, {Text: "Sushi"}},
+	}
+}
+
+// castTestVote votes for an option through the REST API with a fresh
+// client token and returns the response
+func castTestVote(t *testing.T, s *Server, pollID, option string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := apiRequest(t, s, http.MethodGet, "/api/poll/"+pollID+"/token", "", nil)
+	var token ClientToken
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatalf("decoding the client token: %v", err)
+	}
+	return apiRequest(t, s, http.MethodPost, "/api/poll/"+pollID+"/vote", "", RESTVoteRequest{Option: option, ClientID: token.ClientID})
+}
+
+func TestCreatePollRetriesIDCollisions(t *testing.T) {
+	s := newTestServer(t)
+	first := createTestPoll(t, s, testPollRequest())
+
+	candidates := []string{first.ID, "fresh1"}
+	s.idGen = func() string {
+		id := candidates[0]
+		candidates = candidates[1:]
+		return id
+	}
+	req := testPollRequest()
+	req.Question = "Dinner?"
+	second := createTestPoll(t, s, req)
+	if second.ID != "fresh1" {
+		t.Fatalf("created %q, want the ID after the collision", second.ID)
+	}
+	data, err := store.GetPoll(first.ID)
+	if err != nil || data["question"] != "Lunch?" {
+		t.Errorf("the first poll reads %q, %v after the collision, want it untouched", data["question"], err)
+	}
+}
+
+func TestCreatePollFailsWhenEveryIDCollides(t *testing.T) {
+	s := newTestServer(t)
+	first := createTestPoll(t, s, testPollRequest())
+
+	attempts := 0
+	s.idGen = func() string {
+		attempts++
+		return first.ID
+	}
+	if w := apiRequest(t, s, http.MethodPost, "/api/poll", "", testPollRequest()); w.Code != http.StatusInternalServerError {
+		t.Fatalf("creating with every ID taken: %d %s, want 500", w.Code, w.Body)
+	}
+	if attempts != maxIDAttempts {
+		t.Errorf("%d IDs tried, want %d", attempts, maxIDAttempts)
+	}
+}
+
+func TestCreatePollClearsBallotsOfReusedID(t *testing.T) {
+	eachPollStore(t, func(t *testing.T, s PollStore) {
+		fields := map[string]interface{}{"question": "Lunch?", "votes_0": 0}
+		s.CreatePoll("p1", fields, time.Hour)
+		s.RecordVote("p1", []string{"m"}, "0", incr("votes_0"))
+		s.CountWords("p1", []string{"pizza"}, 1)
+
+		// Emptying the hash stands in for the poll expiring before its
+		// ballots
+		s.UpdatePoll("p1", nil, "question", "votes_0")
+		if created, err := s.CreatePoll("p1", fields, time.Hour); err != nil || !created {
+			t.Fatalf("reusing the ID: %v, %v", created, err)
+		}
+		if ttl, _ := s.PollTTL("p1"); ttl <= 59*time.Minute {
+			t.Errorf("TTL = %v, want about an hour", ttl)
+		}
+		if voted, _ := s.HasVoted("p1", "m"); voted {
+			t.Error("the earlier poll's voter is still marked")
+		}
+		if ballot, _ := s.GetBallot("p1", "m"); ballot != "" {
+			t.Errorf("the earlier poll's ballot %q survived", ballot)
+		}
+		if words, _ := s.TopWords("p1", 10); len(words) != 0 {
+			t.Errorf("the earlier poll's words %v survived", words)
+		}
+		if created, _ := s.CreatePoll("p1", fields, time.Hour); created {
+			t.Error("created over a live poll")
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+)
+
+// optionOrder returns the option IDs in display order. Normally that is
+// creation order; on shuffle_options polls each client gets its own
+// permutation, seeded by poll and client ID so it's stable across reloads.
+// Votes still use the canonical option IDs, so no mapping back is needed.
+func optionOrder(options map[string]string, shuffle bool, pollID, clientID string) []string {
+	order := make([]string, 0, len(options))
+	for id := range options {
+		order = append(order, id)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return optionIndex(order[i]) < optionIndex(order[j])
+	})
+
+	if !shuffle || clientID == "" {
+		return order
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(pollID))
+	h.Write([]byte{0})
+	h.Write([]byte(clientID))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	rng.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+	return order
+}
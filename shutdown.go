@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// shutdownGrace bounds the whole shutdown sequence
+	shutdownGrace = envDuration("SHUTDOWN_GRACE", 15*time.Second)
+
+	// closePollsOnShutdown closes every poll with viewers on this instance
+	// when the process is stopped, so a deploy doesn't lose live results
+	closePollsOnShutdown = envBool("CLOSE_POLLS_ON_SHUTDOWN", false)
+
+	// resultsRetention is the TTL given to polls closed during shutdown
+	resultsRetention = envDuration("RESULTS_RETENTION", 7*24*time.Hour)
+)
+
+// shutdown stops accepting requests, optionally closes the polls being
+// watched on this instance, and disconnects WebSocket clients, all within
+// the shutdown grace period
+func (s *Server) shutdown(httpSrv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+
+	// Stop taking new connections; hijacked WebSockets stay open, while
+	// SSE streams are ordinary requests that Shutdown would wait for
+	endStreams()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP shutdown", "error", err)
+	}
+
+	if closePollsOnShutdown {
+		closeLocalPolls(ctx)
+	}
+
+	leavePresence(hub.Rooms())
+	disconnectAll()
+	voteEvents.Close()
+	logger.Info("Shutdown complete")
+}
+
+// closeLocalPolls closes every open poll this instance has viewers for,
+// broadcasts the final state, extends retention and sends notifications
+func closeLocalPolls(ctx context.Context) {
+	pollIDs := hub.Rooms()
+	logger.Info("Closing live polls before shutdown", "polls", len(pollIDs))
+
+	for _, pollID := range pollIDs {
+		if ctx.Err() != nil {
+			logger.Warn("Shutdown grace period expired, polls left open", "polls", len(pollIDs))
+			return
+		}
+
+		status, err := pollStatus(pollID)
+		if err != nil || status == statusClosed {
+			continue
+		}
+		if err := markClosed(pollID); err != nil {
+			logger.Error("Failed to close poll on shutdown", "poll_id", pollID, "error", err)
+			continue
+		}
+
+		retainResults(pollID)
+
+		afterClose(pollID)
+	}
+
+	// Give the pub/sub listener a moment to deliver the final broadcasts
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-ctx.Done():
+	}
+}
+
+// disconnectAll tells every WebSocket client the server is going away,
+// giving the write pumps a moment to flush the close frames
+func disconnectAll() {
+	var clients []*wsClient
+	for _, sub := range append(hub.All(), deckHub.All()...) {
+		if client, ok := sub.(*wsClient); ok {
+			clients = append(clients, client)
+		}
+	}
+
+	for _, client := range clients {
+		client.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	deadline := time.After(time.Second)
+	for _, client := range clients {
+		select {
+		case <-client.done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// retainResults keeps a finished poll's data around for resultsRetention,
+// past the normal poll lifetime
+func retainResults(pollID string) {
+	setExpiry(pollID, resultsRetention)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slack settings. The integration is disabled unless
+// SLACK_SIGNING_SECRET is set; without SLACK_BOT_TOKEN poll messages are
+// posted as the command's reply and only refreshed when someone votes
+// from Slack.
+var (
+	slackSigningSecret = envString("SLACK_SIGNING_SECRET", "")
+	slackBotToken      = envString("SLACK_BOT_TOKEN", "")
+	slackAPIURL        = strings.TrimSuffix(envString("SLACK_API_URL", "https://slack.com/api"), "/")
+
+	// slackUpdateDelay gathers the votes of a burst into one message
+	// update, keeping well within Slack's rate limits
+	slackUpdateDelay = envDuration("SLACK_UPDATE_DELAY", 2*time.Second)
+)
+
+// slackMaxSkew is how old a Slack request may be, against replays
+const slackMaxSkew = 5 * time.Minute
+
+// slackMaxBody bounds the size of a Slack request
+const slackMaxBody = 64 << 10
+
+// slackUsage is the reply to a slash command that isn't a poll
+const slackUsage = "Usage: `/poll Question | Option 1 | Option 2 | ...`"
+
+// slackInteraction is the part of a Slack block_actions payload votes need
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Team struct {
+		ID string `json:"id"`
+	} `json:"team"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	ResponseURL string `json:"response_url"`
+}
+
+// slackResponse is the reply of the Slack Web API
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// verifySlackRequest checks a request's signature: "v0=" and the hex
+// HMAC-SHA256 of "v0:<timestamp>:<body>" under the signing secret
+func verifySlackRequest(r *http.Request, body []byte, now time.Time) bool {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// slackIntegration handles POST /integrations/slack: slash commands that
+// create polls, and the clicks on their vote buttons
+func (s *Server) slackIntegration(w http.ResponseWriter, r *http.Request) {
+	if slackSigningSecret == "" {
+		http.Error(w, "Slack integration is not configured", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, slackMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !verifySlackRequest(r, body, time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if payload := form.Get("payload"); payload != "" {
+		s.slackInteraction(w, r, payload)
+		return
+	}
+	s.slackCommand(w, r, form)
+}
+
+// slackCommand creates a poll from a slash command and posts it to the
+// channel. The user gets the owner token in a reply only they can see.
+func (s *Server) slackCommand(w http.ResponseWriter, r *http.Request, form url.Values) {
+	req, ok := parsePollCommand(form.Get("text"))
+	if !ok {
+		writeSlack(w, map[string]interface{}{"response_type": "ephemeral", "text": slackUsage})
+		return
+	}
+
+	team, user := form.Get("team_id"), form.Get("user_id")
+	created, err := s.createPollAs(r, req, integrationID("slack-owner", team, user))
+	if err != nil {
+		writeSlack(w, map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          "Couldn't create the poll: " + err.Error(),
+		})
+		return
+	}
+	requestLogger(r).Info("Poll created from Slack", "poll_id", created.ID, "team", team)
+
+	card, err := loadPollCard(created.ID)
+	if err != nil {
+		requestLogger(r).Error("Failed to load poll card", "poll_id", created.ID, "error", err)
+		http.Error(w, "Failed to create poll", http.StatusInternalServerError)
+		return
+	}
+	notice := fmt.Sprintf("Poll created. Manage it with the owner token `%s`.", created.OwnerToken)
+
+	// Without a bot token the poll is posted as the command's reply
+	if slackBotToken == "" {
+		writeSlack(w, map[string]interface{}{
+			"response_type": "in_channel",
+			"text":          card.Question,
+			"blocks":        slackBlocks(card),
+		})
+		go respondSlack(form.Get("response_url"), map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          notice,
+		})
+		return
+	}
+
+	posted, err := slackAPI("chat.postMessage", map[string]interface{}{
+		"channel": form.Get("channel_id"),
+		"text":    card.Question,
+		"blocks":  slackBlocks(card),
+	})
+	if err != nil {
+		requestLogger(r).Warn("Failed to post poll to Slack", "poll_id", created.ID, "error", err)
+		writeSlack(w, map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          "Couldn't post the poll to this channel; is the app a member of it? " + notice,
+		})
+		return
+	}
+	store.UpdatePoll(created.ID, map[string]interface{}{"slack_channel": posted.Channel, "slack_ts": posted.TS})
+	writeSlack(w, map[string]interface{}{"response_type": "ephemeral", "text": notice})
+}
+
+// slackInteraction counts a click on a vote button. Votes that aren't
+// counted are explained to the voter alone.
+func (s *Server) slackInteraction(w http.ResponseWriter, r *http.Request, payload string) {
+	var interaction slackInteraction
+	if err := json.Unmarshal([]byte(payload), &interaction); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	team, user := interaction.Team.ID, interaction.User.ID
+	for _, action := range interaction.Actions {
+		if action.ActionID != "vote" {
+			continue
+		}
+		pollID, optionID, ok := strings.Cut(action.Value, ":")
+		if !ok {
+			continue
+		}
+		status := chatVote(r, pollID, optionID, "slack:"+team, integrationID("slack", team, user))
+		if status != voteOK {
+			go respondSlack(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             chatVoteMessage(status),
+			})
+			continue
+		}
+
+		// Messages posted by the bot are refreshed after every vote;
+		// command replies can only be replaced through the response URL
+		if slackBotToken == "" {
+			if card, err := loadPollCard(pollID); err == nil {
+				go respondSlack(interaction.ResponseURL, map[string]interface{}{
+					"replace_original": true,
+					"text":             card.Question,
+					"blocks":           slackBlocks(card),
+				})
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// slackUpdates holds the polls whose Slack message is due for a refresh
+// on this instance
+var slackUpdates = struct {
+	sync.Mutex
+	pending map[string]bool
+}{pending: make(map[string]bool)}
+
+// scheduleSlackUpdate refreshes a poll's Slack message shortly, once for
+// all the votes until then
+func scheduleSlackUpdate(pollID string) {
+	if slackBotToken == "" {
+		return
+	}
+	slackUpdates.Lock()
+	defer slackUpdates.Unlock()
+	if slackUpdates.pending[pollID] {
+		return
+	}
+	slackUpdates.pending[pollID] = true
+	time.AfterFunc(slackUpdateDelay, func() {
+		slackUpdates.Lock()
+		delete(slackUpdates.pending, pollID)
+		slackUpdates.Unlock()
+		refreshSlackMessage(pollID)
+	})
+}
+
+// refreshSlackMessage updates the message a poll was posted to Slack in
+// with its current counts, or its final ones without the buttons
+func refreshSlackMessage(pollID string) {
+	target, err := pollFields(pollID, "slack_channel", "slack_ts")
+	if err != nil {
+		return
+	}
+	channel, ts := target["slack_channel"], target["slack_ts"]
+	if channel == "" || ts == "" {
+		return
+	}
+	card, err := loadPollCard(pollID)
+	if err != nil {
+		return
+	}
+	_, err = slackAPI("chat.update", map[string]interface{}{
+		"channel": channel,
+		"ts":      ts,
+		"text":    card.Question,
+		"blocks":  slackBlocks(card),
+	})
+	if err != nil {
+		logger.Warn("Failed to update Slack message", "poll_id", pollID, "error", err)
+	}
+}
+
+// slackBlocks lays a poll out as Slack blocks: the question, one section
+// per option with its count and a vote button, and a footer
+func slackBlocks(card PollCard) []interface{} {
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": "*" + slackEscape(card.Question) + "*"},
+		},
+	}
+	for _, option := range card.Options {
+		text := "*" + slackEscape(strings.TrimSpace(option.Emoji+" "+option.Text)) + "*"
+		if !card.Hidden {
+			text += fmt.Sprintf("\n`%s` %d (%.0f%%)", bar(option.Percent), option.Votes, option.Percent)
+		}
+		section := map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		}
+		if !card.Closed {
+			section["accessory"] = map[string]interface{}{
+				"type":      "button",
+				"text":      map[string]string{"type": "plain_text", "text": "Vote"},
+				"action_id": "vote",
+				"value":     card.PollID + ":" + option.ID,
+			}
+		}
+		blocks = append(blocks, section)
+	}
+
+	footer := fmt.Sprintf("%d votes", card.Total)
+	if card.Hidden {
+		footer = "Results are shown when the poll closes"
+	}
+	if card.Closed {
+		footer = "🔒 Closed · " + footer
+	}
+	if card.Link != "" {
+		footer += fmt.Sprintf(" · <%s|Open in Pulse>", card.Link)
+	}
+	blocks = append(blocks, map[string]interface{}{
+		"type":     "context",
+		"elements": []interface{}{map[string]string{"type": "mrkdwn", "text": footer}},
+	})
+	return blocks
+}
+
+// slackEscape escapes the characters Slack's mrkdwn treats as markup
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// writeSlack writes the JSON reply to a Slack request
+func writeSlack(w http.ResponseWriter, msg interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// respondSlack posts a message to a command's or interaction's response
+// URL
+func respondSlack(responseURL string, msg interface{}) {
+	if responseURL == "" {
+		return
+	}
+	body, _ := json.Marshal(msg)
+	resp, err := notifyClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed to respond to Slack", "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// slackAPI calls a Slack Web API method with the bot token
+func slackAPI(method string, args interface{}) (*slackResponse, error) {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, slackAPIURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+slackBotToken)
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result slackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("%s: %s", method, result.Error)
+	}
+	return &result, nil
+}
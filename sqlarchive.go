@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Polls live in Redis only as long as their TTL. With ARCHIVE_DATABASE_URL
+// set, a background archiver copies each poll into PostgreSQL shortly
+// before it expires: question, options, final counts and vote history,
+// which GET /api/archive/{pollID} serves from then on.
+var (
+	// archiveDatabaseURL is a PostgreSQL connection string; archiving is
+	// off when it is empty
+	archiveDatabaseURL = envString("ARCHIVE_DATABASE_URL", "")
+
+	// archiveLead is how long before a poll expires it is archived. It
+	// falls after the final results freeze by default, so the archive
+	// holds the frozen state. Polls shorter than four times this are
+	// archived three quarters of the way through their lifetime.
+	archiveLead = envDuration("ARCHIVE_LEAD", 30*time.Second)
+
+	// archiveInterval is how often polls are checked for being due
+	archiveInterval = envDuration("ARCHIVE_INTERVAL", 10*time.Second)
+)
+
+// archiveBatchSize is the most polls archived in one pass
+const archiveBatchSize = 100
+
+// archiveDueKey is a sorted set of the polls waiting to be archived,
+// scored by the Unix time they are due
+const archiveDueKey = "archive_due"
+
+// archiveSchema creates the archive table on startup
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS poll_archive (
+	poll_id     TEXT PRIMARY KEY,
+	question    TEXT NOT NULL,
+	poll_type   TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL,
+	expires_at  TIMESTAMPTZ NOT NULL,
+	archived_at TIMESTAMPTZ NOT NULL,
+	options     JSONB NOT NULL,
+	results     JSONB NOT NULL,
+	history     JSONB NOT NULL
+)`
+
+// ArchivedOption is an option of an archived poll with its final count
+type ArchivedOption struct {
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+	Votes int    `json:"votes"` // ratings on rating polls
+}
+
+// ArchivedPoll is the body of GET /api/archive/{pollID}
+type ArchivedPoll struct {
+	PollID     string           `json:"pollId"`
+	Question   string           `json:"question"`
+	PollType   string           `json:"poll_type"`
+	Status     string           `json:"status"` // when it was archived
+	CreatedAt  int64            `json:"created_at"`
+	ExpiresAt  int64            `json:"expires_at"`
+	ArchivedAt int64            `json:"archived_at"`
+	Options    []ArchivedOption `json:"options"` // in creation order
+	Results    FinalResults     `json:"results"`
+	History    VoteHistory      `json:"history"`
+}
+
+// pollArchive is nil when archiving isn't configured
+var pollArchive *sqlArchive
+
+// sqlArchive keeps expired polls in PostgreSQL
+type sqlArchive struct {
+	db *pgxpool.Pool
+}
+
+// newSQLArchive connects to the archive database and creates its table.
+// It returns nil when ARCHIVE_DATABASE_URL isn't set.
+func newSQLArchive(url string) (*sqlArchive, error) {
+	if url == "" {
+		return nil, nil
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	db, err := pgxpool.New(connectCtx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(connectCtx, archiveSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.Info("Archiving expiring polls to PostgreSQL", "lead", archiveLead)
+	return &sqlArchive{db: db}, nil
+}
+
+// archiveDelay is how long after it was given a lifetime of ttl a poll is
+// archived
+func archiveDelay(ttl time.Duration) time.Duration {
+	return ttl - min(archiveLead, ttl/4)
+}
+
+// scheduleArchive queues a poll to be archived before it expires. It is a
+// no-op when archiving isn't configured.
+func scheduleArchive(pollID string, ttl time.Duration) {
+	if pollArchive == nil {
+		return
+	}
+	due := time.Now().Add(archiveDelay(ttl)).Unix()
+	if err := kv.ZAdd(archiveDueKey, pollID, float64(due)); err != nil {
+		logger.Error("Failed to schedule poll archiving", "poll_id", pollID, "error", err)
+	}
+}
+
+// run archives the polls that are due. Each poll is taken off the
+// queue before it is archived, so only one instance archives it; a failed
+// one goes back on to be retried.
+func (a *sqlArchive) run(interval time.Duration) {
+	if a == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		due, err := kv.ZRangeByScore(archiveDueKey, float64(now.Unix()), archiveBatchSize)
+		if err != nil {
+			logger.Error("Failed to load polls due for archiving", "error", err)
+			continue
+		}
+		for _, pollID := range due {
+			if removed, err := kv.ZRem(archiveDueKey, pollID); err != nil || removed == 0 {
+				continue
+			}
+			if err := a.archive(pollID, now); err != nil {
+				logger.Error("Failed to archive poll", "poll_id", pollID, "error", err)
+				kv.ZAdd(archiveDueKey, pollID, float64(now.Add(interval).Unix()))
+			}
+		}
+	}
+}
+
+// archive copies a poll into the archive, replacing an earlier copy
+func (a *sqlArchive) archive(pollID string, now time.Time) error {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		logger.Warn("Poll expired before it was archived", "poll_id", pollID)
+		return nil
+	}
+
+	results, err := finalResults(pollID)
+	if err != nil {
+		return err
+	}
+	history, err := loadHistory(pollID, 0)
+	if err != nil {
+		return err
+	}
+	votes := parseVotes(data)
+	options := parseOptions(data)
+	archived := make([]ArchivedOption, 0, len(options))
+	for _, id := range optionOrder(options, false, pollID, "") {
+		archived = append(archived, ArchivedOption{ID: id, Text: options[id], Votes: votes[id]})
+	}
+	status := data["status"]
+	if status == "" {
+		status = statusActive
+	}
+	createdAt, _ := strconv.ParseInt(data["created_at"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(data["expires_at"], 10, 64)
+
+	encodedOptions, _ := json.Marshal(archived)
+	encodedResults, _ := json.Marshal(results)
+	encodedHistory, _ := json.Marshal(history)
+	_, err = a.db.Exec(ctx, `
+		INSERT INTO poll_archive (poll_id, question, poll_type, status, created_at, expires_at, archived_at, options, results, history)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (poll_id) DO UPDATE SET
+			question = EXCLUDED.question, poll_type = EXCLUDED.poll_type, status = EXCLUDED.status,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at, archived_at = EXCLUDED.archived_at,
+			options = EXCLUDED.options, results = EXCLUDED.results, history = EXCLUDED.history`,
+		pollID, data["question"], pollTypeOf(data), status,
+		time.Unix(createdAt, 0), time.Unix(expiresAt, 0), now,
+		string(encodedOptions), string(encodedResults), string(encodedHistory))
+	if err != nil {
+		return err
+	}
+	logger.Info("Poll archived to PostgreSQL", "poll_id", pollID)
+	return nil
+}
+
+// load reads an archived poll back, with pgx.ErrNoRows if there is none
+func (a *sqlArchive) load(pollID string) (ArchivedPoll, error) {
+	poll := ArchivedPoll{PollID: pollID}
+	var createdAt, expiresAt, archivedAt time.Time
+	var options, results, history []byte
+	err := a.db.QueryRow(ctx, `
+		SELECT question, poll_type, status, created_at, expires_at, archived_at, options, results, history
+		FROM poll_archive WHERE poll_id = $1`, pollID).
+		Scan(&poll.Question, &poll.PollType, &poll.Status, &createdAt, &expiresAt, &archivedAt, &options, &results, &history)
+	if err != nil {
+		return poll, err
+	}
+	poll.CreatedAt, poll.ExpiresAt, poll.ArchivedAt = createdAt.Unix(), expiresAt.Unix(), archivedAt.Unix()
+	if err := json.Unmarshal(options, &poll.Options); err != nil {
+		return poll, fmt.Errorf("decoding options: %v", err)
+	}
+	if err := json.Unmarshal(results, &poll.Results); err != nil {
+		return poll, fmt.Errorf("decoding results: %v", err)
+	}
+	if err := json.Unmarshal(history, &poll.History); err != nil {
+		return poll, fmt.Errorf("decoding history: %v", err)
+	}
+	return poll, nil
+}
+
+// getArchivedPoll handles GET /api/archive/{pollID}, the results of a poll
+// as they were archived before it expired
+func (s *Server) getArchivedPoll(w http.ResponseWriter, r *http.Request) {
+	if pollArchive == nil {
+		http.Error(w, "Poll archive is not configured", http.StatusNotFound)
+		return
+	}
+	poll, err := pollArchive.load(mux.Vars(r)["pollID"])
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Poll not archived", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load archived poll", "error", err)
+		http.Error(w, "Failed to load archived poll", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line, so proxies
+// don't time it out
+var sseKeepAlive = envDuration("SSE_KEEPALIVE", 25*time.Second)
+
+// sseStream is one read-only Server-Sent Events viewer of a poll
+type sseStream struct {
+	events chan sseEvent
+
+	// Withheld counts, as for WebSocket clients; streams that may only
+	// see the counts of closed polls unhide when the poll closes and hide
+	// again when it is reopened
+	hidden atomic.Bool
+	blind  bool
+
+	openText bool // open-text polls also stream their word cloud
+}
+
+// sseEvent is a broadcast message queued for a stream
+type sseEvent struct {
+	name string
+	data []byte
+}
+
+var (
+	// streamsDone is closed on shutdown to end every stream
+	streamsDone    = make(chan struct{})
+	endStreamsOnce sync.Once
+)
+
+// streamPoll handles GET /api/poll/{pollID}/stream, pushing the same
+// broadcasts WebSocket clients receive as Server-Sent Events, for viewers
+// on networks that block WebSockets
+func (s *Server) streamPoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	stream := &sseStream{events: make(chan sseEvent, 16)}
+	stream.hidden.Store(resultsHidden(r, pollID, data))
+	stream.blind = resultsWithheld(r, pollID, data)
+	stream.openText = pollTypeOf(data) == pollTypeText
+
+	hub.Register(pollID, stream)
+	markPresence(pollID)
+	defer func() {
+		hub.Unregister(pollID, stream)
+		markPresence(pollID)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering
+	w.WriteHeader(http.StatusOK)
+
+	// Start with the current counts, like a new WebSocket connection
+	writeSSE(w, stream.currentVotes(pollID))
+	if stream.openText && !stream.hidden.Load() {
+		writeSSE(w, stream.currentTopWords(pollID))
+	}
+	if countdown, ok := pollCountdown(pollID, data, time.Now()); ok {
+		payload, _ := json.Marshal(countdown)
+		writeSSE(w, sseEvent{name: countdown.Type, data: payload})
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-stream.events:
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			if pollGone(event.name) {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// endStreams ends every SSE stream, so HTTP shutdown doesn't wait on them.
+// Browsers' EventSource reconnects on its own, to another instance if
+// there is one.
+func endStreams() {
+	endStreamsOnce.Do(func() { close(streamsDone) })
+}
+
+// currentVotes builds the voteUpdate event with the poll's current counts,
+// or the hidden placeholder
+func (st *sseStream) currentVotes(pollID string) sseEvent {
+	update := hiddenUpdate
+	if !st.hidden.Load() {
+		update = currentUpdate(pollID)
+	}
+	payload, _ := json.Marshal(update)
+	return sseEvent{name: update.Type, data: payload}
+}
+
+// writeSSE writes one event in the text/event-stream format
+func writeSSE(w http.ResponseWriter, event sseEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data)
+	return err
+}
+
+// deliver queues a broadcast for the stream. A viewer too slow to drain
+// its queue misses events rather than holding up the fan-out; vote
+// updates are full snapshots, so the next one catches it up.
+func (st *sseStream) deliver(b *broadcast) {
+	eventType := b.update.Type
+	if eventType == "topWords" && st.hidden.Load() {
+		return
+	}
+	event := sseEvent{name: eventType, data: b.message}
+	if eventType == "voteUpdate" && st.hidden.Load() {
+		event.data, _ = json.Marshal(hiddenUpdate)
+	}
+	queueSSE(st, event)
+
+	// Everyone sees the final tally
+	if eventType == "pollClosed" && st.blind && st.hidden.CompareAndSwap(true, false) {
+		queueSSE(st, st.currentVotes(b.pollID))
+		if st.openText {
+			queueSSE(st, st.currentTopWords(b.pollID))
+		}
+	}
+	if eventType == "pollReopened" && st.blind && st.hidden.CompareAndSwap(false, true) {
+		queueSSE(st, st.currentVotes(b.pollID))
+	}
+}
+
+// queueSSE hands an event to a stream without blocking
+func queueSSE(stream *sseStream, event sseEvent) {
+	select {
+	case stream.events <- event:
+	default:
+	}
+}
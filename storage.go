@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis deployment modes selectable with REDIS_MODE
+const (
+	redisStandalone = "standalone"
+	redisSentinel   = "sentinel"
+	redisCluster    = "cluster"
+)
+
+// newRedisClient connects to Redis in the configured mode. Sentinel mode
+// follows failovers of the named master; cluster mode routes each key to
+// the node owning its slot.
+func newRedisClient(cfg Config) (redis.UniversalClient, error) {
+	switch cfg.RedisMode {
+	case "", redisStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			PoolSize: cfg.RedisPoolSize,
+		}), nil
+	case redisSentinel:
+		if cfg.RedisMasterName == "" {
+			return nil, fmt.Errorf("sentinel mode needs redis_master_name")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.RedisMasterName,
+			SentinelAddrs:    cfg.redisAddrs(),
+			SentinelPassword: cfg.SentinelPassword,
+			Password:         cfg.RedisPassword,
+			DB:               cfg.RedisDB,
+			PoolSize:         cfg.RedisPoolSize,
+		}), nil
+	case redisCluster:
+		if cfg.RedisDB != 0 {
+			return nil, fmt.Errorf("cluster mode only supports database 0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.redisAddrs(),
+			Password: cfg.RedisPassword,
+			PoolSize: cfg.RedisPoolSize,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown redis mode %q", cfg.RedisMode)
+}
+
+// redisAddrs returns the seed addresses for sentinel and cluster modes
+func (cfg Config) redisAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(cfg.RedisAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// scanKeys walks the keys matching pattern in batches, calling fn for each
+// batch, until limit keys were seen. In cluster mode every master is
+// scanned, since SCAN only covers a single node. It returns how many keys
+// were scanned and whether the walk stopped early.
+func scanKeys(client redis.UniversalClient, pattern string, batch int64, limit int, fn func(keys []string) error) (int, bool, error) {
+	var mu sync.Mutex
+	scanned, truncated := 0, false
+
+	scanNode := func(ctx context.Context, node redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, pattern, batch).Result()
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			scanned += len(keys)
+			done := scanned >= limit
+			err = fn(keys)
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+			if done {
+				mu.Lock()
+				truncated = true
+				mu.Unlock()
+				return nil
+			}
+		}
+	}
+
+	var err error
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scanNode(ctx, node)
+		})
+	} else {
+		err = scanNode(ctx, client)
+	}
+	return scanned, truncated, err
+}
+
+// redisMetricsHook counts failed Redis commands in
+// pulse_redis_errors_total. Replies that are part of normal operation
+// aren't failures: nil replies and a script not cached yet (the client
+// loads it and retries).
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	countRedisError(cmd)
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		countRedisError(cmd)
+	}
+	return nil
+}
+
+func countRedisError(cmd redis.Cmder) {
+	err := cmd.Err()
+	if err == nil || err == redis.Nil {
+		return
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "NOSCRIPT") {
+		return
+	}
+	redisErrorsTotal.WithLabelValues(strings.ToLower(cmd.Name())).Inc()
+}
@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Storage backends selectable with STORE
+const (
+	storeRedis    = "redis"
+	storeMemory   = "memory"
+	storePostgres = "postgres"
+)
+
+// PollStore is the storage behind the core poll operations: creating and
+// reading polls, recording votes and fanning updates out to every
+// instance. Handlers go through the package-level store, so they can run
+// against the in-memory or PostgreSQL backend instead of a live Redis.
+type PollStore interface {
+	// CreatePoll saves a new poll unless the ID is taken, in which case it
+	// reports false and leaves the existing poll alone
+	CreatePoll(id string, fields map[string]interface{}, ttl time.Duration) (bool, error)
+
+	// GetPoll returns every field of a poll, or an empty map if it
+	// doesn't exist
+	GetPoll(id string) (map[string]string, error)
+
+	// GetPolls returns the given fields, or every field, of each poll in
+	// the order of ids. Fields that aren't set are left out, so polls that
+	// don't exist come back empty.
+	GetPolls(ids []string, fields ...string) ([]map[string]string, error)
+
+	// ScanPolls hands fn the IDs of the stored polls a batch at a time,
+	// stopping once about limit were seen. It returns how many were and
+	// whether it stopped short.
+	ScanPolls(limit int, fn func(ids []string) error) (int, bool, error)
+
+	// UpdatePoll sets and removes fields of a poll in one step
+	UpdatePoll(id string, set map[string]interface{}, remove ...string) error
+
+	// UpdateUnvotedPoll is UpdatePoll for a poll nobody has a ballot in.
+	// It reports false, changing nothing, once anyone has voted or if the
+	// poll is gone. The check and the update are one atomic step, except
+	// on a Redis Cluster.
+	UpdateUnvotedPoll(id string, set map[string]interface{}, remove ...string) (bool, error)
+
+	// SetPollFieldNX sets a field of a poll unless it's already set, and
+	// reports whether it did
+	SetPollFieldNX(id, field string, value interface{}) (bool, error)
+
+	// IncrPollField adds by to a counter field of a poll and returns the
+	// new value
+	IncrPollField(id, field string, by int64) (int64, error)
+
+	// ClosePoll sets a poll's status to closed and reports whether it did,
+	// which it doesn't if the poll is gone or was closed already
+	ClosePoll(id string) (bool, error)
+
+	// SwapPollStatus moves a poll from status from to status to, setting
+	// the fields in set along with it, and reports whether it did, which
+	// it doesn't if the poll is gone or no longer in status from. Polls
+	// without a status are active.
+	SwapPollStatus(id, from, to string, set map[string]interface{}) (bool, error)
+
+	// PollTTL returns how long a poll has left; it's negative for a poll
+	// that doesn't exist
+	PollTTL(id string) (time.Duration, error)
+
+	// ExpirePoll gives a poll a new lifetime, along with its voters,
+	// ballots and word cloud
+	ExpirePoll(id string, ttl time.Duration) error
+
+	// HasVoted reports whether member already voted in a poll
+	HasVoted(id, member string) (bool, error)
+
+	// RecordVote marks members, the identifiers of one voter, as having
+	// voted, keeps the ballot under the first and applies each increment
+	// to the poll, returning the new values in the same order. It reports
+	// false, without counting anything, if any of the members already
+	// voted. The check and the increments are one atomic step, except on
+	// a Redis Cluster.
+	RecordVote(id string, members []string, ballot string, increments ...Increment) ([]int64, bool, error)
+
+	// ChangeVote replaces member's ballot, reverting the increments undo
+	// derives from the previous one before applying the new increments,
+	// and returns the previous ballot along with the new values. A member
+	// without a ballot is recorded as a new voter. Reverting leaves
+	// counters that no longer exist alone, such as those of an option
+	// removed since the ballot was cast.
+	ChangeVote(id, member, ballot string, undo func(old string) []Increment, increments ...Increment) (string, []int64, error)
+
+	// RetractVote removes member's ballot and voter mark, reverting the
+	// increments undo derives from the ballot, except on counters that no
+	// longer exist. It returns the removed ballot, or "" if member had
+	// none.
+	RetractVote(id, member string, undo func(old string) []Increment) (string, error)
+
+	// GetBallots returns every voter's ballot in a poll
+	GetBallots(id string) ([]string, error)
+
+	// GetBallot returns member's ballot, or "" if it has none
+	GetBallot(id, member string) (string, error)
+
+	// ScanBallots hands fn a poll's ballots by voter, about batch at a
+	// time
+	ScanBallots(id string, batch int, fn func(ballots map[string]string) error) error
+
+	// CountBallots returns how many voters have a ballot in a poll
+	CountBallots(id string) (int64, error)
+
+	// CountVoters returns how many identifiers are marked as having voted
+	// in a poll; a voter can have several
+	CountVoters(id string) (int64, error)
+
+	// CountWords adds by to each word's count in an open-text poll's word
+	// cloud, which expires along with the poll. Words whose count drops
+	// to zero leave the cloud.
+	CountWords(id string, words []string, by int64) error
+
+	// TopWords returns the most frequent words of a poll's word cloud,
+	// most frequent first
+	TopWords(id string, limit int) ([]WordCount, error)
+
+	// DeletePoll removes a poll together with its voters and companion
+	// keys
+	DeletePoll(id string) error
+
+	// ResetVotes zeroes a poll's counters and forgets its voters and
+	// ballots, leaving its question, options and settings as they are.
+	// It's one atomic step, except on a Redis Cluster.
+	ResetVotes(id string) error
+
+	// Publish sends a payload to every subscriber of a poll, along with
+	// metadata such as the trace context it was published in
+	Publish(id string, payload []byte, meta map[string]string) error
+
+	// Subscribe delivers the payloads published for the watched polls
+	// until ctx is cancelled, including those published while it was cut
+	// off from the store
+	Subscribe(ctx context.Context) <-chan PollMessage
+
+	// Watch and Unwatch add and remove a poll from those Subscribe
+	// delivers, as its first local viewer arrives and its last one
+	// leaves. They don't block.
+	Watch(id string)
+	Unwatch(id string)
+}
+
+// Increment adds By to a counter field of a poll
+type Increment struct {
+	Field string
+	By    int64
+}
+
+// incr is the common increment, by one
+func incr(field string) Increment {
+	return Increment{Field: field, By: 1}
+}
+
+// PollMessage is a payload published for a poll
+type PollMessage struct {
+	PollID  string
+	Payload string
+	Meta    map[string]string
+}
+
+// store is the backend used by the handlers; main sets it up along with
+// kv
+var store PollStore
+
+// pollFields reads some fields of one poll; those that aren't set, or
+// all of them if the poll doesn't exist, are left out
+func pollFields(id string, fields ...string) (map[string]string, error) {
+	polls, err := store.GetPolls([]string{id}, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return polls[0], nil
+}
+
+// pollBallots returns every ballot of a poll by voter
+func pollBallots(id string) (map[string]string, error) {
+	ballots := make(map[string]string)
+	err := store.ScanBallots(id, 1000, func(batch map[string]string) error {
+		for member, ballot := range batch {
+			ballots[member] = ballot
+		}
+		return nil
+	})
+	return ballots, err
+}
+
+// newStore builds the configured backend, along with the key store for the
+// features outside PollStore
+func newStore(cfg Config) (PollStore, KeyStore, error) {
+	switch cfg.Store {
+	case "", storeRedis:
+		client, err := newRedisClient(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.AddHook(redisMetricsHook{})
+		s := &redisStore{client: client, cluster: cfg.RedisMode == redisCluster, watches: newPollWatches()}
+		return s, &redisKeys{client: client}, nil
+	case storeMemory:
+		logger.Warn("Using the in-memory store; data is lost on restart and not shared with other instances")
+		s := newMemoryStore()
+		return s, s.keys, nil
+	case storePostgres:
+		return newPostgresStore(cfg.PostgresURL)
+	}
+	return nil, nil, fmt.Errorf("unknown store %q", cfg.Store)
+}
+
+// redisStore keeps polls in Redis hashes, voters in a set per poll and
+// fans updates out over pub/sub
+type redisStore struct {
+	client redis.UniversalClient
+
+	// A cluster spreads a poll's keys over slots, which rules out
+	// scripts touching several of them
+	cluster bool
+
+	// watches are the polls Subscribe reads the updates of
+	watches *pollWatches
+}
+
+// createPollScript claims a poll ID and writes the poll in one step, so a
+// collision is reported instead of overwriting the existing poll, and a
+// poll is never left without its fields or TTL. The ballot keys left
+// behind by an earlier poll with the same ID go with it.
+//
+// KEYS: poll:<id>, then the ballot keys to delete
+// ARGV: the TTL in milliseconds, 0 for none, then field and value pairs
+var createPollScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+for i = 2, #KEYS do
+	redis.call('DEL', KEYS[i])
+end
+return 1
+`)
+
+func (s *redisStore) CreatePoll(id string, fields map[string]interface{}, ttl time.Duration) (bool, error) {
+	keys := []string{fmt.Sprintf("poll:%s", id)}
+	// A cluster clears the ballot keys separately, one key per command
+	if !s.cluster {
+		keys = append(keys, ballotKeys(id)...)
+	}
+	args := make([]interface{}, 0, 1+2*len(fields))
+	args = append(args, ttl.Milliseconds())
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	created, err := createPollScript.Run(ctx, s.client, keys, args...).Int()
+	if err != nil || created == 0 || !s.cluster {
+		return created == 1, err
+	}
+
+	pipe := s.client.Pipeline()
+	for _, key := range ballotKeys(id) {
+		pipe.Unlink(ctx, key)
+	}
+	_, err = pipe.Exec(ctx)
+	return true, err
+}
+
+func (s *redisStore) GetPoll(id string) (map[string]string, error) {
+	return s.client.HGetAll(ctx, fmt.Sprintf("poll:%s", id)).Result()
+}
+
+func (s *redisStore) GetPolls(ids []string, fields ...string) ([]map[string]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	pipe := s.client.Pipeline()
+	cmds := make([]redis.Cmder, len(ids))
+	for i, id := range ids {
+		if len(fields) == 0 {
+			cmds[i] = pipe.HGetAll(ctx, fmt.Sprintf("poll:%s", id))
+		} else {
+			cmds[i] = pipe.HMGet(ctx, fmt.Sprintf("poll:%s", id), fields...)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	polls := make([]map[string]string, len(ids))
+	for i, cmd := range cmds {
+		switch cmd := cmd.(type) {
+		case *redis.StringStringMapCmd:
+			polls[i] = cmd.Val()
+		case *redis.SliceCmd:
+			polls[i] = make(map[string]string, len(fields))
+			for j, value := range cmd.Val() {
+				if value, ok := value.(string); ok {
+					polls[i][fields[j]] = value
+				}
+			}
+		}
+	}
+	return polls, nil
+}
+
+func (s *redisStore) ScanPolls(limit int, fn func(ids []string) error) (int, bool, error) {
+	return scanKeys(s.client, "poll:*", 1000, limit, func(keys []string) error {
+		ids := make([]string, len(keys))
+		for i, key := range keys {
+			ids[i] = strings.TrimPrefix(key, "poll:")
+		}
+		return fn(ids)
+	})
+}
+
+func (s *redisStore) UpdatePoll(id string, set map[string]interface{}, remove ...string) error {
+	pollKey := fmt.Sprintf("poll:%s", id)
+	pipe := s.client.TxPipeline()
+	if len(set) > 0 {
+		pipe.HSet(ctx, pollKey, set)
+	}
+	if len(remove) > 0 {
+		pipe.HDel(ctx, pollKey, remove...)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// updateUnvotedScript sets ARGV[2..ARGV[1]*2+1] as field, value pairs and
+// removes the remaining ARGV from a poll that exists and has no ballots
+//
+// KEYS: poll:<id>, vote:<id>
+var updateUnvotedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or redis.call('HLEN', KEYS[2]) > 0 then
+	return 0
+end
+local n = tonumber(ARGV[1])
+if n > 0 then
+	redis.call('HSET', KEYS[1], unpack(ARGV, 2, n * 2 + 1))
+end
+if #ARGV > n * 2 + 1 then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, n * 2 + 2))
+end
+return 1
+`)
+
+func (s *redisStore) UpdateUnvotedPoll(id string, set map[string]interface{}, remove ...string) (bool, error) {
+	pollKey, ballotsKey := fmt.Sprintf("poll:%s", id), fmt.Sprintf("vote:%s", id)
+	if s.cluster {
+		voters, err := s.client.HLen(ctx, ballotsKey).Result()
+		if err != nil || voters > 0 {
+			return false, err
+		}
+		return true, s.UpdatePoll(id, set, remove...)
+	}
+
+	args := make([]interface{}, 0, 1+2*len(set)+len(remove))
+	args = append(args, len(set))
+	for field, value := range set {
+		args = append(args, field, value)
+	}
+	for _, field := range remove {
+		args = append(args, field)
+	}
+	updated, err := updateUnvotedScript.Run(ctx, s.client, []string{pollKey, ballotsKey}, args...).Int()
+	return updated == 1, err
+}
+
+func (s *redisStore) SetPollFieldNX(id, field string, value interface{}) (bool, error) {
+	return s.client.HSetNX(ctx, fmt.Sprintf("poll:%s", id), field, value).Result()
+}
+
+func (s *redisStore) IncrPollField(id, field string, by int64) (int64, error) {
+	return s.client.HIncrBy(ctx, fmt.Sprintf("poll:%s", id), field, by).Result()
+}
+
+// closePollScript closes a poll that still exists and isn't closed yet
+//
+// KEYS: poll:<id>
+var closePollScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or redis.call('HGET', KEYS[1], 'status') == 'closed' then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', 'closed')
+return 1
+`)
+
+func (s *redisStore) ClosePoll(id string) (bool, error) {
+	closed, err := closePollScript.Run(ctx, s.client, []string{fmt.Sprintf("poll:%s", id)}).Int()
+	return closed == 1, err
+}
+
+// swapStatusScript changes a poll's status and sets ARGV[3:] as field,
+// value pairs, if the poll exists and its status is ARGV[1]
+var swapStatusScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status or status == '' then
+	status = 'active'
+end
+if status ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[2], unpack(ARGV, 3))
+return 1
+`)
+
+func (s *redisStore) SwapPollStatus(id, from, to string, set map[string]interface{}) (bool, error) {
+	args := []interface{}{from, to}
+	for field, value := range set {
+		args = append(args, field, value)
+	}
+	swapped, err := swapStatusScript.Run(ctx, s.client, []string{fmt.Sprintf("poll:%s", id)}, args...).Int()
+	return swapped == 1, err
+}
+
+func (s *redisStore) PollTTL(id string) (time.Duration, error) {
+	return s.client.PTTL(ctx, fmt.Sprintf("poll:%s", id)).Result()
+}
+
+func (s *redisStore) ExpirePoll(id string, ttl time.Duration) error {
+	pipe := s.client.Pipeline()
+	pipe.Expire(ctx, fmt.Sprintf("poll:%s", id), ttl)
+	pipe.Expire(ctx, fmt.Sprintf("voted:%s", id), ttl)
+	pipe.Expire(ctx, fmt.Sprintf("vote:%s", id), ttl)
+	pipe.Expire(ctx, wordsKey(id), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) HasVoted(id, member string) (bool, error) {
+	return s.client.SIsMember(ctx, fmt.Sprintf("voted:%s", id), member).Result()
+}
+
+// recordVoteScript checks and records a vote in one step, so a vote is
+// either counted in full or not at all. It refuses votes for a poll that
+// expired or was deleted since it was loaded, rather than recreating the
+// hash without a TTL.
+//
+// KEYS: voted:<id>, poll:<id>, vote:<id>
+// ARGV: ballot, the number of members, the members, then field and
+// increment pairs
+var recordVoteScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return redis.error_reply('NOPOLL poll does not exist')
+end
+local n = tonumber(ARGV[2])
+for i = 3, n + 2 do
+	if redis.call('SISMEMBER', KEYS[1], ARGV[i]) == 1 then
+		return false
+	end
+end
+for i = 3, n + 2 do
+	redis.call('SADD', KEYS[1], ARGV[i])
+end
+redis.call('HSET', KEYS[3], ARGV[3], ARGV[1])
+local values = {}
+for i = n + 3, #ARGV, 2 do
+	values[#values + 1] = redis.call('HINCRBY', KEYS[2], ARGV[i], ARGV[i + 1])
+end
+return values
+`)
+
+func (s *redisStore) RecordVote(id string, members []string, ballot string, increments ...Increment) ([]int64, bool, error) {
+	if s.cluster {
+		return s.recordVotePipelined(id, members, ballot, increments...)
+	}
+
+	keys := []string{fmt.Sprintf("voted:%s", id), fmt.Sprintf("poll:%s", id), fmt.Sprintf("vote:%s", id)}
+	args := make([]interface{}, 0, 2+len(members)+2*len(increments))
+	args = append(args, ballot, len(members))
+	for _, member := range members {
+		args = append(args, member)
+	}
+	for _, inc := range increments {
+		args = append(args, inc.Field, inc.By)
+	}
+
+	result, err := recordVoteScript.Run(ctx, s.client, keys, args...).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	replies, _ := result.([]interface{})
+	values := make([]int64, len(replies))
+	for i, reply := range replies {
+		values[i], _ = reply.(int64)
+	}
+	return values, true, nil
+}
+
+// recordVotePipelined records a vote on a cluster. SADD of the first
+// member still decides who was first when the same voter races itself,
+// but the other members and the counters follow in separate round trips.
+func (s *redisStore) recordVotePipelined(id string, members []string, ballot string, increments ...Increment) ([]int64, bool, error) {
+	pollKey := fmt.Sprintf("poll:%s", id)
+	votedKey := fmt.Sprintf("voted:%s", id)
+	member := members[0]
+
+	for _, alias := range members[1:] {
+		voted, err := s.client.SIsMember(ctx, votedKey, alias).Result()
+		if err != nil || voted {
+			return nil, false, err
+		}
+	}
+	added, err := s.client.SAdd(ctx, votedKey, member).Result()
+	if err != nil || added == 0 {
+		return nil, false, err
+	}
+
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(increments))
+	for i, inc := range increments {
+		cmds[i] = pipe.HIncrBy(ctx, pollKey, inc.Field, inc.By)
+	}
+	for _, alias := range members[1:] {
+		pipe.SAdd(ctx, votedKey, alias)
+	}
+	pipe.HSet(ctx, fmt.Sprintf("vote:%s", id), member, ballot)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, true, err
+	}
+
+	values := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		values[i] = cmd.Val()
+	}
+	return values, true, nil
+}
+
+func (s *redisStore) ChangeVote(id, member, ballot string, undo func(old string) []Increment, increments ...Increment) (string, []int64, error) {
+	old, err := s.swapBallot(id, member, ballot)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The swap hands each previous ballot to exactly one caller, so
+	// concurrent revotes by the same voter can't revert it twice
+	pollKey := fmt.Sprintf("poll:%s", id)
+	if old != "" {
+		if err := s.undoIncrements(id, undo(old)); err != nil {
+			return old, nil, err
+		}
+	}
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(increments))
+	for i, inc := range increments {
+		cmds[i] = pipe.HIncrBy(ctx, pollKey, inc.Field, inc.By)
+	}
+	pipe.SAdd(ctx, fmt.Sprintf("voted:%s", id), member)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return old, nil, err
+	}
+
+	values := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		values[i] = cmd.Val()
+	}
+	return old, values, nil
+}
+
+func (s *redisStore) RetractVote(id, member string, undo func(old string) []Increment) (string, error) {
+	old, err := s.swapBallot(id, member, "")
+	if err != nil || old == "" {
+		return "", err
+	}
+
+	if err := s.undoIncrements(id, undo(old)); err != nil {
+		return old, err
+	}
+	return old, s.client.SRem(ctx, fmt.Sprintf("voted:%s", id), member).Err()
+}
+
+// undoIncrementsScript subtracts increments given as field and increment
+// pairs from the fields of a poll that still exist
+//
+// KEYS: poll:<id>
+var undoIncrementsScript = redis.NewScript(`
+for i = 1, #ARGV, 2 do
+	if redis.call('HEXISTS', KEYS[1], ARGV[i]) == 1 then
+		redis.call('HINCRBY', KEYS[1], ARGV[i], -ARGV[i + 1])
+	end
+end
+return 1
+`)
+
+// undoIncrements reverts the increments of a replaced or retracted ballot.
+// A counter that's gone went with its option, or with the poll, and isn't
+// recreated. The script only touches poll:<id>, so it also works on a
+// cluster.
+func (s *redisStore) undoIncrements(id string, increments []Increment) error {
+	if len(increments) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 2*len(increments))
+	for _, inc := range increments {
+		args = append(args, inc.Field, inc.By)
+	}
+	return undoIncrementsScript.Run(ctx, s.client, []string{fmt.Sprintf("poll:%s", id)}, args...).Err()
+}
+
+// swapBallot atomically replaces member's ballot, or removes it when
+// ballot is empty, and returns the previous one. The transaction only
+// touches vote:<id>, so it also works on a cluster.
+func (s *redisStore) swapBallot(id, member, ballot string) (string, error) {
+	key := fmt.Sprintf("vote:%s", id)
+	var old string
+	swap := func(tx *redis.Tx) error {
+		var err error
+		old, err = tx.HGet(ctx, key, member).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if ballot == "" {
+				pipe.HDel(ctx, key, member)
+			} else {
+				pipe.HSet(ctx, key, member, ballot)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < swapRetries; attempt++ {
+		err := s.client.Watch(ctx, swap, key)
+		if err != redis.TxFailedErr {
+			return old, err
+		}
+	}
+	return "", redis.TxFailedErr
+}
+
+// swapRetries bounds how often a ballot swap is retried when another
+// write to the poll's ballots got in between
+const swapRetries = 10
+
+func (s *redisStore) GetBallots(id string) ([]string, error) {
+	return s.client.HVals(ctx, fmt.Sprintf("vote:%s", id)).Result()
+}
+
+func (s *redisStore) GetBallot(id, member string) (string, error) {
+	ballot, err := s.client.HGet(ctx, fmt.Sprintf("vote:%s", id), member).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return ballot, err
+}
+
+func (s *redisStore) ScanBallots(id string, batch int, fn func(ballots map[string]string) error) error {
+	key := fmt.Sprintf("vote:%s", id)
+	var cursor uint64
+	for {
+		pairs, next, err := s.client.HScan(ctx, key, cursor, "", int64(batch)).Result()
+		if err != nil {
+			return err
+		}
+		ballots := make(map[string]string, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			ballots[pairs[i]] = pairs[i+1]
+		}
+		if len(ballots) > 0 {
+			if err := fn(ballots); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *redisStore) CountBallots(id string) (int64, error) {
+	return s.client.HLen(ctx, fmt.Sprintf("vote:%s", id)).Result()
+}
+
+func (s *redisStore) CountVoters(id string) (int64, error) {
+	return s.client.SCard(ctx, fmt.Sprintf("voted:%s", id)).Result()
+}
+
+func (s *redisStore) CountWords(id string, words []string, by int64) error {
+	ttl, err := s.client.PTTL(ctx, fmt.Sprintf("poll:%s", id)).Result()
+	if err != nil {
+		return err
+	}
+
+	key := wordsKey(id)
+	pipe := s.client.Pipeline()
+	for _, word := range words {
+		pipe.ZIncrBy(ctx, key, float64(by), word)
+	}
+	if by < 0 {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "0")
+	}
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) TopWords(id string, limit int) ([]WordCount, error) {
+	entries, err := s.client.ZRevRangeWithScores(ctx, wordsKey(id), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	words := make([]WordCount, len(entries))
+	for i, entry := range entries {
+		words[i] = WordCount{Word: entry.Member.(string), Count: int64(entry.Score)}
+	}
+	return words, nil
+}
+
+func (s *redisStore) DeletePoll(id string) error {
+	// One key per command, since a cluster rejects multi-key commands
+	// spanning slots
+	pipe := s.client.Pipeline()
+	pipe.Unlink(ctx, fmt.Sprintf("poll:%s", id))
+	for _, prefix := range companionPrefixes {
+		pipe.Unlink(ctx, prefix+id)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// errPollNotFound is returned for a poll that doesn't exist
+var errPollNotFound = errors.New("poll not found")
+
+// ballotPrefixes are the companion keys that record who voted and how;
+// resetting a poll deletes them, unlike its comments, presence and audit log
+var ballotPrefixes = []string{"voted:", "vote:", "words:", "votetimes:", "history:", "players:", "voters:", "modanswers:"}
+
+// ballotKeys returns the ballot keys of a poll
+func ballotKeys(id string) []string {
+	keys := make([]string, len(ballotPrefixes))
+	for i, prefix := range ballotPrefixes {
+		keys[i] = prefix + id
+	}
+	return keys
+}
+
+// resetCounterPrefixes name the poll hash fields counting votes that a
+// reset removes. Option totals, votes_<option>, are zeroed instead.
+var resetCounterPrefixes = []string{"rsum_", "rdist_", "threshold_sent_", "responses", "late_votes", "wvotes_"}
+
+// resetAction tells whether a reset zeroes or removes a poll hash field,
+// the same way resetVotesScript does
+func resetAction(field string) (zero, remove bool) {
+	if strings.HasPrefix(field, "votes_") {
+		return !strings.Contains(field, ":"), strings.Contains(field, ":")
+	}
+	for _, prefix := range resetCounterPrefixes {
+		if strings.HasPrefix(field, prefix) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// resetVotesScript resets a poll in one step, so no vote is half counted
+// across it. Option totals are zeroed; per-segment totals and the other
+// counters, named by the prefixes in ARGV, are removed.
+//
+// KEYS: poll:<id>, then the ballot keys to delete
+// ARGV: prefixes of the counter fields to remove
+var resetVotesScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('NOPOLL poll does not exist')
+end
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	if string.sub(field, 1, 6) == 'votes_' then
+		if string.find(field, ':', 1, true) then
+			redis.call('HDEL', KEYS[1], field)
+		else
+			redis.call('HSET', KEYS[1], field, 0)
+		end
+	else
+		for _, prefix in ipairs(ARGV) do
+			if string.sub(field, 1, #prefix) == prefix then
+				redis.call('HDEL', KEYS[1], field)
+				break
+			end
+		end
+	end
+end
+for i = 2, #KEYS do
+	redis.call('DEL', KEYS[i])
+end
+return 1
+`)
+
+func (s *redisStore) ResetVotes(id string) error {
+	pollKey := fmt.Sprintf("poll:%s", id)
+	keys := []string{pollKey}
+	for _, prefix := range ballotPrefixes {
+		keys = append(keys, prefix+id)
+	}
+	if !s.cluster {
+		args := make([]interface{}, len(resetCounterPrefixes))
+		for i, prefix := range resetCounterPrefixes {
+			args[i] = prefix
+		}
+		err := resetVotesScript.Run(ctx, s.client, keys, args...).Err()
+		if err != nil && strings.HasPrefix(err.Error(), "NOPOLL") {
+			return errPollNotFound
+		}
+		return err
+	}
+
+	// One key per command on a cluster; votes cast meanwhile may be
+	// partly reset
+	fields, err := s.client.HKeys(ctx, pollKey).Result()
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return errPollNotFound
+	}
+	pipe := s.client.Pipeline()
+	for _, field := range fields {
+		zero, remove := resetAction(field)
+		if zero {
+			pipe.HSet(ctx, pollKey, field, 0)
+		} else if remove {
+			pipe.HDel(ctx, pollKey, field)
+		}
+	}
+	for _, key := range keys[1:] {
+		pipe.Unlink(ctx, key)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
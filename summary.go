@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionResult is one option's line in a results summary
+type OptionResult struct {
+	ID      string  `json:"id"`
+	Text    string  `json:"text"`
+	Votes   int     `json:"votes"`
+	Percent float64 `json:"percent"`
+}
+
+// PollSummary is a snapshot of a poll's results, shared by the close
+// notifications and exports
+type PollSummary struct {
+	PollID       string         `json:"pollId"`
+	Question     string         `json:"question"`
+	Status       string         `json:"status"`
+	Results      []OptionResult `json:"results"`
+	Total        int            `json:"total"`
+	UniqueVoters int64          `json:"uniqueVoters"`
+	Winners      []string       `json:"winners"` // more than one on a tie
+	GeneratedAt  int64          `json:"generatedAt"`
+}
+
+// loadSummary builds the summary for a poll from the store
+func loadSummary(pollID string) (*PollSummary, error) {
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("poll %s not found", pollID)
+	}
+	voters, err := store.CountVoters(pollID)
+	if err != nil {
+		return nil, err
+	}
+	return buildSummary(pollID, data, voters), nil
+}
+
+// buildSummary computes ordered results, percentages and the winner(s)
+func buildSummary(pollID string, data map[string]string, uniqueVoters int64) *PollSummary {
+	options := parseOptions(data)
+	votes := parseVotes(data)
+	total := totalVotes(votes)
+
+	summary := &PollSummary{
+		PollID:       pollID,
+		Question:     data["question"],
+		Status:       data["status"],
+		Total:        total,
+		UniqueVoters: uniqueVoters,
+		Winners:      []string{},
+		GeneratedAt:  time.Now().Unix(),
+	}
+	if summary.Status == "" {
+		summary.Status = statusActive
+	}
+
+	max := 0
+	for id, text := range options {
+		result := OptionResult{ID: id, Text: text, Votes: votes[id]}
+		if result.Votes > max {
+			max = result.Votes
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	// Keep options in the order they were created
+	sort.Slice(summary.Results, func(i, j int) bool {
+		return optionIndex(summary.Results[i].ID) < optionIndex(summary.Results[j].ID)
+	})
+	// Rounded the same way as GET /api/poll/{pollID}/results
+	counts := make([]int64, len(summary.Results))
+	for i, result := range summary.Results {
+		counts[i] = int64(result.Votes)
+	}
+	for i, percent := range roundedPercents(counts, int64(total)) {
+		summary.Results[i].Percent = percent
+	}
+
+	if max > 0 {
+		for _, result := range summary.Results {
+			if result.Votes == max {
+				summary.Winners = append(summary.Winners, result.Text)
+			}
+		}
+	}
+	return summary
+}
+
+// optionIndex turns an option ID into a sortable number
+func optionIndex(id string) int {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return math.MaxInt32
+	}
+	return n
+}
+
+// Text renders the summary as a plain-text report
+func (s *PollSummary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Poll results: %s\n\n", s.Question)
+	for i, result := range s.Results {
+		fmt.Fprintf(&b, "%2d. %s - %d votes (%.1f%%)\n", i+1, result.Text, result.Votes, result.Percent)
+	}
+	fmt.Fprintf(&b, "\nTotal votes: %d (unique voters: %d)\n", s.Total, s.UniqueVoters)
+
+	switch len(s.Winners) {
+	case 0:
+		b.WriteString("No votes were cast.\n")
+	case 1:
+		fmt.Fprintf(&b, "Winner: %s\n", s.Winners[0])
+	default:
+		fmt.Fprintf(&b, "Tie between: %s\n", strings.Join(s.Winners, ", "))
+	}
+	return b.String()
+}
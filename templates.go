@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on poll templates
+const (
+	maxTemplatesPerOwner = 50
+	maxTemplateName      = 100 // bytes
+)
+
+// PollTemplate is a saved poll setup that recurring polls, like a weekly
+// mood check, are created from. Schedules are kept relative to creation.
+type PollTemplate struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	CreatedAt   int64             `json:"created_at"`
+	Poll        CreatePollRequest `json:"poll"`
+	OpensAfter  int64             `json:"opens_after_seconds,omitempty"`
+	ClosesAfter int64             `json:"closes_after_seconds,omitempty"`
+}
+
+// SaveTemplateRequest is the body of POST /api/templates: a name and
+// either an existing poll to copy or a poll as POST /api/poll takes it
+type SaveTemplateRequest struct {
+	Name        string             `json:"name"`
+	FromPoll    string             `json:"from_poll"`
+	Poll        *CreatePollRequest `json:"poll"`
+	OpensAfter  int64              `json:"opens_after_seconds"`
+	ClosesAfter int64              `json:"closes_after_seconds"`
+}
+
+// templatesKey is the hash of an owner's templates, template ID to JSON
+func templatesKey(ownerHash string) string {
+	return fmt.Sprintf("templates:%s", ownerHash)
+}
+
+// templateFromPoll rebuilds the request that would create a poll like the
+// one in data: same question, options and settings, no votes. Quiz
+// sessions aren't carried over, and schedules are returned as offsets
+// from creation.
+func templateFromPoll(data map[string]string) PollTemplate {
+	req := CreatePollRequest{
+		Question:     data["question"],
+		ConfirmVotes: data["confirm_votes"] == "1",
+		AllowRevote:  data["allow_revote"] == "1",
+		VoterOnly:    data["voter_hash"] != "",
+		SignInOnly:   data["require_sign_in"] == "1",
+		InviteOnly:   data["require_invite"] == "1",
+		BallotTokens: data["ballot_tokens"] == "1",
+		Weighted:     data["weighted"] == "1",
+		Identified:   data["identified"] == "1",
+		Moderated:    data["moderated"] == "1",
+		Visibility:   resultsVisibilityOf(data),
+		Captcha:      data["require_captcha"] == "1",
+		NotifyURL:    data["notify_url"],
+		NotifyEmail:  data["notify_email"],
+		Segments:     parseSegments(data["segments"]),
+		Shuffle:      data["shuffle_options"] == "1",
+		PollType:     data["poll_type"],
+		Dedup:        data["dedup"],
+		AuditLog:     data["audit_log"] == "1",
+		Webhooks:     webhookTargets(data),
+	}
+	req.MinOpen, _ = strconv.Atoi(data["min_open_seconds"])
+	req.CloseGrace, _ = strconv.Atoi(data["close_grace_seconds"])
+	req.ExpiresIn, _ = strconv.Atoi(data["ttl_seconds"])
+	if n := maxChoicesOf(data); n > 1 {
+		req.MaxChoices = n
+	}
+	if req.PollType == pollTypeRating {
+		req.ScaleMin, req.ScaleMax = scaleOf(data)
+	}
+	if raw := data["webhook_thresholds"]; raw != "" {
+		json.Unmarshal([]byte(raw), &req.Thresholds)
+	}
+	if raw := data["allowed_emails"]; raw != "" {
+		req.VoterEmails = strings.Split(raw, ",")
+	}
+	for _, option := range parseOptionDetails(data, optionOrder(parseOptions(data), false, "", "")) {
+		req.Options = append(req.Options, OptionInput{
+			Text:       option.Text,
+			Correct:    data[correctKey(option.ID)] == "1",
+			OptionMeta: option.OptionMeta,
+		})
+	}
+
+	tpl := PollTemplate{Poll: req}
+	createdAt, _ := strconv.ParseInt(data["created_at"], 10, 64)
+	if opensAt, _ := strconv.ParseInt(data["opens_at"], 10, 64); opensAt > createdAt {
+		tpl.OpensAfter = opensAt - createdAt
+	}
+	if closesAt, _ := strconv.ParseInt(data["closes_at"], 10, 64); closesAt > createdAt {
+		tpl.ClosesAfter = closesAt - createdAt
+	}
+	return tpl
+}
+
+// createFromTemplate creates a poll from a template, scheduled relative to
+// now, and writes the POST /api/poll response
+func (s *Server) createFromTemplate(w http.ResponseWriter, r *http.Request, tpl PollTemplate, ownerToken string) {
+	req := tpl.Poll
+	now := time.Now().Unix()
+	if tpl.OpensAfter > 0 {
+		req.OpensAt = now + tpl.OpensAfter
+	}
+	if tpl.ClosesAfter > 0 {
+		req.ClosesAt = now + tpl.ClosesAfter
+	}
+
+	if !createLimit.Allow(clientIP(r)) {
+		tooManyRequests(w, createLimit, "Too many polls created, try again later")
+		return
+	}
+	resp, err := s.newPoll(req, ownerToken, false, requestLogger(r))
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// duplicatePoll handles POST /api/poll/{pollID}/duplicate, which creates a
+// new poll with the same question, options and settings and no votes
+func (s *Server) duplicatePoll(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !requireOwner(w, r, pollID) {
+		return
+	}
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	requestLogger(r).Info("Duplicating poll")
+	s.createFromTemplate(w, r, templateFromPoll(data), ownerTokenFromRequest(r))
+}
+
+// saveTemplate handles POST /api/templates, which saves a template under
+// the request's owner token
+func (s *Server) saveTemplate(w http.ResponseWriter, r *http.Request) {
+	ownerHash := ownerHashFromRequest(r)
+	if ownerHash == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return
+	}
+	var req SaveTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = normalizeText(req.Name)
+	if req.Name == "" || len(req.Name) > maxTemplateName {
+		http.Error(w, fmt.Sprintf("name is required and may be at most %d bytes", maxTemplateName), http.StatusBadRequest)
+		return
+	}
+
+	var tpl PollTemplate
+	switch {
+	case req.FromPoll != "" && req.Poll != nil:
+		http.Error(w, "Give either from_poll or poll, not both", http.StatusBadRequest)
+		return
+	case req.FromPoll != "":
+		if !requireOwner(w, r, req.FromPoll) {
+			return
+		}
+		data, err := store.GetPoll(req.FromPoll)
+		if err != nil || len(data) == 0 {
+			http.Error(w, "Poll not found", http.StatusNotFound)
+			return
+		}
+		tpl = templateFromPoll(data)
+	case req.Poll != nil:
+		if req.Poll.OpensAt != 0 || req.Poll.ClosesAt != 0 || req.Poll.QuizSession != "" {
+			http.Error(w, "Templates schedule polls with opens_after_seconds and closes_after_seconds, and can't join quiz sessions", http.StatusBadRequest)
+			return
+		}
+		if req.OpensAfter < 0 || req.ClosesAfter < 0 || (req.ClosesAfter > 0 && req.ClosesAfter <= req.OpensAfter) {
+			http.Error(w, "closes_after_seconds must come after opens_after_seconds", http.StatusBadRequest)
+			return
+		}
+		tpl = PollTemplate{Poll: *req.Poll, OpensAfter: req.OpensAfter, ClosesAfter: req.ClosesAfter}
+	default:
+		http.Error(w, "from_poll or poll is required", http.StatusBadRequest)
+		return
+	}
+	tpl.ID = newToken()[:12]
+	tpl.Name = req.Name
+	tpl.CreatedAt = time.Now().Unix()
+
+	key := templatesKey(ownerHash)
+	count, err := kv.HLen(key)
+	if err != nil {
+		requestLogger(r).Error("Failed to count templates", "error", err)
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxTemplatesPerOwner {
+		http.Error(w, fmt.Sprintf("At most %d templates are allowed", maxTemplatesPerOwner), http.StatusConflict)
+		return
+	}
+	encoded, _ := json.Marshal(tpl)
+	if err := kv.HSet(key, map[string]interface{}{tpl.ID: encoded}); err != nil {
+		requestLogger(r).Error("Failed to save template", "error", err)
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tpl)
+}
+
+// listTemplates handles GET /api/templates, the templates saved under the
+// request's owner token, by name
+func (s *Server) listTemplates(w http.ResponseWriter, r *http.Request) {
+	ownerHash := ownerHashFromRequest(r)
+	if ownerHash == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return
+	}
+	raw, err := kv.HGetAll(templatesKey(ownerHash))
+	if err != nil {
+		requestLogger(r).Error("Failed to load templates", "error", err)
+		http.Error(w, "Failed to load templates", http.StatusInternalServerError)
+		return
+	}
+	templates := make([]PollTemplate, 0, len(raw))
+	for _, encoded := range raw {
+		var tpl PollTemplate
+		if json.Unmarshal([]byte(encoded), &tpl) == nil {
+			templates = append(templates, tpl)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Name != templates[j].Name {
+			return templates[i].Name < templates[j].Name
+		}
+		return templates[i].ID < templates[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"templates": templates})
+}
+
+// loadTemplate reads one of the request's owner's templates, writing the
+// error response when it can't
+func loadTemplate(w http.ResponseWriter, r *http.Request) (PollTemplate, string, bool) {
+	token, ownerHash := ownerTokenFromRequest(r), ownerHashFromRequest(r)
+	if ownerHash == "" {
+		http.Error(w, "Owner token required", http.StatusUnauthorized)
+		return PollTemplate{}, "", false
+	}
+	encoded, err := kv.HGet(templatesKey(ownerHash), mux.Vars(r)["templateID"])
+	if err == errKeyNotFound {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return PollTemplate{}, "", false
+	}
+	var tpl PollTemplate
+	if err == nil {
+		err = json.Unmarshal([]byte(encoded), &tpl)
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to load template", "error", err)
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return PollTemplate{}, "", false
+	}
+	return tpl, token, true
+}
+
+// createPollFromTemplate handles POST /api/templates/{templateID}/poll,
+// which creates a poll from a template
+func (s *Server) createPollFromTemplate(w http.ResponseWriter, r *http.Request) {
+	tpl, token, ok := loadTemplate(w, r)
+	if !ok {
+		return
+	}
+	requestLogger(r).Info("Creating poll from template", "template_id", tpl.ID)
+	s.createFromTemplate(w, r, tpl, token)
+}
+
+// deleteTemplate handles DELETE /api/templates/{templateID}
+func (s *Server) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	tpl, _, ok := loadTemplate(w, r)
+	if !ok {
+		return
+	}
+	if _, err := kv.HDel(templatesKey(ownerHashFromRequest(r)), tpl.ID); err != nil {
+		requestLogger(r).Error("Failed to delete template", "error", err)
+		http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxPollTextBytes caps the combined UTF-8 size of a poll's question,
+// options and option descriptions, so many medium-length options can't
+// bloat the poll hash. 0 disables the check.
+var maxPollTextBytes = envInt("MAX_POLL_TEXT_BYTES", 8192)
+
+// normalizeText trims surrounding whitespace and converts text to Unicode
+// NFC so that composed and decomposed forms of the same characters (e.g.
+// "é" as one code point vs "e" + combining accent) compare and store equal
+func normalizeText(s string) string {
+	return norm.NFC.String(strings.TrimSpace(s))
+}
+
+// findDuplicate returns the first option that appears more than once after
+// normalization. Options must already be normalized.
+func findDuplicate(options []string) (string, bool) {
+	seen := make(map[string]bool, len(options))
+	for _, option := range options {
+		if seen[option] {
+			return option, true
+		}
+		seen[option] = true
+	}
+	return "", false
+}
+
+// checkTextBudget returns an error when the question, options and option
+// descriptions together exceed maxPollTextBytes. Sizes are counted in
+// bytes of the normalized UTF-8 text, which is what Redis stores.
+func checkTextBudget(question string, options, descriptions []string) error {
+	if maxPollTextBytes <= 0 {
+		return nil
+	}
+	size := len(question)
+	for _, option := range options {
+		size += len(option)
+	}
+	for _, description := range descriptions {
+		size += len(description)
+	}
+	if size > maxPollTextBytes {
+		return fmt.Errorf("Poll text is %d bytes, at most %d allowed in total", size, maxPollTextBytes)
+	}
+	return nil
+}
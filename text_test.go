@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withTextBudget sets maxPollTextBytes for one test
+func withTextBudget(t *testing.T, budget int) {
+	t.Helper()
+	saved := maxPollTextBytes
+	maxPollTextBytes = budget
+	t.Cleanup(func() { maxPollTextBytes = saved })
+}
+
+func TestCheckTextBudgetBoundary(t *testing.T) {
+	withTextBudget(t, 100)
+	question := strings.Repeat("q", 40)
+	options := []string{strings.Repeat("a", 20), strings.Repeat("b", 20)}
+
+	if err := checkTextBudget(question, options, []string{strings.Repeat("d", 20)}); err != nil {
+		t.Errorf("exactly at the budget: %v", err)
+	}
+	if err := checkTextBudget(question, options, []string{strings.Repeat("d", 21)}); err == nil {
+		t.Error("one byte over the budget was accepted")
+	}
+}
+
+func TestCheckTextBudgetCountsBytes(t *testing.T) {
+	withTextBudget(t, 10)
+
+	// "é" is two bytes in UTF-8, so five of them fill the budget
+	if err := checkTextBudget(strings.Repeat("é", 5), nil, nil); err != nil {
+		t.Errorf("10 bytes in 5 runes: %v", err)
+	}
+	if err := checkTextBudget(strings.Repeat("é", 5), []string{"x"}, nil); err == nil {
+		t.Error("11 bytes were accepted")
+	}
+}
+
+func TestCheckTextBudgetDisabled(t *testing.T) {
+	withTextBudget(t, 0)
+	if err := checkTextBudget(strings.Repeat("q", 100000), nil, nil); err != nil {
+		t.Errorf("budget 0 should disable the check: %v", err)
+	}
+}
+
+func TestNormalizeTextNFC(t *testing.T) {
+	composed := "caf\u00e9"    // é as one code point
+	decomposed := "cafe\u0301" // e followed by a combining acute accent
+	if composed == decomposed {
+		t.Fatal("test strings should differ before normalization")
+	}
+	if normalizeText(composed) != normalizeText(decomposed) {
+		t.Errorf("%q and %q normalize differently", composed, decomposed)
+	}
+	if got := normalizeText(decomposed); got != composed {
+		t.Errorf("normalizeText(%q) = %q, want the composed form %q", decomposed, got, composed)
+	}
+}
+
+func TestFindDuplicateAcrossNormalizationForms(t *testing.T) {
+	nfc, nfd := "Cr\u00e8me br\u00fbl\u00e9e", "Cre\u0300me bru\u0302le\u0301e"
+	options := []string{normalizeText(nfc), normalizeText("Tiramisu"), normalizeText(nfd)}
+	dup, found := findDuplicate(options)
+	if !found || dup != nfc {
+		t.Errorf("findDuplicate = %q, %v; want the NFC and NFD spellings reported as one", dup, found)
+	}
+}
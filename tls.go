@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS modes, as logged at startup
+const (
+	tlsOff      = "off"
+	tlsFiles    = "files"
+	tlsAutocert = "autocert"
+)
+
+// tlsMode tells how the server terminates TLS
+func (cfg Config) tlsMode() string {
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		return tlsAutocert
+	case cfg.TLSCertFile != "":
+		return tlsFiles
+	}
+	return tlsOff
+}
+
+// listenAndServe serves httpSrv over plain HTTP or HTTPS, depending on
+// the config. With autocert, certificates for the configured domains are
+// obtained from Let's Encrypt when first needed, renewed before they
+// expire, and kept in the cache directory so restarts don't request new
+// ones.
+func listenAndServe(httpSrv *http.Server, cfg Config) error {
+	switch cfg.tlsMode() {
+	case tlsAutocert:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		httpSrv.TLSConfig = m.TLSConfig()
+		httpSrv.TLSConfig.MinVersion = tls.VersionTLS12
+		serveRedirect(cfg.HTTPRedirectAddr, m.HTTPHandler(nil))
+		return httpSrv.ListenAndServeTLS("", "")
+	case tlsFiles:
+		httpSrv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		serveRedirect(cfg.HTTPRedirectAddr, redirectToHTTPS(cfg.ListenAddr))
+		return httpSrv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return httpSrv.ListenAndServe()
+}
+
+// serveRedirect runs the plain HTTP listener next to an HTTPS server,
+// unless addr is empty. It answers ACME challenges in autocert mode and
+// sends everything else to HTTPS.
+func serveRedirect(addr string, handler http.Handler) {
+	if addr == "" {
+		return
+	}
+	redirectSrv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logger.Info("Redirecting HTTP to HTTPS", "addr", addr)
+		if err := redirectSrv.ListenAndServe(); err != nil {
+			logger.Error("HTTP redirect listener stopped", "error", err)
+		}
+	}()
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS,
+// on the port the HTTPS server listens on
+func redirectToHTTPS(listenAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
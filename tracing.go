@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts every span. Until setupTracing installs a provider its
+// spans are no-ops, so tracing costs nothing when it isn't configured.
+var tracer = otel.Tracer("pulse")
+
+// untracedRoutes get no request span: WebSocket and SSE requests last as
+// long as the connection, and probes and scrapes would drown out the rest
+var untracedRoutes = map[string]bool{
+	"/ws/{pollID}":              true,
+	"/ws/deck/{code}":           true,
+	"/api/poll/{pollID}/stream": true,
+	"/health":                   true,
+	"/healthz":                  true,
+	"/readyz":                   true,
+	"/metrics":                  true,
+}
+
+// setupTracing exports spans over OTLP/HTTP when an OTLP endpoint is
+// configured with the standard OTEL_EXPORTER_OTLP_* variables, which also
+// set headers and timeouts; OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER are
+// honoured too. It returns a function that flushes the remaining spans.
+func setupTracing() func(context.Context) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) {}
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		logger.Error("Failed to set up trace exporter, tracing disabled", "error", err)
+		return func(context.Context) {}
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("pulse"), semconv.ServiceInstanceID(instanceID)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		logger.Warn("Incomplete trace resource", "error", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	logger.Info("Exporting traces over OTLP")
+
+	return func(shutdownCtx context.Context) {
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to flush traces", "error", err)
+		}
+	}
+}
+
+// withTracing gives each request a span named after its route, continuing
+// the trace of a caller that sent a traceparent header
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		if untracedRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		reqCtx, span := tracer.Start(reqCtx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				attribute.String("poll.id", mux.Vars(r)["pollID"]),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(reqCtx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streaming exports flush through the recorder
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// traceMetadata returns the trace context of ctx as metadata to publish
+// along with an update, so the instances relaying it continue the trace
+func traceMetadata(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// traceFromMetadata restores the trace context published with an update
+func traceFromMetadata(meta map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(meta))
+}
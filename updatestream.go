@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Each poll's updates go to a Redis stream of its own, updates:<pollID>,
+// and the new entry's ID is published on a channel of the same name.
+// Instances subscribe to the channels of the polls they have viewers for
+// and read the stream from where they left off, so they do no work for
+// other polls and miss nothing across a dropped connection.
+const updatesPrefix = "updates:"
+
+var (
+	// updatesMaxLen caps each poll's stream at about this many updates
+	updatesMaxLen = envInt("UPDATES_STREAM_MAXLEN", 10000)
+
+	// updatesStreamTTL is how long a poll's stream is kept after its last
+	// update
+	updatesStreamTTL = envDuration("UPDATES_STREAM_TTL", time.Hour)
+
+	// updatesReplay is how far back a new instance starts reading updates
+	// on the PostgreSQL store
+	updatesReplay = envDuration("UPDATES_REPLAY", time.Minute)
+)
+
+// Retries of the updates subscription back off exponentially between these
+const (
+	updatesRetryMin = 100 * time.Millisecond
+	updatesRetryMax = 30 * time.Second
+)
+
+// updatesPingInterval is how long the updates subscription may be idle
+// before its connection is checked
+const updatesPingInterval = 30 * time.Second
+
+// updatesHealthy reports whether this instance is currently receiving
+// updates; without them its viewers' counts are frozen
+var updatesHealthy atomic.Bool
+
+// backoff doubles a retry delay after every failure, up to a cap
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// wait sleeps for the current delay, or less if ctx is cancelled, and
+// doubles it for the next failure
+func (b *backoff) wait(ctx context.Context) {
+	if b.next == 0 {
+		b.next = b.min
+	}
+	select {
+	case <-time.After(b.next):
+	case <-ctx.Done():
+	}
+	b.next = min(2*b.next, b.max)
+}
+
+// reset starts over after a success
+func (b *backoff) reset() {
+	b.next = 0
+}
+
+// instanceID names this process: its field in the presence hashes and its
+// claim on reaction publishing. It defaults to the hostname; instances
+// sharing a host need an INSTANCE_ID each.
+var instanceID = loadInstanceID()
+
+func loadInstanceID() string {
+	if id := envString("INSTANCE_ID", ""); id != "" {
+		return id
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return newToken()[:12]
+}
+
+// Metadata is stored in the stream entry next to the payload, one field
+// per key with this prefix
+const metaFieldPrefix = "meta:"
+
+// publishScript appends an update to a poll's stream, keeps the stream
+// for updatesStreamTTL and announces the entry's ID on the poll's channel
+//
+// KEYS: updates:<id>
+// ARGV: max length, TTL in milliseconds, then field and value pairs
+var publishScript = redis.NewScript(`
+local id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[1], '*', unpack(ARGV, 3))
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PUBLISH', KEYS[1], id)
+return id
+`)
+
+func (s *redisStore) Publish(id string, payload []byte, meta map[string]string) error {
+	args := []interface{}{updatesMaxLen, updatesStreamTTL.Milliseconds(), "poll", id, "payload", payload}
+	for key, value := range meta {
+		args = append(args, metaFieldPrefix+key, value)
+	}
+	return publishScript.Run(ctx, s.client, []string{updatesPrefix + id}, args...).Err()
+}
+
+// pollWatches tracks the polls whose updates an instance reads, and how
+// far into each poll's stream it got
+type pollWatches struct {
+	mu sync.Mutex
+
+	// last is the ID of the last entry read per watched poll, "" until
+	// the poll's stream was first looked at
+	last map[string]string
+
+	// changed is signalled when polls are watched or unwatched
+	changed chan struct{}
+}
+
+func newPollWatches() *pollWatches {
+	return &pollWatches{last: make(map[string]string), changed: make(chan struct{}, 1)}
+}
+
+// Watch and Unwatch are called under the hub's lock, so they only record
+// the change; Subscribe acts on it
+func (s *redisStore) Watch(id string) {
+	s.watches.mu.Lock()
+	if _, ok := s.watches.last[id]; !ok {
+		s.watches.last[id] = ""
+	}
+	s.watches.mu.Unlock()
+	s.watches.signal()
+}
+
+func (s *redisStore) Unwatch(id string) {
+	s.watches.mu.Lock()
+	delete(s.watches.last, id)
+	s.watches.mu.Unlock()
+	s.watches.signal()
+}
+
+// signal wakes Subscribe without blocking
+func (w *pollWatches) signal() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *redisStore) Subscribe(ctx context.Context) <-chan PollMessage {
+	out := make(chan PollMessage)
+	sub := s.client.Subscribe(ctx)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		defer updatesHealthy.Store(false)
+
+		// Subscription changes are made beside the receive loop, which
+		// doesn't hold the subscription's lock while it waits
+		go s.syncSubscriptions(ctx, sub)
+
+		retry := backoff{min: updatesRetryMin, max: updatesRetryMax}
+		for ctx.Err() == nil {
+			msg, err := sub.ReceiveTimeout(ctx, updatesPingInterval)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// An idle connection is checked with a ping, whose
+				// reply arrives as the next message
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					if err = sub.Ping(ctx); err == nil {
+						continue
+					}
+				}
+				updatesHealthy.Store(false)
+				logger.Error("Receiving updates failed, retrying", "error", err)
+				retry.wait(ctx)
+				continue
+			}
+			if !updatesHealthy.Swap(true) {
+				logger.Info("Receiving updates")
+			}
+			retry.reset()
+
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				// Subscribing again after a reconnect catches up on what
+				// was published meanwhile
+				if msg.Kind == "subscribe" {
+					err = s.readUpdates(ctx, strings.TrimPrefix(msg.Channel, updatesPrefix), out)
+				}
+			case *redis.Message:
+				err = s.readUpdates(ctx, strings.TrimPrefix(msg.Channel, updatesPrefix), out)
+			}
+			if err != nil && ctx.Err() == nil {
+				logger.Error("Reading updates failed", "error", err)
+			}
+		}
+	}()
+	return out
+}
+
+// syncSubscriptions keeps the channels subscribed to in line with the
+// watched polls. A newly watched poll's stream is read from its current
+// end, and the catch-up once the subscription is confirmed delivers
+// anything published in between. A poll unwatched and watched again
+// before this caught up is still subscribed but starts over the same way.
+func (s *redisStore) syncSubscriptions(ctx context.Context, sub *redis.PubSub) {
+	subscribed := make(map[string]bool)
+	retry := backoff{min: updatesRetryMin, max: updatesRetryMax}
+	for {
+		select {
+		case <-s.watches.changed:
+		case <-ctx.Done():
+			return
+		}
+
+		s.watches.mu.Lock()
+		var added, removed []string
+		for id, last := range s.watches.last {
+			if !subscribed[id] || last == "" {
+				added = append(added, id)
+			}
+		}
+		for id := range subscribed {
+			if _, ok := s.watches.last[id]; !ok {
+				removed = append(removed, id)
+			}
+		}
+		s.watches.mu.Unlock()
+
+		err := s.startWatching(added)
+		if err == nil && len(added) > 0 {
+			err = sub.Subscribe(ctx, updateChannels(added)...)
+		}
+		if err == nil && len(removed) > 0 {
+			err = sub.Unsubscribe(ctx, updateChannels(removed)...)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Failed to update the update subscriptions, retrying", "error", err)
+			s.watches.signal()
+			retry.wait(ctx)
+			continue
+		}
+		retry.reset()
+		for _, id := range added {
+			subscribed[id] = true
+		}
+		for _, id := range removed {
+			delete(subscribed, id)
+		}
+	}
+}
+
+// startWatching records the current end of each poll's stream as where
+// reading starts
+func (s *redisStore) startWatching(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.XMessageSliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.XRevRangeN(ctx, updatesPrefix+id, "+", "-", 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+
+	s.watches.mu.Lock()
+	defer s.watches.mu.Unlock()
+	for i, id := range ids {
+		if last, ok := s.watches.last[id]; !ok || last != "" {
+			continue
+		}
+		s.watches.last[id] = "0-0"
+		if entries := cmds[i].Val(); len(entries) > 0 {
+			s.watches.last[id] = entries[0].ID
+		}
+	}
+	return nil
+}
+
+// updateChannels names the update channels of polls
+func updateChannels(ids []string) []string {
+	channels := make([]string, len(ids))
+	for i, id := range ids {
+		channels[i] = updatesPrefix + id
+	}
+	return channels
+}
+
+// readUpdates delivers the entries of a watched poll's stream past the
+// last one read
+func (s *redisStore) readUpdates(ctx context.Context, id string, out chan<- PollMessage) error {
+	for {
+		s.watches.mu.Lock()
+		last := s.watches.last[id]
+		s.watches.mu.Unlock()
+		if last == "" {
+			return nil // not watched, or not started yet
+		}
+
+		streams, err := s.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{updatesPrefix + id, last},
+			Count:   100,
+			Block:   -1,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			return nil
+		}
+
+		messages := streams[0].Messages
+		s.watches.mu.Lock()
+		if s.watches.last[id] != last {
+			// Unwatched, or read by a catch-up in between
+			s.watches.mu.Unlock()
+			return nil
+		}
+		s.watches.last[id] = messages[len(messages)-1].ID
+		s.watches.mu.Unlock()
+
+		for _, msg := range messages {
+			payload, _ := msg.Values["payload"].(string)
+			select {
+			case out <- PollMessage{PollID: id, Payload: payload, Meta: streamMeta(msg.Values)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if len(messages) < 100 {
+			return nil
+		}
+	}
+}
+
+// streamMeta collects the metadata fields of a stream entry
+func streamMeta(values map[string]interface{}) map[string]string {
+	meta := make(map[string]string)
+	for field, value := range values {
+		if key, ok := strings.CutPrefix(field, metaFieldPrefix); ok {
+			meta[key], _ = value.(string)
+		}
+	}
+	return meta
+}
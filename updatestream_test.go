@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedisStore runs a redisStore against an in-process Redis
+func newTestRedisStore(t testing.TB) *redisStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &redisStore{client: client, watches: newPollWatches()}
+}
+
+// eachPollStore runs a test against the in-memory store and the Redis one
+func eachPollStore(t *testing.T, test func(t *testing.T, s PollStore)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryStore()) })
+	t.Run("redis", func(t *testing.T) { test(t, newTestRedisStore(t)) })
+}
+
+// nextUpdate waits for the next message Subscribe delivers
+func nextUpdate(t *testing.T, updates <-chan PollMessage) PollMessage {
+	t.Helper()
+	select {
+	case msg := <-updates:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update delivered")
+		return PollMessage{}
+	}
+}
+
+// publishUntilDelivered publishes a payload until the subscription is in
+// place and delivers it, since subscribing happens in the background
+func publishUntilDelivered(t *testing.T, s *redisStore, updates <-chan PollMessage, id, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := s.Publish(id, []byte(payload), nil); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		select {
+		case msg := <-updates:
+			if msg.PollID != id || msg.Payload != payload {
+				t.Fatalf("got %s %q, want %s %q", msg.PollID, msg.Payload, id, payload)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("%q on %s never delivered", payload, id)
+}
+
+func TestSubscribeDeliversWatchedPolls(t *testing.T) {
+	s := newTestRedisStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := s.Subscribe(ctx)
+
+	s.Watch("watched")
+	publishUntilDelivered(t, s, updates, "watched", "first")
+
+	if err := s.Publish("other", []byte("ignored"), nil); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := s.Publish("watched", []byte("second"), map[string]string{"trace": "t1"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	msg := nextUpdate(t, updates)
+	if msg.PollID != "watched" || msg.Payload != "second" || msg.Meta["trace"] != "t1" {
+		t.Fatalf("got %+v, want the second update of the watched poll", msg)
+	}
+}
+
+func TestSubscribeAfterUnwatchAndRewatch(t *testing.T) {
+	s := newTestRedisStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := s.Subscribe(ctx)
+
+	s.Watch("poll")
+	publishUntilDelivered(t, s, updates, "poll", "before")
+
+	// The last viewer leaving and a new one arriving before the
+	// subscriptions are synced, as on a page reload
+	s.Unwatch("poll")
+	s.Watch("poll")
+	publishUntilDelivered(t, s, updates, "poll", "after")
+
+	// Later updates keep flowing
+	if err := s.Publish("poll", []byte("later"), nil); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if msg := nextUpdate(t, updates); msg.Payload != "later" {
+		t.Fatalf("got %q, want %q", msg.Payload, "later")
+	}
+}
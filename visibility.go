@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Results visibility policies, picked with results_visibility at creation.
+// afterVote and afterClose are the reveal_after_vote and hide_results
+// settings, which is how they are stored.
+const (
+	visibilityAlways     = "always"
+	visibilityAfterVote  = "afterVote"
+	visibilityAfterClose = "afterClose"
+)
+
+// applyResultsVisibility turns a poll's results_visibility into the
+// settings it stands for, refusing ones that contradict them
+func applyResultsVisibility(req *CreatePollRequest) error {
+	switch req.Visibility {
+	case "":
+		return nil
+	case visibilityAlways:
+		if req.RevealAfter || req.HideResults {
+			return fmt.Errorf("results_visibility %q contradicts reveal_after_vote and hide_results", visibilityAlways)
+		}
+	case visibilityAfterVote:
+		if req.HideResults {
+			return fmt.Errorf("results_visibility %q contradicts hide_results", visibilityAfterVote)
+		}
+		req.RevealAfter = true
+	case visibilityAfterClose:
+		req.HideResults = true
+	default:
+		return fmt.Errorf("results_visibility must be %q, %q or %q",
+			visibilityAlways, visibilityAfterVote, visibilityAfterClose)
+	}
+	return nil
+}
+
+// resultsVisibilityOf returns a poll's results visibility policy
+func resultsVisibilityOf(data map[string]string) string {
+	switch {
+	case data["hide_results"] == "1":
+		return visibilityAfterClose
+	case data["reveal_after_vote"] == "1":
+		return visibilityAfterVote
+	}
+	return visibilityAlways
+}
+
+// spectatorTokenFromRequest extracts the spectator token of a hide_results
+// poll from the X-Spectator-Token header or the spectatorToken query
+// parameter (browsers can't set headers on WebSocket upgrades)
+func spectatorTokenFromRequest(r *http.Request) string {
+	if token := r.Header.Get("X-Spectator-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("spectatorToken")
+}
+
+// privilegedViewer reports whether the request carries the poll's owner or
+// spectator token, which always see the counts
+func privilegedViewer(r *http.Request, data map[string]string) bool {
+	if ownerMatches(r, data["owner_hash"]) {
+		return true
+	}
+	if token := spectatorTokenFromRequest(r); token != "" && tokenMatches(token, data["spectator_hash"]) {
+		return true
+	}
+	return false
+}
+
+// resultsHidden decides whether GET /api/poll/{pollID} withholds the counts,
+// matching what the WebSocket would send the same requester. Once a poll
+// closes everyone sees the final tally.
+func resultsHidden(r *http.Request, pollID string, data map[string]string) bool {
+	return data["status"] != statusClosed && resultsWithheld(r, pollID, data)
+}
+
+// resultsWithheld reports whether the requester only gets to see the
+// counts while the poll is closed:
+//   - hide_results polls show nothing until closed
+//   - reveal_after_vote polls show counts once ?clientId= has voted
+//
+// The owner and spectator tokens bypass both.
+func resultsWithheld(r *http.Request, pollID string, data map[string]string) bool {
+	hide := data["hide_results"] == "1"
+	reveal := data["reveal_after_vote"] == "1"
+	if !hide && !reveal {
+		return false
+	}
+	if privilegedViewer(r, data) {
+		return false
+	}
+	if hide {
+		return true
+	}
+
+	return !hasVoted(data, voteRequest{
+		PollID:      pollID,
+		ClientID:    clientIdentity(pollID, r.URL.Query().Get("clientId")),
+		IP:          clientIP(r),
+		UserAgent:   r.UserAgent(),
+		VoterCookie: voterCookie(r),
+		Fingerprint: requestFingerprint(r),
+		Account:     accountFromRequest(r),
+	})
+}
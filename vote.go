@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RESTVoteRequest is the body of POST /api/poll/{pollID}/vote
+type RESTVoteRequest struct {
+	Option       string         `json:"option"`
+	Options      []string       `json:"options,omitempty"` // multi-select ballot
+	Ratings      map[string]int `json:"ratings,omitempty"` // rating ballot
+	Answer       string         `json:"answer,omitempty"`  // open-text poll
+	ClientID     string         `json:"clientId"`
+	VoterToken   string         `json:"voterToken,omitempty"`
+	Segment      string         `json:"segment,omitempty"`
+	Player       string         `json:"player,omitempty"`
+	Name         string         `json:"name,omitempty"` // identified polls
+	CaptchaToken string         `json:"captchaToken,omitempty"`
+}
+
+// voteHTTPStatus maps a vote outcome to the HTTP status of a REST vote
+var voteHTTPStatus = map[string]int{
+	voteOK:              http.StatusOK,
+	voteDuplicate:       http.StatusConflict,
+	votePaused:          http.StatusConflict,
+	voteClosed:          http.StatusConflict,
+	voteConfirmRequired: http.StatusConflict,
+	voteBlocked:         http.StatusTooManyRequests,
+	voteRateLimited:     http.StatusTooManyRequests,
+	voteDenied:          http.StatusForbidden,
+	voteClientInvalid:   http.StatusUnauthorized,
+	voteClientExpired:   http.StatusUnauthorized,
+	voteSignInRequired:  http.StatusUnauthorized,
+	voteNameRequired:    http.StatusBadRequest,
+	voteRejected:        http.StatusBadRequest,
+	voteCaptchaFailed:   http.StatusForbidden,
+	voteInvalid:         http.StatusBadRequest,
+	voteNotVoted:        http.StatusNotFound,
+	voteNotOpen:         http.StatusConflict,
+	voteError:           http.StatusInternalServerError,
+}
+
+// votePoll handles POST /api/poll/{pollID}/vote, for clients that can't
+// hold a WebSocket open. Votes go through the same checks and broadcast as
+// WebSocket votes, and the response body is the voteAck.
+func (s *Server) votePoll(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now()
+	pollID := mux.Vars(r)["pollID"]
+	ip := clientIP(r)
+
+	var req RESTVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := store.GetPoll(pollID)
+	if err != nil || len(settings) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	var status string
+	switch {
+	case (req.Option == "" && len(req.Options) == 0 && len(req.Ratings) == 0 && req.Answer == "") || req.ClientID == "":
+		status = voteInvalid
+	case settings["confirm_votes"] == "1":
+		// The intent/confirm round-trip needs a connection to hold the
+		// pending vote
+		status = voteConfirmRequired
+	case settings["require_captcha"] == "1" && verifyCaptcha(req.CaptchaToken, ip) != nil:
+		requestLogger(r).Info("CAPTCHA check failed on REST vote")
+		status = voteCaptchaFailed
+	default:
+		status = handleVote(voteRequest{
+			PollID:     pollID,
+			Option:     req.Option,
+			Options:    req.Options,
+			Ratings:    req.Ratings,
+			Answer:     normalizeText(req.Answer),
+			ClientID:   req.ClientID,
+			IP:         ip,
+			UserAgent:  r.UserAgent(),
+			VoterToken: req.VoterToken,
+			Segment:    normalizeText(req.Segment),
+			Player:     playerName(req.Player),
+			Name:       playerName(req.Name),
+			ReceivedAt: receivedAt,
+
+			VoterCookie: ensureVoterCookie(r, w.Header()),
+			Fingerprint: requestFingerprint(r),
+			Account:     accountFromRequest(r),
+			Log:         requestLogger(r),
+			Trace:       r.Context(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(voteHTTPStatus[status])
+	json.NewEncoder(w).Encode(VoteAck{Type: "voteAck", Status: status, Option: req.Option, Options: req.Options, Ratings: req.Ratings})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// voterCookieName is the server-issued cookie the lenient and strict dedup
+// policies recognize voters by
+const voterCookieName = "pulse_voter"
+
+// fingerprintHeader optionally carries a browser fingerprint computed by
+// the page, for the strict dedup policy. Browsers can't set headers on a
+// WebSocket handshake, so ?fingerprint= works too.
+const fingerprintHeader = "X-Client-Fingerprint"
+
+// voterSecret signs voter cookies and client tokens. Without
+// VOTER_COOKIE_SECRET a random one is used, so neither survives a restart
+// or is recognized by other instances.
+var voterSecret = loadVoterSecret()
+
+func loadVoterSecret() []byte {
+	if secret := envString("VOTER_COOKIE_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	logger.Warn("VOTER_COOKIE_SECRET is not set; voter cookies and client tokens won't survive a restart or work across instances")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fatal("Failed to generate voter secret", "error", err)
+	}
+	return secret
+}
+
+// signVoterID returns the cookie value for a voter ID
+func signVoterID(id string) string {
+	mac := hmac.New(sha256.New, voterSecret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// voterCookie returns the voter ID from a request's signed cookie, or ""
+// if it has none or the signature doesn't match
+func voterCookie(r *http.Request) string {
+	cookie, err := r.Cookie(voterCookieName)
+	if err != nil {
+		return ""
+	}
+	id, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signVoterID(id)), []byte(cookie.Value)) {
+		return ""
+	}
+	return id
+}
+
+// ensureVoterCookie returns the requester's voter ID, adding a fresh
+// signed cookie to header when it has no valid one
+func ensureVoterCookie(r *http.Request, header http.Header) string {
+	if id := voterCookie(r); id != "" {
+		return id
+	}
+	id := newToken()
+	cookie := &http.Cookie{
+		Name:     voterCookieName,
+		Value:    signVoterID(id),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	header.Add("Set-Cookie", cookie.String())
+	return id
+}
+
+// requestFingerprint returns the browser fingerprint a request carries
+func requestFingerprint(r *http.Request) string {
+	if fp := r.Header.Get(fingerprintHeader); fp != "" {
+		return fp
+	}
+	return r.URL.Query().Get("fingerprint")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Limits on the webhooks of one poll
+const (
+	maxWebhooks          = 5
+	maxWebhookThresholds = 20
+)
+
+var (
+	// webhookMaxAttempts is how many times a webhook delivery is tried
+	// before it's given up on
+	webhookMaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", 5)
+
+	// webhookRetryDelay is the wait before the first retry; each further
+	// retry waits twice as long
+	webhookRetryDelay = envDuration("WEBHOOK_RETRY_DELAY", time.Second)
+)
+
+// Webhook events
+const (
+	webhookPollCreated      = "pollCreated"
+	webhookThresholdReached = "thresholdReached"
+	webhookPollClosed       = "pollClosed"
+	webhookFinalResults     = "finalResults"
+)
+
+// WebhookPayload is the JSON body POSTed to a poll's webhooks
+type WebhookPayload struct {
+	Event     string       `json:"event"`
+	PollID    string       `json:"pollId"`
+	Question  string       `json:"question"`
+	Timestamp int64        `json:"timestamp"`           // Unix seconds
+	Threshold int          `json:"threshold,omitempty"` // thresholdReached
+	Total     int          `json:"total,omitempty"`     // thresholdReached
+	Summary   *PollSummary `json:"summary,omitempty"`   // finalResults
+}
+
+// httpURL reports whether raw is an absolute http(s) URL
+func httpURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateWebhooks checks the webhooks and thresholds given at creation,
+// and sorts the thresholds
+func validateWebhooks(webhooks []string, thresholds []int) error {
+	if len(webhooks) > maxWebhooks {
+		return fmt.Errorf("at most %d webhooks are allowed", maxWebhooks)
+	}
+	for _, webhook := range webhooks {
+		if err := validateOutboundURL("webhooks", webhook); err != nil {
+			return err
+		}
+	}
+	if len(thresholds) > 0 && len(webhooks) == 0 {
+		return fmt.Errorf("webhook_thresholds need webhooks")
+	}
+	if len(thresholds) > maxWebhookThresholds {
+		return fmt.Errorf("at most %d webhook_thresholds are allowed", maxWebhookThresholds)
+	}
+	sort.Ints(thresholds)
+	for i, threshold := range thresholds {
+		if threshold < 1 || (i > 0 && threshold == thresholds[i-1]) {
+			return fmt.Errorf("webhook_thresholds must be distinct positive vote counts")
+		}
+	}
+	return nil
+}
+
+// webhookTargets returns the webhooks of a poll hash
+func webhookTargets(data map[string]string) []string {
+	var webhooks []string
+	if raw := data["webhooks"]; raw != "" {
+		json.Unmarshal([]byte(raw), &webhooks)
+	}
+	return webhooks
+}
+
+// sendWebhooks delivers events to a poll's webhooks in the background, in
+// order, each URL on its own. Retries are only kept in memory, so an
+// instance that stops drops the deliveries still waiting on one.
+func sendWebhooks(pollID string, data map[string]string, events ...WebhookPayload) {
+	webhooks := webhookTargets(data)
+	if len(webhooks) == 0 {
+		return
+	}
+	for _, webhook := range webhooks {
+		go func(webhook string) {
+			for _, event := range events {
+				if err := deliverWebhook(webhook, data["webhook_secret"], event); err != nil {
+					logger.Error("Failed to deliver webhook", "poll_id", pollID, "event", event.Event, "error", err)
+				}
+			}
+		}(webhook)
+	}
+}
+
+// deliverWebhook POSTs one event, retrying with exponential backoff on
+// network errors, 5xx and 429 responses
+func deliverWebhook(webhook, secret string, event WebhookPayload) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	delivery := newToken()
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(webhook, secret, delivery, event.Event, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= webhookMaxAttempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook makes one delivery attempt and reports whether a failure is
+// worth retrying. Redirects aren't followed and count as failures. The signature is an HMAC-SHA256 of "<timestamp>.<body>"
+// under the poll's webhook secret.
+func postWebhook(webhook, secret, delivery, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pulse-Event", event)
+	req.Header.Set("X-Pulse-Delivery", delivery)
+	req.Header.Set("X-Pulse-Timestamp", timestamp)
+	req.Header.Set("X-Pulse-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return !errors.Is(err, errOutboundRefused), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+// webhookEvent starts the payload of an event about a poll
+func webhookEvent(event, pollID string, data map[string]string) WebhookPayload {
+	return WebhookPayload{
+		Event:     event,
+		PollID:    pollID,
+		Question:  data["question"],
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// checkThresholds sends thresholdReached for each of a poll's thresholds
+// its vote total has reached. Each threshold is claimed in the poll hash,
+// so it's announced once across instances, and not again if votes are
+// retracted and cast again.
+func checkThresholds(pollID string, data map[string]string, total int) {
+	var thresholds []int
+	if raw := data["webhook_thresholds"]; raw != "" {
+		json.Unmarshal([]byte(raw), &thresholds)
+	}
+	for _, threshold := range thresholds {
+		if threshold > total {
+			break
+		}
+		claimed, err := store.SetPollFieldNX(pollID, fmt.Sprintf("threshold_sent_%d", threshold), total)
+		if err != nil {
+			logger.Error("Failed to claim webhook threshold", "poll_id", pollID, "error", err)
+			return
+		}
+		if !claimed {
+			continue
+		}
+		event := webhookEvent(webhookThresholdReached, pollID, data)
+		event.Threshold = threshold
+		event.Total = total
+		sendWebhooks(pollID, data, event)
+	}
+}
+
+// webhooksClosed sends pollClosed followed by finalResults once a poll
+// has closed
+func webhooksClosed(pollID string) {
+	data, err := store.GetPoll(pollID)
+	if err != nil || len(webhookTargets(data)) == 0 {
+		return
+	}
+	summary, err := loadSummary(pollID)
+	if err != nil {
+		logger.Error("Failed to build summary", "poll_id", pollID, "error", err)
+		return
+	}
+	results := webhookEvent(webhookFinalResults, pollID, data)
+	results.Summary = summary
+	sendWebhooks(pollID, data, webhookEvent(webhookPollClosed, pollID, data), results)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// withOutboundLists sets WEBHOOK_ALLOWLIST and WEBHOOK_DENYLIST for one
+// test. Open connections were checked against the old lists, so they are
+// closed.
+func withOutboundLists(t *testing.T, allow, deny string) {
+	t.Helper()
+	outboundClient.CloseIdleConnections()
+	savedAllow, savedDeny := outboundAllowlist, outboundDenylist
+	outboundAllowlist, outboundDenylist = parseOutboundList(allow), parseOutboundList(deny)
+	t.Cleanup(func() { outboundAllowlist, outboundDenylist = savedAllow, savedDeny })
+}
+
+// countingServer is a webhook receiver counting its requests
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestValidateWebhooksRefusesInternalHosts(t *testing.T) {
+	withOutboundLists(t, "", "")
+	for _, webhook := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+	} {
+		if err := validateWebhooks([]string{webhook}, nil); err == nil {
+			t.Errorf("%s was accepted", webhook)
+		}
+	}
+	if err := validateWebhooks([]string{"https://hooks.example.com/pulse"}, nil); err != nil {
+		t.Errorf("a public hostname was refused: %v", err)
+	}
+}
+
+func TestWebhookDeliveryRefusesPrivateAddresses(t *testing.T) {
+	withOutboundLists(t, "", "")
+	srv, hits := countingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	retry, err := postWebhook(srv.URL, "secret", "d1", webhookPollClosed, []byte(`{}`))
+	if !errors.Is(err, errOutboundRefused) {
+		t.Fatalf("delivery to %s: %v, want errOutboundRefused", srv.URL, err)
+	}
+	if retry {
+		t.Error("a refused address would be retried")
+	}
+	if hits.Load() != 0 {
+		t.Error("the loopback receiver was reached")
+	}
+}
+
+func TestWebhookAllowlistAndDenylist(t *testing.T) {
+	srv, hits := countingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	withOutboundLists(t, "127.0.0.0/8", "")
+	if _, err := postWebhook(srv.URL, "secret", "d1", webhookPollClosed, []byte(`{}`)); err != nil {
+		t.Fatalf("delivery to an allowlisted network: %v", err)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("%d requests received, want 1", hits.Load())
+	}
+
+	withOutboundLists(t, "127.0.0.0/8", "127.0.0.1")
+	if _, err := postWebhook(srv.URL, "secret", "d2", webhookPollClosed, []byte(`{}`)); !errors.Is(err, errOutboundRefused) {
+		t.Fatalf("delivery to a denylisted address: %v, want errOutboundRefused", err)
+	}
+}
+
+func TestWebhookRedirectsNotFollowed(t *testing.T) {
+	withOutboundLists(t, "127.0.0.1", "")
+	target, targetHits := countingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	redirect, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	})
+
+	if _, err := postWebhook(redirect.URL, "secret", "d1", webhookPollClosed, []byte(`{}`)); err == nil {
+		t.Error("a redirect counted as a delivery")
+	}
+	if targetHits.Load() != 0 {
+		t.Error("the redirect was followed")
+	}
+}
+
+func TestNotifyURLGoesThroughOutboundChecks(t *testing.T) {
+	withOutboundLists(t, "", "")
+	if err := validateNotifyURL("http://169.254.169.254/latest/meta-data/"); err == nil {
+		t.Error("an internal notify_url was accepted")
+	}
+
+	srv, hits := countingServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	summary := &PollSummary{PollID: "p1", Question: "Lunch?"}
+	if err := postSummary(srv.URL, summary); !errors.Is(err, errOutboundRefused) {
+		t.Fatalf("summary to %s: %v, want errOutboundRefused", srv.URL, err)
+	}
+	if hits.Load() != 0 {
+		t.Error("the loopback receiver was reached")
+	}
+
+	withOutboundLists(t, "127.0.0.1", "")
+	if err := postSummary(srv.URL, summary); err != nil {
+		t.Fatalf("summary to an allowlisted address: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxVoteWeight bounds one voter's weight, so totals can't overflow
+const maxVoteWeight = 1_000_000_000
+
+// weightsKey is the hash of a weighted poll's voter weights, from the hash
+// of an invite or ballot token to its weight. Tokens without one weigh 1.
+func weightsKey(pollID string) string {
+	return fmt.Sprintf("weights:%s", pollID)
+}
+
+// weightedVoteKey is the poll hash field with an option's weighted total,
+// next to its raw count in votes_<option>
+func weightedVoteKey(optionID string) string {
+	return "wvotes_" + optionID
+}
+
+// WeightsRequest is the body of PUT /api/poll/{pollID}/weights
+type WeightsRequest struct {
+	Weights map[string]int64 `json:"weights"` // invite or ballot token to weight
+}
+
+// validateWeighted checks that a new weighted poll gives each voter a
+// token to carry the weight, and counts plain option totals
+func validateWeighted(req *CreatePollRequest) error {
+	if !req.Weighted {
+		return nil
+	}
+	if !req.InviteOnly && !req.BallotTokens {
+		return fmt.Errorf("weighted polls need require_invite or ballot_tokens, so each voter has a token to weigh")
+	}
+	switch req.PollType {
+	case pollTypeRanked, pollTypeRating, pollTypeText:
+		return fmt.Errorf("weighted can't be combined with %s polls", req.PollType)
+	}
+	return nil
+}
+
+// voterWeight resolves the weight of a ballot's voter token on a weighted
+// poll; other polls weigh every ballot 1
+func voterWeight(state map[string]string, v voteRequest) (int64, error) {
+	if state["weighted"] != "1" || v.VoterToken == "" {
+		return 1, nil
+	}
+	raw, err := kv.HGet(weightsKey(v.PollID), hashToken(v.VoterToken))
+	if err == errKeyNotFound {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
+
+// weightedCounters returns the weighted totals a ballot adds weight to, or
+// nothing on a poll that isn't weighted
+func weightedCounters(data map[string]string, choices []string, weight int64) []Increment {
+	if data["weighted"] != "1" {
+		return nil
+	}
+	counters := make([]Increment, 0, len(choices))
+	for _, optionID := range choices {
+		counters = append(counters, Increment{Field: weightedVoteKey(optionID), By: weight})
+	}
+	return counters
+}
+
+// parseWeightedVotes extracts the weighted totals from a weighted poll's
+// hash, or returns nil for other polls
+func parseWeightedVotes(data map[string]string) map[string]int64 {
+	if data["weighted"] != "1" {
+		return nil
+	}
+	totals := make(map[string]int64)
+	for optionID := range parseOptions(data) {
+		totals[optionID], _ = strconv.ParseInt(data[weightedVoteKey(optionID)], 10, 64)
+	}
+	return totals
+}
+
+// setWeights handles PUT /api/poll/{pollID}/weights, which sets the weights
+// of a weighted poll's invite or ballot tokens, such as the shares each
+// holder has. Weights can only change before anyone votes, so every
+// ballot is counted, and undone on a revote, with the weight it was cast
+// with.
+func (s *Server) setWeights(w http.ResponseWriter, r *http.Request) {
+	pollID := mux.Vars(r)["pollID"]
+	if !isAdmin(r) && !requireOwner(w, r, pollID) {
+		return
+	}
+
+	var req WeightsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Weights) == 0 || len(req.Weights) > maxInvitesPerCall {
+		http.Error(w, fmt.Sprintf("weights must set between 1 and %d tokens", maxInvitesPerCall), http.StatusBadRequest)
+		return
+	}
+	for _, weight := range req.Weights {
+		if weight < 1 || weight > maxVoteWeight {
+			http.Error(w, fmt.Sprintf("weights must be between 1 and %d", maxVoteWeight), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := store.GetPoll(pollID)
+	if err != nil {
+		http.Error(w, "Failed to load poll", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if data["weighted"] != "1" {
+		http.Error(w, "Poll isn't weighted; create it with weighted", http.StatusConflict)
+		return
+	}
+	if pollHasVotes(data) {
+		http.Error(w, "Poll has votes; weights can't change anymore", http.StatusConflict)
+		return
+	}
+
+	// Only the poll's own tokens can be weighed
+	tokensKey := invitesKey(pollID)
+	if data["ballot_tokens"] == "1" {
+		tokensKey = ballotsKey(pollID)
+	}
+	weights := make(map[string]interface{}, len(req.Weights))
+	for token, weight := range req.Weights {
+		known, err := kv.SIsMember(tokensKey, hashToken(token))
+		if err != nil {
+			requestLogger(r).Error("Failed to check tokens", "error", err)
+			http.Error(w, "Failed to set weights", http.StatusInternalServerError)
+			return
+		}
+		if !known {
+			http.Error(w, "Some tokens aren't this poll's invites or ballots", http.StatusNotFound)
+			return
+		}
+		weights[hashToken(token)] = weight
+	}
+
+	if err := setTokenWeights(pollID, weights); err != nil {
+		requestLogger(r).Error("Failed to set weights", "error", err)
+		http.Error(w, "Failed to set weights", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Voter weights set", "tokens", len(weights))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setTokenWeights saves weights by token hash, for as long as the poll
+func setTokenWeights(pollID string, weights map[string]interface{}) error {
+	ttl, err := store.PollTTL(pollID)
+	if err != nil {
+		return err
+	}
+	return kv.Batch(func(b KeyBatch) {
+		b.HSet(weightsKey(pollID), weights)
+		if ttl > 0 {
+			b.Expire(weightsKey(pollID), ttl)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Limits on open-text answers
+var (
+	maxAnswerBytes = envInt("MAX_ANSWER_BYTES", 280)
+	topWordsLimit  = envInt("TOP_WORDS", 50) // words in each topWords broadcast
+)
+
+// maxAnswerWords caps the distinct words one answer adds to the cloud
+const maxAnswerWords = 20
+
+// stopWords are left out of word clouds since nearly every answer has them
+var stopWords = toSet(strings.Fields(`
+	a about above after again against all am an and any are as at be because
+	been before being below between both but by can could did do does doing
+	down during each few for from further had has have having he her here
+	hers herself him himself his how i if in into is it its itself just me
+	more most my myself no nor not now of off on once only or other our ours
+	ourselves out over own same she should so some such than that the their
+	theirs them themselves then there these they this those through to too
+	under until up very was we were what when where which while who whom why
+	will with would you your yours yourself yourselves
+	i'm it's don't isn't can't won't i've i'd i'll you're we're they're
+`))
+
+func toSet(words []string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+	return set
+}
+
+// WordCount is one entry of a word cloud
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int64  `json:"count"`
+}
+
+// TopWords is broadcast after every answer to an open-text poll, with the
+// most frequent words first
+type TopWords struct {
+	Type      string      `json:"type"`
+	Words     []WordCount `json:"words"`
+	Responses int         `json:"responses"`
+}
+
+// wordsKey holds an open-text poll's word counts, as a sorted set
+func wordsKey(pollID string) string {
+	return fmt.Sprintf("words:%s", pollID)
+}
+
+// validAnswer checks an open-text answer against the poll: open-text
+// polls need an answer within maxAnswerBytes, and other polls take none
+func validAnswer(data map[string]string, answer string) bool {
+	if pollTypeOf(data) != pollTypeText {
+		return answer == ""
+	}
+	return answer != "" && len(answer) <= maxAnswerBytes && !strings.Contains(answer, segmentSeparator)
+}
+
+// answerWords splits an answer into the words it adds to the cloud:
+// lowercased, without punctuation or stop words, each counted once
+func answerWords(answer string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(answer), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\'' && r != '-'
+	})
+
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range fields {
+		word = strings.Trim(word, "'-")
+		if len([]rune(word)) < 2 || stopWords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+		if len(words) == maxAnswerWords {
+			break
+		}
+	}
+	return words
+}
+
+// countAnswer adds an answer's words to an open-text poll's word cloud,
+// or takes them out again when by is negative
+func countAnswer(pollID, answer string, by int64) {
+	words := answerWords(answer)
+	if len(words) == 0 {
+		return
+	}
+	if err := store.CountWords(pollID, words, by); err != nil {
+		logger.Error("Failed to count words", "poll_id", pollID, "error", err)
+	}
+}
+
+// currentTopWords builds the topWords message with an open-text poll's
+// current word cloud
+func currentTopWords(pollID string) TopWords {
+	msg := TopWords{Type: "topWords", Words: []WordCount{}}
+	words, err := store.TopWords(pollID, topWordsLimit)
+	if err != nil {
+		logger.Error("Failed to load word cloud", "poll_id", pollID, "error", err)
+		return msg
+	}
+	if words != nil {
+		msg.Words = words
+	}
+	data, err := store.GetPoll(pollID)
+	if err == nil {
+		fmt.Sscanf(data["responses"], "%d", &msg.Responses)
+	}
+	return msg
+}
+
+// sendTopWords sends an open-text poll's word cloud to a connection that
+// may see the results
+func sendTopWords(client *wsClient, pollID string) {
+	if !client.openText || !client.canSeeResults() {
+		return
+	}
+	client.writeJSON(currentTopWords(pollID))
+}
+
+// currentTopWords builds the topWords event for a stream
+func (st *sseStream) currentTopWords(pollID string) sseEvent {
+	payload, _ := json.Marshal(currentTopWords(pollID))
+	return sseEvent{name: "topWords", data: payload}
+}
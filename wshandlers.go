@@ -0,0 +1,105 @@
+package main
+
+import "time"
+
+// wsHandler processes one client message of a given type
+type wsHandler func(m *wsMessage)
+
+// wsMessage is a decoded client message together with the connection it
+// arrived on
+type wsMessage struct {
+	VoteMessage
+	client     *wsClient
+	pollID     string
+	ip         string
+	userAgent  string
+	receivedAt time.Time
+}
+
+// WSError tells a client its message couldn't be handled
+type WSError struct {
+	Type   string `json:"type"` // "error"
+	Reason string `json:"reason"`
+	MsgID  string `json:"msgId,omitempty"`
+}
+
+// registerWSHandlers maps client message types to their handlers. A message
+// without a type is a plain vote.
+func (s *Server) registerWSHandlers() {
+	s.wsHandlers = map[string]wsHandler{
+		"":            s.wsVote,
+		"vote":        s.wsVote,
+		"voteIntent":  s.wsVoteIntent,
+		"voteConfirm": s.wsVoteConfirm,
+		"retract":     s.wsRetract,
+		"reaction":    s.wsReaction,
+	}
+}
+
+// dispatchWS routes a message to its handler. Unknown types and messages
+// over the rate limit get an error reply and leave the connection open.
+func (s *Server) dispatchWS(m *wsMessage) {
+	handler, ok := s.wsHandlers[m.Type]
+	if !ok {
+		m.client.writeJSON(WSError{Type: "error", Reason: "unknown_type", MsgID: m.MsgID})
+		return
+	}
+	if !wsMessageLimit.Allow(m.ip) {
+		m.client.writeJSON(WSError{Type: "error", Reason: "rate_limited", MsgID: m.MsgID})
+		return
+	}
+	handler(m)
+}
+
+// wsVote records a vote and tells the client how it went
+func (s *Server) wsVote(m *wsMessage) {
+	ack := VoteAck{Type: "voteAck", Option: m.Vote, Options: m.Votes, Ratings: m.Ratings, MsgID: m.MsgID}
+	if (m.Vote == "" && len(m.Votes) == 0 && len(m.Ratings) == 0 && m.Answer == "") || m.ClientID == "" {
+		ack.Status = voteInvalid
+		m.client.writeJSON(ack)
+		return
+	}
+	if m.client.confirmVotes {
+		ack.Status = voteConfirmRequired
+		m.client.writeJSON(ack)
+		return
+	}
+	if !m.client.passCaptcha(m.CaptchaToken, m.ip) {
+		ack.Status = voteCaptchaFailed
+		m.client.writeJSON(ack)
+		return
+	}
+	status := handleVote(voteRequest{
+		PollID:     m.pollID,
+		Option:     m.Vote,
+		Options:    m.Votes,
+		Ratings:    m.Ratings,
+		Answer:     normalizeText(m.Answer),
+		ClientID:   m.ClientID,
+		IP:         m.ip,
+		UserAgent:  m.userAgent,
+		VoterToken: m.VoterToken,
+		Segment:    normalizeText(m.Segment),
+		Player:     playerName(m.Player),
+		Name:       playerName(m.Name),
+		ReceivedAt: m.receivedAt,
+
+		VoterCookie: m.client.voterCookie,
+		Fingerprint: m.client.fingerprint,
+		Account:     m.client.account,
+		Log:         m.client.log,
+	})
+	ack.Status = status
+	m.client.writeJSON(ack)
+	m.client.afterVote(m.pollID, status)
+}
+
+// wsVoteIntent starts a confirmed vote
+func (s *Server) wsVoteIntent(m *wsMessage) {
+	m.client.handleVoteIntent(m.pollID, m.VoteMessage, m.ip, m.userAgent)
+}
+
+// wsVoteConfirm completes a confirmed vote
+func (s *Server) wsVoteConfirm(m *wsMessage) {
+	m.client.handleVoteConfirm(m.VoteMessage, m.receivedAt)
+}
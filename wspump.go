@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// wsPongWait is how long a connection may stay silent, pongs
+	// included, before it is considered dead; pings go out at 9/10 of it
+	wsPongWait = envDuration("WS_PONG_WAIT", 60*time.Second)
+
+	// wsSendBuffer is how many messages may wait for a slow connection
+	wsSendBuffer = envInt("WS_SEND_BUFFER", 64)
+
+	// wsSlowClientTimeout is how long a connection's buffer may stay full
+	// before the connection is dropped
+	wsSlowClientTimeout = envDuration("WS_SLOW_CLIENT_TIMEOUT", 5*time.Second)
+)
+
+// wsWriteWait bounds a single write, so a stalled peer can't hold the
+// write pump forever
+const wsWriteWait = 10 * time.Second
+
+// errSendBufferFull is returned when a message is dropped because the
+// connection isn't keeping up
+var errSendBufferFull = errors.New("send buffer full")
+
+// wsFrame is a message queued for the write pump. A close frame ends the
+// connection once everything queued before it has been written.
+type wsFrame struct {
+	messageType int
+	data        []byte
+}
+
+// enqueue hands a message to the write pump without blocking, so one slow
+// connection never holds up a broadcast to the others. Messages that don't
+// fit are dropped, and a connection whose buffer stays full for
+// wsSlowClientTimeout is evicted.
+func (c *wsClient) enqueue(messageType int, data []byte) error {
+	select {
+	case c.send <- wsFrame{messageType: messageType, data: data}:
+		c.fullSince.Store(0)
+		return nil
+	default:
+	}
+
+	now := time.Now().UnixNano()
+	if c.fullSince.CompareAndSwap(0, now) {
+		return errSendBufferFull
+	}
+	if since := c.fullSince.Load(); time.Duration(now-since) > wsSlowClientTimeout && c.evicted.CompareAndSwap(false, true) {
+		wsSlowClientEvictionsTotal.Inc()
+		c.log.Warn("Evicting slow WebSocket client", "full_for", time.Duration(now-since).Round(time.Millisecond))
+		c.conn.Close()
+	}
+	return errSendBufferFull
+}
+
+// writePump is the only goroutine writing to the connection. It sends the
+// queued messages and a ping every 9/10 of wsPongWait, and closes the
+// connection when a write fails, which also ends the read loop.
+func (c *wsClient) writePump(quit <-chan struct{}) {
+	ticker := time.NewTicker(wsPongWait * 9 / 10)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		close(c.done)
+	}()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if frame.messageType == websocket.CloseMessage {
+				c.conn.WriteMessage(websocket.CloseMessage, frame.data)
+				return
+			}
+			if err := c.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// keepAlive makes the read loop fail once the peer stops answering pings,
+// so half-open connections are reaped instead of lingering forever
+func (c *wsClient) keepAlive() {
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+}
+
+// close sends a close frame after the messages already queued, then the
+// write pump closes the connection; the read loop then ends and
+// unregisters the client. A connection too far behind is closed at once.
+func (c *wsClient) close(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.enqueue(websocket.CloseMessage, msg); err != nil {
+		c.log.Debug("Closing WebSocket without a close frame", "error", err)
+		c.conn.Close()
+	}
+}